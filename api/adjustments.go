@@ -0,0 +1,272 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+)
+
+func (a *API) adjustmentRoutes(r *router) {
+	r.Get("/", a.AdjustmentList)
+	r.With(addGetBody).Post("/{adjustment_id}/pay", a.AdjustmentPay)
+	r.With(adminRequired).Post("/{adjustment_id}/refund", a.AdjustmentRefund)
+}
+
+// AdjustmentList lists the adjustments made by editing an order.
+func (a *API) AdjustmentList(w http.ResponseWriter, r *http.Request) error {
+	order, httpErr := a.adjustmentOrder(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if !hasOrderAccess(r.Context(), order) {
+		return unauthorizedError("You don't have access to this order")
+	}
+	format, err := exportFormat(r)
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+
+	adjustments := []*models.Adjustment{}
+	if result := a.DB(r).Where("order_id = ?", order.ID).Order("created_at asc").Find(&adjustments); result.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	if format != "" {
+		return exportAdjustments(w, format, adjustments)
+	}
+	return sendJSON(w, http.StatusOK, adjustments)
+}
+
+// exportAdjustments writes the adjustments of an order.
+func exportAdjustments(w http.ResponseWriter, format string, adjustments []*models.Adjustment) error {
+	table, err := newTableWriter(w, format, "adjustments",
+		"adjustment_id", "order_id", "type", "state", "amount", "currency", "total_before", "total_after", "transaction_id", "created_at")
+	if err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+	for _, adjustment := range adjustments {
+		err := table.WriteRow(adjustment.ID, adjustment.OrderID, adjustment.Type, adjustment.State, adjustment.Amount, adjustment.Currency,
+			adjustment.TotalBefore, adjustment.TotalAfter, adjustment.TransactionID, adjustment.CreatedAt)
+		if err != nil {
+			return internalServerError("Error writing export").WithInternalError(err)
+		}
+	}
+	if err := table.Close(); err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+	return nil
+}
+
+// AdjustmentPay charges the amount an edit added to a paid order. It takes
+// the same parameters as a payment for the order, with the amount of the
+// adjustment.
+func (a *API) AdjustmentPay(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	claims := gcontext.GetClaims(ctx)
+
+	params := PaymentParams{Currency: "USD"}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		return badRequestError("Could not read params: %v", err)
+	}
+	if params.ProviderType == "" {
+		return badRequestError("Paying an adjustment requires specifying a 'provider'")
+	}
+
+	order, adjustment, httpErr := a.loadAdjustment(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if !hasOrderAccess(ctx, order) {
+		return unauthorizedError("You must be logged in to pay for this order")
+	}
+	if adjustment.Type != models.AdjustmentChargeType {
+		return badRequestError("Only charge adjustments can be paid")
+	}
+	if adjustment.State != models.PendingState || adjustment.TransactionID != "" {
+		return badRequestError("This adjustment has already been paid")
+	}
+	if adjustment.Currency != params.Currency {
+		return badRequestError("Currencies doesn't match - %v vs %v", adjustment.Currency, params.Currency)
+	}
+	if adjustment.Amount != params.Amount {
+		return badRequestError("Amount doesn't match the adjustment - %v vs %v", adjustment.Amount, params.Amount)
+	}
+
+	provider := gcontext.GetPaymentProviders(ctx)[strings.ToLower(params.ProviderType)]
+	if provider == nil {
+		return badRequestError("Payment provider '%s' not configured", params.ProviderType)
+	}
+	charge, err := provider.NewCharger(ctx, r, log.WithField("component", "payment_provider"))
+	if err != nil {
+		return badRequestError("Error creating payment provider: %v", err)
+	}
+
+	// claim the adjustment, so it's only charged once
+	db := a.DB(r)
+	claimed, err := adjustment.Claim(db)
+	if err != nil {
+		return internalServerError("Error saving adjustment").WithInternalError(err)
+	}
+	if !claimed {
+		return badRequestError("This adjustment has already been paid")
+	}
+
+	tr := models.NewTransaction(order)
+	tr.Amount = adjustment.Amount
+	tr.InvoiceNumber = order.InvoiceNumber
+	tr.InvoiceID = order.InvoiceID
+	processorID, err := charge(adjustment.Amount, adjustment.Currency, order, order.InvoiceID)
+	tr.ProcessorID = processorID
+
+	tx := db.Begin()
+	if err != nil {
+		if pendingErr, ok := err.(*payments.PaymentPendingError); ok {
+			// the adjustment is settled once the payment is confirmed
+			tr.Status = models.PendingState
+			tr.ProviderMetadata = pendingErr.Metadata()
+			adjustment.State = models.PendingState
+			adjustment.TransactionID = tr.ID
+			tx.Create(tr)
+			tx.Save(adjustment)
+			tx.Commit()
+			return sendJSON(w, http.StatusOK, tr)
+		}
+
+		tr.FailureCode = strconv.FormatInt(http.StatusInternalServerError, 10)
+		tr.FailureDescription = err.Error()
+		tr.Status = models.FailedState
+		tx.Create(tr)
+		if err := adjustment.ReleaseClaim(tx); err != nil {
+			log.WithError(err).WithField("adjustment_id", adjustment.ID).Error("Failed to release the adjustment after a failed charge")
+		}
+		tx.Commit()
+		return internalServerError("There was an error charging your card: %v", err).WithInternalError(err)
+	}
+
+	// if saving fails after the charge went through, the adjustment stays
+	// processing, so it can't be charged again
+	tr.Status = models.PaidState
+	if result := tx.Create(tr); result.Error != nil {
+		tx.Rollback()
+		return internalServerError("Saving payment failed").WithInternalError(result.Error)
+	}
+	if err := settleAdjustment(tx, r.RemoteAddr, claims.Subject, adjustment, tr); err != nil {
+		tx.Rollback()
+		return internalServerError("Saving payment failed").WithInternalError(err)
+	}
+	if result := tx.Commit(); result.Error != nil {
+		return internalServerError("Saving payment failed").WithInternalError(result.Error)
+	}
+
+	return sendJSON(w, http.StatusOK, tr)
+}
+
+// AdjustmentRefund retries the refund of an adjustment that failed when the
+// order was edited. Requires admin permissions.
+func (a *API) AdjustmentRefund(w http.ResponseWriter, r *http.Request) error {
+	order, adjustment, httpErr := a.loadAdjustment(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if adjustment.Type != models.AdjustmentRefundType {
+		return badRequestError("Only refund adjustments can be refunded")
+	}
+	if adjustment.State != models.PendingState {
+		return badRequestError("This adjustment has already been refunded")
+	}
+
+	if httpErr := a.refundAdjustment(r, a.DB(r), order, adjustment); httpErr != nil {
+		return httpErr
+	}
+	return sendJSON(w, http.StatusOK, adjustment)
+}
+
+// refundAdjustment refunds the amount an edit removed from a paid order
+// against the charge of the order.
+func (a *API) refundAdjustment(r *http.Request, db *gorm.DB, order *models.Order, adjustment *models.Adjustment) *HTTPError {
+	claims := gcontext.GetClaims(r.Context())
+
+	charge, httpErr := paidCharge(db, order.ID)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	// claim the adjustment, so it's only refunded once
+	claimed, err := adjustment.Claim(db)
+	if err != nil {
+		return internalServerError("Error saving adjustment").WithInternalError(err)
+	}
+	if !claimed {
+		return badRequestError("This adjustment has already been refunded")
+	}
+
+	refund := refundParams{PaymentParams: PaymentParams{Amount: adjustment.Amount, Currency: adjustment.Currency}}
+	m, httpErr := a.refundTransaction(r, db, charge, refund)
+	if httpErr == nil && m.Status != models.PaidState {
+		httpErr = internalServerError("Refund failed: %s", m.FailureDescription)
+	}
+	if httpErr != nil {
+		if err := adjustment.ReleaseClaim(db); err != nil {
+			getLogEntry(r).WithError(err).WithField("adjustment_id", adjustment.ID).Error("Failed to release the adjustment after a failed refund")
+		}
+		return httpErr
+	}
+
+	if err := settleAdjustment(db, r.RemoteAddr, claims.Subject, adjustment, m); err != nil {
+		return internalServerError("Error saving adjustment").WithInternalError(err)
+	}
+	return nil
+}
+
+// settleAdjustment marks an adjustment as paid by a transaction.
+func settleAdjustment(tx *gorm.DB, ip, userID string, adjustment *models.Adjustment, tr *models.Transaction) error {
+	adjustment.State = models.PaidState
+	adjustment.TransactionID = tr.ID
+	if err := tx.Save(adjustment).Error; err != nil {
+		return err
+	}
+	models.LogEvent(tx, ip, userID, adjustment.OrderID, models.EventUpdated, []string{"adjustment", adjustment.ID, adjustment.State})
+	return nil
+}
+
+func (a *API) adjustmentOrder(r *http.Request) (*models.Order, *HTTPError) {
+	ctx := r.Context()
+	order := &models.Order{}
+	result := a.DB(r).
+		Preload("LineItems").
+		Preload("BillingAddress").
+		Preload("ShippingAddress").
+		Where("instance_id = ?", gcontext.GetInstanceID(ctx)).
+		First(order, "id = ?", gcontext.GetOrderID(ctx))
+	if result.Error != nil {
+		if result.RecordNotFound() {
+			return nil, notFoundError("Order not found")
+		}
+		return nil, internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	return order, nil
+}
+
+func (a *API) loadAdjustment(r *http.Request) (*models.Order, *models.Adjustment, *HTTPError) {
+	order, httpErr := a.adjustmentOrder(r)
+	if httpErr != nil {
+		return nil, nil, httpErr
+	}
+
+	adjustment := &models.Adjustment{}
+	result := a.DB(r).Where("order_id = ?", order.ID).First(adjustment, "id = ?", chi.URLParam(r, "adjustment_id"))
+	if result.Error != nil {
+		if result.RecordNotFound() {
+			return nil, nil, notFoundError("Adjustment not found")
+		}
+		return nil, nil, internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	return order, adjustment, nil
+}
@@ -0,0 +1,241 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/payments"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdjustments(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+
+	editQuantity := func(test *RouteTest, quantity uint64) *models.Order {
+		op := &orderRequestParams{
+			LineItems: []*orderLineItem{{Sku: test.Data.firstLineItem.Sku, Quantity: quantity}},
+		}
+		provider := &memProvider{name: payments.StripeProvider}
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := runWithMemProvider(t, test, provider, http.MethodPut, "/orders/"+test.Data.firstOrder.ID, op, token)
+		order := new(models.Order)
+		extractPayload(t, http.StatusOK, recorder, order)
+		return order
+	}
+
+	t.Run("Charge", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+
+		order := editQuantity(test, 3)
+		assert.EqualValues(t, 36, order.Total)
+		assert.Equal(t, models.PaidState, order.PaymentState)
+		require.Len(t, order.Adjustments, 1)
+		adjustment := order.Adjustments[0]
+		assert.Equal(t, models.AdjustmentChargeType, adjustment.Type)
+		assert.Equal(t, models.PendingState, adjustment.State)
+		assert.EqualValues(t, 12, adjustment.Amount)
+		assert.EqualValues(t, 24, adjustment.TotalBefore)
+		assert.EqualValues(t, 36, adjustment.TotalAfter)
+
+		op := &orderRequestParams{LineItems: []*orderLineItem{{Sku: test.Data.firstLineItem.Sku, Quantity: 4}}}
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := runOrderUpdate(test, test.Data.firstOrder, op, token)
+		validateError(t, http.StatusBadRequest, recorder, "must be settled")
+
+		url := "/orders/" + test.Data.firstOrder.ID + "/adjustments/" + adjustment.ID + "/pay"
+		provider := &memProvider{name: payments.StripeProvider, chargeID: "adjustment-charge"}
+		params := map[string]interface{}{"amount": 5, "currency": "USD", "provider": "stripe"}
+		recorder = runWithMemProvider(t, test, provider, http.MethodPost, url, params, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "Amount doesn't match the adjustment")
+
+		params["amount"] = 12
+		recorder = runWithMemProvider(t, test, provider, http.MethodPost, url, params, test.Data.testUserToken)
+		tr := new(models.Transaction)
+		extractPayload(t, http.StatusOK, recorder, tr)
+		assert.Equal(t, models.PaidState, tr.Status)
+		assert.Equal(t, models.ChargeTransactionType, tr.Type)
+		assert.EqualValues(t, 12, tr.Amount)
+		assert.Equal(t, "adjustment-charge", tr.ProcessorID)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/orders/"+test.Data.firstOrder.ID+"/adjustments", nil, test.Data.testUserToken)
+		adjustments := []*models.Adjustment{}
+		extractPayload(t, http.StatusOK, recorder, &adjustments)
+		require.Len(t, adjustments, 1)
+		assert.Equal(t, models.PaidState, adjustments[0].State)
+		assert.Equal(t, tr.ID, adjustments[0].TransactionID)
+
+		recorder = runWithMemProvider(t, test, provider, http.MethodPost, url, params, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "already been paid")
+	})
+
+	t.Run("ChargeClaimed", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+
+		order := editQuantity(test, 3)
+		require.Len(t, order.Adjustments, 1)
+		adjustment := order.Adjustments[0]
+		// another request is charging the adjustment
+		require.NoError(t, test.DB.Model(adjustment).UpdateColumn("state", models.AdjustmentProcessingState).Error)
+
+		// the provider fails if it's called
+		url := "/orders/" + test.Data.firstOrder.ID + "/adjustments/" + adjustment.ID + "/pay"
+		provider := &memProvider{name: payments.StripeProvider}
+		params := map[string]interface{}{"amount": 12, "currency": "USD", "provider": "stripe"}
+		recorder := runWithMemProvider(t, test, provider, http.MethodPost, url, params, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "already been paid")
+	})
+
+	t.Run("ChargeFailed", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+
+		order := editQuantity(test, 3)
+		require.Len(t, order.Adjustments, 1)
+		adjustment := order.Adjustments[0]
+
+		url := "/orders/" + test.Data.firstOrder.ID + "/adjustments/" + adjustment.ID + "/pay"
+		provider := &memProvider{name: payments.StripeProvider}
+		params := map[string]interface{}{"amount": 12, "currency": "USD", "provider": "stripe"}
+		recorder := runWithMemProvider(t, test, provider, http.MethodPost, url, params, test.Data.testUserToken)
+		validateError(t, http.StatusInternalServerError, recorder)
+
+		stored := new(models.Adjustment)
+		require.NoError(t, test.DB.First(stored, "id = ?", adjustment.ID).Error)
+		assert.Equal(t, models.PendingState, stored.State)
+		assert.Empty(t, stored.TransactionID)
+	})
+
+	t.Run("Refund", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+
+		order := editQuantity(test, 1)
+		assert.EqualValues(t, 12, order.Total)
+		require.Len(t, order.Adjustments, 1)
+		adjustment := order.Adjustments[0]
+		assert.Equal(t, models.AdjustmentRefundType, adjustment.Type)
+		assert.Equal(t, models.PaidState, adjustment.State)
+		assert.EqualValues(t, 12, adjustment.Amount)
+		require.NotEmpty(t, adjustment.TransactionID)
+
+		refund := new(models.Transaction)
+		require.NoError(t, test.DB.First(refund, "id = ?", adjustment.TransactionID).Error)
+		assert.Equal(t, models.RefundTransactionType, refund.Type)
+		assert.Equal(t, models.PaidState, refund.Status)
+		assert.EqualValues(t, 12, refund.Amount)
+	})
+
+	t.Run("RefundRetry", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+
+		// no payment provider is configured, so the refund can't be issued
+		op := &orderRequestParams{LineItems: []*orderLineItem{{Sku: test.Data.firstLineItem.Sku, Quantity: 1}}}
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := runOrderUpdate(test, test.Data.firstOrder, op, token)
+		order := new(models.Order)
+		extractPayload(t, http.StatusOK, recorder, order)
+		require.Len(t, order.Adjustments, 1)
+		adjustment := order.Adjustments[0]
+		assert.Equal(t, models.PendingState, adjustment.State)
+
+		url := "/orders/" + test.Data.firstOrder.ID + "/adjustments/" + adjustment.ID + "/refund"
+		recorder = test.TestEndpoint(http.MethodPost, url, nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+
+		recorder = runMemProviderRefund(t, test, url, nil)
+		refunded := new(models.Adjustment)
+		extractPayload(t, http.StatusOK, recorder, refunded)
+		assert.Equal(t, models.PaidState, refunded.State)
+		assert.NotEmpty(t, refunded.TransactionID)
+
+		recorder = runMemProviderRefund(t, test, url, nil)
+		validateError(t, http.StatusBadRequest, recorder, "already been refunded")
+	})
+
+	t.Run("MemberDiscount", func(t *testing.T) {
+		test := NewRouteTest(t)
+		settings := calculator.Settings{
+			MemberDiscounts: []*calculator.MemberDiscount{{
+				Claims:       map[string]string{"email": test.Data.testUser.Email},
+				Percentage:   15,
+				ProductTypes: []string{"Book"},
+			}},
+		}
+		site := startTestSiteWithSettings(settings)
+		defer site.Close()
+		test.Config.SiteURL = site.URL
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+		order := new(models.Order)
+		extractPayload(t, http.StatusCreated, recorder, order)
+		require.EqualValues(t, 849, order.Total)
+		require.NoError(t, test.DB.Model(order).UpdateColumn("payment_state", models.PaidState).Error)
+
+		// the admin editing the order doesn't have the buyer's discount
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		op := &orderRequestParams{LineItems: []*orderLineItem{{Sku: order.LineItems[0].Sku, Quantity: 1}}}
+		recorder = runOrderUpdate(test, order, op, token)
+		updated := new(models.Order)
+		extractPayload(t, http.StatusOK, recorder, updated)
+		assert.EqualValues(t, 849, updated.Total)
+		assert.Empty(t, updated.Adjustments)
+
+		op.LineItems[0].Quantity = 2
+		recorder = runOrderUpdate(test, order, op, token)
+		updated = new(models.Order)
+		extractPayload(t, http.StatusOK, recorder, updated)
+		assert.EqualValues(t, 1698, updated.Total)
+		require.Len(t, updated.Adjustments, 1)
+		assert.Equal(t, models.AdjustmentChargeType, updated.Adjustments[0].Type)
+		assert.EqualValues(t, 849, updated.Adjustments[0].Amount)
+	})
+	t.Run("NewItemMemberPrice", func(t *testing.T) {
+		test := NewRouteTest(t)
+		site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/gocommerce/settings.json":
+				fmt.Fprintln(w, `{}`)
+			case "/member-product":
+				fmt.Fprintln(w, productMetaFrame(fmt.Sprintf(`
+					{"sku": "member-product", "title": "Member Product", "type": "Book", "prices": [
+						{"amount": "9.00", "currency": "USD"},
+						{"amount": "5.00", "currency": "USD", "claims": {"email": %q}}
+					]}`, test.Data.testUser.Email)))
+			default:
+				handleTestProducts(w, r)
+			}
+		}))
+		defer site.Close()
+		test.Config.SiteURL = site.URL
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+		order := new(models.Order)
+		extractPayload(t, http.StatusCreated, recorder, order)
+		require.NoError(t, test.DB.Model(order).UpdateColumn("payment_state", models.PaidState).Error)
+
+		// the item is priced for the buyer, not the admin adding it
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		op := &orderRequestParams{LineItems: []*orderLineItem{{Path: "/member-product", Quantity: 1}}}
+		recorder = runOrderUpdate(test, order, op, token)
+		updated := new(models.Order)
+		extractPayload(t, http.StatusOK, recorder, updated)
+		var added *models.LineItem
+		for _, item := range updated.LineItems {
+			if item.Sku == "member-product" {
+				added = item
+			}
+		}
+		require.NotNil(t, added)
+		assert.EqualValues(t, 500, added.Price)
+	})
+}
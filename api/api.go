@@ -2,6 +2,7 @@ package api
 
 import (
 	"context"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -23,6 +24,10 @@ import (
 
 const (
 	defaultVersion = "unknown version"
+
+	// settingsTimeout bounds the requests for the settings of a site, which
+	// pricing requests wait for.
+	settingsTimeout = 10 * time.Second
 )
 
 var (
@@ -35,6 +40,7 @@ type API struct {
 	db         *gorm.DB
 	config     *conf.GlobalConfiguration
 	httpClient *http.Client
+	settings   *settingsCache
 	version    string
 }
 
@@ -72,6 +78,30 @@ func waitForTermination(log logrus.FieldLogger, done <-chan struct{}) {
 	}
 }
 
+// forwardedFor returns the middleware that takes the client IP from the
+// X-Forwarded-For header. The header is trusted from anyone, unless the
+// subnets of the trusted proxies are configured.
+func forwardedFor(config *conf.GlobalConfiguration, log logrus.FieldLogger) *xff.XFF {
+	if len(config.API.TrustedProxies) > 0 {
+		xffmw, err := xff.New(xff.Options{AllowedSubnets: config.API.TrustedProxies})
+		if err == nil {
+			return xffmw
+		}
+		log.WithError(err).Error("Bad trusted proxies, trusting X-Forwarded-For from anyone")
+	}
+	xffmw, _ := xff.Default()
+	return xffmw
+}
+
+// clientIP returns the IP of the client of a request, without the port that
+// differs for each connection.
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
 // NewAPI instantiates a new REST API using the default version.
 func NewAPI(globalConfig *conf.GlobalConfiguration, log logrus.FieldLogger, db *gorm.DB) *API {
 	return NewAPIWithVersion(context.Background(), globalConfig, log, db, defaultVersion)
@@ -82,11 +112,12 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 	api := &API{
 		config:     globalConfig,
 		db:         db,
-		httpClient: &http.Client{},
+		httpClient: &http.Client{Timeout: settingsTimeout},
+		settings:   newSettingsCache(),
 		version:    version,
 	}
 
-	xffmw, _ := xff.Default()
+	xffmw := forwardedFor(globalConfig, log)
 	logger := newStructuredLogger(log)
 
 	r := newRouter()
@@ -103,13 +134,17 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 			r.Use(api.loadInstanceConfig)
 		}
 		r.Use(api.withToken)
+		r.Use(api.autoClaimOrders)
 
 		r.Route("/orders", api.orderRoutes)
+		r.Post("/cart/price", api.CartPrice)
 		r.Route("/users", api.userRoutes)
 
 		r.Route("/downloads", func(r *router) {
 			r.With(authRequired).Get("/", api.DownloadList)
+			r.With(adminRequired).Post("/refresh", api.DownloadRefreshSku)
 			r.Get("/{download_id}", api.DownloadURL)
+			r.Get("/{download_id}/file", api.DownloadFile)
 		})
 
 		r.Route("/vatnumbers", func(r *router) {
@@ -121,6 +156,7 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 			r.Route("/{payment_id}", func(r *router) {
 				r.With(adminRequired).Get("/", api.PaymentView)
 				r.With(adminRequired).With(addGetBody).Post("/refund", api.PaymentRefund)
+				r.With(authRequired).Get("/credit_note", api.CreditNoteView)
 				r.Post("/confirm", api.PaymentConfirm)
 			})
 		})
@@ -134,14 +170,23 @@ func NewAPIWithVersion(ctx context.Context, globalConfig *conf.GlobalConfigurati
 
 			r.Get("/sales", api.SalesReport)
 			r.Get("/products", api.ProductsReport)
+			r.Get("/customers", api.CustomersReport)
+			r.Get("/coupons", api.CouponsReport)
+			r.Get("/coupons/{coupon_code}", api.CouponOrders)
 		})
 
+		r.Route("/products", api.productRoutes)
+		r.Route("/license_keys", api.licenseKeyRoutes)
+		r.With(adminRequired).Get("/returns", api.ReturnList)
+		r.With(adminRequired).Get("/catalog/cache", api.CatalogCacheStats)
+
 		r.Route("/coupons", func(r *router) {
 			r.With(adminRequired).Get("/", api.CouponList)
 			r.Get("/{coupon_code}", api.CouponView)
 		})
 
 		r.Get("/settings", api.ViewSettings)
+		r.With(adminRequired).Post("/settings/refresh", api.RefreshSettings)
 
 		r.With(authRequired).Post("/claim", api.ClaimOrders)
 	})
@@ -194,6 +239,11 @@ func (a *API) orderRoutes(r *router) {
 			r.Get("/", a.DownloadList)
 			r.Post("/refresh", a.DownloadRefresh)
 		})
+		r.With(adminRequired).Get("/events", a.OrderEvents)
+		r.Route("/notes", a.orderNoteRoutes)
+		r.Route("/shipments", a.shipmentRoutes)
+		r.Route("/returns", a.returnRoutes)
+		r.Route("/adjustments", a.adjustmentRoutes)
 		r.Get("/receipt", a.ReceiptView)
 		r.Post("/receipt", a.ResendOrderReceipt)
 	})
@@ -210,16 +260,21 @@ func (a *API) userRoutes(r *router) {
 
 		r.Get("/", a.UserView)
 		r.With(adminRequired).Delete("/", a.UserDelete)
+		r.With(adminRequired).Post("/merge", a.UserMerge)
+		r.Get("/export", a.UserExport)
+		r.With(adminRequired).Post("/erase", a.UserErase)
+		r.With(adminRequired).Get("/erasures", a.UserErasures)
 
 		r.Get("/payments", a.PaymentListForUser)
 		r.Get("/orders", a.OrderList)
 
 		r.Route("/addresses", func(r *router) {
 			r.Get("/", a.AddressList)
-			r.With(adminRequired).Post("/", a.CreateNewAddress)
+			r.Post("/", a.CreateNewAddress)
 			r.Route("/{addr_id}", func(r *router) {
 				r.Get("/", a.AddressView)
-				r.With(adminRequired).Delete("/", a.AddressDelete)
+				r.Put("/", a.AddressUpdate)
+				r.Delete("/", a.AddressDelete)
 			})
 		})
 	})
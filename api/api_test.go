@@ -16,6 +16,10 @@ import (
 
 func TestTraceWrapper(t *testing.T) {
 	hook := test.NewGlobal()
+	// other tests lower the level of the global logger
+	level := logrus.GetLevel()
+	logrus.SetLevel(logrus.InfoLevel)
+	defer logrus.SetLevel(level)
 	globalConfig := new(conf.GlobalConfiguration)
 	globalConfig.MultiInstanceMode = true
 	globalConfig.OperatorToken = "token"
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/netlify/gocommerce/calculator"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+type cartParams struct {
+	Currency string `json:"currency"`
+
+	// Country is the country taxes are calculated for. It defaults to the
+	// country of the shipping address.
+	Country         string          `json:"country"`
+	ShippingAddress *models.Address `json:"shipping_address"`
+
+	CouponCode string `json:"coupon"`
+
+	LineItems []*orderLineItem `json:"line_items"`
+}
+
+type cartTax struct {
+	Rate   uint64 `json:"rate"`
+	Amount uint64 `json:"amount"`
+}
+
+type cartPrice struct {
+	Currency string `json:"currency"`
+	Country  string `json:"country"`
+
+	LineItems []*models.LineItem `json:"line_items"`
+	Coupon    *models.Coupon     `json:"coupon,omitempty"`
+
+	Subtotal       uint64    `json:"subtotal"`
+	Discount       uint64    `json:"discount"`
+	CouponDiscount uint64    `json:"coupon_discount"`
+	MemberDiscount uint64    `json:"member_discount"`
+	NetTotal       uint64    `json:"net_total"`
+	Taxes          uint64    `json:"taxes"`
+	TaxesByRate    []cartTax `json:"taxes_by_rate"`
+	Total          uint64    `json:"total"`
+}
+
+// CartPrice prices a cart the same way an order with these line items would
+// be priced, without storing anything. Member discounts apply for the user
+// of the token, if any.
+func (a *API) CartPrice(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+
+	params := &cartParams{Currency: "USD"}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read cart params: %v", err)
+	}
+	if len(params.LineItems) == 0 {
+		return badRequestError("A cart needs at least one line item")
+	}
+	country := params.Country
+	if country == "" && params.ShippingAddress != nil {
+		country = params.ShippingAddress.Country
+	}
+
+	order := models.NewOrder(gcontext.GetInstanceID(ctx), "", "", params.Currency)
+	order.ShippingAddress.Country = country
+	if params.CouponCode != "" {
+		coupon, err := a.lookupCoupon(ctx, w, params.CouponCode)
+		if err != nil {
+			return err
+		}
+		if !coupon.Valid() {
+			return badRequestError("This coupon is not valid at this time")
+		}
+		order.CouponCode = coupon.Code
+		order.Coupon = coupon
+	}
+
+	catalog, err := models.NewCatalog(gcontext.GetConfig(ctx), a.DB(r), order.InstanceID)
+	if err != nil {
+		return internalServerError("Error loading product catalog").WithInternalError(err)
+	}
+	if httpError := a.processLineItems(ctx, catalog, order, params.LineItems); httpError != nil {
+		return httpError
+	}
+
+	settings, err := a.loadSettings(ctx, log)
+	if err != nil {
+		return internalServerError(err.Error()).WithInternalError(err)
+	}
+	claims := gcontext.GetClaimsAsMap(ctx)
+	order.CalculateTotal(settings, claims, log)
+
+	// pricing the cart without the coupon tells its effect apart from the
+	// member discounts
+	memberDiscount := order.Discount
+	if order.Coupon != nil {
+		items := make([]calculator.Item, len(order.LineItems))
+		for i, item := range order.LineItems {
+			items[i] = item
+		}
+		params := calculator.PriceParameters{Country: country, Currency: order.Currency, Items: items}
+		withoutCoupon := calculator.CalculatePrice(settings, claims, params, log)
+		memberDiscount = withoutCoupon.Discount
+	}
+
+	return sendJSON(w, http.StatusOK, &cartPrice{
+		Currency:       order.Currency,
+		Country:        country,
+		LineItems:      order.LineItems,
+		Coupon:         order.Coupon,
+		Subtotal:       order.SubTotal,
+		Discount:       order.Discount,
+		CouponDiscount: order.Discount - memberDiscount,
+		MemberDiscount: memberDiscount,
+		NetTotal:       order.NetTotal,
+		Taxes:          order.Taxes,
+		TaxesByRate:    taxesByRate(order.TaxAmounts),
+		Total:          order.Total,
+	})
+}
+
+// taxesByRate lists the taxes of the cart per tax rate. The amounts are
+// calculated for the whole quantity of the line items, so they add up to the
+// taxes of the cart.
+func taxesByRate(amounts []calculator.TaxAmount) []cartTax {
+	taxes := []cartTax{}
+	for _, amount := range amounts {
+		if amount.Taxes > 0 {
+			taxes = append(taxes, cartTax{Rate: amount.Rate, Amount: amount.Taxes})
+		}
+	}
+	return taxes
+}
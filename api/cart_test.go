@@ -0,0 +1,135 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCartPrice(t *testing.T) {
+	server := startTestSite()
+	defer server.Close()
+
+	t.Run("Simple", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		body := strings.NewReader(`{"line_items": [{"path": "/simple-product", "quantity": 2}]}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/cart/price", body, nil)
+
+		price := &cartPrice{}
+		extractPayload(t, http.StatusOK, recorder, price)
+		assert.Equal(t, "USD", price.Currency)
+		assert.EqualValues(t, 1998, price.Subtotal)
+		assert.EqualValues(t, 0, price.Taxes)
+		assert.Len(t, price.TaxesByRate, 0)
+		assert.EqualValues(t, 1998, price.Total)
+		require.Len(t, price.LineItems, 1)
+		assert.Equal(t, "product-1", price.LineItems[0].Sku)
+		assert.EqualValues(t, 999, price.LineItems[0].CalculationDetail.Total)
+
+		var orders, items int
+		require.NoError(t, test.DB.Model(&models.Order{}).Count(&orders).Error)
+		require.NoError(t, test.DB.Model(&models.LineItem{}).Count(&items).Error)
+		assert.Equal(t, 2, orders, "pricing a cart must not create an order")
+		assert.Equal(t, 3, items, "pricing a cart must not create line items")
+	})
+
+	t.Run("WithTaxes", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		body := strings.NewReader(`{
+			"shipping_address": {"country": "Germany"},
+			"line_items": [{"path": "/bundle-product", "quantity": 1}, {"path": "/simple-product", "quantity": 1}]
+		}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/cart/price", body, nil)
+
+		price := &cartPrice{}
+		extractPayload(t, http.StatusOK, recorder, price)
+		assert.Equal(t, "Germany", price.Country)
+		assert.EqualValues(t, 176, price.Taxes)
+		assert.EqualValues(t, 2174, price.Total)
+
+		var sum uint64
+		for _, tax := range price.TaxesByRate {
+			sum += tax.Amount
+		}
+		assert.Equal(t, price.Taxes, sum)
+		require.Len(t, price.TaxesByRate, 2)
+		// the book part of the bundle is taxed at the rate of books
+		assert.EqualValues(t, 7, price.TaxesByRate[0].Rate)
+		assert.EqualValues(t, 119, price.TaxesByRate[0].Amount)
+		assert.EqualValues(t, 19, price.TaxesByRate[1].Rate)
+		assert.EqualValues(t, 57, price.TaxesByRate[1].Amount)
+	})
+
+	t.Run("WithTaxesForQuantity", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		body := strings.NewReader(`{
+			"shipping_address": {"country": "Germany"},
+			"line_items": [{"path": "/bundle-product", "quantity": 3}]
+		}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/cart/price", body, nil)
+
+		price := &cartPrice{}
+		extractPayload(t, http.StatusOK, recorder, price)
+		assert.EqualValues(t, 317, price.Taxes)
+		// taxing a single e-book part gives 57, three of them are taxed 170
+		require.Len(t, price.TaxesByRate, 2)
+		assert.EqualValues(t, 7, price.TaxesByRate[0].Rate)
+		assert.EqualValues(t, 147, price.TaxesByRate[0].Amount)
+		assert.EqualValues(t, 19, price.TaxesByRate[1].Rate)
+		assert.EqualValues(t, 170, price.TaxesByRate[1].Amount)
+	})
+
+	t.Run("WithCouponAndMemberDiscount", func(t *testing.T) {
+		test := NewRouteTest(t)
+		settings := calculator.Settings{
+			MemberDiscounts: []*calculator.MemberDiscount{{
+				Claims:       map[string]string{"email": test.Data.testUser.Email},
+				Percentage:   15,
+				ProductTypes: []string{"Book"},
+			}},
+		}
+		site := startTestSiteWithSettings(settings)
+		defer site.Close()
+		test.Config.SiteURL = site.URL
+		couponServer := startCouponList("SPECIAL-EVENT", 10)
+		defer couponServer.Close()
+		test.Config.Coupons.URL = couponServer.URL
+
+		body := `{"coupon": "SPECIAL-EVENT", "line_items": [{"path": "/simple-product", "quantity": 1}]}`
+		recorder := test.TestEndpoint(http.MethodPost, "/cart/price", strings.NewReader(body), test.Data.testUserToken)
+		price := &cartPrice{}
+		extractPayload(t, http.StatusOK, recorder, price)
+		require.NotNil(t, price.Coupon)
+		assert.Equal(t, "SPECIAL-EVENT", price.Coupon.Code)
+		assert.EqualValues(t, 150, price.MemberDiscount)
+		assert.EqualValues(t, price.Discount-150, price.CouponDiscount)
+		assert.True(t, price.CouponDiscount > 0)
+		assert.EqualValues(t, 999-price.Discount, price.Total)
+
+		// anonymous buyers only get the coupon
+		recorder = test.TestEndpoint(http.MethodPost, "/cart/price", strings.NewReader(body), nil)
+		price = &cartPrice{}
+		extractPayload(t, http.StatusOK, recorder, price)
+		assert.EqualValues(t, 0, price.MemberDiscount)
+		assert.EqualValues(t, 100, price.CouponDiscount)
+		assert.EqualValues(t, 899, price.Total)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		recorder := test.TestEndpoint(http.MethodPost, "/cart/price", strings.NewReader(`{"line_items": []}`), nil)
+		validateError(t, http.StatusBadRequest, recorder)
+
+		recorder = test.TestEndpoint(http.MethodPost, "/cart/price", strings.NewReader(`{"line_items": [{"path": "/unknown", "quantity": 1}]}`), nil)
+		validateError(t, http.StatusInternalServerError, recorder)
+	})
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/netlify/gocommerce/pdf"
+)
+
+// CreditNoteView returns the credit note issued for a refund. It renders as
+// JSON by default and as a PDF document when requested with `?format=pdf` or
+// an `Accept: application/pdf` header.
+func (a *API) CreditNoteView(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	db := a.DB(r)
+
+	payID := chi.URLParam(r, "payment_id")
+	trans, httpErr := getTransaction(db, payID)
+	if httpErr != nil {
+		return httpErr
+	}
+	if trans.Type != models.RefundTransactionType {
+		return badRequestError("Credit notes are only issued for refunds")
+	}
+
+	order := &models.Order{}
+	if rsp := db.Preload("BillingAddress").First(order, "id = ?", trans.OrderID); rsp.Error != nil {
+		if rsp.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error while querying for order").WithInternalError(rsp.Error)
+	}
+
+	if !hasOrderAccess(ctx, order) || (order.UserID == "" && !gcontext.IsAdmin(ctx)) {
+		return unauthorizedError("You don't have access to this credit note")
+	}
+
+	note := models.NewCreditNote(trans, order)
+	if note == nil {
+		return notFoundError("No credit note has been issued for this refund")
+	}
+
+	if !wantsPDF(r) {
+		return sendJSON(w, http.StatusOK, note)
+	}
+
+	log.Debugf("Rendering credit note %s as PDF", documentID(note.ID, note.Number))
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=\"credit-note-%s.pdf\"", documentID(note.ID, note.Number)))
+	w.WriteHeader(http.StatusOK)
+	_, err := renderCreditNote(note).WriteTo(w)
+	return err
+}
+
+func wantsPDF(r *http.Request) bool {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format == "pdf"
+	}
+	return strings.Contains(r.Header.Get("Accept"), "application/pdf")
+}
+
+// documentID falls back to the plain number for documents issued before
+// number formats were configurable.
+func documentID(id string, number int64) string {
+	if id != "" {
+		return id
+	}
+	return strconv.FormatInt(number, 10)
+}
+
+func renderCreditNote(note *models.CreditNote) *pdf.Document {
+	doc := pdf.New()
+	page := doc.AddPage()
+
+	page.BoldText(60, 80, 20, "Credit Note No. "+documentID(note.ID, note.Number))
+	page.Text(60, 110, 10, "Date: "+note.CreatedAt.Format("2006-01-02"))
+	if note.InvoiceNumber != 0 {
+		page.Text(60, 125, 10, "Refers to invoice No. "+documentID(note.InvoiceID, note.InvoiceNumber))
+	}
+	page.Text(60, 140, 10, "Order: "+note.OrderID)
+
+	y := 180.0
+	addr := note.BillingAddress
+	for _, line := range []string{addr.Name, addr.Company, addr.Address1, addr.Address2, strings.TrimSpace(addr.Zip + " " + addr.City), addr.State, addr.Country, note.Email} {
+		if line == "" {
+			continue
+		}
+		page.Text(60, y, 10, line)
+		y += 14
+	}
+	if note.VATNumber != "" {
+		page.Text(60, y, 10, "VAT number: "+note.VATNumber)
+		y += 14
+	}
+
+	y += 30
+	page.Line(60, pdf.PageWidth-60, y)
+	y += 20
+	page.BoldText(60, y, 12, "Refunded amount")
+	page.BoldText(pdf.PageWidth-200, y, 12, fmt.Sprintf("%.2f %s", float64(note.Amount)/100, note.Currency))
+
+	return doc
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/netlify/gocommerce/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func createTestRefund(t *testing.T, test *RouteTest, creditNoteNumber int64) *models.Transaction {
+	refund := models.NewTransaction(test.Data.firstOrder)
+	refund.ID = "first-refund"
+	refund.Type = models.RefundTransactionType
+	refund.Status = models.PaidState
+	refund.Amount = 10
+	refund.InvoiceNumber = 7
+	refund.CreditNoteNumber = creditNoteNumber
+	require.NoError(t, test.DB.Create(refund).Error)
+	return refund
+}
+
+func TestCreditNoteView(t *testing.T) {
+	t.Run("JSON", func(t *testing.T) {
+		test := NewRouteTest(t)
+		refund := createTestRefund(t, test, 3)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/payments/"+refund.ID+"/credit_note", nil, test.Data.testUserToken)
+		note := &models.CreditNote{}
+		extractPayload(t, http.StatusOK, recorder, note)
+		assert.EqualValues(t, 3, note.Number)
+		assert.EqualValues(t, 7, note.InvoiceNumber)
+		assert.Equal(t, test.Data.firstOrder.ID, note.OrderID)
+		assert.EqualValues(t, 10, note.Amount)
+		assert.Equal(t, test.Data.testAddress.Name, note.BillingAddress.Name)
+	})
+	t.Run("PDF", func(t *testing.T) {
+		test := NewRouteTest(t)
+		refund := createTestRefund(t, test, 3)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/payments/"+refund.ID+"/credit_note?format=pdf", nil, test.Data.testUserToken)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "application/pdf", recorder.Header().Get("Content-Type"))
+		assert.True(t, bytes.HasPrefix(recorder.Body.Bytes(), []byte("%PDF-")))
+		assert.Contains(t, recorder.Body.String(), "Credit Note No. 3")
+	})
+	t.Run("NotIssued", func(t *testing.T) {
+		test := NewRouteTest(t)
+		refund := createTestRefund(t, test, 0)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/payments/"+refund.ID+"/credit_note", nil, test.Data.testUserToken)
+		validateError(t, http.StatusNotFound, recorder, "No credit note")
+	})
+	t.Run("NotARefund", func(t *testing.T) {
+		test := NewRouteTest(t)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/payments/"+test.Data.firstTransaction.ID+"/credit_note", nil, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "only issued for refunds")
+	})
+	t.Run("WrongUser", func(t *testing.T) {
+		test := NewRouteTest(t)
+		refund := createTestRefund(t, test, 3)
+
+		token := testToken("villian", "villian@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodGet, "/payments/"+refund.ID+"/credit_note", nil, token)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
@@ -1,17 +1,35 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/assetstores"
 	gcontext "github.com/netlify/gocommerce/context"
 	"github.com/netlify/gocommerce/models"
+	"github.com/sirupsen/logrus"
 )
 
 const maxIPsPerDay = 50
 
+type downloadRefreshParams struct {
+	Sku string `json:"sku"`
+}
+
+type downloadRefreshResult struct {
+	Orders    int `json:"orders"`
+	Downloads int `json:"downloads"`
+	// Notifying is the number of buyers the update is being mailed to
+	Notifying int `json:"notifying"`
+}
+
 // DownloadURL returns a signed URL to download a purchased asset.
 func (a *API) DownloadURL(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
@@ -45,40 +63,150 @@ func (a *API) DownloadURL(w http.ResponseWriter, r *http.Request) error {
 		return unauthorizedError("This download has not been paid yet")
 	}
 
-	rows, err := db.Model(&models.Event{}).
-		Select("count(distinct(ip))").
-		Where("order_id = ? and created_at > ? and changes = 'download'", order.ID, time.Now().Add(-24*time.Hour)).
-		Rows()
-	if err != nil {
-		return internalServerError("Error signing download").WithInternalError(err)
+	// license keys are delivered with the download list and need no signing
+	if download.LicenseKey != "" {
+		return sendJSON(w, http.StatusOK, download)
 	}
-	var count uint64
-	for rows.Next() {
-		err = rows.Scan(&count)
+
+	if download.ExpiryDays > 0 {
+		paidAt, err := orderPaidAt(db, order)
 		if err != nil {
 			return internalServerError("Error signing download").WithInternalError(err)
 		}
+		if download.Expired(paidAt) {
+			return unauthorizedError("This download has expired")
+		}
+	}
+
+	count, err := countDownloadEvents(db, "count(distinct(ip))", "order_id = ? and created_at > ? and (changes = 'download' or changes like 'download,%')", order.ID, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		return internalServerError("Error signing download").WithInternalError(err)
 	}
 	if count > maxIPsPerDay {
 		return unauthorizedError("This download has been accessed from too many IPs within the last day")
 	}
 
+	if download.MaxDownloadsPerIP > 0 {
+		count, err := countDownloadEvents(db, "count(*)", "order_id = ? and ip = ? and changes = ?", order.ID, clientIP(r), downloadEventChanges(download))
+		if err != nil {
+			return internalServerError("Error signing download").WithInternalError(err)
+		}
+		if count >= download.MaxDownloadsPerIP {
+			return unauthorizedError("This download has been accessed too often from your IP")
+		}
+	}
+
 	if err := download.SignURL(assets); err != nil {
 		return internalServerError("Error signing download").WithInternalError(err)
 	}
 
 	tx := db.Begin()
-	tx.Model(download).Updates(map[string]interface{}{"download_count": gorm.Expr("download_count + 1")})
+	rsp := tx.Model(download).
+		Where("max_downloads = 0 OR download_count < max_downloads").
+		Updates(map[string]interface{}{"download_count": gorm.Expr("download_count + 1")})
+	if rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error signing download").WithInternalError(rsp.Error)
+	}
+	if rsp.RowsAffected == 0 {
+		tx.Rollback()
+		return unauthorizedError("This download has reached its download limit")
+	}
 	var subject string
 	if claims != nil {
 		subject = claims.Subject
 	}
-	models.LogEvent(tx, r.RemoteAddr, subject, order.ID, models.EventUpdated, []string{"download"})
+	models.LogEvent(tx, clientIP(r), subject, order.ID, models.EventUpdated, []string{"download", download.ID})
 	tx.Commit()
 
 	return sendJSON(w, http.StatusOK, download)
 }
 
+func countDownloadEvents(db *gorm.DB, selection string, where string, args ...interface{}) (uint64, error) {
+	rows, err := db.Model(&models.Event{}).Select(selection).Where(where, args...).Rows()
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var count uint64
+	for rows.Next() {
+		if err := rows.Scan(&count); err != nil {
+			return 0, err
+		}
+	}
+	return count, nil
+}
+
+func downloadEventChanges(download *models.Download) string {
+	return "download," + download.ID
+}
+
+// orderPaidAt returns when the order was paid, falling back to its creation
+// for orders without a paid charge.
+func orderPaidAt(db *gorm.DB, order *models.Order) (time.Time, error) {
+	trans := &models.Transaction{}
+	rsp := db.Where("order_id = ? AND type = ? AND status = ?", order.ID, models.ChargeTransactionType, models.PaidState).
+		Order("created_at asc").
+		First(trans)
+	if rsp.RecordNotFound() {
+		return order.CreatedAt, nil
+	}
+	if rsp.Error != nil {
+		return time.Time{}, rsp.Error
+	}
+	return trans.CreatedAt, nil
+}
+
+// DownloadFile serves the file of a download from asset stores that don't
+// host the files themselves. Access is granted by the signature of the URL
+// returned from DownloadURL.
+func (a *API) DownloadFile(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	db := a.DB(r)
+	downloadID := chi.URLParam(r, "download_id")
+	logEntrySetField(r, "download_id", downloadID)
+
+	store, ok := gcontext.GetAssetStore(ctx).(assetstores.FileStore)
+	if !ok {
+		return notFoundError("Downloads are not served by this store")
+	}
+
+	query := r.URL.Query()
+	if err := store.Verify(downloadID, query.Get("expires"), query.Get("signature")); err != nil {
+		return unauthorizedError(err.Error())
+	}
+
+	download := &models.Download{}
+	if result := db.Where("id = ?", downloadID).First(download); result.Error != nil {
+		if result.RecordNotFound() {
+			return notFoundError("Download not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+
+	file, err := store.Open(download.URL)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return notFoundError("Download file not found")
+		}
+		return internalServerError("Error opening download file").WithInternalError(err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return internalServerError("Error opening download file").WithInternalError(err)
+	}
+	if info.IsDir() {
+		return notFoundError("Download file not found")
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filepath.Base(info.Name())))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+	return nil
+}
+
 // DownloadList lists all purchased downloads for an order or a user.
 func (a *API) DownloadList(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
@@ -163,7 +291,7 @@ func (a *API) DownloadRefresh(w http.ResponseWriter, r *http.Request) error {
 		return unauthorizedError("This order has not been completed yet")
 	}
 
-	if err := order.UpdateDownloads(config, log); err != nil {
+	if err := order.UpdateDownloads(a.db, config, log); err != nil {
 		return internalServerError("Error during updating downloads").WithInternalError(err)
 	}
 
@@ -173,3 +301,70 @@ func (a *API) DownloadRefresh(w http.ResponseWriter, r *http.Request) error {
 
 	return sendJSON(w, http.StatusOK, map[string]string{})
 }
+
+// DownloadRefreshSku refreshes the downloads of a sku for all paid orders and
+// notifies the buyers of new downloads or versions.
+func (a *API) DownloadRefreshSku(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	db := a.DB(r)
+	config := gcontext.GetConfig(ctx)
+	claims := gcontext.GetClaims(ctx)
+	log := getLogEntry(r)
+
+	params := &downloadRefreshParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read refresh params: %v", err)
+	}
+	if params.Sku == "" {
+		return badRequestError("A sku is required to refresh downloads")
+	}
+	logEntrySetField(r, "sku", params.Sku)
+
+	updates, err := models.RefreshSkuDownloads(db, config, gcontext.GetInstanceID(ctx), params.Sku, log)
+	if err != nil {
+		return internalServerError("Error during updating downloads").WithInternalError(err)
+	}
+
+	// only the new downloads are inserted, so that edits made to the orders
+	// in the meantime are kept
+	result := &downloadRefreshResult{Orders: len(updates)}
+	tx := db.Begin()
+	for _, update := range updates {
+		for i := range update.Downloads {
+			if rsp := tx.Create(&update.Downloads[i]); rsp.Error != nil {
+				tx.Rollback()
+				return internalServerError("Error during saving downloads").WithInternalError(rsp.Error)
+			}
+		}
+		models.LogEvent(tx, r.RemoteAddr, claims.Subject, update.Order.ID, models.EventUpdated, []string{"downloads"})
+		result.Downloads += len(update.Downloads)
+		if update.Order.Email != "" {
+			result.Notifying++
+		}
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error during saving downloads").WithInternalError(rsp.Error)
+	}
+
+	// a popular sku has many buyers, so they're mailed in the background
+	go sendDownloadsUpdatedMails(ctx, db, r.RemoteAddr, claims.Subject, log, updates)
+
+	return sendJSON(w, http.StatusOK, result)
+}
+
+// sendDownloadsUpdatedMails notifies the buyers of orders of their new
+// downloads.
+func sendDownloadsUpdatedMails(ctx context.Context, db *gorm.DB, ip, userID string, log logrus.FieldLogger, updates []models.DownloadUpdate) {
+	mailer := gcontext.GetMailer(ctx)
+
+	for _, update := range updates {
+		if update.Order.Email == "" {
+			continue
+		}
+		if err := mailer.DownloadsUpdatedMail(update.Order, update.Downloads); err != nil {
+			log.WithError(err).WithField("order_id", update.Order.ID).Error("Error sending download update mail")
+			continue
+		}
+		models.LogEvent(db, ip, userID, update.Order.ID, models.EventEmail, []string{"downloads_updated", update.Order.Email})
+	}
+}
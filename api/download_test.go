@@ -1,15 +1,22 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/netlify/gocommerce/models"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDownloadList(t *testing.T) {
@@ -33,8 +40,9 @@ func currentDownloads(test *RouteTest) []models.Download {
 }
 
 type DownloadMeta struct {
-	Title string `json:"title"`
-	URL   string `json:"url"`
+	Title   string `json:"title"`
+	URL     string `json:"url"`
+	Version string `json:"version,omitempty"`
 }
 
 func startTestSiteWithDownloads(t *testing.T, downloads []*DownloadMeta) *httptest.Server {
@@ -90,3 +98,189 @@ func TestDownloadRefresh(t *testing.T) {
 	}
 	assert.True(t, exists)
 }
+
+func TestDownloadRefreshSku(t *testing.T) {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	refresh := func(t *testing.T, test *RouteTest, version string) *downloadRefreshResult {
+		testSite := startTestSiteWithDownloads(t, []*DownloadMeta{
+			{Title: "Flight Manual", URL: "/flight-manual.pdf", Version: version},
+		})
+		defer testSite.Close()
+		test.Config.SiteURL = testSite.URL
+		models.ResetCatalogCache()
+
+		body := strings.NewReader(`{"sku": "123-i-can-fly-456"}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/downloads/refresh", body, token)
+		result := &downloadRefreshResult{}
+		extractPayload(t, http.StatusOK, recorder, result)
+		return result
+	}
+
+	t.Run("NewVersion", func(t *testing.T) {
+		test := NewRouteTest(t)
+		downloadsBefore := currentDownloads(test)
+
+		result := refresh(t, test, "1.0")
+		assert.Equal(t, 1, result.Orders)
+		assert.Equal(t, 1, result.Downloads)
+		assert.Equal(t, 1, result.Notifying)
+
+		result = refresh(t, test, "1.0")
+		assert.Equal(t, 0, result.Orders)
+
+		result = refresh(t, test, "2.0")
+		assert.Equal(t, 1, result.Orders)
+		assert.Equal(t, 1, result.Downloads)
+
+		versions := []string{}
+		for _, download := range currentDownloads(test) {
+			if download.URL == "/flight-manual.pdf" {
+				versions = append(versions, download.Version)
+			}
+		}
+		assert.Len(t, currentDownloads(test), len(downloadsBefore)+2)
+		assert.ElementsMatch(t, []string{"1.0", "2.0"}, versions)
+	})
+
+	t.Run("KeepsOrders", func(t *testing.T) {
+		test := NewRouteTest(t)
+		before := &models.Order{}
+		require.NoError(t, test.DB.First(before, "id = ?", test.Data.firstOrder.ID).Error)
+
+		result := refresh(t, test, "1.0")
+		assert.Equal(t, 1, result.Orders)
+
+		// only the downloads are inserted, the order isn't saved again
+		after := &models.Order{}
+		require.NoError(t, test.DB.First(after, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, before.UpdatedAt, after.UpdatedAt)
+	})
+
+	t.Run("MissingSku", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, "/downloads/refresh", strings.NewReader(`{}`), token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := strings.NewReader(`{"sku": "123-i-can-fly-456"}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/downloads/refresh", body, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
+func TestDownloadFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "downloads")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "batwing.pdf"), []byte("batwing manual"), 0644))
+
+	setup := func(t *testing.T) *RouteTest {
+		test := NewRouteTest(t)
+		test.Config.Downloads.Provider = "local"
+		test.Config.Downloads.Local.Path = dir
+		require.NoError(t, test.DB.Model(&models.Download{}).Where("id = ?", "first-download").Update("url", "/batwing.pdf").Error)
+		return test
+	}
+
+	t.Run("Signed", func(t *testing.T) {
+		test := setup(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/downloads/first-download", nil, test.Data.testUserToken)
+		download := &models.Download{}
+		extractPayload(t, http.StatusOK, recorder, download)
+		require.True(t, strings.HasPrefix(download.URL, "/downloads/first-download/file?"), download.URL)
+
+		recorder = test.TestEndpoint(http.MethodGet, download.URL, nil, nil)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "batwing manual", recorder.Body.String())
+		assert.Contains(t, recorder.Header().Get("Content-Disposition"), "batwing.pdf")
+	})
+
+	t.Run("BadSignature", func(t *testing.T) {
+		test := setup(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/downloads/first-download/file?expires=9999999999&signature=forged", nil, nil)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("NotServed", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/downloads/first-download/file", nil, nil)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+}
+
+func TestDownloadLimits(t *testing.T) {
+	t.Run("MaxDownloads", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(&models.Download{}).Where("id = ?", "first-download").Update("max_downloads", 1).Error)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/downloads/first-download", nil, test.Data.testUserToken)
+		download := &models.Download{}
+		extractPayload(t, http.StatusOK, recorder, download)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/downloads/first-download", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+
+		stored := &models.Download{}
+		require.NoError(t, test.DB.First(stored, "id = ?", "first-download").Error)
+		assert.EqualValues(t, 1, stored.DownloadCount)
+	})
+
+	t.Run("MaxDownloadsPerIP", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(&models.Download{}).Where("id = ?", "first-download").Update("max_downloads_per_ip", 1).Error)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/downloads/first-download", nil, test.Data.testUserToken)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/downloads/first-download", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("MaxDownloadsPerIPAcrossConnections", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.GlobalConfig.API.TrustedProxies = []string{"10.0.0.0/8"}
+		require.NoError(t, test.DB.Model(&models.Download{}).Where("id = ?", "first-download").Update("max_downloads_per_ip", 1).Error)
+
+		download := func(remoteAddr, forwardedFor string) *httptest.ResponseRecorder {
+			recorder := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, baseURL+"/downloads/first-download", nil)
+			req.RemoteAddr = remoteAddr
+			if forwardedFor != "" {
+				req.Header.Set("X-Forwarded-For", forwardedFor)
+			}
+			require.NoError(t, signHTTPRequest(req, test.Data.testUserToken, test.Config.JWT.Secret))
+			ctx, err := WithInstanceConfig(context.Background(), test.GlobalConfig.SMTP, test.Config, "")
+			require.NoError(t, err)
+			NewAPIWithVersion(ctx, test.GlobalConfig, logrus.StandardLogger(), test.DB, "").handler.ServeHTTP(recorder, req)
+			return recorder
+		}
+
+		assert.Equal(t, http.StatusOK, download("203.0.113.7:40001", "").Code)
+		// a new connection from the same client
+		validateError(t, http.StatusUnauthorized, download("203.0.113.7:40002", ""))
+		// the header of a client that isn't a trusted proxy is ignored
+		validateError(t, http.StatusUnauthorized, download("203.0.113.7:40003", "198.51.100.1"))
+		// a trusted proxy forwards another client
+		assert.Equal(t, http.StatusOK, download("10.0.0.2:40004", "198.51.100.1").Code)
+
+		// without trusted proxies the header of any client is used
+		test.GlobalConfig.API.TrustedProxies = nil
+		assert.Equal(t, http.StatusOK, download("203.0.113.7:40005", "198.51.100.2").Code)
+	})
+
+	t.Run("Expired", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(&models.Download{}).Where("id = ?", "first-download").Update("expiry_days", 1).Error)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/downloads/first-download", nil, test.Data.testUserToken)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		paidAt := time.Now().Add(-72 * time.Hour)
+		require.NoError(t, test.DB.Model(&models.Transaction{}).Where("id = ?", test.Data.firstTransaction.ID).Update("created_at", paidAt).Error)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/downloads/first-download", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
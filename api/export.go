@@ -0,0 +1,233 @@
+package api
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	csvFormat  = "csv"
+	xlsxFormat = "xlsx"
+
+	csvContentType  = "text/csv"
+	xlsxContentType = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+
+	// exportBatchSize is the number of records loaded at once while
+	// streaming an export.
+	exportBatchSize = 100
+)
+
+// exportFormat returns the spreadsheet format requested with the `format`
+// parameter or the Accept header, or an empty string for JSON.
+func exportFormat(r *http.Request) (string, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case csvFormat, xlsxFormat:
+		return format, nil
+	case "json":
+		return "", nil
+	case "":
+	default:
+		return "", fmt.Errorf("Bad value for format: %v", format)
+	}
+
+	accept := r.Header.Get("Accept")
+	switch {
+	case strings.Contains(accept, csvContentType):
+		return csvFormat, nil
+	case strings.Contains(accept, xlsxContentType):
+		return xlsxFormat, nil
+	}
+	return "", nil
+}
+
+// tableWriter streams rows of a spreadsheet to the response.
+type tableWriter interface {
+	WriteRow(values ...interface{}) error
+	Close() error
+}
+
+// newTableWriter starts a spreadsheet download named after the endpoint and
+// writes the header row.
+func newTableWriter(w http.ResponseWriter, format, name string, header ...string) (tableWriter, error) {
+	filename := name + "-" + time.Now().UTC().Format("20060102") + "." + format
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	var table tableWriter
+	switch format {
+	case csvFormat:
+		w.Header().Set("Content-Type", csvContentType+"; charset=utf-8")
+		table = newCSVWriter(w)
+	case xlsxFormat:
+		w.Header().Set("Content-Type", xlsxContentType)
+		xlsx, err := newXLSXWriter(w)
+		if err != nil {
+			return nil, err
+		}
+		table = xlsx
+	default:
+		return nil, fmt.Errorf("Unknown export format: %v", format)
+	}
+
+	values := make([]interface{}, len(header))
+	for i, h := range header {
+		values[i] = h
+	}
+	return table, table.WriteRow(values...)
+}
+
+// exportValue formats a cell value and reports whether it is a number.
+func exportValue(value interface{}) (string, bool) {
+	switch v := value.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, false
+	case int:
+		return strconv.Itoa(v), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case uint64:
+		return strconv.FormatUint(v, 10), true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), false
+	case time.Time:
+		if v.IsZero() {
+			return "", false
+		}
+		return v.UTC().Format(time.RFC3339), false
+	case *time.Time:
+		if v == nil {
+			return "", false
+		}
+		return exportValue(*v)
+	default:
+		return fmt.Sprintf("%v", v), false
+	}
+}
+
+type csvWriter struct {
+	w    http.ResponseWriter
+	csv  *csv.Writer
+	rows int
+}
+
+func newCSVWriter(w http.ResponseWriter) *csvWriter {
+	return &csvWriter{w: w, csv: csv.NewWriter(w)}
+}
+
+func (c *csvWriter) WriteRow(values ...interface{}) error {
+	record := make([]string, len(values))
+	for i, value := range values {
+		s, numeric := exportValue(value)
+		// keep spreadsheets from evaluating user provided text as formulas
+		if !numeric && s != "" && strings.ContainsAny(s[:1], "=+-@\t\r") {
+			s = "'" + s
+		}
+		record[i] = s
+	}
+	if err := c.csv.Write(record); err != nil {
+		return err
+	}
+
+	c.rows++
+	if c.rows%exportBatchSize == 0 {
+		c.csv.Flush()
+		if f, ok := c.w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	return c.csv.Error()
+}
+
+func (c *csvWriter) Close() error {
+	c.csv.Flush()
+	return c.csv.Error()
+}
+
+const (
+	xlsxContentTypes = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/><Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/></Types>`
+	xlsxRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/></Relationships>`
+	xlsxWorkbook = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Sheet1" sheetId="1" r:id="rId1"/></sheets></workbook>`
+	xlsxWorkbookRels = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/></Relationships>`
+	xlsxSheetStart = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`
+	xlsxSheetEnd = `</sheetData></worksheet>`
+)
+
+// xlsxWriter writes a single sheet workbook. The sheet is the last entry of
+// the archive, so its rows can be streamed without knowing them in advance.
+type xlsxWriter struct {
+	zip   *zip.Writer
+	sheet *bufio.Writer
+}
+
+func newXLSXWriter(w io.Writer) (*xlsxWriter, error) {
+	archive := zip.NewWriter(w)
+	parts := []struct{ name, content string }{
+		{"[Content_Types].xml", xlsxContentTypes},
+		{"_rels/.rels", xlsxRels},
+		{"xl/workbook.xml", xlsxWorkbook},
+		{"xl/_rels/workbook.xml.rels", xlsxWorkbookRels},
+	}
+	for _, part := range parts {
+		f, err := archive.Create(part.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.WriteString(f, part.content); err != nil {
+			return nil, err
+		}
+	}
+
+	f, err := archive.Create("xl/worksheets/sheet1.xml")
+	if err != nil {
+		return nil, err
+	}
+	sheet := bufio.NewWriter(f)
+	if _, err := sheet.WriteString(xlsxSheetStart); err != nil {
+		return nil, err
+	}
+	return &xlsxWriter{zip: archive, sheet: sheet}, nil
+}
+
+func (x *xlsxWriter) WriteRow(values ...interface{}) error {
+	x.sheet.WriteString("<row>")
+	for _, value := range values {
+		s, numeric := exportValue(value)
+		if numeric {
+			x.sheet.WriteString("<c><v>" + s + "</v></c>")
+			continue
+		}
+		x.sheet.WriteString(`<c t="inlineStr"><is><t xml:space="preserve">`)
+		if err := xml.EscapeText(x.sheet, []byte(s)); err != nil {
+			return err
+		}
+		x.sheet.WriteString("</t></is></c>")
+	}
+	_, err := x.sheet.WriteString("</row>")
+	return err
+}
+
+func (x *xlsxWriter) Close() error {
+	if _, err := x.sheet.WriteString(xlsxSheetEnd); err != nil {
+		return err
+	}
+	if err := x.sheet.Flush(); err != nil {
+		return err
+	}
+	return x.zip.Close()
+}
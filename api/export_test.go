@@ -0,0 +1,166 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/csv"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func readCSVExport(t *testing.T, recorder *httptest.ResponseRecorder) [][]string {
+	require.Equal(t, http.StatusOK, recorder.Code, recorder.Body.String())
+	assert.Contains(t, recorder.Header().Get("Content-Type"), csvContentType)
+	records, err := csv.NewReader(recorder.Body).ReadAll()
+	require.NoError(t, err)
+	return records
+}
+
+func TestExportFormat(t *testing.T) {
+	tests := map[string]struct {
+		URL    string
+		Accept string
+		Format string
+	}{
+		"JSON":        {"/orders", "application/json", ""},
+		"AcceptCSV":   {"/orders", "text/csv", csvFormat},
+		"AcceptXLSX":  {"/orders", xlsxContentType, xlsxFormat},
+		"ParamCSV":    {"/orders?format=csv", "", csvFormat},
+		"ParamJSON":   {"/orders?format=json", "text/csv", ""},
+		"ParamBefore": {"/orders?format=xlsx", "text/csv", xlsxFormat},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.URL, nil)
+			req.Header.Set("Accept", tc.Accept)
+			format, err := exportFormat(req)
+			require.NoError(t, err)
+			assert.Equal(t, tc.Format, format)
+		})
+	}
+
+	_, err := exportFormat(httptest.NewRequest(http.MethodGet, "/orders?format=pdf", nil))
+	assert.Error(t, err)
+}
+
+func TestExport(t *testing.T) {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	t.Run("Orders", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders?format=csv", nil, test.Data.testUserToken)
+		records := readCSVExport(t, recorder)
+		require.Len(t, records, 4)
+		assert.Equal(t, orderExportHeader, records[0])
+
+		skus := map[string]string{}
+		for _, record := range records[1:] {
+			skus[record[18]] = record[0]
+			assert.Equal(t, test.Data.testAddress.Country, record[11])
+		}
+		assert.Equal(t, test.Data.firstOrder.ID, skus[test.Data.firstLineItem.Sku])
+		assert.Equal(t, test.Data.secondOrder.ID, skus[test.Data.secondLineItem1.Sku])
+		assert.Equal(t, test.Data.secondOrder.ID, skus[test.Data.secondLineItem2.Sku])
+	})
+
+	t.Run("OrdersFiltered", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders?format=csv&coupon_code=zerodiscount&items=batwing", nil, test.Data.testUserToken)
+		records := readCSVExport(t, recorder)
+		require.Len(t, records, 2)
+		assert.Equal(t, test.Data.firstOrder.ID, records[1][0])
+	})
+
+	t.Run("PaymentsXLSX", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/payments?format=xlsx", nil, token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, xlsxContentType, recorder.Header().Get("Content-Type"))
+
+		archive, err := zip.NewReader(bytes.NewReader(recorder.Body.Bytes()), int64(recorder.Body.Len()))
+		require.NoError(t, err)
+		var sheet []byte
+		for _, f := range archive.File {
+			if f.Name == "xl/worksheets/sheet1.xml" {
+				rc, err := f.Open()
+				require.NoError(t, err)
+				sheet, err = ioutil.ReadAll(rc)
+				require.NoError(t, err)
+				rc.Close()
+			}
+		}
+		require.NotNil(t, sheet)
+		assert.Contains(t, string(sheet), test.Data.firstTransaction.ID)
+		assert.Contains(t, string(sheet), test.Data.secondTransaction.ID)
+		assert.Contains(t, string(sheet), "<c><v>100</v></c>")
+	})
+
+	t.Run("Users", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/users?format=csv", nil, token)
+		records := readCSVExport(t, recorder)
+		require.Len(t, records, 2)
+		assert.Equal(t, test.Data.testUser.Email, records[1][1])
+		assert.Equal(t, "2", records[1][4])
+	})
+
+	t.Run("SalesReport", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/sales?format=csv", nil, token)
+		records := readCSVExport(t, recorder)
+		require.Len(t, records, 2)
+		assert.Equal(t, "USD", records[1][1])
+		assert.Equal(t, "79", records[1][6])
+	})
+
+	t.Run("Returns", func(t *testing.T) {
+		test := NewRouteTest(t)
+		ret := requestReturn(t, test, `{"reason": "Cape too short", "items": [{"line_item_id": 11, "quantity": 1}]}`, http.StatusCreated)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/returns?format=csv&state=requested", nil, token)
+		records := readCSVExport(t, recorder)
+		require.Len(t, records, 2)
+		assert.Equal(t, returnExportHeader, records[0])
+		assert.Equal(t, ret.ID, records[1][0])
+		assert.Equal(t, "Cape too short", records[1][4])
+		assert.Equal(t, test.Data.firstLineItem.Sku, records[1][10])
+		assert.Equal(t, "1", records[1][11])
+	})
+
+	t.Run("OrderLists", func(t *testing.T) {
+		test := NewRouteTest(t)
+		orderURL := "/orders/" + test.Data.secondOrder.ID
+		createShipment(t, test, test.Data.secondOrder.ID, `{"carrier": "UPS", "items": [{"line_item_id": 21, "quantity": 1}]}`, http.StatusCreated)
+		adjustment := &models.Adjustment{ID: "export-adjustment", OrderID: test.Data.secondOrder.ID, Type: models.AdjustmentChargeType, Amount: 5, Currency: "USD", State: models.PendingState}
+		require.NoError(t, test.DB.Create(adjustment).Error)
+		note := &models.OrderNote{OrderID: test.Data.secondOrder.ID, Text: "Gift wrap, please"}
+		require.NoError(t, test.DB.Create(note).Error)
+
+		records := readCSVExport(t, test.TestEndpoint(http.MethodGet, orderURL+"/shipments?format=csv", nil, token))
+		require.Len(t, records, 2)
+		assert.Equal(t, "UPS", records[1][2])
+		assert.Equal(t, "456-i-rollover-all-things", records[1][7])
+
+		records = readCSVExport(t, test.TestEndpoint(http.MethodGet, orderURL+"/adjustments?format=csv", nil, token))
+		require.Len(t, records, 2)
+		assert.Equal(t, adjustment.ID, records[1][0])
+		assert.Equal(t, "5", records[1][4])
+
+		records = readCSVExport(t, test.TestEndpoint(http.MethodGet, orderURL+"/notes?format=csv", nil, token))
+		require.Len(t, records, 2)
+		assert.Equal(t, "Gift wrap, please", records[1][5])
+	})
+
+	t.Run("BadFormat", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/payments?format=pdf", nil, token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+}
@@ -137,6 +137,26 @@ func (ts *InstanceTestSuite) TestUpdate() {
 	require.Equal(ts.T(), "https://test.mysite.com", i.BaseConfig.SiteURL)
 }
 
+func (ts *InstanceTestSuite) TestDeleteKeepsSharedSequences() {
+	instanceID := uuid.NewRandom().String()
+	instance := &models.Instance{ID: instanceID, UUID: testUUID}
+	require.NoError(ts.T(), models.CreateInstance(ts.API.db, instance))
+
+	own := &models.Sequence{Name: "invoice:" + instanceID, Entity: instanceID, Number: 3}
+	shared := &models.Sequence{Name: "invoice:" + instanceID + "-entity", Entity: instanceID + "-entity", Number: 5}
+	require.NoError(ts.T(), ts.API.db.Create(own).Error)
+	require.NoError(ts.T(), ts.API.db.Create(shared).Error)
+	defer ts.API.db.Delete(shared)
+
+	require.NoError(ts.T(), models.DeleteInstance(ts.API.db, instance))
+
+	count := 0
+	require.NoError(ts.T(), ts.API.db.Model(&models.Sequence{}).Where("name = ?", own.Name).Count(&count).Error)
+	assert.Equal(ts.T(), 0, count)
+	require.NoError(ts.T(), ts.API.db.Model(&models.Sequence{}).Where("name = ?", shared.Name).Count(&count).Error)
+	assert.Equal(ts.T(), 1, count)
+}
+
 func TestInstance(t *testing.T) {
 	suite.Run(t, new(InstanceTestSuite))
 }
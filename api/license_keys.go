@@ -0,0 +1,176 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/pborman/uuid"
+)
+
+type licenseKeyUploadParams struct {
+	Sku  string   `json:"sku"`
+	Keys []string `json:"keys"`
+}
+
+func (a *API) licenseKeyRoutes(r *router) {
+	r.Use(adminRequired)
+
+	r.Get("/", a.LicenseKeyList)
+	r.With(addGetBody).Post("/", a.LicenseKeyUpload)
+	r.Delete("/{key_id}", a.LicenseKeyDelete)
+}
+
+// LicenseKeyList lists the license keys of the instance. It can be filtered
+// by sku and by whether the keys have been assigned to an order.
+func (a *API) LicenseKeyList(w http.ResponseWriter, r *http.Request) error {
+	query := a.DB(r).Where("instance_id = ?", gcontext.GetInstanceID(r.Context()))
+
+	params := r.URL.Query()
+	if sku := params.Get("sku"); sku != "" {
+		query = query.Where("sku = ?", sku)
+	}
+	switch params.Get("assigned") {
+	case "":
+	case "true":
+		query = query.Where("order_id <> ?", "")
+	case "false":
+		query = query.Where("order_id = ?", "")
+	default:
+		return badRequestError("Bad value for assigned: %v", params.Get("assigned"))
+	}
+
+	format, err := exportFormat(r)
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	if format != "" {
+		return exportLicenseKeys(w, a.DB(r), query.Order("created_at asc"), format)
+	}
+
+	offset, limit, err := paginate(w, r, query.Model(&models.LicenseKey{}))
+	if err != nil {
+		return badRequestError("Bad Pagination Parameters: %v", err)
+	}
+
+	keys := []models.LicenseKey{}
+	if result := query.Order("created_at asc").Offset(offset).Limit(limit).Find(&keys); result.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	return sendJSON(w, http.StatusOK, keys)
+}
+
+func exportLicenseKeys(w http.ResponseWriter, db *gorm.DB, query *gorm.DB, format string) error {
+	rows, err := query.Model(&models.LicenseKey{}).Rows()
+	if err != nil {
+		return internalServerError("Error during database query").WithInternalError(err)
+	}
+	defer rows.Close()
+
+	table, err := newTableWriter(w, format, "license_keys", "id", "sku", "key", "order_id", "assigned_at", "created_at")
+	if err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+	for rows.Next() {
+		key := &models.LicenseKey{}
+		if err := db.ScanRows(rows, key); err != nil {
+			return internalServerError("Error during database query").WithInternalError(err)
+		}
+		if err := table.WriteRow(key.ID, key.Sku, key.Key, key.OrderID, key.AssignedAt, key.CreatedAt); err != nil {
+			return internalServerError("Error writing export").WithInternalError(err)
+		}
+	}
+	if err := table.Close(); err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+	return nil
+}
+
+// LicenseKeyUpload adds keys to the pool of a sku. Keys must be unique within
+// the instance.
+func (a *API) LicenseKeyUpload(w http.ResponseWriter, r *http.Request) error {
+	db := a.DB(r)
+	instanceID := gcontext.GetInstanceID(r.Context())
+
+	params := &licenseKeyUploadParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read license key params: %v", err)
+	}
+	if params.Sku == "" {
+		return badRequestError("License keys must have a sku")
+	}
+
+	keys := []string{}
+	seen := map[string]bool{}
+	for _, key := range params.Keys {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		if seen[key] {
+			return badRequestError("Duplicate license key: %s", key)
+		}
+		seen[key] = true
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return badRequestError("No license keys provided")
+	}
+
+	existing := []models.LicenseKey{}
+	if rsp := db.Where("instance_id = ? AND license_key in (?)", instanceID, keys).Find(&existing); rsp.Error != nil {
+		return internalServerError("Error while querying for license keys").WithInternalError(rsp.Error)
+	}
+	if len(existing) > 0 {
+		return badRequestError("License key already exists: %s", existing[0].Key)
+	}
+
+	created := make([]*models.LicenseKey, len(keys))
+	tx := db.Begin()
+	for i, key := range keys {
+		created[i] = &models.LicenseKey{
+			ID:         uuid.NewRandom().String(),
+			InstanceID: instanceID,
+			Sku:        params.Sku,
+			Key:        key,
+		}
+		if rsp := tx.Create(created[i]); rsp.Error != nil {
+			tx.Rollback()
+			return internalServerError("Error while saving license keys").WithInternalError(rsp.Error)
+		}
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("Error while saving license keys").WithInternalError(rsp.Error)
+	}
+
+	return sendJSON(w, http.StatusCreated, created)
+}
+
+// LicenseKeyDelete removes a key from the pool. Assigned keys can't be
+// deleted.
+func (a *API) LicenseKeyDelete(w http.ResponseWriter, r *http.Request) error {
+	db := a.DB(r)
+	keyID := chi.URLParam(r, "key_id")
+
+	key := &models.LicenseKey{}
+	rsp := db.Where("instance_id = ? AND id = ?", gcontext.GetInstanceID(r.Context()), keyID).First(key)
+	if rsp.RecordNotFound() {
+		return notFoundError("License key not found")
+	}
+	if rsp.Error != nil {
+		return internalServerError("Error while querying for license key").WithInternalError(rsp.Error)
+	}
+	if key.OrderID != "" {
+		return badRequestError("License key has already been assigned to an order")
+	}
+
+	if rsp := db.Delete(key); rsp.Error != nil {
+		return internalServerError("Error while deleting license key").WithInternalError(rsp.Error)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	stripe "github.com/stripe/stripe-go"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func uploadLicenseKeys(t *testing.T, test *RouteTest, sku string, keys ...string) []models.LicenseKey {
+	body, err := json.Marshal(&licenseKeyUploadParams{Sku: sku, Keys: keys})
+	require.NoError(t, err)
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	recorder := test.TestEndpoint(http.MethodPost, "/license_keys", bytes.NewBuffer(body), token)
+
+	created := []models.LicenseKey{}
+	extractPayload(t, http.StatusCreated, recorder, &created)
+	return created
+}
+
+func TestLicenseKeyAdmin(t *testing.T) {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	t.Run("Upload", func(t *testing.T) {
+		test := NewRouteTest(t)
+		created := uploadLicenseKeys(t, test, "batmobile-os", "AAAA-1111", " BBBB-2222 ", "")
+		require.Len(t, created, 2)
+		assert.Equal(t, "BBBB-2222", created[1].Key)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/license_keys?sku=batmobile-os&assigned=false", nil, token)
+		keys := []models.LicenseKey{}
+		extractPayload(t, http.StatusOK, recorder, &keys)
+		assert.Len(t, keys, 2)
+	})
+
+	t.Run("Duplicate", func(t *testing.T) {
+		test := NewRouteTest(t)
+		uploadLicenseKeys(t, test, "batmobile-os", "AAAA-1111")
+
+		body := bytes.NewBufferString(`{"sku": "batmobile-os", "keys": ["AAAA-1111"]}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/license_keys", body, token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		test := NewRouteTest(t)
+		created := uploadLicenseKeys(t, test, "batmobile-os", "AAAA-1111")
+
+		recorder := test.TestEndpoint(http.MethodDelete, "/license_keys/"+created[0].ID, nil, token)
+		assert.Equal(t, http.StatusNoContent, recorder.Code)
+
+		recorder = test.TestEndpoint(http.MethodDelete, "/license_keys/"+created[0].ID, nil, token)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/license_keys", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
+// payLicenseKeyOrder confirms the payment of the first order after uploading
+// the keys to the pool of its first line item.
+func payLicenseKeyOrder(t *testing.T, test *RouteTest, keys ...string) {
+	stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+		if path == fmt.Sprintf("/v1/payment_intents/%s/confirm", stripePaymentIntentID) {
+			intent := v.(*stripe.PaymentIntent)
+			intent.ID = stripePaymentIntentID
+			intent.Status = stripe.PaymentIntentStatusSucceeded
+			return nil
+		}
+		t.Fatalf("unknown Stripe API call to %s", path)
+		return &stripe.Error{Code: stripe.ErrorCodeURLInvalid}
+	}))
+	defer stripe.SetBackend(stripe.APIBackend, nil)
+
+	uploadLicenseKeys(t, test, test.Data.firstLineItem.Sku, keys...)
+
+	test.Data.firstLineItem.Type = models.LicenseKeyProductType
+	require.NoError(t, test.DB.Save(test.Data.firstLineItem).Error)
+	test.Data.firstOrder.PaymentState = models.PendingState
+	require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+	test.Data.firstTransaction.Status = models.PendingState
+	test.Data.firstTransaction.ProcessorID = stripePaymentIntentID
+	require.NoError(t, test.DB.Save(test.Data.firstTransaction).Error)
+
+	recorder := test.TestEndpoint(http.MethodPost, fmt.Sprintf("/payments/%s/confirm", test.Data.firstTransaction.ID), nil, test.Data.testUserToken)
+	trans := models.Transaction{}
+	extractPayload(t, http.StatusOK, recorder, &trans)
+	assert.Equal(t, models.PaidState, trans.Status)
+}
+
+func TestLicenseKeyAssignment(t *testing.T) {
+	test := NewRouteTest(t)
+	payLicenseKeyOrder(t, test, "AAAA-1111", "BBBB-2222")
+
+	recorder := test.TestEndpoint(http.MethodGet, "/downloads", nil, test.Data.testUserToken)
+	downloads := []models.Download{}
+	extractPayload(t, http.StatusOK, recorder, &downloads)
+	keys := []string{}
+	for _, download := range downloads {
+		if download.LicenseKey != "" {
+			assert.Equal(t, models.LicenseKeyFormat, download.Format)
+			keys = append(keys, download.LicenseKey)
+		}
+	}
+	assert.Len(t, keys, int(test.Data.firstLineItem.Quantity))
+	assert.Contains(t, keys, "AAAA-1111")
+
+	assigned := []models.LicenseKey{}
+	require.NoError(t, test.DB.Where("order_id = ?", test.Data.firstOrder.ID).Find(&assigned).Error)
+	assert.Len(t, assigned, len(keys))
+}
+
+func TestLicenseKeyAssignmentMissing(t *testing.T) {
+	test := NewRouteTest(t)
+	// not enough keys for the quantity of the line item
+	payLicenseKeyOrder(t, test, "AAAA-1111")
+
+	order := &models.Order{}
+	require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+	assert.Equal(t, models.PaidState, order.PaymentState)
+
+	assigned := 0
+	require.NoError(t, test.DB.Model(&models.LicenseKey{}).Where("order_id = ?", order.ID).Count(&assigned).Error)
+	assert.Equal(t, 0, assigned)
+
+	notes := []models.OrderNote{}
+	require.NoError(t, test.DB.Where("order_id = ?", order.ID).Find(&notes).Error)
+	require.Len(t, notes, 1)
+	assert.False(t, notes[0].CustomerVisible)
+	assert.Contains(t, notes[0].Text, "License keys could not be assigned")
+}
@@ -3,23 +3,24 @@ package api
 import (
 	"context"
 	"encoding/json"
-	"fmt"
 	"net/http"
 	"sync"
+	"time"
 
 	"github.com/go-chi/chi"
 	"github.com/jinzhu/gorm"
 	"github.com/mattes/vat"
-	"github.com/netlify/gocommerce/calculator"
 	"github.com/netlify/gocommerce/claims"
+	"github.com/netlify/gocommerce/conf"
 	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/countries"
 	"github.com/netlify/gocommerce/models"
 	"github.com/pborman/uuid"
 	"github.com/sirupsen/logrus"
 )
 
 // MaxConcurrentLookups controls the number of simultaneous HTTP Order lookups
-const MaxConcurrentLookups = 10
+const MaxConcurrentLookups = models.MaxConcurrentMetadataFetches
 
 type orderLineItem struct {
 	Sku      string                 `json:"sku"`
@@ -56,7 +57,8 @@ type orderRequestParams struct {
 
 	FulfillmentState string `json:"fulfillment_state"`
 
-	CouponCode string `json:"coupon"`
+	CouponCode   string `json:"coupon"`
+	RemoveCoupon bool   `json:"remove_coupon"`
 }
 
 type receiptParams struct {
@@ -85,9 +87,12 @@ func (a *API) withOrderID(w http.ResponseWriter, r *http.Request) (context.Conte
 // ClaimOrders will look for any orders with no user id belonging to an email and claim them
 func (a *API) ClaimOrders(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
-	db := a.DB(r)
 	log := getLogEntry(r)
-	instanceID := gcontext.GetInstanceID(ctx)
+	config := gcontext.GetConfig(ctx)
+
+	if config.GuestOrders.ClaimPolicy == conf.ClaimPolicyDisabled {
+		return badRequestError("Claiming orders is disabled")
+	}
 
 	claims := gcontext.GetClaims(ctx)
 	if claims.Email == "" {
@@ -98,6 +103,70 @@ func (a *API) ClaimOrders(w http.ResponseWriter, r *http.Request) error {
 		return badRequestError("Must provide a ID in the token to claim orders")
 	}
 
+	if httpErr := verifyClaimEmail(config, claims); httpErr != nil {
+		return httpErr
+	}
+
+	if _, httpErr := claimOrders(a.DB(r), gcontext.GetInstanceID(ctx), claims, log); httpErr != nil {
+		return httpErr
+	}
+
+	log.Info("Finished updating")
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// autoClaimOrders claims the guest orders of a user on the first
+// authenticated request, if the instance is configured to do so. Failing to
+// claim them doesn't fail the request.
+func (a *API) autoClaimOrders(w http.ResponseWriter, r *http.Request) (context.Context, error) {
+	ctx := r.Context()
+	config := gcontext.GetConfig(ctx)
+	claims := gcontext.GetClaims(ctx)
+	if config == nil || config.GuestOrders.ClaimPolicy != conf.ClaimPolicyAuto {
+		return ctx, nil
+	}
+	if claims == nil || claims.Subject == "" || claims.Email == "" || verifyClaimEmail(config, claims) != nil {
+		return ctx, nil
+	}
+
+	instanceID := gcontext.GetInstanceID(ctx)
+	log := getLogEntry(r)
+	user := &models.User{}
+	rsp := a.DB(r).First(user, "id = ?", claims.Subject)
+	if rsp.Error != nil && !rsp.RecordNotFound() {
+		log.WithError(rsp.Error).Warn("Failed to query for the user to claim orders")
+		return ctx, nil
+	}
+	// only the first request of the user claims orders
+	if rsp.Error == nil && user.OrdersClaimedAt != nil {
+		return ctx, nil
+	}
+
+	claimed, httpErr := claimOrders(a.DB(r), instanceID, claims, log)
+	if httpErr != nil {
+		log.WithError(httpErr).Warn("Failed to claim orders")
+		return ctx, nil
+	}
+	log.Infof("Claimed %d orders", claimed)
+	return ctx, nil
+}
+
+// verifyClaimEmail checks that the email of a token is verified enough to
+// claim the orders placed with it.
+func verifyClaimEmail(config *conf.Configuration, claims *claims.JWTClaims) *HTTPError {
+	if claims.EmailVerified != nil && !*claims.EmailVerified {
+		return forbiddenError("The email of the token must be verified to claim orders")
+	}
+	if claims.EmailVerified == nil && !config.GuestOrders.AllowUnverifiedEmail {
+		return forbiddenError("The email of the token must be verified to claim orders")
+	}
+	return nil
+}
+
+// claimOrders links the guest orders placed with the email of the claims to
+// the user, who is created if needed. It returns the number of orders claimed.
+func claimOrders(db *gorm.DB, instanceID string, claims *claims.JWTClaims, log logrus.FieldLogger) (int, *HTTPError) {
 	log = log.WithFields(logrus.Fields{
 		"user_id":    claims.Subject,
 		"user_email": claims.Email,
@@ -113,7 +182,7 @@ func (a *API) ClaimOrders(w http.ResponseWriter, r *http.Request) error {
 
 	orders := []models.Order{}
 	if res := query.Find(&orders); res.Error != nil {
-		return internalServerError("Failed to query for orders with email: %s", claims.Email).WithInternalError(res.Error)
+		return 0, internalServerError("Failed to query for orders with email: %s", claims.Email).WithInternalError(res.Error)
 	}
 
 	tx := db.Begin()
@@ -126,27 +195,32 @@ func (a *API) ClaimOrders(w http.ResponseWriter, r *http.Request) error {
 	}
 	if res := tx.FirstOrCreate(&user); res.Error != nil {
 		tx.Rollback()
-		return internalServerError("Failed to create user with ID %s", claims.Subject).WithInternalError(res.Error).WithInternalMessage("Failed to create new user: %+v", user)
+		return 0, internalServerError("Failed to create user with ID %s", claims.Subject).WithInternalError(res.Error).WithInternalMessage("Failed to create new user: %+v", user)
 	}
 
-	for _, o := range orders {
+	for i := range orders {
+		o := &orders[i]
 		o.UserID = user.ID
 		o.BillingAddress.UserID = user.ID
 		o.ShippingAddress.UserID = user.ID
 
-		if res := tx.Save(&o); res.Error != nil {
+		if res := tx.Save(o); res.Error != nil {
 			tx.Rollback()
-			return internalServerError("Failed to update an order with user ID %s", user.ID).WithInternalError(res.Error).WithInternalMessage("Failed to update order ID %s", o.ID)
+			return 0, internalServerError("Failed to update an order with user ID %s", user.ID).WithInternalError(res.Error).WithInternalMessage("Failed to update order ID %s", o.ID)
 		}
 	}
 
-	if rsp := tx.Commit(); rsp.Error != nil {
-		return internalServerError("Failed to update all the orders").WithInternalError(rsp.Error)
+	now := time.Now()
+	if res := tx.Model(&user).UpdateColumn("orders_claimed_at", &now); res.Error != nil {
+		tx.Rollback()
+		return 0, internalServerError("Failed to update user with ID %s", user.ID).WithInternalError(res.Error)
 	}
 
-	log.Info("Finished updating")
-	w.WriteHeader(http.StatusNoContent)
-	return nil
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return 0, internalServerError("Failed to update all the orders").WithInternalError(rsp.Error)
+	}
+	log.Debugf("Claimed %d orders", len(orders))
+	return len(orders), nil
 }
 
 // ReceiptView renders an HTML receipt for an order
@@ -215,13 +289,19 @@ func (a *API) ResendOrderReceipt(w http.ResponseWriter, r *http.Request) error {
 		order.Email = params.Email
 	}
 
+	userID := ""
+	if claims := gcontext.GetClaims(ctx); claims != nil {
+		userID = claims.Subject
+	}
 	mailer := gcontext.GetMailer(ctx)
 	for _, transaction := range order.Transactions {
 		if transaction.Type == models.ChargeTransactionType {
 			transaction.Order = order
 			if mailErr := mailer.OrderConfirmationMail(transaction); mailErr != nil {
 				log.WithError(mailErr).Errorf("Error sending order confirmation mail")
+				continue
 			}
+			models.LogEvent(a.DB(r), r.RemoteAddr, userID, order.ID, models.EventEmail, []string{"order_confirmation", order.Email})
 		}
 	}
 
@@ -249,7 +329,7 @@ func (a *API) OrderList(w http.ResponseWriter, r *http.Request) error {
 	var err error
 	params := r.URL.Query()
 	query := orderQuery(a.DB(r))
-	query, err = parseOrderParams(query, params)
+	query, err = parseOrderParams(query, params, gcontext.IsAdmin(ctx))
 	if err != nil {
 		return badRequestError("Bad parameters in query: %v", err)
 	}
@@ -265,6 +345,14 @@ func (a *API) OrderList(w http.ResponseWriter, r *http.Request) error {
 	}
 	log.WithField("query_user_id", userID).Debug("URL parsed and query perpared")
 
+	format, err := exportFormat(r)
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	if format != "" {
+		return exportOrders(w, a.DB(r), query, format)
+	}
+
 	offset, limit, err := paginate(w, r, query.Model(&models.Order{}))
 	if err != nil {
 		return badRequestError("Bad Pagination Parameters: %v", err)
@@ -280,6 +368,116 @@ func (a *API) OrderList(w http.ResponseWriter, r *http.Request) error {
 	return sendJSON(w, http.StatusOK, orders)
 }
 
+var orderExportHeader = []string{
+	"order_id", "invoice_number", "created_at", "email", "user_id", "currency",
+	"payment_state", "fulfillment_state", "coupon_code",
+	"billing_name", "billing_company", "billing_country", "shipping_country", "vatnumber",
+	"order_subtotal", "order_discount", "order_taxes", "order_total",
+	"sku", "title", "type", "quantity", "unit_price", "unit_discount", "unit_taxes", "unit_total",
+}
+
+// exportOrders streams the orders matching the query with one row per line
+// item. Orders are read from a cursor and their line items and addresses are
+// loaded for a batch of orders at a time.
+func exportOrders(w http.ResponseWriter, db *gorm.DB, query *gorm.DB, format string) error {
+	orderTable := query.NewScope(models.Order{}).QuotedTableName()
+	rows, err := query.Model(&models.Order{}).Select(orderTable + ".*").Rows()
+	if err != nil {
+		return internalServerError("Error during database query").WithInternalError(err)
+	}
+	defer rows.Close()
+
+	table, err := newTableWriter(w, format, "orders", orderExportHeader...)
+	if err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+
+	batch := make([]*models.Order, 0, exportBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		orderIDs := make([]string, len(batch))
+		addressIDs := []string{}
+		for i, order := range batch {
+			orderIDs[i] = order.ID
+			addressIDs = append(addressIDs, order.BillingAddressID, order.ShippingAddressID)
+		}
+
+		items := []*models.LineItem{}
+		if err := db.Where("order_id IN (?)", orderIDs).Order("id asc").Find(&items).Error; err != nil {
+			return err
+		}
+		itemsByOrder := map[string][]*models.LineItem{}
+		for _, item := range items {
+			itemsByOrder[item.OrderID] = append(itemsByOrder[item.OrderID], item)
+		}
+
+		addresses := []models.Address{}
+		if err := db.Where("id IN (?)", addressIDs).Find(&addresses).Error; err != nil {
+			return err
+		}
+		addressesByID := map[string]models.Address{}
+		for _, address := range addresses {
+			addressesByID[address.ID] = address
+		}
+
+		for _, order := range batch {
+			billing := addressesByID[order.BillingAddressID]
+			shipping := addressesByID[order.ShippingAddressID]
+			orderValues := []interface{}{
+				order.ID, order.InvoiceNumber, order.CreatedAt, order.Email, order.UserID, order.Currency,
+				order.PaymentState, order.FulfillmentState, order.CouponCode,
+				billing.Name, billing.Company, billing.Country, shipping.Country, order.VATNumber,
+				order.SubTotal, order.Discount, order.Taxes, order.Total,
+			}
+
+			orderItems := itemsByOrder[order.ID]
+			if len(orderItems) == 0 {
+				if err := table.WriteRow(orderValues...); err != nil {
+					return err
+				}
+				continue
+			}
+			for _, item := range orderItems {
+				detail := item.CalculationDetail
+				if detail == nil {
+					detail = &models.CalculationDetail{}
+				}
+				values := append(orderValues[:len(orderValues):len(orderValues)],
+					item.Sku, item.Title, item.Type, item.Quantity, item.PriceInLowestUnit(),
+					detail.Discount, detail.Taxes, detail.Total,
+				)
+				if err := table.WriteRow(values...); err != nil {
+					return err
+				}
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	for rows.Next() {
+		order := &models.Order{}
+		if err := db.ScanRows(rows, order); err != nil {
+			return internalServerError("Error during database query").WithInternalError(err)
+		}
+		batch = append(batch, order)
+		if len(batch) == exportBatchSize {
+			if err := flush(); err != nil {
+				return internalServerError("Error writing export").WithInternalError(err)
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+	if err := table.Close(); err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+	return nil
+}
+
 // OrderView will request a specific order using the 'id' parameter.
 // Only the owner of the order, an admin, or an anon order are allowed to be seen
 func (a *API) OrderView(w http.ResponseWriter, r *http.Request) error {
@@ -298,6 +496,9 @@ func (a *API) OrderView(w http.ResponseWriter, r *http.Request) error {
 	if !hasOrderAccess(ctx, order) {
 		return unauthorizedError("You don't have access to this order")
 	}
+	if err := loadOrderNotes(r, a.DB(r), order); err != nil {
+		return internalServerError("Error during database query").WithInternalError(err)
+	}
 
 	log.Debugf("Successfully got order %s", order.ID)
 	return sendJSON(w, http.StatusOK, order)
@@ -353,7 +554,12 @@ func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
 
 	log.WithField("order_user_id", order.UserID).Debug("Successfully set the order's ID")
 
-	shipping, httpError := a.processAddress(tx, order, "Shipping Address", params.ShippingAddress, params.ShippingAddressID)
+	if httpError := useDefaultAddresses(tx, order, params); httpError != nil {
+		tx.Rollback()
+		return httpError
+	}
+
+	shipping, httpError := a.processAddress(tx, order, "Shipping Address", params.ShippingAddress, params.ShippingAddressID, &config.Shipping)
 	if httpError != nil {
 		tx.Rollback()
 		return httpError
@@ -365,7 +571,7 @@ func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
 	order.ShippingAddress = *shipping
 	order.ShippingAddressID = shipping.ID
 
-	billing, httpError := a.processAddress(tx, order, "Billing Address", params.BillingAddress, params.BillingAddressID)
+	billing, httpError := a.processAddress(tx, order, "Billing Address", params.BillingAddress, params.BillingAddressID, nil)
 	if httpError != nil {
 		tx.Rollback()
 		return httpError
@@ -407,7 +613,7 @@ func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
 	tx.Create(order)
 	models.LogEvent(tx, r.RemoteAddr, order.UserID, order.ID, models.EventCreated, nil)
 	if config.Webhooks.Order != "" {
-		hook, err := models.NewHook("order", config.SiteURL, config.Webhooks.Order, order.UserID, config.Webhooks.Secret, order)
+		hook, err := models.NewHook("order", config.SiteURL, config.Webhooks.Order, order.UserID, order.ID, config.Webhooks.Secret, order)
 		if err != nil {
 			log.WithError(err).Error("Failed to process webhook")
 		}
@@ -422,6 +628,10 @@ func (a *API) OrderCreate(w http.ResponseWriter, r *http.Request) error {
 // OrderUpdate will allow an ADMIN only to update the details of a record
 // it is also important to note that it will not let modification of an order if the
 // order is no longer pending.
+// Line items can be added, removed by setting their quantity to 0, and changed,
+// as can the coupon. The order is repriced afterwards. Editing a paid order
+// creates an adjustment for the difference, which is either charged to the
+// customer or refunded right away.
 // Addresses can be made by posting a new one directly, OR by referencing one by ID. If
 // both are provided, the one that is made by ID will win out and the other will be ignored.
 // There are also blocks to changing certain fields after the state has been locked
@@ -432,7 +642,7 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 	log := getLogEntry(r)
 	claims := gcontext.GetClaims(ctx)
 	config := gcontext.GetConfig(ctx)
-	changes := []string{}
+	diff := models.EventDiff{}
 
 	orderParams := new(orderRequestParams)
 	err := json.NewDecoder(r.Body).Decode(orderParams)
@@ -458,16 +668,17 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 	//
 	if orderParams.SessionID != "" {
 		log.Debugf("Updating session id from '%s' to '%s'", existingOrder.SessionID, orderParams.SessionID)
+		diff.Add("session_id", existingOrder.SessionID, orderParams.SessionID)
 		existingOrder.SessionID = orderParams.SessionID
-		changes = append(changes, "session_id")
 	}
 	if orderParams.Email != "" {
 		log.Debugf("Updating email from '%s' to '%s'", existingOrder.Email, orderParams.Email)
+		diff.Add("email", existingOrder.Email, orderParams.Email)
 		existingOrder.Email = orderParams.Email
-		changes = append(changes, "email")
 	}
 
 	if orderParams.MetaData != nil {
+		diff.Add("meta", existingOrder.MetaData, orderParams.MetaData)
 		existingOrder.MetaData = orderParams.MetaData
 	}
 
@@ -476,8 +687,8 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 			return badRequestError("Can't update the currency after payment has been processed")
 		}
 		log.Debugf("Updating currency from '%v' to '%v'", existingOrder.Currency, orderParams.Currency)
+		diff.Add("currency", existingOrder.Currency, orderParams.Currency)
 		existingOrder.Currency = orderParams.Currency
-		changes = append(changes, "currency")
 	}
 	if orderParams.VATNumber != "" {
 		if alreadyPaid {
@@ -485,8 +696,8 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 		}
 
 		log.Debugf("Updating vat number from '%v' to '%v'", existingOrder.VATNumber, orderParams.VATNumber)
+		diff.Add("vatnumber", existingOrder.VATNumber, orderParams.VATNumber)
 		existingOrder.VATNumber = orderParams.VATNumber
-		changes = append(changes, "vatnumber")
 	}
 
 	tx := db.Begin()
@@ -497,7 +708,7 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 	if orderParams.BillingAddress != nil || orderParams.BillingAddressID != "" {
 		log.Debugf("Updating order's billing address")
 
-		addr, httpErr := a.processAddress(tx, existingOrder, "Billing Address", orderParams.BillingAddress, orderParams.BillingAddressID)
+		addr, httpErr := a.processAddress(tx, existingOrder, "Billing Address", orderParams.BillingAddress, orderParams.BillingAddressID, nil)
 		if httpErr != nil {
 			log.WithError(httpErr).Warn("Failed to update the billing address")
 			tx.Rollback()
@@ -509,13 +720,13 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 			"address_id":     addr.ID,
 			"old_address_id": old,
 		}).Debugf("Updated the billing address id to %s", addr.ID)
-		changes = append(changes, "billing_address")
+		diff.Add("billing_address_id", old, addr.ID)
 	}
 
 	if orderParams.ShippingAddress != nil || orderParams.ShippingAddressID != "" {
 		log.Debugf("Updating order's shipping address")
 
-		addr, httpErr := a.processAddress(tx, existingOrder, "Shipping Address", orderParams.ShippingAddress, orderParams.ShippingAddressID)
+		addr, httpErr := a.processAddress(tx, existingOrder, "Shipping Address", orderParams.ShippingAddress, orderParams.ShippingAddressID, &config.Shipping)
 		if httpErr != nil {
 			log.WithError(httpErr).Warn("Failed to update the shipping address")
 			tx.Rollback()
@@ -528,7 +739,7 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 			"address_id":     addr.ID,
 			"old_address_id": old,
 		}).Debugf("Updated the shipping address id to %s", addr.ID)
-		changes = append(changes, "shipping_address")
+		diff.Add("shipping_address_id", old, addr.ID)
 	}
 
 	if orderParams.FulfillmentState != "" {
@@ -543,29 +754,103 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 			tx.Rollback()
 			return badRequestError("Bad fulfillment state: " + orderParams.FulfillmentState)
 		}
-		existingOrder.FulfillmentState = orderParams.FulfillmentState
-		changes = append(changes, "fulfillment_state")
+		// once an order has shipments its fulfillment state follows them
+		var shipments int64
+		if result := tx.Model(&models.Shipment{}).Where("order_id = ?", existingOrder.ID).Count(&shipments); result.Error != nil {
+			tx.Rollback()
+			return internalServerError("Error during database query").WithInternalError(result.Error)
+		}
+		if shipments > 0 {
+			tx.Rollback()
+			return badRequestError("The fulfillment state of an order with shipments is derived from its shipments")
+		}
+		change, err := existingOrder.Transition(tx, config, r.RemoteAddr, claims.Subject, models.FulfillmentStateField, orderParams.FulfillmentState)
+		if err != nil {
+			tx.Rollback()
+			if _, ok := err.(*models.TransitionError); ok {
+				return badRequestError(err.Error())
+			}
+			return internalServerError("Error changing fulfillment state").WithInternalError(err)
+		}
+		if err := change.QueueHook(tx); err != nil {
+			tx.Rollback()
+			return internalServerError("Failed to process webhook").WithInternalError(err)
+		}
 	}
 
 	//
-	// handle the line items
+	// handle the line items and the coupon
 	//
-	updatedItems := make(map[string]*orderLineItem)
-	for _, item := range orderParams.LineItems {
-		updatedItems[item.Sku] = item
+	reprice := len(orderParams.LineItems) > 0 || orderParams.CouponCode != "" || orderParams.RemoveCoupon
+	if reprice && alreadyPaid {
+		for _, adjustment := range existingOrder.Adjustments {
+			if adjustment.State != models.PaidState {
+				tx.Rollback()
+				return badRequestError("The pending adjustment %s must be settled before the order can be edited again", adjustment.ID)
+			}
+		}
+	}
+
+	if orderParams.RemoveCoupon {
+		diff.Add("coupon_code", existingOrder.CouponCode, "")
+		existingOrder.CouponCode = ""
+		existingOrder.Coupon = nil
+		existingOrder.RawCoupon = ""
+	} else if orderParams.CouponCode != "" {
+		coupon, err := a.lookupCoupon(ctx, w, orderParams.CouponCode)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if !coupon.Valid() {
+			tx.Rollback()
+			return badRequestError("This coupon is not valid at this time")
+		}
+		diff.Add("coupon_code", existingOrder.CouponCode, coupon.Code)
+		existingOrder.CouponCode = coupon.Code
+		existingOrder.Coupon = coupon
 	}
 
+	quantitiesBefore := map[string]uint64{}
 	for _, item := range existingOrder.LineItems {
-		if update, exists := updatedItems[item.Sku]; exists {
-			item.Quantity = update.Quantity
-			if update.Path != "" {
-				item.Path = update.Path
-			}
+		quantitiesBefore[item.Sku] = item.Quantity
+	}
+	if len(orderParams.LineItems) > 0 {
+		if httpErr := a.updateLineItems(ctx, tx, existingOrder, orderParams.LineItems); httpErr != nil {
+			tx.Rollback()
+			return httpErr
 		}
 	}
+	quantitiesAfter := map[string]uint64{}
+	for _, item := range existingOrder.LineItems {
+		quantitiesAfter[item.Sku] = item.Quantity
+	}
+	diff.Add("line_items", quantitiesBefore, quantitiesAfter)
+
+	var adjustment *models.Adjustment
+	if reprice {
+		settings, err := a.loadSettings(ctx, log)
+		if err != nil {
+			tx.Rollback()
+			return internalServerError(err.Error()).WithInternalError(err)
+		}
+
+		totalBefore := existingOrder.Total
+		// reprice for the buyer, not the admin editing the order
+		existingOrder.CalculateTotal(settings, existingOrder.Claims, log)
+		diff.Add("total", totalBefore, existingOrder.Total)
 
-	if len(updatedItems) > 0 {
-		changes = append(changes, "line_items")
+		if alreadyPaid {
+			adjustment = models.NewAdjustment(existingOrder, totalBefore)
+		}
+		if adjustment != nil {
+			if rsp := tx.Create(adjustment); rsp.Error != nil {
+				tx.Rollback()
+				return internalServerError("Error saving adjustment").WithInternalError(rsp.Error)
+			}
+			existingOrder.Adjustments = append(existingOrder.Adjustments, adjustment)
+			models.LogEvent(tx, r.RemoteAddr, claims.Subject, existingOrder.ID, models.EventCreated, []string{"adjustment", adjustment.ID, adjustment.Type})
+		}
 	}
 
 	log.Info("Saving order updates")
@@ -574,10 +859,10 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 		return internalServerError("Error saving order updates").WithInternalError(rsp.Error)
 	}
 
-	models.LogEvent(tx, r.RemoteAddr, claims.Subject, existingOrder.ID, models.EventUpdated, changes)
+	models.LogEventDiff(tx, r.RemoteAddr, claims.Subject, existingOrder.ID, models.EventUpdated, diff)
 	if config.Webhooks.Update != "" {
 		// TODO should this be claims.Subject or existingOrder.UserID ?
-		hook, err := models.NewHook("update", config.SiteURL, config.Webhooks.Update, claims.Subject, config.Webhooks.Secret, existingOrder)
+		hook, err := models.NewHook("update", config.SiteURL, config.Webhooks.Update, claims.Subject, existingOrder.ID, config.Webhooks.Secret, existingOrder)
 		if err != nil {
 			log.WithError(err).Error("Failed to process web hook")
 		}
@@ -588,6 +873,13 @@ func (a *API) OrderUpdate(w http.ResponseWriter, r *http.Request) error {
 		return internalServerError("Error committing order updates").WithInternalError(rsp.Error)
 	}
 
+	// a refund that fails is left pending, so it can be retried
+	if adjustment != nil && adjustment.Type == models.AdjustmentRefundType {
+		if httpErr := a.refundAdjustment(r, db, existingOrder, adjustment); httpErr != nil {
+			log.WithError(httpErr).WithField("adjustment_id", adjustment.ID).Warn("Failed to refund the adjustment of the order")
+		}
+	}
+
 	return sendJSON(w, http.StatusOK, existingOrder)
 }
 
@@ -631,7 +923,67 @@ func setOrderEmail(tx *gorm.DB, order *models.Order, claims *claims.JWTClaims, l
 	return nil
 }
 
+// useDefaultAddresses sets the default addresses of the user for the
+// addresses missing from the params of a new order.
+func useDefaultAddresses(tx *gorm.DB, order *models.Order, params *orderRequestParams) *HTTPError {
+	missingShipping := params.ShippingAddress == nil && params.ShippingAddressID == ""
+	missingBilling := params.BillingAddress == nil && params.BillingAddressID == ""
+	if order.UserID == "" || !missingShipping && !missingBilling {
+		return nil
+	}
+
+	user, err := models.GetUser(tx, order.UserID)
+	if err != nil {
+		return internalServerError("problem while querying for userID: %s", order.UserID).WithInternalError(err)
+	}
+	if user == nil {
+		return nil
+	}
+	if missingShipping {
+		params.ShippingAddressID = user.DefaultShippingAddressID
+	}
+	if missingBilling {
+		params.BillingAddressID = user.DefaultBillingAddressID
+	}
+	return nil
+}
+
 func (a *API) createLineItems(ctx context.Context, tx *gorm.DB, order *models.Order, items []*orderLineItem, log logrus.FieldLogger) *HTTPError {
+	catalog, err := models.NewCatalog(gcontext.GetConfig(ctx), tx, gcontext.GetInstanceID(ctx))
+	if err != nil {
+		return internalServerError("Error loading product catalog").WithInternalError(err)
+	}
+
+	if httpError := a.processLineItems(ctx, catalog, order, items); httpError != nil {
+		return httpError
+	}
+
+	for _, item := range order.LineItems {
+		order.SubTotal = order.SubTotal + (item.Price+item.AddonPrice)*item.Quantity
+		if err := tx.Save(item).Error; err != nil {
+			return internalServerError("Error creating line item").WithInternalError(err)
+		}
+	}
+
+	for _, download := range order.Downloads {
+		if err := tx.Create(&download).Error; err != nil {
+			return internalServerError("Error creating download item").WithInternalError(err)
+		}
+	}
+
+	settings, err := a.loadSettings(ctx, log)
+	if err != nil {
+		return internalServerError(err.Error()).WithInternalError(err)
+	}
+
+	order.Claims = gcontext.GetClaimsAsMap(ctx)
+	order.CalculateTotal(settings, order.Claims, log)
+	return nil
+}
+
+// processLineItems adds the requested items to the order and looks up their
+// prices in the catalog. Nothing is saved.
+func (a *API) processLineItems(ctx context.Context, catalog models.Catalog, order *models.Order, items []*orderLineItem) *HTTPError {
 	sem := make(chan int, MaxConcurrentLookups)
 	var wg sync.WaitGroup
 	sharedErr := verificationError{}
@@ -663,7 +1015,7 @@ func (a *API) createLineItems(ctx context.Context, tx *gorm.DB, order *models.Or
 				return
 			}
 
-			if err := a.processLineItem(ctx, order, item); err != nil {
+			if err := a.processLineItem(ctx, catalog, order, item); err != nil {
 				sharedErr.setError(err)
 			}
 		}(lineItem, orderItem)
@@ -673,49 +1025,140 @@ func (a *API) createLineItems(ctx context.Context, tx *gorm.DB, order *models.Or
 	if sharedErr.err != nil {
 		return internalServerError("Error processing line item").WithInternalError(sharedErr.err)
 	}
+	return nil
+}
+
+// updateLineItems applies the requested quantities to the line items of an
+// order matched by sku. Items with new skus are processed and added to the
+// order, items with a quantity of 0 are removed. Quantities can't go below
+// what was shipped, returned or refunded already.
+// Prices of existing items are kept, new items are priced with the claims of
+// the buyer the order was priced for.
+func (a *API) updateLineItems(ctx context.Context, tx *gorm.DB, order *models.Order, params []*orderLineItem) *HTTPError {
+	locked, err := lockedQuantities(tx, order.ID)
+	if err != nil {
+		return internalServerError("Error while querying for line items").WithInternalError(err)
+	}
 
+	existing := map[string]*models.LineItem{}
 	for _, item := range order.LineItems {
-		order.SubTotal = order.SubTotal + (item.Price+item.AddonPrice)*item.Quantity
+		existing[item.Sku] = item
+	}
+
+	var catalog models.Catalog
+	removed := map[string]bool{}
+	added := []*models.LineItem{}
+	downloads := len(order.Downloads)
+	for _, param := range params {
+		if item, ok := existing[param.Sku]; ok && param.Sku != "" {
+			if param.Quantity < locked[item.ID] {
+				return badRequestError("Quantity of line item %s can't be lower than the %d shipped, returned or refunded already", item.Sku, locked[item.ID])
+			}
+			if param.Quantity == 0 {
+				removed[item.Sku] = true
+				continue
+			}
+			item.Quantity = param.Quantity
+			if param.Path != "" {
+				item.Path = param.Path
+			}
+			continue
+		}
+
+		if param.Quantity == 0 {
+			return badRequestError("Quantity of new line item %s must be positive", param.Sku)
+		}
+		if catalog == nil {
+			catalog, err = models.NewCatalog(gcontext.GetConfig(ctx), tx, gcontext.GetInstanceID(ctx))
+			if err != nil {
+				return internalServerError("Error loading product catalog").WithInternalError(err)
+			}
+		}
+		item := &models.LineItem{
+			Sku:      param.Sku,
+			Quantity: param.Quantity,
+			MetaData: param.MetaData,
+			Path:     param.Path,
+			OrderID:  order.ID,
+		}
+		for _, addon := range param.Addons {
+			item.AddonItems = append(item.AddonItems, &models.AddonItem{Sku: addon.Sku})
+		}
+		if err := item.Process(catalog, order.Claims, order); err != nil {
+			return badRequestError("Error processing line item %s: %v", param.Sku+param.Path, err)
+		}
+		if _, ok := existing[item.Sku]; ok {
+			return badRequestError("Line item %s is part of the order already", item.Sku)
+		}
+		existing[item.Sku] = item
+		added = append(added, item)
+	}
+
+	lineItems := []*models.LineItem{}
+	for _, item := range order.LineItems {
+		if !removed[item.Sku] {
+			lineItems = append(lineItems, item)
+			continue
+		}
+		if err := tx.Delete(item).Error; err != nil {
+			return internalServerError("Error removing line item").WithInternalError(err)
+		}
+		if err := tx.Delete(models.Download{}, "order_id = ? AND sku = ?", order.ID, item.Sku).Error; err != nil {
+			return internalServerError("Error removing download item").WithInternalError(err)
+		}
+	}
+	lineItems = append(lineItems, added...)
+	if len(lineItems) == 0 {
+		return badRequestError("An order must have at least one line item")
+	}
+	order.LineItems = lineItems
+
+	for _, item := range added {
 		if err := tx.Save(item).Error; err != nil {
 			return internalServerError("Error creating line item").WithInternalError(err)
 		}
 	}
-
-	for _, download := range order.Downloads {
+	for _, download := range order.Downloads[downloads:] {
 		if err := tx.Create(&download).Error; err != nil {
 			return internalServerError("Error creating download item").WithInternalError(err)
 		}
 	}
-
-	settings, err := a.loadSettings(ctx)
-	if err != nil {
-		return internalServerError(err.Error()).WithInternalError(err)
+	kept := []models.Download{}
+	for _, download := range order.Downloads {
+		if !removed[download.Sku] {
+			kept = append(kept, download)
+		}
 	}
-
-	order.CalculateTotal(settings, gcontext.GetClaimsAsMap(ctx), log)
+	order.Downloads = kept
 	return nil
 }
 
-func (a *API) loadSettings(ctx context.Context) (*calculator.Settings, error) {
-	config := gcontext.GetConfig(ctx)
-
-	settings := &calculator.Settings{}
-	resp, err := a.httpClient.Get(config.SettingsURL())
-	if err != nil {
-		return nil, fmt.Errorf("Error loading site settings: %v", err)
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode == http.StatusOK {
-		decoder := json.NewDecoder(resp.Body)
-		if err := decoder.Decode(settings); err != nil {
-			return nil, fmt.Errorf("Error parsing site settings: %v", err)
+// lockedQuantities returns the quantities of the line items of an order that
+// can't be removed from it anymore, by line item ID.
+func lockedQuantities(db *gorm.DB, orderID string) (map[int64]uint64, error) {
+	locked := map[int64]uint64{}
+	for _, query := range []func(*gorm.DB, string) (map[int64]uint64, error){
+		models.ShippedQuantities,
+		models.ReturnedQuantities,
+		models.RefundedQuantities,
+	} {
+		quantities, err := query(db, orderID)
+		if err != nil {
+			return nil, err
+		}
+		for id, quantity := range quantities {
+			if quantity > locked[id] {
+				locked[id] = quantity
+			}
 		}
 	}
-
-	return settings, nil
+	return locked, nil
 }
 
-func (a *API) processAddress(tx *gorm.DB, order *models.Order, name string, address *models.Address, id string) (*models.Address, *HTTPError) {
+// processAddress loads the address with the given id or validates and stores
+// a new one. Shipping addresses are checked against the countries the
+// instance ships to, which is skipped if shipping is nil.
+func (a *API) processAddress(tx *gorm.DB, order *models.Order, name string, address *models.Address, id string, shipping *conf.ShippingConfiguration) (*models.Address, *HTTPError) {
 	if address == nil && id == "" {
 		return nil, nil
 	}
@@ -729,6 +1172,9 @@ func (a *API) processAddress(tx *gorm.DB, order *models.Order, name string, addr
 		if order.UserID != loadedAddress.UserID {
 			return nil, badRequestError("Can't update the order to an %v that doesn't belong to the user", name)
 		}
+		if httpErr := checkShippingCountry(shipping, loadedAddress.Country); httpErr != nil {
+			return nil, httpErr
+		}
 		return loadedAddress, nil
 	}
 
@@ -737,6 +1183,9 @@ func (a *API) processAddress(tx *gorm.DB, order *models.Order, name string, addr
 	if err := address.Validate(); err != nil {
 		return nil, badRequestError("Failed to validate %v: %v", name, err.Error())
 	}
+	if httpErr := checkShippingCountry(shipping, address.Country); httpErr != nil {
+		return nil, httpErr
+	}
 
 	// is a valid id that doesn't already belong to a user
 	address.ID = uuid.NewRandom().String()
@@ -744,11 +1193,31 @@ func (a *API) processAddress(tx *gorm.DB, order *models.Order, name string, addr
 	return address, nil
 }
 
-func (a *API) processLineItem(ctx context.Context, order *models.Order, item *models.LineItem) error {
-	config := gcontext.GetConfig(ctx)
+// checkShippingCountry refuses countries that aren't in the allowed countries
+// of the instance, if it has any, or that are in its denied countries.
+func checkShippingCountry(shipping *conf.ShippingConfiguration, country string) *HTTPError {
+	if shipping == nil {
+		return nil
+	}
+
+	listed := func(list []string) bool {
+		for _, c := range list {
+			if countries.Same(c, country) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(shipping.AllowedCountries) > 0 && !listed(shipping.AllowedCountries) || listed(shipping.DeniedCountries) {
+		return badRequestError("Orders can't be shipped to %v", country)
+	}
+	return nil
+}
+
+func (a *API) processLineItem(ctx context.Context, catalog models.Catalog, order *models.Order, item *models.LineItem) error {
 	jwtClaims := gcontext.GetClaimsAsMap(ctx)
 
-	return item.Process(config, jwtClaims, order)
+	return item.Process(catalog, jwtClaims, order)
 }
 
 func orderQuery(db *gorm.DB) *gorm.DB {
@@ -757,5 +1226,8 @@ func orderQuery(db *gorm.DB) *gorm.DB {
 		Preload("Downloads").
 		Preload("ShippingAddress").
 		Preload("BillingAddress").
-		Preload("Transactions")
+		Preload("Transactions").
+		Preload("Shipments").
+		Preload("Shipments.Items").
+		Preload("Adjustments")
 }
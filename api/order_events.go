@@ -0,0 +1,105 @@
+package api
+
+import (
+	"net/http"
+	"sort"
+	"time"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+const (
+	timelineEvent       = "event"
+	timelineEmail       = "email"
+	timelineTransaction = "transaction"
+	timelineWebhook     = "webhook"
+)
+
+// timelineEntry is one thing that happened to an order. Depending on the kind
+// it holds an event, a transaction or a webhook delivery.
+type timelineEntry struct {
+	Kind        string              `json:"kind"`
+	CreatedAt   time.Time           `json:"created_at"`
+	Event       *models.Event       `json:"event,omitempty"`
+	Transaction *models.Transaction `json:"transaction,omitempty"`
+	Webhook     *webhookDelivery    `json:"webhook,omitempty"`
+}
+
+type webhookDelivery struct {
+	ID             uint64     `json:"id"`
+	Type           string     `json:"type"`
+	URL            string     `json:"url"`
+	Done           bool       `json:"done"`
+	Failed         bool       `json:"failed"`
+	Tries          int        `json:"tries"`
+	ResponseStatus string     `json:"response_status,omitempty"`
+	ErrorMessage   *string    `json:"error_message,omitempty"`
+	CompletedAt    *time.Time `json:"completed_at,omitempty"`
+}
+
+// OrderEvents returns the timeline of an order: its events, including the
+// emails sent about it, its transactions and the webhooks it triggered, oldest
+// first.
+func (a *API) OrderEvents(w http.ResponseWriter, r *http.Request) error {
+	db := a.DB(r)
+	ctx := r.Context()
+
+	order := &models.Order{}
+	result := db.Where("instance_id = ?", gcontext.GetInstanceID(ctx)).First(order, "id = ?", gcontext.GetOrderID(ctx))
+	if result.Error != nil {
+		if result.RecordNotFound() {
+			return notFoundError("Order not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+
+	timeline := []*timelineEntry{}
+
+	events := []*models.Event{}
+	if rsp := db.Where("order_id = ?", order.ID).Order("created_at asc, id asc").Find(&events); rsp.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	for _, event := range events {
+		kind := timelineEvent
+		if event.Type == string(models.EventEmail) {
+			kind = timelineEmail
+		}
+		timeline = append(timeline, &timelineEntry{Kind: kind, CreatedAt: event.CreatedAt, Event: event})
+	}
+
+	transactions := []*models.Transaction{}
+	if rsp := db.Where("order_id = ?", order.ID).Preload("RefundItems").Order("created_at asc").Find(&transactions); rsp.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	for _, transaction := range transactions {
+		timeline = append(timeline, &timelineEntry{Kind: timelineTransaction, CreatedAt: transaction.CreatedAt, Transaction: transaction})
+	}
+
+	hooks := []*models.Hook{}
+	if rsp := db.Where("order_id = ?", order.ID).Order("created_at asc, id asc").Find(&hooks); rsp.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(rsp.Error)
+	}
+	for _, hook := range hooks {
+		timeline = append(timeline, &timelineEntry{
+			Kind:      timelineWebhook,
+			CreatedAt: hook.CreatedAt,
+			Webhook: &webhookDelivery{
+				ID:             hook.ID,
+				Type:           hook.Type,
+				URL:            hook.URL,
+				Done:           hook.Done,
+				Failed:         hook.Failed,
+				Tries:          hook.Tries,
+				ResponseStatus: hook.ResponseStatus,
+				ErrorMessage:   hook.ErrorMessage,
+				CompletedAt:    hook.CompletedAt,
+			},
+		})
+	}
+
+	sort.SliceStable(timeline, func(i, j int) bool {
+		return timeline[i].CreatedAt.Before(timeline[j].CreatedAt)
+	})
+	return sendJSON(w, http.StatusOK, timeline)
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOrderEvents(t *testing.T) {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	t.Run("Timeline", func(t *testing.T) {
+		test := NewRouteTest(t)
+		server := startTestSite()
+		defer server.Close()
+		test.Config.SiteURL = server.URL
+		test.Config.Webhooks.Update = "https://example.com/hooks/update"
+		url := "/orders/" + test.Data.firstOrder.ID
+
+		body := strings.NewReader(`{"email": "robin@wayneindustries.com", "line_items": [{"sku": "123-i-can-fly-456", "quantity": 3}]}`)
+		recorder := test.TestEndpoint(http.MethodPut, url, body, token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		recorder = test.TestEndpoint(http.MethodPost, url+"/receipt", strings.NewReader(`{}`), token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		recorder = test.TestEndpoint(http.MethodGet, url+"/events", nil, token)
+		timeline := []timelineEntry{}
+		extractPayload(t, http.StatusOK, recorder, &timeline)
+
+		kinds := map[string][]timelineEntry{}
+		for i, entry := range timeline {
+			kinds[entry.Kind] = append(kinds[entry.Kind], entry)
+			if i > 0 {
+				assert.False(t, entry.CreatedAt.Before(timeline[i-1].CreatedAt), "timeline must be chronological")
+			}
+		}
+
+		require.Len(t, kinds[timelineTransaction], 1)
+		assert.Equal(t, test.Data.firstTransaction.ID, kinds[timelineTransaction][0].Transaction.ID)
+
+		// the quantity change of the paid order creates an adjustment
+		require.Len(t, kinds[timelineEvent], 2)
+		adjustment, update := kinds[timelineEvent][0].Event, kinds[timelineEvent][1].Event
+		if adjustment.Type != "created" {
+			adjustment, update = update, adjustment
+		}
+		assert.Equal(t, "created", adjustment.Type)
+		assert.Equal(t, "adjustment", strings.Split(adjustment.Changes, ",")[0])
+		assert.Equal(t, "updated", update.Type)
+		assert.Equal(t, "email,line_items,total", update.Changes)
+		assert.Equal(t, "bruce@wayneindustries.com", update.Diff["email"].Before)
+		assert.Equal(t, "robin@wayneindustries.com", update.Diff["email"].After)
+		assert.Equal(t, map[string]interface{}{"123-i-can-fly-456": float64(2)}, update.Diff["line_items"].Before)
+		assert.Equal(t, map[string]interface{}{"123-i-can-fly-456": float64(3)}, update.Diff["line_items"].After)
+
+		require.Len(t, kinds[timelineEmail], 1)
+		assert.Equal(t, "order_confirmation,robin@wayneindustries.com", kinds[timelineEmail][0].Event.Changes)
+
+		require.Len(t, kinds[timelineWebhook], 1)
+		assert.Equal(t, "update", kinds[timelineWebhook][0].Webhook.Type)
+		assert.Equal(t, "https://example.com/hooks/update", kinds[timelineWebhook][0].Webhook.URL)
+	})
+	t.Run("UnchangedFields", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/orders/" + test.Data.firstOrder.ID
+
+		body := strings.NewReader(`{"email": "` + test.Data.firstOrder.Email + `"}`)
+		recorder := test.TestEndpoint(http.MethodPut, url, body, token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+
+		recorder = test.TestEndpoint(http.MethodGet, url+"/events", nil, token)
+		timeline := []timelineEntry{}
+		extractPayload(t, http.StatusOK, recorder, &timeline)
+		for _, entry := range timeline {
+			if entry.Kind == timelineEvent {
+				assert.Empty(t, entry.Event.Diff)
+			}
+		}
+	})
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/"+test.Data.firstOrder.ID+"/events", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+	t.Run("NotFound", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/nope/events", nil, token)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+}
@@ -0,0 +1,201 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+type orderNoteParams struct {
+	Text            string `json:"text"`
+	CustomerVisible bool   `json:"customer_visible"`
+	Email           bool   `json:"email"`
+}
+
+func (a *API) orderNoteRoutes(r *router) {
+	r.Use(adminRequired)
+
+	r.Get("/", a.OrderNoteList)
+	r.With(addGetBody).Post("/", a.OrderNoteCreate)
+	r.Delete("/{note_id}", a.OrderNoteDelete)
+}
+
+// OrderNoteList lists all notes of an order, oldest first.
+func (a *API) OrderNoteList(w http.ResponseWriter, r *http.Request) error {
+	order, err := a.noteOrder(r)
+	if err != nil {
+		return err
+	}
+	format, err := exportFormat(r)
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+
+	notes := []*models.OrderNote{}
+	if result := a.DB(r).Where("order_id = ?", order.ID).Order("created_at asc, id asc").Find(&notes); result.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	if format != "" {
+		return exportOrderNotes(w, format, notes)
+	}
+	return sendJSON(w, http.StatusOK, notes)
+}
+
+// exportOrderNotes writes the notes of an order.
+func exportOrderNotes(w http.ResponseWriter, format string, notes []*models.OrderNote) error {
+	table, err := newTableWriter(w, format, "order_notes",
+		"note_id", "order_id", "user_id", "author_email", "customer_visible", "text", "emailed_at", "created_at")
+	if err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+	for _, note := range notes {
+		err := table.WriteRow(note.ID, note.OrderID, note.UserID, note.AuthorEmail, note.CustomerVisible, note.Text, note.EmailedAt, note.CreatedAt)
+		if err != nil {
+			return internalServerError("Error writing export").WithInternalError(err)
+		}
+	}
+	if err := table.Close(); err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+	return nil
+}
+
+// OrderNoteCreate adds a note to an order, authored by the current user.
+// Customer visible notes can be emailed to the buyer right away.
+func (a *API) OrderNoteCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	claims := gcontext.GetClaims(ctx)
+
+	order, err := a.noteOrder(r)
+	if err != nil {
+		return err
+	}
+
+	params := &orderNoteParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read order note params: %v", err)
+	}
+	params.Text = strings.TrimSpace(params.Text)
+	if params.Text == "" {
+		return badRequestError("Order notes must have a text")
+	}
+	if params.Email && !params.CustomerVisible {
+		return badRequestError("Only customer visible notes can be emailed")
+	}
+	if params.Email && order.Email == "" {
+		return badRequestError("Order has no email address to send the note to")
+	}
+
+	note := &models.OrderNote{
+		OrderID:         order.ID,
+		UserID:          claims.Subject,
+		AuthorEmail:     claims.Email,
+		Text:            params.Text,
+		CustomerVisible: params.CustomerVisible,
+	}
+
+	tx := a.DB(r).Begin()
+	if result := tx.Create(note); result.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error creating order note").WithInternalError(result.Error)
+	}
+	models.LogEvent(tx, r.RemoteAddr, claims.Subject, order.ID, models.EventUpdated, []string{"notes"})
+	if result := tx.Commit(); result.Error != nil {
+		return internalServerError("Error creating order note").WithInternalError(result.Error)
+	}
+
+	if params.Email {
+		mailer := gcontext.GetMailer(ctx)
+		if err := mailer.OrderNoteMail(order, note); err != nil {
+			log.WithError(err).WithField("order_id", order.ID).Error("Error sending order note mail")
+		} else {
+			now := time.Now()
+			note.EmailedAt = &now
+			if result := a.DB(r).Model(note).UpdateColumn("emailed_at", now); result.Error != nil {
+				log.WithError(result.Error).Error("Error recording order note mail")
+			}
+			models.LogEvent(a.DB(r), r.RemoteAddr, claims.Subject, order.ID, models.EventEmail, []string{"order_note", order.Email})
+		}
+	}
+
+	return sendJSON(w, http.StatusCreated, note)
+}
+
+// OrderNoteDelete removes a note from an order.
+func (a *API) OrderNoteDelete(w http.ResponseWriter, r *http.Request) error {
+	claims := gcontext.GetClaims(r.Context())
+	order, err := a.noteOrder(r)
+	if err != nil {
+		return err
+	}
+
+	noteID, err := strconv.ParseInt(chi.URLParam(r, "note_id"), 10, 64)
+	if err != nil {
+		return notFoundError("Order note not found")
+	}
+
+	tx := a.DB(r).Begin()
+	result := tx.Where("order_id = ?", order.ID).Delete(&models.OrderNote{ID: noteID})
+	if result.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error deleting order note").WithInternalError(result.Error)
+	}
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		return notFoundError("Order note not found")
+	}
+	models.LogEvent(tx, r.RemoteAddr, claims.Subject, order.ID, models.EventUpdated, []string{"notes"})
+	if result := tx.Commit(); result.Error != nil {
+		return internalServerError("Error deleting order note").WithInternalError(result.Error)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (a *API) noteOrder(r *http.Request) (*models.Order, error) {
+	ctx := r.Context()
+	order := &models.Order{}
+	result := a.DB(r).Where("instance_id = ?", gcontext.GetInstanceID(ctx)).First(order, "id = ?", gcontext.GetOrderID(ctx))
+	if result.Error != nil {
+		if result.RecordNotFound() {
+			return nil, notFoundError("Order not found")
+		}
+		return nil, internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	return order, nil
+}
+
+// loadOrderNotes attaches the notes of an order the current user may read:
+// all notes for admins and the customer visible ones for everybody else.
+func loadOrderNotes(r *http.Request, db *gorm.DB, order *models.Order) error {
+	isAdmin := gcontext.IsAdmin(r.Context())
+	query := db.Where("order_id = ?", order.ID)
+	if !isAdmin {
+		query = query.Where("customer_visible = ?", true)
+	}
+	order.Notes = []*models.OrderNote{}
+	if err := query.Order("created_at asc, id asc").Find(&order.Notes).Error; err != nil {
+		return err
+	}
+	if !isAdmin {
+		hideNoteAuthors(order.Notes)
+	}
+	return nil
+}
+
+// hideNoteAuthors removes who wrote the notes, which is only shown to admins.
+func hideNoteAuthors(notes []*models.OrderNote) {
+	for _, note := range notes {
+		note.UserID = ""
+		note.AuthorEmail = ""
+	}
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func createOrderNote(t *testing.T, test *RouteTest, body string) *models.OrderNote {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	url := "/orders/" + test.Data.firstOrder.ID + "/notes"
+	recorder := test.TestEndpoint(http.MethodPost, url, strings.NewReader(body), token)
+	note := &models.OrderNote{}
+	extractPayload(t, http.StatusCreated, recorder, note)
+	return note
+}
+
+func TestOrderNotes(t *testing.T) {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	t.Run("Create", func(t *testing.T) {
+		test := NewRouteTest(t)
+		note := createOrderNote(t, test, `{"text": " Packed with extra care "}`)
+		assert.Equal(t, test.Data.firstOrder.ID, note.OrderID)
+		assert.Equal(t, "admin-yo", note.UserID)
+		assert.Equal(t, "admin@wayneindustries.com", note.AuthorEmail)
+		assert.Equal(t, "Packed with extra care", note.Text)
+		assert.False(t, note.CustomerVisible)
+		assert.Nil(t, note.EmailedAt)
+
+		events := []models.Event{}
+		require.NoError(t, test.DB.Where("order_id = ? AND changes = ?", test.Data.firstOrder.ID, "notes").Find(&events).Error)
+		assert.Len(t, events, 1)
+	})
+	t.Run("CreateEmailed", func(t *testing.T) {
+		test := NewRouteTest(t)
+		note := createOrderNote(t, test, `{"text": "Your cape is on its way", "customer_visible": true, "email": true}`)
+		assert.True(t, note.CustomerVisible)
+		assert.NotNil(t, note.EmailedAt)
+	})
+	t.Run("CreateInvalid", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/orders/" + test.Data.firstOrder.ID + "/notes"
+		for _, body := range []string{`{"text": "  "}`, `{"text": "internal", "email": true}`} {
+			recorder := test.TestEndpoint(http.MethodPost, url, strings.NewReader(body), token)
+			validateError(t, http.StatusBadRequest, recorder)
+		}
+	})
+	t.Run("List", func(t *testing.T) {
+		test := NewRouteTest(t)
+		first := createOrderNote(t, test, `{"text": "first"}`)
+		second := createOrderNote(t, test, `{"text": "second", "customer_visible": true}`)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/"+test.Data.firstOrder.ID+"/notes", nil, token)
+		notes := []models.OrderNote{}
+		extractPayload(t, http.StatusOK, recorder, &notes)
+		require.Len(t, notes, 2)
+		assert.Equal(t, first.ID, notes[0].ID)
+		assert.Equal(t, second.ID, notes[1].ID)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/orders/"+test.Data.secondOrder.ID+"/notes", nil, token)
+		extractPayload(t, http.StatusOK, recorder, &notes)
+		assert.Len(t, notes, 0)
+	})
+	t.Run("Delete", func(t *testing.T) {
+		test := NewRouteTest(t)
+		note := createOrderNote(t, test, `{"text": "oops"}`)
+
+		url := fmt.Sprintf("/orders/%s/notes/%d", test.Data.secondOrder.ID, note.ID)
+		recorder := test.TestEndpoint(http.MethodDelete, url, nil, token)
+		validateError(t, http.StatusNotFound, recorder)
+
+		url = fmt.Sprintf("/orders/%s/notes/%d", test.Data.firstOrder.ID, note.ID)
+		recorder = test.TestEndpoint(http.MethodDelete, url, nil, token)
+		assert.Equal(t, http.StatusNoContent, recorder.Code)
+
+		recorder = test.TestEndpoint(http.MethodDelete, url, nil, token)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/"+test.Data.firstOrder.ID+"/notes", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+	t.Run("OrderView", func(t *testing.T) {
+		test := NewRouteTest(t)
+		createOrderNote(t, test, `{"text": "internal"}`)
+		visible := createOrderNote(t, test, `{"text": "visible", "customer_visible": true}`)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/"+test.Data.firstOrder.ID, nil, test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		require.Len(t, order.Notes, 1)
+		assert.Equal(t, visible.ID, order.Notes[0].ID)
+		// buyers don't get to know who on the staff wrote the note
+		assert.Empty(t, order.Notes[0].UserID)
+		assert.Empty(t, order.Notes[0].AuthorEmail)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/orders/"+test.Data.firstOrder.ID, nil, token)
+		order = &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		require.Len(t, order.Notes, 2)
+		assert.Equal(t, visible.UserID, order.Notes[1].UserID)
+		assert.Equal(t, visible.AuthorEmail, order.Notes[1].AuthorEmail)
+	})
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/models"
+)
+
+var searchWordPattern = regexp.MustCompile(`[\pL\pN]+`)
+
+// likeEscaper escapes the wildcards of LIKE patterns, to be used with
+// likeEscape. The escape character works on all supported databases, unlike a
+// backslash, which MySQL treats specially in string literals.
+var likeEscaper = strings.NewReplacer("!", "!!", "%", "!%", "_", "!_")
+
+const likeEscape = " ESCAPE '!'"
+
+// orderSearchField is something an order can be found by. Its condition has
+// one or more placeholders for the LIKE pattern of a search term, and the
+// weight says how relevant a match is.
+type orderSearchField struct {
+	condition string
+	weight    int
+}
+
+// orderSearchTables holds the quoted names of the tables searched for orders,
+// and the condition for the notes that can be searched.
+type orderSearchTables struct {
+	order, address, lineItem, note, user string
+	visibleNotes                         string
+}
+
+func newOrderSearchTables(query *gorm.DB) *orderSearchTables {
+	return &orderSearchTables{
+		order:    query.NewScope(models.Order{}).QuotedTableName(),
+		address:  query.NewScope(models.Address{}).QuotedTableName(),
+		lineItem: query.NewScope(models.LineItem{}).QuotedTableName(),
+		note:     query.NewScope(models.OrderNote{}).QuotedTableName(),
+		user:     query.NewScope(models.User{}).QuotedTableName(),
+	}
+}
+
+// addOrderSearch filters the query to the orders matching all the terms of a
+// search in their ID, invoice number or ID, email, customer name, addresses,
+// SKUs or notes. Internal notes are only searched for admins. It returns the
+// expression for the relevance of the matches to sort by. Postgres uses its
+// full-text search, other databases match with LIKE. Related records are
+// searched with subqueries so every order shows up once.
+func addOrderSearch(query *gorm.DB, q string, isAdmin bool) (*gorm.DB, interface{}) {
+	tables := newOrderSearchTables(query)
+	tables.visibleNotes = "deleted_at IS NULL"
+	if !isAdmin {
+		visible := "1"
+		if query.Dialect().GetName() == "postgres" {
+			visible = "true"
+		}
+		tables.visibleNotes += " AND customer_visible = " + visible
+	}
+	if query.Dialect().GetName() == "postgres" {
+		return addFullTextOrderSearch(query, tables, q)
+	}
+	return addLikeOrderSearch(query, tables, q)
+}
+
+func addLikeOrderSearch(query *gorm.DB, t *orderSearchTables, q string) (*gorm.DB, interface{}) {
+	addressMatch := func(columns ...string) string {
+		conditions := make([]string, len(columns))
+		for i, column := range columns {
+			conditions[i] = column + " LIKE ?" + likeEscape
+		}
+		addresses := "(SELECT id FROM " + t.address + " WHERE " + strings.Join(conditions, " OR ") + ")"
+		return "(" + t.order + ".billing_address_id IN " + addresses + " OR " + t.order + ".shipping_address_id IN " + addresses + ")"
+	}
+	fields := []orderSearchField{
+		{t.order + ".invoice_id LIKE ?" + likeEscape, 8},
+		{t.order + ".email LIKE ?" + likeEscape, 8},
+		{"(" + addressMatch("name") + " OR " + t.order + ".user_id IN (SELECT id FROM " + t.user + " WHERE name LIKE ?" + likeEscape + "))", 4},
+		{t.order + ".id IN (SELECT order_id FROM " + t.lineItem + " WHERE sku LIKE ?" + likeEscape + " AND deleted_at IS NULL)", 4},
+		{addressMatch("company", "address1", "address2", "city", "state", "zip", "country"), 2},
+		{t.order + ".id IN (SELECT order_id FROM " + t.note + " WHERE text LIKE ?" + likeEscape + " AND " + t.visibleNotes + ")", 1},
+	}
+
+	scores := []string{}
+	scoreArgs := []interface{}{}
+	for _, term := range strings.Fields(q) {
+		conditions := []string{t.order + ".id = ?", t.order + ".invoice_id = ?"}
+		args := []interface{}{term, term}
+		scores = append(scores, "CASE WHEN "+t.order+".id = ? OR "+t.order+".invoice_id = ? THEN 16 ELSE 0 END")
+		scoreArgs = append(scoreArgs, term, term)
+		if number, err := strconv.ParseInt(term, 10, 64); err == nil {
+			conditions = append(conditions, t.order+".invoice_number = ?")
+			args = append(args, number)
+			scores = append(scores, "CASE WHEN "+t.order+".invoice_number = ? THEN 16 ELSE 0 END")
+			scoreArgs = append(scoreArgs, number)
+		}
+
+		pattern := "%" + likeEscaper.Replace(term) + "%"
+		for _, field := range fields {
+			conditions = append(conditions, field.condition)
+			scores = append(scores, "CASE WHEN "+field.condition+" THEN "+strconv.Itoa(field.weight)+" ELSE 0 END")
+			for i := strings.Count(field.condition, "?"); i > 0; i-- {
+				args = append(args, pattern)
+				scoreArgs = append(scoreArgs, pattern)
+			}
+		}
+		query = query.Where("("+strings.Join(conditions, " OR ")+")", args...)
+	}
+	if len(scores) == 0 {
+		return query, nil
+	}
+	return query, gorm.Expr("("+strings.Join(scores, " + ")+") DESC", scoreArgs...)
+}
+
+// addFullTextOrderSearch matches the terms against a document built for every
+// order from the order and its related records. The document isn't indexed,
+// so each search scans all orders left after the other filters, and runs the
+// subqueries for each of them. That is fine for the order volumes of a shop,
+// but the search should be filtered by user or date where that's possible.
+func addFullTextOrderSearch(query *gorm.DB, t *orderSearchTables, q string) (*gorm.DB, interface{}) {
+	terms := strings.Fields(q)
+	if len(terms) == 0 {
+		return query, nil
+	}
+
+	// prefix matches on every word of the search
+	words := searchWordPattern.FindAllString(q, -1)
+	for i, word := range words {
+		words[i] = word + ":*"
+	}
+	tsquery := strings.Join(words, " & ")
+
+	address := func(column, columns string) string {
+		return "(SELECT concat_ws(' ', " + columns + ") FROM " + t.address + " WHERE id = " + t.order + "." + column + ")"
+	}
+	weighted := func(weight string, parts ...string) string {
+		return "setweight(to_tsvector('simple', concat_ws(' ', " + strings.Join(parts, ", ") + ")), '" + weight + "')"
+	}
+	document := "(" + strings.Join([]string{
+		weighted("A", t.order+".id", t.order+".invoice_number::text", t.order+".invoice_id", t.order+".email"),
+		weighted("B",
+			address("billing_address_id", "name"),
+			address("shipping_address_id", "name"),
+			"(SELECT name FROM "+t.user+" WHERE id = "+t.order+".user_id)",
+			"(SELECT string_agg(sku, ' ') FROM "+t.lineItem+" WHERE order_id = "+t.order+".id AND deleted_at IS NULL)",
+		),
+		weighted("C",
+			address("billing_address_id", "company, address1, address2, city, state, zip, country"),
+			address("shipping_address_id", "company, address1, address2, city, state, zip, country"),
+		),
+		weighted("D", "(SELECT string_agg(text, ' ') FROM "+t.note+" WHERE order_id = "+t.order+".id AND "+t.visibleNotes+")"),
+	}, " || ") + ")"
+
+	exact := []string{}
+	args := []interface{}{}
+	for _, term := range terms {
+		exact = append(exact, t.order+".id = ?", t.order+".invoice_id = ?")
+		args = append(args, term, term)
+		if number, err := strconv.ParseInt(term, 10, 64); err == nil {
+			exact = append(exact, t.order+".invoice_number = ?")
+			args = append(args, number)
+		}
+	}
+	exactMatch := "(" + strings.Join(exact, " OR ") + ")"
+	args = append([]interface{}{tsquery}, args...)
+
+	query = query.Where("("+document+" @@ to_tsquery('simple', ?) OR "+exactMatch+")", args...)
+	relevance := "ts_rank(" + document + ", to_tsquery('simple', ?)) + CASE WHEN " + exactMatch + " THEN 1 ELSE 0 END DESC"
+	return query, gorm.Expr(relevance, args...)
+}
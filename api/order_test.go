@@ -17,6 +17,7 @@ import (
 
 	"github.com/netlify/gocommerce/calculator"
 	"github.com/netlify/gocommerce/claims"
+	"github.com/netlify/gocommerce/conf"
 	"github.com/netlify/gocommerce/models"
 	"github.com/stretchr/testify/require"
 )
@@ -95,6 +96,101 @@ func TestOrderCreate(t *testing.T) {
 		assert.Equal(t, stored.UserID, order.UserID)
 	})
 
+	t.Run("DefaultAddresses", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		billing := getTestAddress()
+		billing.UserID = test.Data.testUser.ID
+		require.NoError(t, test.DB.Create(billing).Error)
+		require.NoError(t, test.DB.Model(test.Data.testUser).UpdateColumns(map[string]interface{}{
+			"default_shipping_address_id": test.Data.testAddress.ID,
+			"default_billing_address_id":  billing.ID,
+		}).Error)
+
+		body := strings.NewReader(`{
+			"line_items": [{"path": "/simple-product", "quantity": 1}]
+		}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, test.Data.testAddress.ID, order.ShippingAddressID)
+		assert.Equal(t, billing.ID, order.BillingAddressID)
+		assert.Equal(t, billing.Name, order.BillingAddress.Name)
+	})
+
+	t.Run("NoDefaultAddress", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		body := strings.NewReader(`{
+			"line_items": [{"path": "/simple-product", "quantity": 1}]
+		}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder, "Shipping Address Required")
+	})
+
+	t.Run("NormalizedAddress", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		body := strings.NewReader(`{
+			"email": "info@example.com",
+			"shipping_address": {
+				"name": "Test User", "address1": "610 22nd Street",
+				"city": "San Francisco", "state": "California", "country": "United States", "zip": "94107-1234"
+			},
+			"line_items": [{"path": "/simple-product", "quantity": 1}]
+		}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		assert.Equal(t, "US", order.ShippingAddress.Country)
+		assert.Equal(t, "CA", order.ShippingAddress.State)
+		assert.Equal(t, "94107-1234", order.ShippingAddress.Zip)
+	})
+
+	t.Run("InvalidAddress", func(t *testing.T) {
+		addresses := map[string]string{
+			"Unknown country": `"city": "Gotham", "country": "dcland", "zip": "12345"`,
+			"Unknown state":   `"city": "Berlin", "state": "Gotham", "country": "DE", "zip": "10115"`,
+			"Invalid zip":     `"city": "Berlin", "country": "Germany", "zip": "1011"`,
+			"state":           `"city": "San Francisco", "country": "US", "zip": "94107"`,
+		}
+		for msg, address := range addresses {
+			test := NewRouteTest(t)
+			test.Config.SiteURL = server.URL
+			body := strings.NewReader(`{
+				"email": "info@example.com",
+				"shipping_address": {"name": "Test User", "address1": "610 22nd Street", ` + address + `},
+				"line_items": [{"path": "/simple-product", "quantity": 1}]
+			}`)
+			recorder := test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+			validateError(t, http.StatusBadRequest, recorder, msg)
+		}
+	})
+
+	t.Run("ShippingCountries", func(t *testing.T) {
+		create := func(test *RouteTest, country string) *httptest.ResponseRecorder {
+			body := strings.NewReader(`{
+				"email": "info@example.com",
+				"shipping_address": {"name": "Test User", "address1": "Street 1", "city": "Somewhere", "country": "` + country + `", "zip": "1234"},
+				"billing_address": {"name": "Test User", "address1": "Street 1", "city": "Somewhere", "country": "Denmark", "zip": "1234"},
+				"line_items": [{"path": "/simple-product", "quantity": 1}]
+			}`)
+			return test.TestEndpoint(http.MethodPost, "/orders", body, test.Data.testUserToken)
+		}
+
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.Shipping.AllowedCountries = []string{"Austria", "BE"}
+		validateError(t, http.StatusBadRequest, create(test, "Denmark"), "Orders can't be shipped to DK")
+		assert.Equal(t, http.StatusCreated, create(test, "AUT").Code)
+
+		test.Config.Shipping.AllowedCountries = nil
+		test.Config.Shipping.DeniedCountries = []string{"AT"}
+		validateError(t, http.StatusBadRequest, create(test, "Austria"), "Orders can't be shipped to AT")
+		assert.Equal(t, http.StatusCreated, create(test, "Belgium").Code)
+	})
+
 	t.Run("NameBackwardsCompatible", func(t *testing.T) {
 		test := NewRouteTest(t)
 		test.Config.SiteURL = server.URL
@@ -135,8 +231,8 @@ func TestOrderCreate(t *testing.T) {
 		var total uint64 = 1069
 		var taxes uint64 = 70
 		assert.Equal(t, "info@example.com", order.Email, "Total should be info@example.com, was %v", order.Email)
-		assert.Equal(t, "Germany", order.ShippingAddress.Country)
-		assert.Equal(t, "Germany", order.BillingAddress.Country)
+		assert.Equal(t, "DE", order.ShippingAddress.Country)
+		assert.Equal(t, "DE", order.BillingAddress.Country)
 		assert.Equal(t, total, order.Total, fmt.Sprintf("Total should be 1069, was %v", order.Total))
 		assert.Equal(t, taxes, order.Taxes, fmt.Sprintf("Total should be 70, was %v", order.Total))
 	})
@@ -161,8 +257,8 @@ func TestOrderCreate(t *testing.T) {
 		var total uint64 = 1105
 		var taxes uint64 = 106
 		assert.Equal(t, "info@example.com", order.Email, "Total should be info@example.com, was %v", order.Email)
-		assert.Equal(t, "Germany", order.ShippingAddress.Country)
-		assert.Equal(t, "Germany", order.BillingAddress.Country)
+		assert.Equal(t, "DE", order.ShippingAddress.Country)
+		assert.Equal(t, "DE", order.BillingAddress.Country)
 		assert.Equal(t, total, order.Total, fmt.Sprintf("Total should be 1105, was %v", order.Total))
 		assert.Equal(t, taxes, order.Taxes, fmt.Sprintf("Total should be 106, was %v", order.Taxes))
 	})
@@ -252,6 +348,8 @@ func TestOrderCreate(t *testing.T) {
 
 	t.Run("MultipleItemsWithDownloads", func(t *testing.T) {
 		test := NewRouteTest(t)
+		// the site has no settings file
+		test.Config.Settings.MissingAsEmpty = true
 
 		site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			switch r.URL.Path {
@@ -486,7 +584,7 @@ func TestOrdersList(t *testing.T) {
 		t.Run("RangeWithParams", func(t *testing.T) {
 			test := NewRouteTest(t)
 			token := test.Data.testUserToken
-			url := fmt.Sprintf("/orders?per_page=50&page=1&from=%d&billing_countries=dcland", test.Data.firstOrder.CreatedAt.Unix())
+			url := fmt.Sprintf("/orders?per_page=50&page=1&from=%d&billing_countries=USA", test.Data.firstOrder.CreatedAt.Unix())
 			recorder := test.TestEndpoint(http.MethodGet, url, nil, token)
 
 			orders := []models.Order{}
@@ -507,6 +605,93 @@ func TestOrdersList(t *testing.T) {
 	})
 }
 
+func TestOrderSearch(t *testing.T) {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	search := func(t *testing.T, test *RouteTest, q string, token *jwt.Token) []string {
+		recorder := test.TestEndpoint(http.MethodGet, "/users/all/orders?q="+url.QueryEscape(q), nil, token)
+		orders := []models.Order{}
+		extractPayload(t, http.StatusOK, recorder, &orders)
+		ids := []string{}
+		for i := range orders {
+			ids = append(ids, orders[i].ID)
+		}
+		return ids
+	}
+
+	t.Run("Fields", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(test.Data.secondOrder).UpdateColumn("invoice_number", 1042).Error)
+		note := &models.OrderNote{OrderID: test.Data.firstOrder.ID, Text: "Deliver to the batcave"}
+		require.NoError(t, test.DB.Create(note).Error)
+
+		first, second := test.Data.firstOrder.ID, test.Data.secondOrder.ID
+		assert.Equal(t, []string{first}, search(t, test, first, token))
+		assert.Equal(t, []string{second}, search(t, test, "1042", token))
+		assert.Equal(t, []string{second}, search(t, test, "fancy-belts", token))
+		assert.Equal(t, []string{first}, search(t, test, "batcave", token))
+		assert.Equal(t, []string{first}, search(t, test, "wayne can-fly", token))
+		assert.ElementsMatch(t, []string{first, second}, search(t, test, "cave way", token))
+		assert.Empty(t, search(t, test, "joker", token))
+	})
+
+	t.Run("InvoiceID", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(test.Data.secondOrder).UpdateColumn("invoice_id", "INV-2026-00042").Error)
+
+		second := test.Data.secondOrder.ID
+		assert.Equal(t, []string{second}, search(t, test, "INV-2026-00042", token))
+		assert.Equal(t, []string{second}, search(t, test, "00042", token))
+	})
+
+	t.Run("Wildcards", func(t *testing.T) {
+		test := NewRouteTest(t)
+		note := &models.OrderNote{OrderID: test.Data.firstOrder.ID, Text: "Gift wrap 100% of it"}
+		require.NoError(t, test.DB.Create(note).Error)
+
+		assert.Empty(t, search(t, test, "_", token))
+		assert.Equal(t, []string{test.Data.firstOrder.ID}, search(t, test, "%", token))
+	})
+
+	t.Run("Deduplicated", func(t *testing.T) {
+		test := NewRouteTest(t)
+		// both line items of the second order match
+		ids := search(t, test, "-", token)
+		assert.ElementsMatch(t, []string{test.Data.firstOrder.ID, test.Data.secondOrder.ID}, ids)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/users/all/orders?items=t", nil, token)
+		orders := []models.Order{}
+		extractPayload(t, http.StatusOK, recorder, &orders)
+		assert.Len(t, orders, 2)
+	})
+
+	t.Run("Relevance", func(t *testing.T) {
+		test := NewRouteTest(t)
+		order := createOrder(test, "gotham@example.com", "USD")
+		ids := search(t, test, "gotham", token)
+		require.Len(t, ids, 3)
+		assert.Equal(t, order.ID, ids[0])
+	})
+
+	t.Run("InternalNotes", func(t *testing.T) {
+		test := NewRouteTest(t)
+		notes := []*models.OrderNote{
+			{OrderID: test.Data.firstOrder.ID, Text: "Suspicious customer"},
+			{OrderID: test.Data.secondOrder.ID, Text: "Thanks for being a loyal customer", CustomerVisible: true},
+		}
+		for _, note := range notes {
+			require.NoError(t, test.DB.Create(note).Error)
+		}
+
+		assert.Len(t, search(t, test, "customer", token), 2)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/orders?q=customer", nil, test.Data.testUserToken)
+		orders := []models.Order{}
+		extractPayload(t, http.StatusOK, recorder, &orders)
+		require.Len(t, orders, 1)
+		assert.Equal(t, test.Data.secondOrder.ID, orders[0].ID)
+	})
+}
+
 func TestUserOrdersList(t *testing.T) {
 	t.Run("AllOrders", func(t *testing.T) {
 		test := NewRouteTest(t)
@@ -842,12 +1027,17 @@ func TestOrderUpdate(t *testing.T) {
 		require.NoError(t, rsp.Error, "Failed to update email")
 
 		op := &orderRequestParams{
-			Email:            "mrfreeze@dc.com",
-			Currency:         "monopoly-dollars",
-			FulfillmentState: "shipping",
+			Email:    "mrfreeze@dc.com",
+			Currency: "monopoly-dollars",
 		}
 		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
 		recorder := runOrderUpdate(test, test.Data.firstOrder, op, token)
+		extractPayload(t, http.StatusOK, recorder, new(models.Order))
+
+		// only paid orders can be shipped
+		rsp = test.DB.Model(test.Data.firstOrder).UpdateColumns(map[string]interface{}{"payment_state": models.PaidState, "state": models.PaidState})
+		require.NoError(t, rsp.Error, "Failed to update payment state")
+		recorder = runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{FulfillmentState: "shipping"}, token)
 
 		assert := assert.New(t)
 		rspOrder := new(models.Order)
@@ -860,20 +1050,65 @@ func TestOrderUpdate(t *testing.T) {
 		assert.Equal("mrfreeze@dc.com", rspOrder.Email)
 		assert.Equal("monopoly-dollars", rspOrder.Currency)
 		assert.Equal("shipping", rspOrder.FulfillmentState)
+		assert.Equal("shipping", rspOrder.State)
 
 		// did it get persisted to the db
 		assert.Equal("mrfreeze@dc.com", saved.Email)
 		assert.Equal("monopoly-dollars", saved.Currency)
 		assert.Equal("shipping", saved.FulfillmentState)
+		assert.Equal("shipping", saved.State)
 		validateOrder(t, saved, rspOrder)
 
 		// should be the only field that has changed ~ check it
 		saved.Email = test.Data.firstOrder.Email
 		saved.Currency = test.Data.firstOrder.Currency
 		saved.FulfillmentState = test.Data.firstOrder.FulfillmentState
+		saved.PaymentState = test.Data.firstOrder.PaymentState
+		saved.State = test.Data.firstOrder.State
 		validateOrder(t, test.Data.firstOrder, saved)
 	})
 
+	t.Run("FulfillmentTransitions", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Webhooks.Fulfillment = "https://example.com/hooks/fulfillment"
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+		for _, state := range []string{models.ShippingState, models.ShippedState} {
+			recorder := runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{FulfillmentState: state}, token)
+			rspOrder := new(models.Order)
+			extractPayload(t, http.StatusOK, recorder, rspOrder)
+			assert.Equal(t, state, rspOrder.FulfillmentState)
+			assert.Equal(t, state, rspOrder.State)
+		}
+
+		recorder := runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{FulfillmentState: models.PendingState}, token)
+		validateError(t, http.StatusBadRequest, recorder, "Can't change fulfillment_state from 'shipped' to 'pending'")
+
+		hooks := []models.Hook{}
+		require.NoError(t, test.DB.Where("order_id = ? AND type = ?", test.Data.firstOrder.ID, "fulfillment").Find(&hooks).Error)
+		assert.Len(t, hooks, 2)
+
+		events := []models.Event{}
+		require.NoError(t, test.DB.Where("order_id = ? AND changes = ?", test.Data.firstOrder.ID, "fulfillment_state").Find(&events).Error)
+		require.Len(t, events, 2)
+		assert.Equal(t, models.ShippingState, events[0].Diff["fulfillment_state"].After)
+		assert.Equal(t, models.ShippedState, events[1].Diff["fulfillment_state"].After)
+	})
+
+	t.Run("ShipUnpaid", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{FulfillmentState: models.ShippedState}, token)
+		validateError(t, http.StatusBadRequest, recorder, "the order has not been paid")
+
+		saved := new(models.Order)
+		require.NoError(t, test.DB.First(saved, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.Equal(t, models.PendingState, saved.FulfillmentState)
+	})
+
 	t.Run("ExistingAddress", func(t *testing.T) {
 		test := NewRouteTest(t)
 		newAddr := getTestAddress()
@@ -970,6 +1205,96 @@ func TestOrderUpdate(t *testing.T) {
 		assert.Equal(t, op.MetaData, order.MetaData, "Order metadata should have been updated")
 	})
 
+	t.Run("LineItemsAddAndRemove", func(t *testing.T) {
+		test := NewRouteTest(t)
+		server := startTestSite()
+		defer server.Close()
+		test.Config.SiteURL = server.URL
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+		op := &orderRequestParams{
+			LineItems: []*orderLineItem{
+				{Path: "/simple-product", Quantity: 2},
+				{Sku: test.Data.firstLineItem.Sku, Quantity: 0},
+			},
+		}
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := runOrderUpdate(test, test.Data.firstOrder, op, token)
+
+		rspOrder := new(models.Order)
+		extractPayload(t, http.StatusOK, recorder, rspOrder)
+		require.Len(t, rspOrder.LineItems, 1)
+		assert.Equal(t, "product-1", rspOrder.LineItems[0].Sku)
+		assert.EqualValues(t, 1998, rspOrder.Total)
+		assert.Len(t, rspOrder.Adjustments, 0)
+
+		saved := new(models.Order)
+		require.NoError(t, orderQuery(test.DB).First(saved, "id = ?", test.Data.firstOrder.ID).Error)
+		require.Len(t, saved.LineItems, 1)
+		assert.Equal(t, "product-1", saved.LineItems[0].Sku)
+		assert.EqualValues(t, 1998, saved.Total)
+		assert.Len(t, saved.Downloads, 0)
+
+		events := []models.Event{}
+		require.NoError(t, test.DB.Where("order_id = ? AND type = ?", test.Data.firstOrder.ID, models.EventUpdated).Find(&events).Error)
+		require.Len(t, events, 1)
+		assert.EqualValues(t, 24, events[0].Diff["total"].Before)
+		assert.EqualValues(t, 1998, events[0].Diff["total"].After)
+	})
+
+	t.Run("LineItemsRemoveAll", func(t *testing.T) {
+		test := NewRouteTest(t)
+		op := &orderRequestParams{
+			LineItems: []*orderLineItem{{Sku: test.Data.firstLineItem.Sku, Quantity: 0}},
+		}
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := runOrderUpdate(test, test.Data.firstOrder, op, token)
+		validateError(t, http.StatusBadRequest, recorder, "An order must have at least one line item")
+	})
+
+	t.Run("LineItemsBelowShipped", func(t *testing.T) {
+		test := NewRouteTest(t)
+		shipment := models.NewShipment(test.Data.firstOrder, "UPS", "1Z", "")
+		shipment.Items = []*models.ShipmentItem{{OrderID: test.Data.firstOrder.ID, LineItemID: test.Data.firstLineItem.ID, Sku: test.Data.firstLineItem.Sku, Quantity: 2}}
+		require.NoError(t, test.DB.Create(shipment).Error)
+
+		op := &orderRequestParams{
+			LineItems: []*orderLineItem{{Sku: test.Data.firstLineItem.Sku, Quantity: 1}},
+		}
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := runOrderUpdate(test, test.Data.firstOrder, op, token)
+		validateError(t, http.StatusBadRequest, recorder, "can't be lower than the 2 shipped, returned or refunded already")
+	})
+
+	t.Run("Coupon", func(t *testing.T) {
+		test := NewRouteTest(t)
+		server := startTestSite()
+		defer server.Close()
+		test.Config.SiteURL = server.URL
+		couponServer := startCouponList("SPECIAL-EVENT", 50)
+		defer couponServer.Close()
+		test.Config.Coupons.URL = couponServer.URL
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+		recorder := runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{CouponCode: "SPECIAL-EVENT"}, token)
+		rspOrder := new(models.Order)
+		extractPayload(t, http.StatusOK, recorder, rspOrder)
+		assert.Equal(t, "SPECIAL-EVENT", rspOrder.CouponCode)
+		assert.EqualValues(t, 12, rspOrder.Discount)
+		assert.EqualValues(t, 12, rspOrder.Total)
+
+		recorder = runOrderUpdate(test, test.Data.firstOrder, &orderRequestParams{RemoveCoupon: true}, token)
+		rspOrder = new(models.Order)
+		extractPayload(t, http.StatusOK, recorder, rspOrder)
+		assert.Equal(t, "", rspOrder.CouponCode)
+		assert.Nil(t, rspOrder.Coupon)
+		assert.EqualValues(t, 0, rspOrder.Discount)
+		assert.EqualValues(t, 24, rspOrder.Total)
+	})
+
 	t.Run("InvalidFulfilmentState", func(t *testing.T) {
 		test := NewRouteTest(t)
 		op := &orderRequestParams{
@@ -993,7 +1318,7 @@ func TestClaim(t *testing.T) {
 		rsp := test.DB.Save(test.Data.firstOrder)
 		require.NoError(t, rsp.Error, "Failed to update email")
 
-		token := testToken("villian", "villian@wayneindustries.com")
+		token := testVerifiedToken("villian", "villian@wayneindustries.com", true)
 		recorder := test.TestEndpoint(http.MethodPost, "/claim", nil, token)
 		require.Equal(t, http.StatusNoContent, recorder.Code)
 
@@ -1032,13 +1357,99 @@ func TestClaim(t *testing.T) {
 		rsp := test.DB.Save(test.Data.firstOrder)
 		require.NoError(t, rsp.Error, "Failed to update email")
 
-		token := testToken("villian", "villian@wayneindustries.com")
+		token := testVerifiedToken("villian", "villian@wayneindustries.com", true)
 		recorder := test.TestEndpoint(http.MethodPost, "/claim", nil, token)
 		require.Equal(t, http.StatusNoContent, recorder.Code)
 
 		recorder = test.TestEndpoint(http.MethodPost, "/claim", nil, token)
 		require.Equal(t, http.StatusNoContent, recorder.Code)
 	})
+
+	claimable := func(t *testing.T, test *RouteTest) {
+		update := map[string]interface{}{"email": "villian@wayneindustries.com", "user_id": ""}
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).UpdateColumns(update).Error)
+	}
+	claimedBy := func(t *testing.T, test *RouteTest) string {
+		saved := &models.Order{}
+		require.NoError(t, test.DB.First(saved, "id = ?", test.Data.firstOrder.ID).Error)
+		return saved.UserID
+	}
+
+	t.Run("UnverifiedEmail", func(t *testing.T) {
+		test := NewRouteTest(t)
+		claimable(t, test)
+
+		token := testVerifiedToken("villian", "villian@wayneindustries.com", false)
+		recorder := test.TestEndpoint(http.MethodPost, "/claim", nil, token)
+		validateError(t, http.StatusForbidden, recorder, "must be verified")
+		assert.Equal(t, "", claimedBy(t, test))
+	})
+
+	t.Run("AllowUnverifiedEmail", func(t *testing.T) {
+		test := NewRouteTest(t)
+		claimable(t, test)
+
+		// tokens without an email_verified claim are refused by default
+		token := testToken("villian", "villian@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodPost, "/claim", nil, token)
+		validateError(t, http.StatusForbidden, recorder)
+		assert.Equal(t, "", claimedBy(t, test))
+
+		test.Config.GuestOrders.AllowUnverifiedEmail = true
+		recorder = test.TestEndpoint(http.MethodPost, "/claim", nil, token)
+		require.Equal(t, http.StatusNoContent, recorder.Code)
+		assert.Equal(t, "villian", claimedBy(t, test))
+
+		user := &models.User{}
+		require.NoError(t, test.DB.First(user, "id = ?", "villian").Error)
+		assert.NotNil(t, user.OrdersClaimedAt)
+	})
+
+	t.Run("Disabled", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.GuestOrders.ClaimPolicy = conf.ClaimPolicyDisabled
+		claimable(t, test)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/claim", nil, testToken("villian", "villian@wayneindustries.com"))
+		validateError(t, http.StatusBadRequest, recorder, "Claiming orders is disabled")
+		assert.Equal(t, "", claimedBy(t, test))
+	})
+
+	t.Run("Auto", func(t *testing.T) {
+		test := NewRouteTest(t)
+		claimable(t, test)
+		token := testVerifiedToken("villian", "villian@wayneindustries.com", true)
+
+		// the default policy leaves the orders alone
+		recorder := test.TestEndpoint(http.MethodGet, "/users/villian/orders", nil, token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "", claimedBy(t, test))
+
+		test.Config.GuestOrders.ClaimPolicy = conf.ClaimPolicyAuto
+		recorder = test.TestEndpoint(http.MethodGet, "/users/villian/orders", nil, token)
+		orders := []models.Order{}
+		extractPayload(t, http.StatusOK, recorder, &orders)
+		require.Len(t, orders, 1)
+		assert.Equal(t, test.Data.firstOrder.ID, orders[0].ID)
+		assert.Equal(t, "villian", claimedBy(t, test))
+
+		// only the first request claims orders
+		claimable(t, test)
+		recorder = test.TestEndpoint(http.MethodGet, "/users/villian/orders", nil, token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "", claimedBy(t, test))
+	})
+
+	t.Run("AutoUnverifiedEmail", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.GuestOrders.ClaimPolicy = conf.ClaimPolicyAuto
+		claimable(t, test)
+
+		token := testVerifiedToken("villian", "villian@wayneindustries.com", false)
+		recorder := test.TestEndpoint(http.MethodGet, "/users/villian/orders", nil, token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "", claimedBy(t, test))
+	})
 }
 
 // -------------------------------------------------------------------------------------------------------------------
@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/countries"
 	"github.com/netlify/gocommerce/models"
 	"github.com/pkg/errors"
 )
@@ -86,6 +87,22 @@ func sortField(value string) string {
 	return sortFields[value]
 }
 
+// addressFilterValues splits the values of an address filter. Countries are
+// also matched by their ISO 3166-1 alpha-2 code, since addresses store the
+// code while older addresses may have the name.
+func addressFilterValues(value string, dbField string) []string {
+	values := strings.Split(value, ",")
+	if dbField != "country" {
+		return values
+	}
+	for _, v := range values {
+		if code, ok := countries.Code(v); ok && code != v {
+			values = append(values, code)
+		}
+	}
+	return values
+}
+
 func addAddressFilter(query *gorm.DB, params url.Values, queryField string, dbField string) *gorm.DB {
 	addressTable := query.NewScope(models.Address{}).QuotedTableName()
 	orderTable := query.NewScope(models.Order{}).QuotedTableName()
@@ -93,13 +110,13 @@ func addAddressFilter(query *gorm.DB, params url.Values, queryField string, dbFi
 	if billingField := params.Get("billing_" + queryField); billingField != "" {
 		statement := "JOIN " + addressTable + " as billing_address on billing_address.id = " +
 			orderTable + ".billing_address_id AND " + "billing_address." + dbField + " in (?)"
-		query = query.Joins(statement, strings.Split(billingField, ","))
+		query = query.Joins(statement, addressFilterValues(billingField, dbField))
 	}
 
 	if shippingField := params.Get("shipping_" + queryField); shippingField != "" {
 		statement := "JOIN " + addressTable + " as shipping_address on shipping_address.id = " +
 			orderTable + ".shipping_address_id AND " + "shipping_address." + dbField + " in (?)"
-		query = query.Joins(statement, strings.Split(shippingField, ","))
+		query = query.Joins(statement, addressFilterValues(shippingField, dbField))
 	}
 	return query
 }
@@ -112,18 +129,18 @@ func addNegativeAddressFilter(query *gorm.DB, params url.Values, queryField stri
 	if billingField := params.Get("billing_" + queryField + "!"); billingField != "" {
 		statement := "JOIN " + addressTable + " as billing_address on billing_address.id = " +
 			orderTable + ".billing_address_id AND " + "billing_address." + dbField + " not in (?)"
-		query = query.Joins(statement, strings.Split(billingField, ","))
+		query = query.Joins(statement, addressFilterValues(billingField, dbField))
 	}
 
 	if shippingField := params.Get("shipping_" + queryField + "!"); shippingField != "" {
 		statement := "JOIN " + addressTable + " as shipping_address on shipping_address.id = " +
 			orderTable + ".shipping_address_id AND " + "shipping_address." + dbField + " not in (?)"
-		query = query.Joins(statement, strings.Split(shippingField, ","))
+		query = query.Joins(statement, addressFilterValues(shippingField, dbField))
 	}
 	return query
 }
 
-func parseOrderParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
+func parseOrderParams(query *gorm.DB, params url.Values, isAdmin bool) (*gorm.DB, error) {
 	orderTable := query.NewScope(models.Order{}).QuotedTableName()
 
 	if tax := params.Get("tax"); tax != "" {
@@ -138,6 +155,11 @@ func parseOrderParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
 	query = addNegativeAddressFilter(query, params, "countries", "country")
 	query = addAddressFilter(query, params, "name", "name")
 
+	var relevance interface{}
+	if q := params.Get("q"); q != "" {
+		query, relevance = addOrderSearch(query, q, isAdmin)
+	}
+
 	if values, exists := params["sort"]; exists {
 		for _, value := range values {
 			parts := strings.Split(value, " ")
@@ -159,21 +181,21 @@ func parseOrderParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
 			query = query.Order(field + " " + string(dir))
 		}
 	} else {
+		if relevance != nil {
+			query = query.Order(relevance)
+		}
 		query = query.Order("created_at desc")
 	}
 
+	// line items are matched with a subquery so orders with several matching
+	// items are only listed once
+	lineItemTable := query.NewScope(models.LineItem{}).QuotedTableName()
 	if items := params.Get("items"); items != "" {
-		lineItemTable := query.NewScope(models.LineItem{}).QuotedTableName()
-		statement := "JOIN " + lineItemTable + " as line_item on line_item.order_id = " +
-			orderTable + ".id AND line_item.title LIKE ?"
-		query = query.Joins(statement, "%"+items+"%")
+		query = query.Where(orderTable+".id IN (SELECT order_id FROM "+lineItemTable+" WHERE title LIKE ?)", "%"+items+"%")
 	}
 
 	if itemType := params.Get("item_type"); itemType != "" {
-		lineItemTable := query.NewScope(models.LineItem{}).QuotedTableName()
-		statement := "JOIN " + lineItemTable + " as line_item on line_item.order_id = " +
-			orderTable + ".id AND line_item.type LIKE ?"
-		query = query.Joins(statement, "%"+itemType+"%")
+		query = query.Where(orderTable+".id IN (SELECT order_id FROM "+lineItemTable+" WHERE type LIKE ?)", "%"+itemType+"%")
 	}
 
 	query, err := addFilterChoices(query, orderTable, params, "payment_state", models.PaymentStates)
@@ -187,6 +209,7 @@ func parseOrderParams(query *gorm.DB, params url.Values) (*gorm.DB, error) {
 
 	query = addFilters(query, orderTable, params, []string{
 		"invoice_number",
+		"invoice_id",
 	})
 
 	query = addLikeFilters(query, orderTable, params, []string{
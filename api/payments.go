@@ -34,6 +34,16 @@ type PaymentParams struct {
 	Description  string `json:"description"`
 }
 
+type refundParams struct {
+	PaymentParams
+	Items []refundItemParams `json:"items"`
+}
+
+type refundItemParams struct {
+	LineItemID int64  `json:"line_item_id"`
+	Quantity   uint64 `json:"quantity"`
+}
+
 // PaymentListForUser is the endpoint for listing transactions for a user.
 // The ID in the claim and the ID in the path must match (or have admin override)
 func (a *API) PaymentListForUser(w http.ResponseWriter, r *http.Request) error {
@@ -80,7 +90,11 @@ func (a *API) PaymentListForOrder(w http.ResponseWriter, r *http.Request) error
 	return sendJSON(w, http.StatusOK, order.Transactions)
 }
 
-func paymentComplete(r *http.Request, tx *gorm.DB, tr *models.Transaction, order *models.Order) {
+// paymentComplete records a successful charge and marks the order as paid.
+// The charge went through already, so license keys that can't be assigned
+// don't fail it: the order is flagged with an internal note instead and the
+// error is returned as keysErr, for the admin to be notified.
+func paymentComplete(r *http.Request, tx *gorm.DB, tr *models.Transaction, order *models.Order) (change *models.StateChange, keysErr error, err error) {
 	ctx := r.Context()
 	log := getLogEntry(r)
 	config := gcontext.GetConfig(ctx)
@@ -91,26 +105,67 @@ func paymentComplete(r *http.Request, tx *gorm.DB, tr *models.Transaction, order
 	} else {
 		tx.Save(tr)
 	}
-	order.PaymentState = models.PaidState
+	change, err = order.Transition(tx, config, r.RemoteAddr, tr.UserID, models.PaymentStateField, models.PaidState)
+	if err != nil {
+		return nil, nil, err
+	}
 	tx.Save(order)
 
-	if config.Webhooks.Payment != "" {
-		hook, err := models.NewHook("payment", config.SiteURL, config.Webhooks.Payment, order.UserID, config.Webhooks.Secret, order)
-		if err != nil {
-			log.WithError(err).Error("Failed to process webhook")
+	// keys assigned before the failure are undone with the savepoint
+	downloads := order.Downloads
+	tx.Exec("SAVEPOINT license_keys")
+	if keysErr = models.AssignLicenseKeys(tx, order); keysErr != nil {
+		log.WithError(keysErr).Error("Failed to assign license keys")
+		tx.Exec("ROLLBACK TO SAVEPOINT license_keys")
+		order.Downloads = downloads
+		note := &models.OrderNote{
+			OrderID: order.ID,
+			Text:    "License keys could not be assigned: " + keysErr.Error(),
 		}
-		tx.Save(hook)
+		if err := tx.Create(note).Error; err != nil {
+			return nil, nil, err
+		}
+		models.LogEvent(tx, r.RemoteAddr, tr.UserID, order.ID, models.EventUpdated, []string{"notes"})
 	}
+	tx.Exec("RELEASE SAVEPOINT license_keys")
+	return change, keysErr, nil
 }
 
-func sendOrderConfirmation(ctx context.Context, log logrus.FieldLogger, tr *models.Transaction) {
-	mailer := gcontext.GetMailer(ctx)
+// notifyMissingLicenseKeys tells the shop admin about a paid order whose
+// license keys couldn't be assigned.
+func notifyMissingLicenseKeys(ctx context.Context, log logrus.FieldLogger, order *models.Order, keysErr error) {
+	if keysErr == nil {
+		return
+	}
+	if err := gcontext.GetMailer(ctx).LicenseKeysMissingMail(order, keysErr); err != nil {
+		log.WithError(err).WithField("order_id", order.ID).Error("Error sending license keys missing mail")
+	}
+}
 
-	err1 := mailer.OrderConfirmationMail(tr)
-	err2 := mailer.OrderReceivedMail(tr)
+// sendTransitionMails sends the mails of an order state change.
+func sendTransitionMails(ctx context.Context, db *gorm.DB, ip string, log logrus.FieldLogger, change *models.StateChange, tr *models.Transaction) {
+	if change == nil {
+		return
+	}
+	mailer := gcontext.GetMailer(ctx)
 
-	if err1 != nil || err2 != nil {
-		log.Errorf("Error sending order confirmation mails: %v %v", err1, err2)
+	for _, mail := range change.Mails {
+		var err error
+		changes := []string{string(mail)}
+		switch mail {
+		case models.OrderConfirmationMail:
+			err = mailer.OrderConfirmationMail(tr)
+			changes = append(changes, tr.Order.Email)
+		case models.OrderReceivedMail:
+			err = mailer.OrderReceivedMail(tr)
+		default:
+			err = fmt.Errorf("Unknown order mail: %s", mail)
+		}
+		if err != nil {
+			log.WithError(err).Errorf("Error sending %s mail", mail)
+			continue
+		}
+		models.LogEvent(db, ip, tr.UserID, tr.OrderID, models.EventEmail, changes)
 	}
 }
 
@@ -188,21 +243,21 @@ func (a *API) PaymentCreate(w http.ResponseWriter, r *http.Request) error {
 		return internalServerError("We failed to authorize the amount for this order: %v", err)
 	}
 
-	invoiceNumber := order.InvoiceNumber
-	if invoiceNumber == 0 {
-		var err error
-		invoiceNumber, err = models.NextInvoiceNumber(tx, order.InstanceID)
+	if order.InvoiceNumber == 0 {
+		invoiceNumber, invoiceID, err := models.NextInvoiceNumber(tx, gcontext.GetConfig(ctx), order)
 		if err != nil {
 			tx.Rollback()
 			return internalServerError("We failed to generate a valid invoice ID, please try again later: %v", err)
 		}
 		order.InvoiceNumber = invoiceNumber
+		order.InvoiceID = invoiceID
 	}
 
 	tr := models.NewTransaction(order)
-	processorID, err := charge(params.Amount, params.Currency, order, invoiceNumber)
+	processorID, err := charge(params.Amount, params.Currency, order, order.InvoiceID)
 	tr.ProcessorID = processorID
-	tr.InvoiceNumber = invoiceNumber
+	tr.InvoiceNumber = order.InvoiceNumber
+	tr.InvoiceID = order.InvoiceID
 	order.PaymentProcessor = provider.Name()
 
 	if err != nil {
@@ -219,16 +274,29 @@ func (a *API) PaymentCreate(w http.ResponseWriter, r *http.Request) error {
 		tr.FailureDescription = err.Error()
 		tr.Status = models.FailedState
 		tx.Create(tr)
+		if _, transitionErr := order.Transition(tx, gcontext.GetConfig(ctx), r.RemoteAddr, tr.UserID, models.PaymentStateField, models.FailedState); transitionErr != nil {
+			log.WithError(transitionErr).Error("Failed to mark order as failed")
+		}
+		// keep the invoice number on the order so a retry doesn't leave a gap
+		tx.Save(order)
 		tx.Commit()
 		return internalServerError("There was an error charging your card: %v", err).WithInternalError(err)
 	}
 
-	paymentComplete(r, tx, tr, order)
+	change, keysErr, err := paymentComplete(r, tx, tr, order)
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Saving payment failed").WithInternalError(err)
+	}
 	if err := tx.Commit().Error; err != nil {
 		return internalServerError("Saving payment failed").WithInternalError(err)
 	}
 
-	go sendOrderConfirmation(ctx, log, tr)
+	if err := change.QueueHook(a.DB(r)); err != nil {
+		log.WithError(err).Error("Failed to queue payment webhook")
+	}
+	go sendTransitionMails(ctx, a.DB(r), r.RemoteAddr, log, change, tr)
+	go notifyMissingLicenseKeys(ctx, log, order, keysErr)
 
 	return sendJSON(w, http.StatusOK, tr)
 }
@@ -292,20 +360,38 @@ func (a *API) PaymentConfirm(w http.ResponseWriter, r *http.Request) error {
 	tx := db.Begin()
 
 	if trans.InvoiceNumber == 0 {
-		invoiceNumber, err := models.NextInvoiceNumber(tx, order.InstanceID)
-		if err != nil {
-			tx.Rollback()
-			return internalServerError("We failed to generate a valid invoice ID, please try again later: %v", err)
+		if order.InvoiceNumber == 0 {
+			invoiceNumber, invoiceID, err := models.NextInvoiceNumber(tx, gcontext.GetConfig(ctx), order)
+			if err != nil {
+				tx.Rollback()
+				return internalServerError("We failed to generate a valid invoice ID, please try again later: %v", err)
+			}
+			order.InvoiceNumber = invoiceNumber
+			order.InvoiceID = invoiceID
 		}
-		trans.InvoiceNumber = invoiceNumber
+		trans.InvoiceNumber = order.InvoiceNumber
+		trans.InvoiceID = order.InvoiceID
 	}
 
-	paymentComplete(r, tx, trans, order)
+	change, keysErr, err := paymentComplete(r, tx, trans, order)
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Saving payment failed").WithInternalError(err)
+	}
+	// the payment may settle an adjustment of an edited order
+	if err := tx.Model(&models.Adjustment{}).Where("transaction_id = ? AND state = ?", trans.ID, models.PendingState).Update("state", models.PaidState).Error; err != nil {
+		tx.Rollback()
+		return internalServerError("Saving payment failed").WithInternalError(err)
+	}
 	if err := tx.Commit().Error; err != nil {
 		return internalServerError("Saving payment failed").WithInternalError(err)
 	}
 
-	go sendOrderConfirmation(ctx, log, trans)
+	if err := change.QueueHook(a.DB(r)); err != nil {
+		log.WithError(err).Error("Failed to queue payment webhook")
+	}
+	go sendTransitionMails(ctx, a.DB(r), r.RemoteAddr, log, change, trans)
+	go notifyMissingLicenseKeys(ctx, log, order, keysErr)
 
 	return sendJSON(w, http.StatusOK, trans)
 }
@@ -321,6 +407,14 @@ func (a *API) PaymentList(w http.ResponseWriter, r *http.Request) error {
 		return badRequestError("Malformed request: %v", err)
 	}
 
+	format, err := exportFormat(r)
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	if format != "" {
+		return exportPayments(w, a.DB(r), query, format)
+	}
+
 	trans, httpErr := queryForTransactions(query, log, "", "")
 	if httpErr != nil {
 		return httpErr
@@ -328,6 +422,42 @@ func (a *API) PaymentList(w http.ResponseWriter, r *http.Request) error {
 	return sendJSON(w, http.StatusOK, trans)
 }
 
+var paymentExportHeader = []string{
+	"id", "order_id", "invoice_number", "credit_note_number", "type", "status",
+	"processor_id", "user_id", "amount", "currency", "failure_code", "created_at",
+}
+
+// exportPayments streams the transactions matching the query.
+func exportPayments(w http.ResponseWriter, db *gorm.DB, query *gorm.DB, format string) error {
+	rows, err := query.Model(&models.Transaction{}).Rows()
+	if err != nil {
+		return internalServerError("Error while querying for transactions").WithInternalError(err)
+	}
+	defer rows.Close()
+
+	table, err := newTableWriter(w, format, "payments", paymentExportHeader...)
+	if err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+	for rows.Next() {
+		tr := &models.Transaction{}
+		if err := db.ScanRows(rows, tr); err != nil {
+			return internalServerError("Error while querying for transactions").WithInternalError(err)
+		}
+		err := table.WriteRow(
+			tr.ID, tr.OrderID, tr.InvoiceNumber, tr.CreditNoteNumber, tr.Type, tr.Status,
+			tr.ProcessorID, tr.UserID, tr.Amount, tr.Currency, tr.FailureCode, tr.CreatedAt,
+		)
+		if err != nil {
+			return internalServerError("Error writing export").WithInternalError(err)
+		}
+	}
+	if err := table.Close(); err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+	return nil
+}
+
 // PaymentView returns information about a single payment. It is only available to admins.
 func (a *API) PaymentView(w http.ResponseWriter, r *http.Request) error {
 	payID := chi.URLParam(r, "payment_id")
@@ -339,12 +469,11 @@ func (a *API) PaymentView(w http.ResponseWriter, r *http.Request) error {
 }
 
 // PaymentRefund refunds a transaction for a specific amount. This allows partial
-// refunds if desired. It is only available to admins.
+// refunds if desired. The line items covered by the refund can be listed with
+// their quantities. It is only available to admins.
 func (a *API) PaymentRefund(w http.ResponseWriter, r *http.Request) error {
-	ctx := r.Context()
 	db := a.DB(r)
-	config := gcontext.GetConfig(ctx)
-	params := PaymentParams{Currency: "USD"}
+	params := refundParams{PaymentParams: PaymentParams{Currency: "USD"}}
 	err := json.NewDecoder(r.Body).Decode(&params)
 	if err != nil {
 		return badRequestError("Could not read params: %v", err)
@@ -356,41 +485,79 @@ func (a *API) PaymentRefund(w http.ResponseWriter, r *http.Request) error {
 		return httpErr
 	}
 
+	m, httpErr := a.refundTransaction(r, db, trans, params)
+	if httpErr != nil {
+		return httpErr
+	}
+	return sendJSON(w, http.StatusOK, m)
+}
+
+// refundTransaction refunds a paid charge through its payment provider and
+// records the refund transaction, whether it succeeded or not.
+func (a *API) refundTransaction(r *http.Request, db *gorm.DB, trans *models.Transaction, params refundParams) (*models.Transaction, *HTTPError) {
+	ctx := r.Context()
+	config := gcontext.GetConfig(ctx)
+
 	if trans.Currency != params.Currency {
-		return badRequestError("Currencies do not match - %v vs %v", trans.Currency, params.Currency)
+		return nil, badRequestError("Currencies do not match - %v vs %v", trans.Currency, params.Currency)
 	}
 
 	if params.Amount <= 0 || params.Amount > trans.Amount {
-		return badRequestError("The balance of the refund must be between 0 and the total amount")
+		return nil, badRequestError("The balance of the refund must be between 0 and the total amount")
 	}
 
 	if trans.FailureCode != "" {
-		return badRequestError("Can't refund a failed transaction")
+		return nil, badRequestError("Can't refund a failed transaction")
 	}
 
 	if trans.Status != models.PaidState {
-		return badRequestError("Can't refund a transaction that hasn't been paid")
+		return nil, badRequestError("Can't refund a transaction that hasn't been paid")
 	}
 
 	log := getLogEntry(r)
 	order, httpErr := queryForOrder(db, trans.OrderID, log)
 	if httpErr != nil {
-		return httpErr
+		return nil, httpErr
 	}
 	if order.PaymentProcessor == "" {
-		return badRequestError("Order does not specify a payment provider")
+		return nil, badRequestError("Order does not specify a payment provider")
 	}
 
 	provider := gcontext.GetPaymentProviders(ctx)[order.PaymentProcessor]
 	if provider == nil {
-		return badRequestError("Payment provider '%s' not configured", order.PaymentProcessor)
+		return nil, badRequestError("Payment provider '%s' not configured", order.PaymentProcessor)
 	}
 	refund, err := provider.NewRefunder(ctx, r, log.WithField("component", "payment_provider"))
 	if err != nil {
-		return badRequestError("Error creating payment provider: %v", err)
+		return nil, badRequestError("Error creating payment provider: %v", err)
+	}
+
+	// the pending refund reserves its items before any money is moved, so
+	// concurrent refunds can't cover the same items twice
+	tx := db.Begin()
+	if err := models.LockOrder(tx, order.ID); err != nil {
+		tx.Rollback()
+		return nil, internalServerError("Error while refunding").WithInternalError(err)
+	}
+	refunded, err := models.RefundedAmount(tx, trans)
+	if err != nil {
+		tx.Rollback()
+		return nil, internalServerError("Error while refunding").WithInternalError(err)
+	}
+	if refunded+params.Amount > trans.Amount {
+		tx.Rollback()
+		left := uint64(0)
+		if refunded < trans.Amount {
+			left = trans.Amount - refunded
+		}
+		return nil, badRequestError("Only %d of the transaction can still be refunded", left)
+	}
+	refundItems, httpErr := refundItemsForOrder(tx, order, params.Items)
+	if httpErr != nil {
+		tx.Rollback()
+		return nil, httpErr
 	}
 
-	// ok make the refund
 	m := &models.Transaction{
 		InstanceID: order.InstanceID,
 		ID:         uuid.NewRandom().String(),
@@ -398,15 +565,31 @@ func (a *API) PaymentRefund(w http.ResponseWriter, r *http.Request) error {
 		Currency:   params.Currency,
 		UserID:     trans.UserID,
 		OrderID:    trans.OrderID,
+		ChargeID:   trans.ID,
 		Type:       models.RefundTransactionType,
 		Status:     models.PendingState,
+
+		InvoiceNumber: trans.InvoiceNumber,
+		InvoiceID:     trans.InvoiceID,
+	}
+	for _, item := range refundItems {
+		item.TransactionID = m.ID
+	}
+	m.RefundItems = refundItems
+	if result := tx.Create(m); result.Error != nil {
+		tx.Rollback()
+		return nil, internalServerError("Error while refunding").WithInternalError(result.Error)
+	}
+	if result := tx.Commit(); result.Error != nil {
+		return nil, internalServerError("Error while refunding").WithInternalError(result.Error)
 	}
 
-	tx := db.Begin()
-	tx.Create(m)
+	// ok make the refund
 	provID := provider.Name()
 	log.Debugf("Starting refund to %s", provID)
 	refundID, err := refund(trans.ProcessorID, params.Amount, params.Currency)
+
+	tx = db.Begin()
 	if err != nil {
 		log.WithError(err).Info("Failed to refund value")
 		m.FailureCode = strconv.FormatInt(http.StatusInternalServerError, 10)
@@ -415,19 +598,80 @@ func (a *API) PaymentRefund(w http.ResponseWriter, r *http.Request) error {
 	} else {
 		m.ProcessorID = refundID
 		m.Status = models.PaidState
+
+		creditNoteNumber, creditNoteID, err := models.NextCreditNoteNumber(tx, config, order)
+		if err != nil {
+			// the refund went through already, so we still record it
+			log.WithError(err).Error("Failed to generate a credit note number")
+		} else {
+			m.CreditNoteNumber = creditNoteNumber
+			m.CreditNoteID = creditNoteID
+		}
 	}
 
 	log.Infof("Finished transaction with %s: %s", provID, m.ProcessorID)
 	tx.Save(m)
 	if config.Webhooks.Refund != "" {
-		hook, err := models.NewHook("refund", config.SiteURL, config.Webhooks.Refund, m.UserID, config.Webhooks.Secret, m)
+		hook, err := models.NewHook("refund", config.SiteURL, config.Webhooks.Refund, m.UserID, m.OrderID, config.Webhooks.Secret, m)
 		if err != nil {
 			log.WithError(err).Error("Failed to process webhook")
 		}
 		tx.Save(hook)
 	}
 	tx.Commit()
-	return sendJSON(w, http.StatusOK, m)
+	return m, nil
+}
+
+// refundItemsForOrder checks that the requested quantities haven't been
+// refunded already, or aren't being refunded, and values them at the price
+// paid for the line items.
+func refundItemsForOrder(db *gorm.DB, order *models.Order, params []refundItemParams) ([]*models.RefundItem, *HTTPError) {
+	if len(params) == 0 {
+		return nil, nil
+	}
+
+	lineItems := []*models.LineItem{}
+	if rsp := db.Where("order_id = ?", order.ID).Find(&lineItems); rsp.Error != nil {
+		return nil, internalServerError("Error while querying for line items").WithInternalError(rsp.Error)
+	}
+	refunded, err := models.ReservedRefundQuantities(db, order.ID)
+	if err != nil {
+		return nil, internalServerError("Error while querying for refunds").WithInternalError(err)
+	}
+
+	items := []*models.RefundItem{}
+	for _, param := range params {
+		var lineItem *models.LineItem
+		for _, li := range lineItems {
+			if li.ID == param.LineItemID {
+				lineItem = li
+				break
+			}
+		}
+		if lineItem == nil {
+			return nil, badRequestError("Line item %d is not part of the order", param.LineItemID)
+		}
+		if param.Quantity == 0 {
+			return nil, badRequestError("Refunded quantity of line item %d must be positive", param.LineItemID)
+		}
+		if refunded[lineItem.ID]+param.Quantity > lineItem.Quantity {
+			return nil, badRequestError("Only %d of line item %d can be refunded", lineItem.Quantity-refunded[lineItem.ID], lineItem.ID)
+		}
+		refunded[lineItem.ID] += param.Quantity
+
+		var unitPrice uint64
+		if lineItem.CalculationDetail != nil && lineItem.Total > 0 {
+			unitPrice = uint64(lineItem.Total)
+		}
+		items = append(items, &models.RefundItem{
+			OrderID:    order.ID,
+			LineItemID: lineItem.ID,
+			Sku:        lineItem.Sku,
+			Quantity:   param.Quantity,
+			Amount:     unitPrice * param.Quantity,
+		})
+	}
+	return items, nil
 }
 
 // PreauthorizePayment creates a new payment that can be authorized in the browser
@@ -495,6 +739,20 @@ func getTransaction(db *gorm.DB, payID string) (*models.Transaction, *HTTPError)
 	return trans, nil
 }
 
+// paidCharge returns the first paid charge of an order, which refunds are
+// issued against.
+func paidCharge(db *gorm.DB, orderID string) (*models.Transaction, *HTTPError) {
+	charge := &models.Transaction{}
+	rsp := db.Where("order_id = ? AND type = ? AND status = ?", orderID, models.ChargeTransactionType, models.PaidState).Order("created_at asc").First(charge)
+	if rsp.RecordNotFound() {
+		return nil, badRequestError("Order has no paid charge to refund")
+	}
+	if rsp.Error != nil {
+		return nil, internalServerError("Error while querying for transactions").WithInternalError(rsp.Error)
+	}
+	return charge, nil
+}
+
 func (a *API) verifyAmount(ctx context.Context, order *models.Order, amount uint64) error {
 	if order.Total != amount {
 		return fmt.Errorf("Amount calculated for order didn't match amount to charge. %v vs %v", order.Total, amount)
@@ -21,6 +21,9 @@ import (
 
 	"strings"
 
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
 	paypalsdk "github.com/netlify/PayPal-Go-SDK"
 	"github.com/netlify/gocommerce/conf"
 	gcontext "github.com/netlify/gocommerce/context"
@@ -270,7 +273,74 @@ func TestPaymentsRefund(t *testing.T) {
 			assert.Empty(t, payment.FailureDescription)
 			assert.Equal(t, models.RefundTransactionType, payment.Type)
 			assert.Equal(t, models.PaidState, payment.Status)
+			assert.EqualValues(t, 1, payment.CreditNoteNumber)
+			assert.Equal(t, test.Data.firstTransaction.InvoiceNumber, payment.InvoiceNumber)
+		}
+	})
+
+	t.Run("WithItems", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/payments/" + test.Data.firstTransaction.ID + "/refund"
+		params := &refundParams{
+			PaymentParams: PaymentParams{Amount: 12, Currency: "USD"},
+			Items:         []refundItemParams{{LineItemID: test.Data.firstLineItem.ID, Quantity: 1}},
+		}
+
+		rsp := new(models.Transaction)
+		extractPayload(t, http.StatusOK, runMemProviderRefund(t, test, url, params), rsp)
+		require.Len(t, rsp.RefundItems, 1)
+		assert.Equal(t, test.Data.firstLineItem.Sku, rsp.RefundItems[0].Sku)
+		assert.EqualValues(t, 1, rsp.RefundItems[0].Quantity)
+		assert.EqualValues(t, 12, rsp.RefundItems[0].Amount)
+
+		refunded, err := models.RefundedQuantities(test.DB, test.Data.firstOrder.ID)
+		require.NoError(t, err)
+		assert.EqualValues(t, 1, refunded[test.Data.firstLineItem.ID])
+
+		params.Items[0].Quantity = 2
+		validateError(t, http.StatusBadRequest, runMemProviderRefund(t, test, url, params), "Only 1 of line item")
+
+		params.Items[0].LineItemID = test.Data.secondLineItem1.ID
+		validateError(t, http.StatusBadRequest, runMemProviderRefund(t, test, url, params), "not part of the order")
+	})
+
+	t.Run("WithItemsBeingRefunded", func(t *testing.T) {
+		test := NewRouteTest(t)
+		// a refund of all of the item that is still in progress
+		pending := models.NewTransaction(test.Data.firstOrder)
+		pending.Type = models.RefundTransactionType
+		pending.Status = models.PendingState
+		pending.RefundItems = []*models.RefundItem{{OrderID: test.Data.firstOrder.ID, LineItemID: test.Data.firstLineItem.ID, Quantity: test.Data.firstLineItem.Quantity}}
+		require.NoError(t, test.DB.Create(pending).Error)
+
+		url := "/payments/" + test.Data.firstTransaction.ID + "/refund"
+		params := &refundParams{
+			PaymentParams: PaymentParams{Amount: 12, Currency: "USD"},
+			Items:         []refundItemParams{{LineItemID: test.Data.firstLineItem.ID, Quantity: 1}},
 		}
+		validateError(t, http.StatusBadRequest, runMemProviderRefund(t, test, url, params), "Only 0 of line item")
+	})
+
+	t.Run("AlreadyRefunded", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/payments/" + test.Data.firstTransaction.ID + "/refund"
+		params := &refundParams{PaymentParams: PaymentParams{Amount: 50, Currency: "USD"}}
+		rsp := new(models.Transaction)
+		extractPayload(t, http.StatusOK, runMemProviderRefund(t, test, url, params), rsp)
+		assert.Equal(t, test.Data.firstTransaction.ID, rsp.ChargeID)
+
+		// a pending refund made before refunds were linked to their charge
+		legacy := models.NewTransaction(test.Data.firstOrder)
+		legacy.Type = models.RefundTransactionType
+		legacy.Status = models.PendingState
+		legacy.Amount = 20
+		require.NoError(t, test.DB.Create(legacy).Error)
+
+		params.Amount = 31
+		validateError(t, http.StatusBadRequest, runMemProviderRefund(t, test, url, params), "Only 30 of the transaction")
+
+		params.Amount = 30
+		extractPayload(t, http.StatusOK, runMemProviderRefund(t, test, url, params), rsp)
 	})
 
 	t.Run("PayPal", func(t *testing.T) {
@@ -327,6 +397,28 @@ func runPaymentRefund(test *RouteTest, url string, params interface{}) *httptest
 	return test.TestEndpoint(http.MethodPost, url, bytes.NewBuffer(body), token)
 }
 
+// runMemProviderRefund runs a refund against an in-memory payment provider.
+func runMemProviderRefund(t *testing.T, test *RouteTest, url string, params interface{}) *httptest.ResponseRecorder {
+	provider := &memProvider{name: payments.StripeProvider}
+	return runWithMemProvider(t, test, provider, http.MethodPost, url, params, testAdminToken("magical-unicorn", ""))
+}
+
+func runWithMemProvider(t *testing.T, test *RouteTest, provider *memProvider, method, url string, params interface{}, token *jwt.Token) *httptest.ResponseRecorder {
+	globalConfig := new(conf.GlobalConfiguration)
+	ctx, err := WithInstanceConfig(context.Background(), globalConfig.SMTP, test.Config, "")
+	require.NoError(t, err)
+	ctx = gcontext.WithPaymentProviders(ctx, map[string]payments.Provider{payments.StripeProvider: provider})
+
+	body, err := json.Marshal(params)
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, url, bytes.NewBuffer(body))
+	require.NoError(t, signHTTPRequest(r, token, test.Config.JWT.Secret))
+
+	NewAPIWithVersion(ctx, test.GlobalConfig, logrus.StandardLogger(), test.DB, defaultVersion).handler.ServeHTTP(w, r)
+	return w
+}
+
 var stripePaymentIntentID = fmt.Sprintf("payment-intent-%d", rand.Int())
 
 func TestPaymentCreate(t *testing.T) {
@@ -516,6 +608,100 @@ func TestPaymentCreate(t *testing.T) {
 				})
 			}
 		})
+		t.Run("InvoiceNumbers", func(t *testing.T) {
+			year := time.Now().Year()
+			tests := map[string]struct {
+				config   conf.SequenceConfiguration
+				entity   string
+				legacy   int64
+				expected string
+			}{
+				"Default":                  {expected: "1"},
+				"ContinuesLegacy":          {legacy: 41, expected: "42"},
+				"ContinuesLegacyForEntity": {entity: "Wayne Enterprises", legacy: 41, expected: "42"},
+				"Formatted": {
+					config:   conf.SequenceConfiguration{Format: "INV-{year}-{currency}-{number:6}", Reset: "yearly", PerCurrency: true},
+					legacy:   41,
+					expected: fmt.Sprintf("INV-%d-USD-000001", year),
+				},
+			}
+
+			for name, tc := range tests {
+				t.Run(name, func(t *testing.T) {
+					test := NewRouteTest(t)
+					test.Config.Invoices.Numbers = tc.config
+					test.Config.Invoices.Entity = tc.entity
+					if tc.legacy > 0 {
+						require.NoError(t, test.DB.Create(&models.InvoiceNumber{InstanceID: "global-instance", Number: tc.legacy}).Error)
+					}
+
+					var invoiceID string
+					stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+						invoiceID = params.GetParams().Metadata["invoice_number"]
+						intent := v.(*stripe.PaymentIntent)
+						intent.ID = stripePaymentIntentID
+						intent.Status = stripe.PaymentIntentStatusSucceeded
+						return nil
+					}))
+					defer stripe.SetBackend(stripe.APIBackend, nil)
+
+					test.Data.firstOrder.PaymentState = models.PendingState
+					require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+					body, err := json.Marshal(&stripePaymentParams{
+						Amount:                test.Data.firstOrder.Total,
+						Currency:              test.Data.firstOrder.Currency,
+						StripePaymentMethodID: "payment-method-simple",
+						Provider:              payments.StripeProvider,
+					})
+					require.NoError(t, err)
+
+					recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+
+					trans := models.Transaction{}
+					extractPayload(t, http.StatusOK, recorder, &trans)
+					assert.Equal(t, tc.expected, trans.InvoiceID)
+					assert.Equal(t, tc.expected, invoiceID)
+
+					order := &models.Order{}
+					require.NoError(t, test.DB.Find(order, "id = ?", trans.OrderID).Error)
+					assert.Equal(t, tc.expected, order.InvoiceID)
+					assert.Equal(t, trans.InvoiceNumber, order.InvoiceNumber)
+				})
+			}
+
+			// numbers would repeat, so no payment is made
+			badFormats := map[string]conf.SequenceConfiguration{
+				"YearlyResetWithoutYear":     {Format: "INV-{number:6}", Reset: "yearly"},
+				"PerCurrencyWithoutCurrency": {Format: "INV-{year}-{number:6}", PerCurrency: true},
+			}
+			for name, numbers := range badFormats {
+				numbers := numbers
+				t.Run(name, func(t *testing.T) {
+					test := NewRouteTest(t)
+					test.Config.Invoices.Numbers = numbers
+					stripe.SetBackend(stripe.APIBackend, NewTrackingStripeBackend(func(method, path, key string, params stripe.ParamsContainer, v interface{}) error {
+						t.Fatalf("unexpected Stripe API call to %s", path)
+						return nil
+					}))
+					defer stripe.SetBackend(stripe.APIBackend, nil)
+
+					test.Data.firstOrder.PaymentState = models.PendingState
+					require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+					body, err := json.Marshal(&stripePaymentParams{
+						Amount:                test.Data.firstOrder.Total,
+						Currency:              test.Data.firstOrder.Currency,
+						StripePaymentMethodID: "payment-method-simple",
+						Provider:              payments.StripeProvider,
+					})
+					require.NoError(t, err)
+
+					recorder := test.TestEndpoint(http.MethodPost, "/orders/first-order/payments", bytes.NewBuffer(body), test.Data.testUserToken)
+					validateError(t, http.StatusInternalServerError, recorder)
+				})
+			}
+		})
 	})
 }
 
@@ -763,6 +949,7 @@ type paypalPaymentCreateParams struct {
 type memProvider struct {
 	refundCalls []refundCall
 	name        string
+	chargeID    string
 }
 
 type refundCall struct {
@@ -787,7 +974,10 @@ func (mp *memProvider) NewConfirmer(ctx context.Context, r *http.Request, log lo
 	return mp.confirm, nil
 }
 
-func (mp *memProvider) charge(amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
+func (mp *memProvider) charge(amount uint64, currency string, order *models.Order, invoiceID string) (string, error) {
+	if mp.chargeID != "" {
+		return mp.chargeID, nil
+	}
 	return "", errors.New("Shouldn't have called this")
 }
 
@@ -835,3 +1025,51 @@ func (t trackingStripeBackend) CallRaw(method, path, key string, body *form.Valu
 }
 
 func (t trackingStripeBackend) SetMaxNetworkRetries(maxNetworkRetries int) {}
+
+func TestPaymentCreateFailed(t *testing.T) {
+	test := NewRouteTest(t)
+	test.Data.firstOrder.PaymentState = models.PendingState
+	require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+	globalConfig := new(conf.GlobalConfiguration)
+	provider := &memProvider{name: payments.StripeProvider}
+	ctx, err := WithInstanceConfig(context.Background(), globalConfig.SMTP, test.Config, "")
+	require.NoError(t, err)
+	ctx = gcontext.WithPaymentProviders(ctx, map[string]payments.Provider{payments.StripeProvider: provider})
+
+	params := PaymentParams{Amount: test.Data.firstOrder.Total, Currency: "USD", ProviderType: payments.StripeProvider}
+	body, err := json.Marshal(params)
+	require.NoError(t, err)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/orders/"+test.Data.firstOrder.ID+"/payments", bytes.NewBuffer(body))
+	require.NoError(t, signHTTPRequest(r, test.Data.testUserToken, test.Config.JWT.Secret))
+	NewAPIWithVersion(ctx, test.GlobalConfig, logrus.StandardLogger(), test.DB, defaultVersion).handler.ServeHTTP(w, r)
+	validateError(t, http.StatusInternalServerError, w)
+
+	saved := &models.Order{}
+	require.NoError(t, test.DB.First(saved, "id = ?", test.Data.firstOrder.ID).Error)
+	assert.Equal(t, models.FailedState, saved.PaymentState)
+	assert.Equal(t, models.FailedState, saved.State)
+}
+
+func TestPaymentCreateWithBadWebhook(t *testing.T) {
+	test := NewRouteTest(t)
+	test.Config.Webhooks.Payment = "http://[::1"
+	test.Data.firstOrder.PaymentState = models.PendingState
+	require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+
+	// the card is charged, so the payment is kept even if the webhook fails
+	provider := &memProvider{name: payments.StripeProvider, chargeID: "charge-with-bad-webhook"}
+	params := PaymentParams{Amount: test.Data.firstOrder.Total, Currency: "USD", ProviderType: payments.StripeProvider}
+	recorder := runWithMemProvider(t, test, provider, http.MethodPost, "/orders/"+test.Data.firstOrder.ID+"/payments", params, test.Data.testUserToken)
+	trans := &models.Transaction{}
+	extractPayload(t, http.StatusOK, recorder, trans)
+	assert.Equal(t, models.PaidState, trans.Status)
+
+	saved := &models.Transaction{}
+	require.NoError(t, test.DB.First(saved, "processor_id = ?", "charge-with-bad-webhook").Error)
+	assert.Equal(t, models.PaidState, saved.Status)
+	order := &models.Order{}
+	require.NoError(t, test.DB.First(order, "id = ?", test.Data.firstOrder.ID).Error)
+	assert.Equal(t, models.PaidState, order.PaymentState)
+}
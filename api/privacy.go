@@ -0,0 +1,169 @@
+package api
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+const zipContentType = "application/zip"
+
+// userData is everything stored about a user and the guest orders with its
+// email.
+type userData struct {
+	User      *models.User        `json:"user"`
+	Addresses []*models.Address   `json:"addresses"`
+	Orders    []*models.Order     `json:"orders"`
+	Notes     []*models.OrderNote `json:"notes"`
+	Returns   []*models.Return    `json:"returns"`
+	Events    []*models.Event     `json:"events"`
+}
+
+// exportFile is a JSON file in the ZIP archive of an export.
+type exportFile struct {
+	name string
+	data interface{}
+}
+
+// files returns the parts of the export as JSON files for a ZIP archive.
+func (d *userData) files() []exportFile {
+	return []exportFile{
+		{"user.json", d.User},
+		{"addresses.json", d.Addresses},
+		{"orders.json", d.Orders},
+		{"notes.json", d.Notes},
+		{"returns.json", d.Returns},
+		{"events.json", d.Events},
+	}
+}
+
+// UserExport returns all the personal data stored about a user as JSON, or as
+// a ZIP archive with one JSON file per kind of record when requested with
+// `format=zip`. Only admins get the internal notes on the orders.
+func (a *API) UserExport(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	db := a.DB(r)
+	log := getLogEntry(r)
+
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		return notFoundError("Couldn't find a record for " + gcontext.GetUserID(ctx))
+	}
+
+	zipped := false
+	switch format := r.URL.Query().Get("format"); format {
+	case "zip":
+		zipped = true
+	case "json":
+	case "":
+		zipped = strings.Contains(r.Header.Get("Accept"), zipContentType)
+	default:
+		return badRequestError("Bad value for format: %v", format)
+	}
+
+	data := &userData{User: user}
+	if result := models.UserOrders(orderQuery(db), gcontext.GetInstanceID(ctx), user).Order("created_at asc").Find(&data.Orders); result.Error != nil {
+		return internalServerError("Error while querying for orders").WithInternalError(result.Error)
+	}
+	orderIDs := []string{}
+	for _, order := range data.Orders {
+		orderIDs = append(orderIDs, order.ID)
+	}
+
+	if result := db.Where("user_id = ?", user.ID).Find(&data.Addresses); result.Error != nil {
+		return internalServerError("Error while querying for addresses").WithInternalError(result.Error)
+	}
+
+	notesQuery := db.Where("order_id IN (?)", orderIDs)
+	if !gcontext.IsAdmin(ctx) {
+		notesQuery = notesQuery.Where("customer_visible = ?", true)
+	}
+	if result := notesQuery.Order("created_at asc").Find(&data.Notes); result.Error != nil {
+		return internalServerError("Error while querying for order notes").WithInternalError(result.Error)
+	}
+	if !gcontext.IsAdmin(ctx) {
+		hideNoteAuthors(data.Notes)
+	}
+
+	if result := db.Preload("Items").Where("user_id = ? OR order_id IN (?)", user.ID, orderIDs).Order("created_at asc").Find(&data.Returns); result.Error != nil {
+		return internalServerError("Error while querying for returns").WithInternalError(result.Error)
+	}
+
+	if result := db.Where("user_id = ? OR order_id IN (?)", user.ID, orderIDs).Order("created_at asc, id asc").Find(&data.Events); result.Error != nil {
+		return internalServerError("Error while querying for events").WithInternalError(result.Error)
+	}
+
+	log.WithField("order_count", len(data.Orders)).Info("Exported user data")
+	if !zipped {
+		return sendJSON(w, http.StatusOK, data)
+	}
+
+	filename := "user-" + user.ID + "-" + time.Now().UTC().Format("20060102") + ".zip"
+	w.Header().Set("Content-Type", zipContentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	archive := zip.NewWriter(w)
+	for _, file := range data.files() {
+		f, err := archive.Create(file.name)
+		if err != nil {
+			return internalServerError("Error writing export").WithInternalError(err)
+		}
+		enc := json.NewEncoder(f)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(file.data); err != nil {
+			return internalServerError("Error writing export").WithInternalError(err)
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+	return nil
+}
+
+// UserErase anonymizes the personal data of a user in its orders, addresses,
+// events and webhooks, and returns the audit record of the erasure. Financial
+// records are kept. It requires admin access.
+func (a *API) UserErase(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	db := a.DB(r)
+	log := getLogEntry(r)
+	claims := gcontext.GetClaims(ctx)
+
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		return notFoundError("Couldn't find a record for " + gcontext.GetUserID(ctx))
+	}
+
+	tx := db.Begin()
+	erasure, err := models.ErasePersonalData(tx, gcontext.GetInstanceID(ctx), user, claims.Subject)
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Error while erasing user data").WithInternalError(err)
+	}
+	if result := tx.Commit(); result.Error != nil {
+		return internalServerError("Error while erasing user data").WithInternalError(result.Error)
+	}
+
+	log.WithField("erasure_id", erasure.ID).Infof("Erased personal data of %d orders", erasure.Orders)
+	return sendJSON(w, http.StatusOK, erasure)
+}
+
+// UserErasures lists the erasures of a user's personal data. It requires
+// admin access.
+func (a *API) UserErasures(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	erasures := []*models.Erasure{}
+	result := a.DB(r).
+		Where("instance_id = ? AND user_id = ?", gcontext.GetInstanceID(ctx), gcontext.GetUserID(ctx)).
+		Order("created_at asc").
+		Find(&erasures)
+	if result.Error != nil {
+		return internalServerError("Error while querying for erasures").WithInternalError(result.Error)
+	}
+	return sendJSON(w, http.StatusOK, erasures)
+}
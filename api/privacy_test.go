@@ -0,0 +1,178 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func TestUserExport(t *testing.T) {
+	setup := func(t *testing.T) *RouteTest {
+		test := NewRouteTest(t)
+		guestOrder := models.NewOrder("", "session3", test.Data.testUser.Email, "USD")
+		notes := []*models.OrderNote{
+			{OrderID: test.Data.firstOrder.ID, Text: "Thanks for your order", CustomerVisible: true, UserID: "alfred", AuthorEmail: "alfred@wayneindustries.com"},
+			{OrderID: test.Data.firstOrder.ID, Text: "Suspicious customer"},
+		}
+		for _, i := range []interface{}{guestOrder, notes[0], notes[1]} {
+			require.NoError(t, test.DB.Create(i).Error)
+		}
+		models.LogEvent(test.DB, "127.0.0.1", test.Data.testUser.ID, test.Data.firstOrder.ID, models.EventEmail, []string{"order_confirmation", test.Data.testUser.Email})
+		return test
+	}
+
+	t.Run("JSON", func(t *testing.T) {
+		test := setup(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID+"/export", nil, test.Data.testUserToken)
+		data := &userData{}
+		extractPayload(t, http.StatusOK, recorder, data)
+
+		assert.Equal(t, test.Data.testUser.Email, data.User.Email)
+		assert.Len(t, data.Orders, 3)
+		assert.Len(t, data.Addresses, 1)
+		require.Len(t, data.Notes, 1)
+		assert.Equal(t, "Thanks for your order", data.Notes[0].Text)
+		assert.Empty(t, data.Notes[0].AuthorEmail)
+		require.Len(t, data.Events, 1)
+		assert.Equal(t, "127.0.0.1", data.Events[0].IP)
+	})
+
+	t.Run("AdminNotes", func(t *testing.T) {
+		test := setup(t)
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID+"/export?format=json", nil, token)
+		data := &userData{}
+		extractPayload(t, http.StatusOK, recorder, data)
+		assert.Len(t, data.Notes, 2)
+	})
+
+	t.Run("ZIP", func(t *testing.T) {
+		test := setup(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID+"/export?format=zip", nil, test.Data.testUserToken)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, zipContentType, recorder.Header().Get("Content-Type"))
+
+		archive, err := zip.NewReader(bytes.NewReader(recorder.Body.Bytes()), int64(recorder.Body.Len()))
+		require.NoError(t, err)
+		names := []string{}
+		for _, f := range archive.File {
+			names = append(names, f.Name)
+		}
+		assert.Equal(t, []string{"user.json", "addresses.json", "orders.json", "notes.json", "returns.json", "events.json"}, names)
+
+		f, err := archive.File[2].Open()
+		require.NoError(t, err)
+		defer f.Close()
+		orders := []models.Order{}
+		require.NoError(t, json.NewDecoder(f).Decode(&orders))
+		assert.Len(t, orders, 3)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/users/" + test.Data.testUser.ID + "/export"
+		recorder := test.TestEndpoint(http.MethodGet, url+"?format=pdf", nil, test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder)
+
+		recorder = test.TestEndpoint(http.MethodGet, url, nil, testToken("joker", "joker@example.com"))
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
+func TestUserErase(t *testing.T) {
+	t.Run("Simple", func(t *testing.T) {
+		test := NewRouteTest(t)
+		first := test.Data.firstOrder
+		require.NoError(t, test.DB.Model(first).UpdateColumns(map[string]interface{}{"ip": "127.0.0.1", "raw_meta_data": `{"phone": "555-1234"}`}).Error)
+		models.LogEvent(test.DB, "127.0.0.1", test.Data.testUser.ID, first.ID, models.EventEmail, []string{"order_confirmation", test.Data.testUser.Email})
+		diff := models.EventDiff{}
+		diff.Add("email", "old@example.com", test.Data.testUser.Email)
+		diff.Add("currency", "EUR", "USD")
+		models.LogEventDiff(test.DB, "127.0.0.1", test.Data.testUser.ID, first.ID, models.EventUpdated, diff)
+		require.NoError(t, test.DB.Model(first).UpdateColumn("vat_number", "DE123456789").Error)
+		hook, err := models.NewHook("order", "", "http://example.com", test.Data.testUser.ID, first.ID, "", first)
+		require.NoError(t, err)
+		require.NoError(t, test.DB.Create(hook).Error)
+		note := &models.OrderNote{OrderID: first.ID, Text: "Leave it with Alfred"}
+		require.NoError(t, test.DB.Create(note).Error)
+		ret := &models.Return{ID: "erased-return", OrderID: first.ID, UserID: test.Data.testUser.ID, State: models.ReturnRejected, Reason: "Bought it for my nephew", RejectionReason: "Bruce, that was a gift"}
+		require.NoError(t, test.DB.Create(ret).Error)
+
+		token := testAdminToken("magical-unicorn", "")
+		recorder := test.TestEndpoint(http.MethodPost, "/users/"+test.Data.testUser.ID+"/erase", nil, token)
+		erasure := &models.Erasure{}
+		extractPayload(t, http.StatusOK, recorder, erasure)
+		assert.Equal(t, test.Data.testUser.ID, erasure.UserID)
+		assert.Equal(t, "magical-unicorn", erasure.ErasedBy)
+		assert.Equal(t, 2, erasure.Orders)
+		assert.Equal(t, 2, erasure.Events)
+		assert.Equal(t, 1, erasure.Hooks)
+		assert.Equal(t, 1, erasure.Notes)
+		assert.Equal(t, 1, erasure.Returns)
+
+		order := &models.Order{}
+		require.NoError(t, orderQuery(test.DB).First(order, "id = ?", first.ID).Error)
+		assert.Empty(t, order.Email)
+		assert.Empty(t, order.IP)
+		assert.Empty(t, order.VATNumber)
+		assert.Empty(t, order.MetaData)
+		assert.Equal(t, first.Total, order.Total)
+		assert.Equal(t, first.InvoiceNumber, order.InvoiceNumber)
+		require.Len(t, order.Transactions, 1)
+		assert.Equal(t, uint64(100), order.Transactions[0].Amount)
+		assert.Empty(t, order.BillingAddress.Name)
+		assert.Empty(t, order.BillingAddress.Address1)
+		assert.Equal(t, test.Data.testAddress.Country, order.BillingAddress.Country)
+
+		events := []models.Event{}
+		require.NoError(t, test.DB.Where("order_id = ?", first.ID).Order("id asc").Find(&events).Error)
+		require.Len(t, events, 2)
+		assert.Empty(t, events[0].IP)
+		assert.Equal(t, "order_confirmation", events[0].Changes)
+		assert.NotContains(t, events[1].Diff, "email")
+		assert.Contains(t, events[1].Diff, "currency")
+
+		savedHook := &models.Hook{}
+		require.NoError(t, test.DB.First(savedHook, "id = ?", hook.ID).Error)
+		assert.Empty(t, savedHook.Payload)
+		assert.True(t, savedHook.Done, "undelivered webhooks are cancelled")
+		assert.True(t, savedHook.Failed)
+
+		savedNote := &models.OrderNote{}
+		require.NoError(t, test.DB.First(savedNote, "id = ?", note.ID).Error)
+		assert.Empty(t, savedNote.Text)
+
+		savedReturn := &models.Return{}
+		require.NoError(t, test.DB.First(savedReturn, "id = ?", ret.ID).Error)
+		assert.Empty(t, savedReturn.Reason)
+		assert.Empty(t, savedReturn.RejectionReason)
+
+		user := &models.User{}
+		require.NoError(t, test.DB.First(user, "id = ?", test.Data.testUser.ID).Error)
+		assert.Empty(t, user.Email)
+		assert.Empty(t, user.Name)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID+"/erasures", nil, token)
+		erasures := []models.Erasure{}
+		extractPayload(t, http.StatusOK, recorder, &erasures)
+		require.Len(t, erasures, 1)
+		assert.Equal(t, erasure.ID, erasures[0].ID)
+	})
+
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, "/users/"+test.Data.testUser.ID+"/erase", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+
+		user := &models.User{}
+		require.NoError(t, test.DB.First(user, "id = ?", test.Data.testUser.ID).Error)
+		assert.Equal(t, test.Data.testUser.Email, user.Email)
+	})
+}
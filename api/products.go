@@ -0,0 +1,192 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+	"github.com/pborman/uuid"
+)
+
+type productParams struct {
+	Sku  string                   `json:"sku"`
+	Path string                   `json:"path"`
+	Meta *models.LineItemMetadata `json:"meta"`
+}
+
+func (a *API) productRoutes(r *router) {
+	r.Use(adminRequired)
+
+	r.Get("/", a.ProductList)
+	r.With(addGetBody).Post("/", a.ProductCreate)
+	r.Route("/{product_sku}", func(r *router) {
+		r.Use(a.withProduct)
+
+		r.Get("/", a.ProductView)
+		r.With(addGetBody).Put("/", a.ProductUpdate)
+		r.Delete("/", a.ProductDelete)
+	})
+}
+
+func (a *API) withProduct(w http.ResponseWriter, r *http.Request) (context.Context, error) {
+	ctx := r.Context()
+	sku := chi.URLParam(r, "product_sku")
+	logEntrySetField(r, "product_sku", sku)
+
+	product := &models.Product{}
+	rsp := a.DB(r).Where("instance_id = ? AND sku = ?", gcontext.GetInstanceID(ctx), sku).First(product)
+	if rsp.RecordNotFound() {
+		return nil, notFoundError("Product not found")
+	}
+	if rsp.Error != nil {
+		return nil, internalServerError("Error while querying for product").WithInternalError(rsp.Error)
+	}
+	return gcontext.WithProduct(ctx, product), nil
+}
+
+// ProductList lists the products of the database catalog.
+func (a *API) ProductList(w http.ResponseWriter, r *http.Request) error {
+	query := a.DB(r).Where("instance_id = ?", gcontext.GetInstanceID(r.Context()))
+	if path := r.URL.Query().Get("path"); path != "" {
+		query = query.Where("path = ?", path)
+	}
+
+	format, err := exportFormat(r)
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	if format != "" {
+		return exportProducts(w, a.DB(r), query.Order("sku asc"), format)
+	}
+
+	offset, limit, err := paginate(w, r, query.Model(&models.Product{}))
+	if err != nil {
+		return badRequestError("Bad Pagination Parameters: %v", err)
+	}
+
+	products := []models.Product{}
+	if result := query.Order("sku asc").Offset(offset).Limit(limit).Find(&products); result.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	return sendJSON(w, http.StatusOK, products)
+}
+
+func exportProducts(w http.ResponseWriter, db *gorm.DB, query *gorm.DB, format string) error {
+	rows, err := query.Model(&models.Product{}).Rows()
+	if err != nil {
+		return internalServerError("Error during database query").WithInternalError(err)
+	}
+	defer rows.Close()
+
+	table, err := newTableWriter(w, format, "products", "sku", "path", "title", "type", "created_at", "updated_at")
+	if err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+	for rows.Next() {
+		product := &models.Product{}
+		if err := db.ScanRows(rows, product); err != nil {
+			return internalServerError("Error during database query").WithInternalError(err)
+		}
+		if err := product.AfterFind(); err != nil {
+			return internalServerError("Error during database query").WithInternalError(err)
+		}
+		if err := table.WriteRow(product.Sku, product.Path, product.Meta.Title, product.Meta.Type, product.CreatedAt, product.UpdatedAt); err != nil {
+			return internalServerError("Error writing export").WithInternalError(err)
+		}
+	}
+	if err := table.Close(); err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+	return nil
+}
+
+// ProductView returns a single product of the database catalog.
+func (a *API) ProductView(w http.ResponseWriter, r *http.Request) error {
+	return sendJSON(w, http.StatusOK, gcontext.GetProduct(r.Context()))
+}
+
+// ProductCreate adds a product to the database catalog.
+func (a *API) ProductCreate(w http.ResponseWriter, r *http.Request) error {
+	db := a.DB(r)
+	instanceID := gcontext.GetInstanceID(r.Context())
+
+	params := &productParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read product params: %v", err)
+	}
+	if params.Meta == nil {
+		params.Meta = &models.LineItemMetadata{}
+	}
+	if params.Sku == "" {
+		params.Sku = params.Meta.Sku
+	}
+	if params.Sku == "" {
+		return badRequestError("Products must have a sku")
+	}
+
+	var count uint64
+	if rsp := db.Model(&models.Product{}).Where("instance_id = ? AND sku = ?", instanceID, params.Sku).Count(&count); rsp.Error != nil {
+		return internalServerError("Error while querying for product").WithInternalError(rsp.Error)
+	}
+	if count > 0 {
+		return badRequestError("A product with sku '%s' already exists", params.Sku)
+	}
+
+	product := &models.Product{
+		InstanceID: instanceID,
+		ID:         uuid.NewRandom().String(),
+		Sku:        params.Sku,
+		Path:       params.Path,
+		Meta:       params.Meta,
+	}
+	if rsp := db.Create(product); rsp.Error != nil {
+		return internalServerError("Error while saving product").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusCreated, product)
+}
+
+// ProductUpdate changes the path or metadata of a product in the database
+// catalog. The sku of a product can't be changed.
+func (a *API) ProductUpdate(w http.ResponseWriter, r *http.Request) error {
+	product := gcontext.GetProduct(r.Context())
+
+	params := &productParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read product params: %v", err)
+	}
+	if params.Sku != "" && params.Sku != product.Sku {
+		return badRequestError("The sku of a product can't be changed")
+	}
+
+	if params.Path != "" {
+		product.Path = params.Path
+	}
+	if params.Meta != nil {
+		product.Meta = params.Meta
+	}
+	if rsp := a.DB(r).Save(product); rsp.Error != nil {
+		return internalServerError("Error while saving product").WithInternalError(rsp.Error)
+	}
+	return sendJSON(w, http.StatusOK, product)
+}
+
+// ProductDelete removes a product from the database catalog.
+func (a *API) ProductDelete(w http.ResponseWriter, r *http.Request) error {
+	product := gcontext.GetProduct(r.Context())
+	if rsp := a.DB(r).Delete(product); rsp.Error != nil {
+		return internalServerError("Error while deleting product").WithInternalError(rsp.Error)
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// CatalogCacheStats returns the hit rate and counters of the product
+// metadata cache for the instance.
+func (a *API) CatalogCacheStats(w http.ResponseWriter, r *http.Request) error {
+	instanceID := gcontext.GetInstanceID(r.Context())
+	return sendJSON(w, http.StatusOK, models.GetCatalogCacheStats(instanceID))
+}
@@ -0,0 +1,188 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func startTestCatalogSite() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gocommerce/settings.json":
+			fmt.Fprintln(w, `{}`)
+		case "/gocommerce/products.json":
+			fmt.Fprintln(w, `{"products": [
+				{"path": "/simple-product", "sku": "feed-product", "title": "Feed Product", "type": "Book", "prices": [
+					{"amount": "12.50", "currency": "USD"}
+				]}
+			]}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+func TestProductAdmin(t *testing.T) {
+	t.Run("CRUD", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+		body := strings.NewReader(`{"sku": "db-product", "path": "/db-product", "meta": {"title": "DB Product", "prices": [{"amount": "5.00", "currency": "USD"}]}}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/products", body, token)
+		product := &models.Product{}
+		extractPayload(t, http.StatusCreated, recorder, product)
+		assert.Equal(t, "db-product", product.Sku)
+		assert.Equal(t, "DB Product", product.Meta.Title)
+
+		recorder = test.TestEndpoint(http.MethodPost, "/products", strings.NewReader(`{"sku": "db-product"}`), token)
+		validateError(t, http.StatusBadRequest, recorder, "already exists")
+
+		body = strings.NewReader(`{"meta": {"title": "Renamed", "prices": [{"amount": "6.00", "currency": "USD"}]}}`)
+		recorder = test.TestEndpoint(http.MethodPut, "/products/db-product", body, token)
+		extractPayload(t, http.StatusOK, recorder, product)
+		assert.Equal(t, "Renamed", product.Meta.Title)
+		assert.Equal(t, "db-product", product.Meta.Sku)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/products", nil, token)
+		products := []models.Product{}
+		extractPayload(t, http.StatusOK, recorder, &products)
+		require.Len(t, products, 1)
+		assert.Equal(t, "/db-product", products[0].Path)
+		assert.Equal(t, "6.00", products[0].Meta.Prices[0].Amount)
+
+		recorder = test.TestEndpoint(http.MethodDelete, "/products/db-product", nil, token)
+		assert.Equal(t, http.StatusNoContent, recorder.Code)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/products/db-product", nil, token)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/products", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
+
+func TestOrderCreateWithCatalog(t *testing.T) {
+	server := startTestCatalogSite()
+	defer server.Close()
+
+	t.Run("Database", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.Catalog.Provider = models.DatabaseCatalogProvider
+		require.NoError(t, test.DB.Create(&models.Product{
+			ID:   "db-product",
+			Sku:  "db-product",
+			Path: "/simple-product",
+			Meta: &models.LineItemMetadata{
+				Title:  "DB Product",
+				Prices: []models.PriceMetadata{{Amount: "5.00", Currency: "USD"}},
+			},
+		}).Error)
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		require.Len(t, order.LineItems, 1)
+		assert.Equal(t, "db-product", order.LineItems[0].Sku)
+		assert.Equal(t, "DB Product", order.LineItems[0].Title)
+		assert.Equal(t, uint64(500), order.Total)
+	})
+
+	t.Run("JSONFeed", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.Catalog.Provider = models.FeedCatalogProvider
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusCreated, recorder, order)
+		require.Len(t, order.LineItems, 1)
+		assert.Equal(t, "feed-product", order.LineItems[0].Sku)
+		assert.Equal(t, uint64(1250), order.Total)
+	})
+
+	t.Run("UnknownProduct", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.SiteURL = server.URL
+		test.Config.Catalog.Provider = models.DatabaseCatalogProvider
+
+		recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+		validateError(t, http.StatusInternalServerError, recorder)
+	})
+}
+
+func TestCatalogCache(t *testing.T) {
+	var requests, notModified int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/gocommerce/settings.json":
+			fmt.Fprintln(w, `{}`)
+		case "/simple-product":
+			atomic.AddInt32(&requests, 1)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				atomic.AddInt32(&notModified, 1)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("ETag", `"v1"`)
+			handleTestProducts(w, r)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	test := NewRouteTest(t)
+	test.Config.SiteURL = server.URL
+	test.Config.Catalog.CacheTTL = 1
+
+	body := `{
+		"email": "info@example.com",
+		"shipping_address": {
+			"name": "Test User", "address1": "610 22nd Street",
+			"city": "San Francisco", "state": "CA", "country": "USA", "zip": "94107"
+		},
+		"line_items": [
+			{"path": "/simple-product", "quantity": 1},
+			{"path": "/simple-product", "quantity": 2},
+			{"path": "/simple-product", "quantity": 3}
+		]
+	}`
+	recorder := test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(body), test.Data.testUserToken)
+	order := &models.Order{}
+	extractPayload(t, http.StatusCreated, recorder, order)
+	assert.Len(t, order.LineItems, 3)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&requests))
+
+	models.SetCatalogCacheClock(func() time.Time { return time.Now().Add(2 * time.Second) })
+	recorder = test.TestEndpoint(http.MethodPost, "/orders", strings.NewReader(defaultPayload), test.Data.testUserToken)
+	extractPayload(t, http.StatusCreated, recorder, order)
+	assert.Equal(t, "product-1", order.LineItems[0].Sku)
+	assert.EqualValues(t, 2, atomic.LoadInt32(&requests))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&notModified))
+
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	recorder = test.TestEndpoint(http.MethodGet, "/catalog/cache", nil, token)
+	stats := models.CatalogCacheStats{}
+	extractPayload(t, http.StatusOK, recorder, &stats)
+	assert.EqualValues(t, 1, stats.Misses)
+	assert.EqualValues(t, 1, stats.Revalidated)
+	assert.EqualValues(t, 2, stats.Hits)
+	assert.InDelta(t, 0.75, stats.HitRate, 0.001)
+	assert.Equal(t, 1, stats.Entries)
+
+	assert.Equal(t, models.CatalogCacheStats{}, models.GetCatalogCacheStats("other-instance"))
+}
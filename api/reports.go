@@ -1,99 +1,1119 @@
 package api
 
 import (
+	"database/sql"
+	"fmt"
 	"net/http"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
 	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/countries"
 	"github.com/netlify/gocommerce/models"
 )
 
 type salesRow struct {
+	Period   string `json:"period,omitempty"`
 	Total    uint64 `json:"total"`
 	SubTotal uint64 `json:"subtotal"`
+	Discount uint64 `json:"discount"`
 	Taxes    uint64 `json:"taxes"`
 	Currency string `json:"currency"`
 	Orders   uint64 `json:"orders"`
+
+	Refunds     uint64 `json:"refunds"`
+	CreditNotes uint64 `json:"credit_notes"`
+	NetTotal    int64  `json:"net_total"`
+
+	TaxBreakdown []*taxRow `json:"tax_breakdown,omitempty"`
+
+	Previous *salesRow `json:"previous,omitempty"`
+}
+
+// taxRow sums the taxes of the line items sold to a country at a tax rate.
+type taxRow struct {
+	Country  string `json:"country"`
+	Rate     uint64 `json:"rate"`
+	NetTotal uint64 `json:"net_total"`
+	Taxes    uint64 `json:"taxes"`
 }
 
 type productsRow struct {
-	Sku      string `json:"sku"`
-	Path     string `json:"path"`
+	Sku        string `json:"sku,omitempty"`
+	Path       string `json:"path,omitempty"`
+	Type       string `json:"type,omitempty"`
+	CouponCode string `json:"coupon_code,omitempty"`
+	Currency   string `json:"currency"`
+
+	Units    uint64 `json:"units"`
+	Gross    uint64 `json:"gross"`
+	Discount uint64 `json:"discount"`
+	Net      uint64 `json:"net"`
+	Taxes    uint64 `json:"taxes"`
 	Total    uint64 `json:"total"`
-	Currency string `json:"currency"`
+
+	RefundedUnits  uint64 `json:"refunded_units"`
+	RefundedAmount uint64 `json:"refunded_amount"`
+	ReturnedUnits  uint64 `json:"returned_units"`
 }
 
-// SalesReport lists the sales numbers for a period
+// SalesReport lists the sales numbers for a period. The numbers can be split
+// into buckets with `interval=day|week|month` and compared to the previous
+// period of the same length with `compare=true`.
 func (a *API) SalesReport(w http.ResponseWriter, r *http.Request) error {
+	db := a.DB(r)
 	instanceID := gcontext.GetInstanceID(r.Context())
+	params := r.URL.Query()
 
-	query := a.DB(r).
-		Model(&models.Order{}).
-		Select("sum(total) as total, sum(sub_total) as subtotal, sum(taxes) as taxes, currency, count(*) as orders").
-		Where("payment_state = 'paid' AND instance_id = ?", instanceID).
-		Group("currency")
-
-	query, err := parseTimeQueryParams(query, query.NewScope(models.Order{}).QuotedTableName(), r.URL.Query())
+	interval := params.Get("interval")
+	if _, err := periodExpression(db, interval, "created_at"); err != nil {
+		return badRequestError(err.Error())
+	}
+	format, err := exportFormat(r)
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	from, to, err := getTimeQueryParams(params)
 	if err != nil {
 		return badRequestError(err.Error())
 	}
 
-	rows, err := query.Rows()
+	result, err := salesReport(db, instanceID, interval, from, to)
 	if err != nil {
 		return internalServerError("Database error").WithInternalError(err)
 	}
+
+	if params.Get("compare") == "true" {
+		if from == nil || to == nil {
+			return badRequestError("Comparing to the previous period requires 'from' and 'to'")
+		}
+		prevFrom := from.Add(-to.Sub(*from))
+		prevTo := from.Add(-time.Nanosecond)
+		previous, err := salesReport(db, instanceID, interval, &prevFrom, &prevTo)
+		if err != nil {
+			return internalServerError("Database error").WithInternalError(err)
+		}
+		comparePeriods(result, previous)
+	}
+
+	if format != "" {
+		return exportSalesReport(w, format, result)
+	}
+	return sendJSON(w, http.StatusOK, result)
+}
+
+// exportSalesReport writes one row per tax breakdown entry of every sales
+// row, so the taxes of a period can be summed up by country and rate.
+func exportSalesReport(w http.ResponseWriter, format string, result []*salesRow) error {
+	table, err := newTableWriter(w, format, "sales",
+		"period", "currency", "orders", "subtotal", "discount", "taxes", "total",
+		"refunds", "credit_notes", "net_total",
+		"tax_country", "tax_rate", "tax_net_total", "tax_amount",
+		"previous_orders", "previous_total", "previous_net_total",
+	)
+	if err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+
+	for _, row := range result {
+		values := []interface{}{
+			row.Period, row.Currency, row.Orders, row.SubTotal, row.Discount, row.Taxes, row.Total,
+			row.Refunds, row.CreditNotes, row.NetTotal,
+		}
+		previous := []interface{}{nil, nil, nil}
+		if row.Previous != nil {
+			previous = []interface{}{row.Previous.Orders, row.Previous.Total, row.Previous.NetTotal}
+		}
+
+		taxes := row.TaxBreakdown
+		if len(taxes) == 0 {
+			taxes = []*taxRow{nil}
+		}
+		for _, tax := range taxes {
+			taxValues := []interface{}{nil, nil, nil, nil}
+			if tax != nil {
+				taxValues = []interface{}{tax.Country, tax.Rate, tax.NetTotal, tax.Taxes}
+			}
+			line := append(append(append([]interface{}{}, values...), taxValues...), previous...)
+			if err := table.WriteRow(line...); err != nil {
+				return internalServerError("Error writing export").WithInternalError(err)
+			}
+		}
+	}
+
+	if err := table.Close(); err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+	return nil
+}
+
+func salesReport(db *gorm.DB, instanceID, interval string, from, to *time.Time) ([]*salesRow, error) {
+	ordersTable := db.NewScope(models.Order{}).QuotedTableName()
+	transactionsTable := db.NewScope(models.Transaction{}).QuotedTableName()
+	itemsTable := db.NewScope(models.LineItem{}).QuotedTableName()
+	taxesTable := db.NewScope(models.LineItemTax{}).QuotedTableName()
+	addressesTable := db.NewScope(models.Address{}).QuotedTableName()
+
+	orderPeriod, err := periodExpression(db, interval, ordersTable+".created_at")
+	if err != nil {
+		return nil, err
+	}
+	query := db.
+		Model(&models.Order{}).
+		Select(orderPeriod+" as period, sum(total) as total, sum(sub_total) as subtotal, sum(discount) as discount, sum(taxes) as taxes, currency, count(*) as orders").
+		Where("payment_state = 'paid' AND instance_id = ?", instanceID).
+		Group(groupByPeriod(orderPeriod, "currency"))
+	query = filterTimeRange(query, ordersTable, from, to)
+
+	rows, err := query.Rows()
+	if err != nil {
+		return nil, err
+	}
 	defer rows.Close()
 	result := []*salesRow{}
+	byPeriod := map[string]*salesRow{}
 	for rows.Next() {
 		row := &salesRow{}
-		err = rows.Scan(&row.Total, &row.SubTotal, &row.Taxes, &row.Currency, &row.Orders)
+		err = rows.Scan(&row.Period, &row.Total, &row.SubTotal, &row.Discount, &row.Taxes, &row.Currency, &row.Orders)
 		if err != nil {
-			return internalServerError("Database error").WithInternalError(err)
+			return nil, err
 		}
 		result = append(result, row)
+		byPeriod[row.Currency+"|"+row.Period] = row
+	}
+	salesRowFor := func(currency, period string) *salesRow {
+		row, ok := byPeriod[currency+"|"+period]
+		if !ok {
+			row = &salesRow{Currency: currency, Period: period}
+			result = append(result, row)
+			byPeriod[currency+"|"+period] = row
+		}
+		return row
 	}
 
-	return sendJSON(w, http.StatusOK, result)
+	// net the credit notes issued within the period against the sales
+	refundPeriod, err := periodExpression(db, interval, transactionsTable+".created_at")
+	if err != nil {
+		return nil, err
+	}
+	refundQuery := db.
+		Model(&models.Transaction{}).
+		Select(refundPeriod+" as period, sum(amount) as refunds, count(*) as credit_notes, currency").
+		Where("type = ? AND status = ? AND instance_id = ?", models.RefundTransactionType, models.PaidState, instanceID).
+		Group(groupByPeriod(refundPeriod, "currency"))
+	refundQuery = filterTimeRange(refundQuery, transactionsTable, from, to)
+
+	refundRows, err := refundQuery.Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer refundRows.Close()
+	for refundRows.Next() {
+		var refunds, creditNotes uint64
+		var period, currency string
+		if err := refundRows.Scan(&period, &refunds, &creditNotes, &currency); err != nil {
+			return nil, err
+		}
+		row := salesRowFor(currency, period)
+		row.Refunds = refunds
+		row.CreditNotes = creditNotes
+	}
+
+	// taxes are reported by the country the order is shipped to, which is the
+	// one the taxes were calculated for. Line items priced before their taxes
+	// were stored by rate show up with a rate of 0.
+	taxRate := "COALESCE(" + taxesTable + ".rate, 0)"
+	taxQuery := db.
+		Model(&models.LineItem{}).
+		Select(orderPeriod+" as period, "+ordersTable+".currency, COALESCE("+addressesTable+".country, '') as country, "+
+			taxRate+" as rate, "+
+			"COALESCE(sum(COALESCE("+taxesTable+".net_total, "+itemsTable+".calculation_net_total * "+itemsTable+".quantity)), 0) as net_total, "+
+			"COALESCE(sum(COALESCE("+taxesTable+".taxes, "+itemsTable+".calculation_taxes * "+itemsTable+".quantity)), 0) as taxes").
+		Joins("JOIN "+ordersTable+" ON "+ordersTable+".id = "+itemsTable+".order_id").
+		Joins("LEFT JOIN "+taxesTable+" ON "+taxesTable+".line_item_id = "+itemsTable+".id").
+		Joins("LEFT JOIN "+addressesTable+" ON "+addressesTable+".id = "+ordersTable+".shipping_address_id").
+		Where(ordersTable+".payment_state = 'paid' AND "+ordersTable+".instance_id = ?", instanceID).
+		Group(groupByPeriod(orderPeriod, ordersTable+".currency", addressesTable+".country", taxRate))
+	taxQuery = filterTimeRange(taxQuery, ordersTable, from, to)
+
+	taxRows, err := taxQuery.Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer taxRows.Close()
+	for taxRows.Next() {
+		var period, currency string
+		var rate sql.NullInt64
+		tax := &taxRow{}
+		if err := taxRows.Scan(&period, &currency, &tax.Country, &rate, &tax.NetTotal, &tax.Taxes); err != nil {
+			return nil, err
+		}
+		tax.Rate = uint64(rate.Int64)
+		// older addresses have country names instead of codes
+		if code, ok := countries.Code(tax.Country); ok {
+			tax.Country = code
+		}
+		row := salesRowFor(currency, period)
+		row.TaxBreakdown = addTaxRow(row.TaxBreakdown, tax)
+	}
+
+	result = fillPeriods(result, interval, from, to)
+	for _, row := range result {
+		row.NetTotal = int64(row.Total) - int64(row.Refunds)
+	}
+
+	return result, nil
+}
+
+// comparePeriods attaches the rows of the previous period to the rows of the
+// current one. Rows are matched by currency and by their position within the
+// period.
+func comparePeriods(current, previous []*salesRow) {
+	positions := map[string]int{}
+	previousRows := map[string]*salesRow{}
+	for _, row := range previous {
+		key := fmt.Sprintf("%s|%d", row.Currency, positions[row.Currency])
+		positions[row.Currency]++
+		previousRows[key] = row
+	}
+
+	positions = map[string]int{}
+	for _, row := range current {
+		key := fmt.Sprintf("%s|%d", row.Currency, positions[row.Currency])
+		positions[row.Currency]++
+		if prev, ok := previousRows[key]; ok {
+			row.Previous = prev
+		} else {
+			row.Previous = &salesRow{Currency: row.Currency}
+		}
+	}
+}
+
+// productsGroupings maps the values of the group_by parameter of the products
+// report to the columns grouped by.
+var productsGroupings = map[string]struct {
+	items  string
+	orders string
+}{
+	"sku":    {items: "sku"},
+	"type":   {items: "type"},
+	"coupon": {orders: "coupon_code"},
 }
 
-// ProductsReport list the products sold within a period
+var productsOrderFields = map[string]func(row *productsRow) uint64{
+	"units":           func(row *productsRow) uint64 { return row.Units },
+	"gross":           func(row *productsRow) uint64 { return row.Gross },
+	"discount":        func(row *productsRow) uint64 { return row.Discount },
+	"net":             func(row *productsRow) uint64 { return row.Net },
+	"taxes":           func(row *productsRow) uint64 { return row.Taxes },
+	"total":           func(row *productsRow) uint64 { return row.Total },
+	"refunded_units":  func(row *productsRow) uint64 { return row.RefundedUnits },
+	"refunded_amount": func(row *productsRow) uint64 { return row.RefundedAmount },
+	"returned_units":  func(row *productsRow) uint64 { return row.ReturnedUnits },
+}
+
+// ProductsReport lists the products sold within a period. Rows are per sku,
+// or per product type or coupon code with `group_by=type|coupon`, and can be
+// sorted with `order_by=<field> [asc|desc]`. Refunds are counted by the date
+// of the refund and returns by the date the items were received.
 func (a *API) ProductsReport(w http.ResponseWriter, r *http.Request) error {
 	db := a.DB(r)
 	instanceID := gcontext.GetInstanceID(r.Context())
+	params := r.URL.Query()
 	ordersTable := db.NewScope(models.Order{}).QuotedTableName()
 	itemsTable := db.NewScope(models.LineItem{}).QuotedTableName()
+	refundItemsTable := db.NewScope(models.RefundItem{}).QuotedTableName()
+	transactionsTable := db.NewScope(models.Transaction{}).QuotedTableName()
+	returnsTable := db.NewScope(models.Return{}).QuotedTableName()
+	returnItemsTable := db.NewScope(models.ReturnItem{}).QuotedTableName()
+
+	groupBy := params.Get("group_by")
+	if groupBy == "" {
+		groupBy = "sku"
+	}
+	grouping, ok := productsGroupings[groupBy]
+	if !ok {
+		return badRequestError("Bad value for group_by: %v", groupBy)
+	}
+	groupColumn := itemsTable + "." + grouping.items
+	if grouping.orders != "" {
+		groupColumn = ordersTable + "." + grouping.orders
+	}
+
+	orderBy, desc := "total", true
+	if value := params.Get("order_by"); value != "" {
+		parts := strings.Fields(value)
+		orderBy = parts[0]
+		if _, ok := productsOrderFields[orderBy]; !ok || len(parts) > 2 {
+			return badRequestError("Bad value for order_by: %v", value)
+		}
+		if len(parts) == 2 {
+			switch strings.ToLower(parts[1]) {
+			case string(ascending):
+				desc = false
+			case string(descending):
+			default:
+				return badRequestError("Bad direction for order_by: %v", parts[1])
+			}
+		}
+	}
+
+	from, to, err := getTimeQueryParams(params)
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	format, err := exportFormat(r)
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+
 	query := db.
 		Model(&models.LineItem{}).
-		Select("sku, path, sum(quantity * price) as total, currency").
-		Joins("JOIN " + ordersTable + " ON " + ordersTable + ".id = " + itemsTable + ".order_id " + "AND " + ordersTable + ".payment_state = 'paid'").
-		Group("sku, path, currency").
-		Order("total desc")
+		Select("COALESCE("+groupColumn+", '') as grouping, MAX("+itemsTable+".path) as path, "+ordersTable+".currency, "+
+			"sum("+itemsTable+".quantity) as units, "+
+			"sum(("+itemsTable+".price + "+itemsTable+".addon_price) * "+itemsTable+".quantity) as gross, "+
+			"COALESCE(sum("+itemsTable+".calculation_discount * "+itemsTable+".quantity), 0) as discount, "+
+			"COALESCE(sum("+itemsTable+".calculation_net_total * "+itemsTable+".quantity), 0) as net, "+
+			"COALESCE(sum("+itemsTable+".calculation_taxes * "+itemsTable+".quantity), 0) as taxes").
+		Joins("JOIN "+ordersTable+" ON "+ordersTable+".id = "+itemsTable+".order_id AND "+ordersTable+".payment_state = 'paid'").
+		Where(ordersTable+".instance_id = ?", instanceID).
+		Group(groupColumn + ", " + ordersTable + ".currency")
+	query = filterTimeRange(query, ordersTable, from, to)
 
-	query = query.Where(ordersTable+".instance_id = ?", instanceID)
-	from, to, err := getTimeQueryParams(r.URL.Query())
+	rows, err := query.Rows()
 	if err != nil {
-		return badRequestError(err.Error())
+		return internalServerError("Database error").WithInternalError(err)
+	}
+	defer rows.Close()
+	result := []*productsRow{}
+	byGroup := map[string]*productsRow{}
+	for rows.Next() {
+		var grouping string
+		var path sql.NullString
+		row := &productsRow{}
+		err = rows.Scan(&grouping, &path, &row.Currency, &row.Units, &row.Gross, &row.Discount, &row.Net, &row.Taxes)
+		if err != nil {
+			return internalServerError("Database error").WithInternalError(err)
+		}
+		row.setGrouping(groupBy, grouping)
+		if groupBy == "sku" {
+			row.Path = path.String
+		}
+		row.Total = row.Net + row.Taxes
+		result = append(result, row)
+		byGroup[grouping+"|"+row.Currency] = row
+	}
+
+	refundQuery := db.
+		Model(&models.RefundItem{}).
+		Select("COALESCE("+groupColumn+", '') as grouping, "+transactionsTable+".currency, "+
+			"sum("+refundItemsTable+".quantity), sum("+refundItemsTable+".amount)").
+		Joins("JOIN "+transactionsTable+" ON "+transactionsTable+".id = "+refundItemsTable+".transaction_id").
+		Joins("JOIN "+itemsTable+" ON "+itemsTable+".id = "+refundItemsTable+".line_item_id").
+		Joins("JOIN "+ordersTable+" ON "+ordersTable+".id = "+refundItemsTable+".order_id").
+		Where(transactionsTable+".status = ? AND "+transactionsTable+".instance_id = ?", models.PaidState, instanceID).
+		Group(groupColumn + ", " + transactionsTable + ".currency")
+	refundQuery = filterTimeRange(refundQuery, transactionsTable, from, to)
+
+	refundRows, err := refundQuery.Rows()
+	if err != nil {
+		return internalServerError("Database error").WithInternalError(err)
+	}
+	defer refundRows.Close()
+	for refundRows.Next() {
+		var grouping, currency string
+		var units, amount uint64
+		if err := refundRows.Scan(&grouping, &currency, &units, &amount); err != nil {
+			return internalServerError("Database error").WithInternalError(err)
+		}
+		row, ok := byGroup[grouping+"|"+currency]
+		if !ok {
+			row = &productsRow{Currency: currency}
+			row.setGrouping(groupBy, grouping)
+			result = append(result, row)
+			byGroup[grouping+"|"+currency] = row
+		}
+		row.RefundedUnits = units
+		row.RefundedAmount = amount
+	}
+
+	returnQuery := db.
+		Model(&models.ReturnItem{}).
+		Select("COALESCE("+groupColumn+", '') as grouping, "+ordersTable+".currency, sum("+returnItemsTable+".quantity)").
+		Joins("JOIN "+returnsTable+" ON "+returnsTable+".id = "+returnItemsTable+".return_id").
+		Joins("JOIN "+itemsTable+" ON "+itemsTable+".id = "+returnItemsTable+".line_item_id").
+		Joins("JOIN "+ordersTable+" ON "+ordersTable+".id = "+returnItemsTable+".order_id").
+		Where(returnsTable+".state IN (?) AND "+returnsTable+".instance_id = ?", []string{models.ReturnReceived, models.ReturnRefunding, models.ReturnRefunded}, instanceID).
+		Group(groupColumn + ", " + ordersTable + ".currency")
+	if from != nil {
+		returnQuery = returnQuery.Where(returnsTable+".received_at >= ?", from)
+	}
+	if to != nil {
+		returnQuery = returnQuery.Where(returnsTable+".received_at <= ?", to)
+	}
+
+	returnRows, err := returnQuery.Rows()
+	if err != nil {
+		return internalServerError("Database error").WithInternalError(err)
+	}
+	defer returnRows.Close()
+	for returnRows.Next() {
+		var grouping, currency string
+		var units uint64
+		if err := returnRows.Scan(&grouping, &currency, &units); err != nil {
+			return internalServerError("Database error").WithInternalError(err)
+		}
+		row, ok := byGroup[grouping+"|"+currency]
+		if !ok {
+			row = &productsRow{Currency: currency}
+			row.setGrouping(groupBy, grouping)
+			result = append(result, row)
+			byGroup[grouping+"|"+currency] = row
+		}
+		row.ReturnedUnits = units
+	}
+
+	field := productsOrderFields[orderBy]
+	sort.SliceStable(result, func(i, j int) bool {
+		if desc {
+			return field(result[i]) > field(result[j])
+		}
+		return field(result[i]) < field(result[j])
+	})
+
+	if format != "" {
+		return exportProductsReport(w, format, result)
+	}
+	return sendJSON(w, http.StatusOK, result)
+}
+
+func (row *productsRow) setGrouping(groupBy, value string) {
+	switch groupBy {
+	case "type":
+		row.Type = value
+	case "coupon":
+		row.CouponCode = value
+	default:
+		row.Sku = value
+	}
+}
+
+func exportProductsReport(w http.ResponseWriter, format string, result []*productsRow) error {
+	table, err := newTableWriter(w, format, "products",
+		"sku", "path", "type", "coupon_code", "currency",
+		"units", "gross", "discount", "net", "taxes", "total", "refunded_units", "refunded_amount", "returned_units",
+	)
+	if err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+	for _, row := range result {
+		err := table.WriteRow(
+			row.Sku, row.Path, row.Type, row.CouponCode, row.Currency,
+			row.Units, row.Gross, row.Discount, row.Net, row.Taxes, row.Total, row.RefundedUnits, row.RefundedAmount, row.ReturnedUnits,
+		)
+		if err != nil {
+			return internalServerError("Error writing export").WithInternalError(err)
+		}
+	}
+	if err := table.Close(); err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+	return nil
+}
+
+const (
+	dayInterval   = "day"
+	weekInterval  = "week"
+	monthInterval = "month"
+
+	// noPeriod is selected as the period of reports without an interval
+	noPeriod = "''"
+
+	periodFormat = "2006-01-02"
+)
+
+// periodExpression returns the SQL expression that truncates a timestamp
+// column to the start of its day, week (starting on Monday) or month,
+// formatted as YYYY-MM-DD.
+func periodExpression(db *gorm.DB, interval, column string) (string, error) {
+	switch interval {
+	case "":
+		return noPeriod, nil
+	case dayInterval, weekInterval, monthInterval:
+	default:
+		return "", fmt.Errorf("Bad value for interval: %v", interval)
+	}
+
+	switch db.Dialect().GetName() {
+	case "postgres":
+		return "to_char(date_trunc('" + interval + "', " + column + "), 'YYYY-MM-DD')", nil
+	case "mysql":
+		switch interval {
+		case dayInterval:
+			return "DATE_FORMAT(" + column + ", '%Y-%m-%d')", nil
+		case weekInterval:
+			return "DATE_FORMAT(DATE_SUB(" + column + ", INTERVAL WEEKDAY(" + column + ") DAY), '%Y-%m-%d')", nil
+		default:
+			return "DATE_FORMAT(" + column + ", '%Y-%m-01')", nil
+		}
+	case "sqlite3":
+		switch interval {
+		case dayInterval:
+			return "strftime('%Y-%m-%d', " + column + ")", nil
+		case weekInterval:
+			return "date(" + column + ", '-6 days', 'weekday 1')", nil
+		default:
+			return "strftime('%Y-%m-01', " + column + ")", nil
+		}
+	}
+	return "", fmt.Errorf("Intervals are not supported for %v databases", db.Dialect().GetName())
+}
+
+// addTaxRow adds the amounts of a tax row to the row of the same country and
+// rate, if there is one already.
+func addTaxRow(rows []*taxRow, tax *taxRow) []*taxRow {
+	for _, row := range rows {
+		if row.Country == tax.Country && row.Rate == tax.Rate {
+			row.NetTotal += tax.NetTotal
+			row.Taxes += tax.Taxes
+			return rows
+		}
 	}
+	return append(rows, tax)
+}
+
+func groupByPeriod(period string, columns ...string) string {
+	if period != noPeriod {
+		columns = append([]string{period}, columns...)
+	}
+	return strings.Join(columns, ", ")
+}
+
+func filterTimeRange(query *gorm.DB, tableName string, from, to *time.Time) *gorm.DB {
 	if from != nil {
-		query = query.Where(ordersTable+".created_at >= ?", from)
+		query = query.Where(tableName+".created_at >= ?", from)
 	}
 	if to != nil {
-		query.Where(ordersTable+".created_at <= ?", to)
+		query = query.Where(tableName+".created_at <= ?", to)
+	}
+	return query
+}
+
+func periodStart(t time.Time, interval string) time.Time {
+	t = t.UTC()
+	switch interval {
+	case weekInterval:
+		offset := (int(t.Weekday()) + 6) % 7
+		return time.Date(t.Year(), t.Month(), t.Day()-offset, 0, 0, 0, 0, time.UTC)
+	case monthInterval:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	}
+}
+
+func nextPeriod(t time.Time, interval string) time.Time {
+	switch interval {
+	case weekInterval:
+		return t.AddDate(0, 0, 7)
+	case monthInterval:
+		return t.AddDate(0, 1, 0)
+	default:
+		return t.AddDate(0, 0, 1)
+	}
+}
+
+// fillPeriods adds empty rows for the periods without sales, so every
+// currency has a row for every period between from and to, and sorts the
+// rows by period and currency.
+func fillPeriods(rows []*salesRow, interval string, from, to *time.Time) []*salesRow {
+	if interval != "" {
+		periods := map[string]map[string]bool{}
+		var first, last time.Time
+		for _, row := range rows {
+			if periods[row.Currency] == nil {
+				periods[row.Currency] = map[string]bool{}
+			}
+			periods[row.Currency][row.Period] = true
+			t, err := time.Parse(periodFormat, row.Period)
+			if err != nil {
+				continue
+			}
+			if first.IsZero() || t.Before(first) {
+				first = t
+			}
+			if t.After(last) {
+				last = t
+			}
+		}
+		if from != nil {
+			first = periodStart(*from, interval)
+		}
+		if to != nil {
+			last = periodStart(*to, interval)
+		}
+
+		for currency, seen := range periods {
+			for t := first; !t.After(last); t = nextPeriod(t, interval) {
+				if period := t.Format(periodFormat); !seen[period] {
+					rows = append(rows, &salesRow{Currency: currency, Period: period})
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		if rows[i].Period != rows[j].Period {
+			return rows[i].Period < rows[j].Period
+		}
+		return rows[i].Currency < rows[j].Currency
+	})
+	return rows
+}
+
+type customerPeriodRow struct {
+	Period             string `json:"period,omitempty"`
+	Currency           string `json:"currency"`
+	NewCustomers       uint64 `json:"new_customers"`
+	ReturningCustomers uint64 `json:"returning_customers"`
+	Orders             uint64 `json:"orders"`
+	Revenue            uint64 `json:"revenue"`
+	AverageOrderValue  uint64 `json:"average_order_value"`
+}
+
+// lifetimeValueRow describes the distribution of the revenue per customer.
+type lifetimeValueRow struct {
+	Currency  string `json:"currency"`
+	Customers uint64 `json:"customers"`
+	Average   uint64 `json:"average"`
+	P25       uint64 `json:"p25"`
+	Median    uint64 `json:"median"`
+	P75       uint64 `json:"p75"`
+	P90       uint64 `json:"p90"`
+	Max       uint64 `json:"max"`
+}
+
+// cohortRow lists how many customers acquired in a month ordered again in
+// the following months. Retention[0] is the size of the cohort.
+type cohortRow struct {
+	Cohort    string   `json:"cohort"`
+	Customers uint64   `json:"customers"`
+	Retention []uint64 `json:"retention"`
+}
+
+type customersReport struct {
+	Periods       []*customerPeriodRow `json:"periods"`
+	LifetimeValue []*lifetimeValueRow  `json:"lifetime_value"`
+	Cohorts       []*cohortRow         `json:"cohorts"`
+}
+
+type customerStats struct {
+	firstMonth  string
+	firstPeriod string
+	// earlier is set for customers who ordered before the report's period
+	earlier bool
+	revenue map[string]uint64
+	months  map[string]bool
+}
+
+// customerOrders sums up the orders of a customer in one currency and month,
+// and in one period if the report has an interval.
+type customerOrders struct {
+	key      string
+	currency string
+	month    string
+	period   string
+	inRange  bool
+	orders   uint64
+	revenue  uint64
+}
+
+// CustomersReport lists new and returning customers with their average order
+// value for a period, optionally split by `interval=day|week|month`, the
+// distribution of the lifetime value of the customers and their monthly
+// acquisition cohorts. Orders of registered users are attributed to the user,
+// other orders to their email address.
+func (a *API) CustomersReport(w http.ResponseWriter, r *http.Request) error {
+	db := a.DB(r)
+	instanceID := gcontext.GetInstanceID(r.Context())
+	params := r.URL.Query()
+
+	interval := params.Get("interval")
+	period, err := periodExpression(db, interval, "created_at")
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	from, to, err := getTimeQueryParams(params)
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	format, err := exportFormat(r)
+	if err != nil {
+		return badRequestError(err.Error())
 	}
 
+	// orders before the period are needed to tell new from returning
+	// customers, so they are only summed up separately
+	month, _ := periodExpression(db, monthInterval, "created_at")
+	inRange := "1"
+	args := []interface{}{instanceID}
+	if from != nil {
+		inRange = "CASE WHEN created_at >= ? THEN 1 ELSE 0 END"
+		args = append(args, from)
+	}
+	// guest orders of registered users belong to the user
+	ordersTable := db.NewScope(models.Order{}).QuotedTableName()
+	usersTable := db.NewScope(models.User{}).QuotedTableName()
+	customerID := "COALESCE(NULLIF(" + ordersTable + ".user_id, ''), " +
+		"(SELECT min(id) FROM " + usersTable + " WHERE instance_id = ? AND lower(email) = lower(" + ordersTable + ".email)), '')"
+
+	query := db.Model(&models.Order{}).
+		Select(customerID+" as customer_id, lower(email) as customer_email, currency, "+
+			month+" as order_month, "+period+" as order_period, "+inRange+" as in_range, "+
+			"count(*) as orders, sum(total) as revenue", args...).
+		Where("payment_state = 'paid' AND instance_id = ?", instanceID).
+		Group("customer_id, customer_email, currency, order_month, order_period, in_range")
+	if to != nil {
+		query = query.Where("created_at <= ?", to)
+	}
 	rows, err := query.Rows()
 	if err != nil {
 		return internalServerError("Database error").WithInternalError(err)
 	}
 	defer rows.Close()
-	result := []*productsRow{}
+
+	customers := map[string]*customerStats{}
+	groups := []*customerOrders{}
 	for rows.Next() {
-		row := &productsRow{}
-		err = rows.Scan(&row.Sku, &row.Path, &row.Total, &row.Currency)
+		var customerID, email sql.NullString
+		var inRange int
+		group := &customerOrders{}
+		if err := rows.Scan(&customerID, &email, &group.currency, &group.month, &group.period, &inRange, &group.orders, &group.revenue); err != nil {
+			return internalServerError("Database error").WithInternalError(err)
+		}
+		group.inRange = inRange == 1
+		group.key = customerID.String
+		if group.key == "" {
+			group.key = "email:" + email.String
+		}
+		groups = append(groups, group)
+
+		customer, ok := customers[group.key]
+		if !ok {
+			customer = &customerStats{firstMonth: group.month, firstPeriod: group.period, revenue: map[string]uint64{}, months: map[string]bool{}}
+			customers[group.key] = customer
+		}
+		if group.month < customer.firstMonth {
+			customer.firstMonth = group.month
+		}
+		if group.period < customer.firstPeriod {
+			customer.firstPeriod = group.period
+		}
+		customer.revenue[group.currency] += group.revenue
+		if group.inRange {
+			customer.months[group.month] = true
+		} else {
+			customer.earlier = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return internalServerError("Database error").WithInternalError(err)
+	}
+
+	report := &customersReport{}
+	periods := map[string]*customerPeriodRow{}
+	seenInPeriod := map[string]bool{}
+	for _, group := range groups {
+		if !group.inRange {
+			continue
+		}
+		row, ok := periods[group.period+"|"+group.currency]
+		if !ok {
+			row = &customerPeriodRow{Period: group.period, Currency: group.currency}
+			periods[group.period+"|"+group.currency] = row
+			report.Periods = append(report.Periods, row)
+		}
+		row.Orders += group.orders
+		row.Revenue += group.revenue
+
+		if seenInPeriod[group.period+"|"+group.currency+"|"+group.key] {
+			continue
+		}
+		seenInPeriod[group.period+"|"+group.currency+"|"+group.key] = true
+		customer := customers[group.key]
+		if (interval != "" && group.period == customer.firstPeriod) || (interval == "" && !customer.earlier) {
+			row.NewCustomers++
+		} else {
+			row.ReturningCustomers++
+		}
+	}
+
+	for _, row := range report.Periods {
+		if row.Orders > 0 {
+			row.AverageOrderValue = row.Revenue / row.Orders
+		}
+	}
+	sort.SliceStable(report.Periods, func(i, j int) bool {
+		if report.Periods[i].Period != report.Periods[j].Period {
+			return report.Periods[i].Period < report.Periods[j].Period
+		}
+		return report.Periods[i].Currency < report.Periods[j].Currency
+	})
+
+	report.LifetimeValue = lifetimeValues(customers)
+	report.Cohorts = customerCohorts(customers)
+
+	if format != "" {
+		return exportCustomersReport(w, format, params.Get("table"), report)
+	}
+	return sendJSON(w, http.StatusOK, report)
+}
+
+func lifetimeValues(customers map[string]*customerStats) []*lifetimeValueRow {
+	values := map[string][]uint64{}
+	for _, customer := range customers {
+		for currency, revenue := range customer.revenue {
+			values[currency] = append(values[currency], revenue)
+		}
+	}
+
+	result := []*lifetimeValueRow{}
+	for currency, revenues := range values {
+		sort.Slice(revenues, func(i, j int) bool { return revenues[i] < revenues[j] })
+		var sum uint64
+		for _, revenue := range revenues {
+			sum += revenue
+		}
+		percentile := func(p int) uint64 {
+			return revenues[(len(revenues)-1)*p/100]
+		}
+		result = append(result, &lifetimeValueRow{
+			Currency:  currency,
+			Customers: uint64(len(revenues)),
+			Average:   sum / uint64(len(revenues)),
+			P25:       percentile(25),
+			Median:    percentile(50),
+			P75:       percentile(75),
+			P90:       percentile(90),
+			Max:       revenues[len(revenues)-1],
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Currency < result[j].Currency })
+	return result
+}
+
+// customerCohorts groups the customers acquired within the period by the month
+// of their first order.
+func customerCohorts(customers map[string]*customerStats) []*cohortRow {
+	cohorts := map[string]*cohortRow{}
+	for _, customer := range customers {
+		if customer.earlier {
+			continue
+		}
+		start, err := time.Parse(periodFormat, customer.firstMonth)
 		if err != nil {
+			continue
+		}
+		cohort, ok := cohorts[start.Format("2006-01")]
+		if !ok {
+			cohort = &cohortRow{Cohort: start.Format("2006-01")}
+			cohorts[cohort.Cohort] = cohort
+		}
+		cohort.Customers++
+
+		for month := range customer.months {
+			t, err := time.Parse(periodFormat, month)
+			if err != nil {
+				continue
+			}
+			offset := (t.Year()-start.Year())*12 + int(t.Month()-start.Month())
+			for len(cohort.Retention) <= offset {
+				cohort.Retention = append(cohort.Retention, 0)
+			}
+			cohort.Retention[offset]++
+		}
+	}
+
+	result := make([]*cohortRow, 0, len(cohorts))
+	for _, cohort := range cohorts {
+		result = append(result, cohort)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Cohort < result[j].Cohort })
+	return result
+}
+
+// exportCustomersReport writes one of the tables of the report, selected with
+// `table=periods|lifetime_value|cohorts`.
+func exportCustomersReport(w http.ResponseWriter, format, name string, report *customersReport) error {
+	var header []string
+	var rows [][]interface{}
+	switch name {
+	case "", "periods":
+		header = []string{"period", "currency", "new_customers", "returning_customers", "orders", "revenue", "average_order_value"}
+		for _, row := range report.Periods {
+			rows = append(rows, []interface{}{row.Period, row.Currency, row.NewCustomers, row.ReturningCustomers, row.Orders, row.Revenue, row.AverageOrderValue})
+		}
+	case "lifetime_value":
+		header = []string{"currency", "customers", "average", "p25", "median", "p75", "p90", "max"}
+		for _, row := range report.LifetimeValue {
+			rows = append(rows, []interface{}{row.Currency, row.Customers, row.Average, row.P25, row.Median, row.P75, row.P90, row.Max})
+		}
+	case "cohorts":
+		header = []string{"cohort", "customers"}
+		months := 0
+		for _, row := range report.Cohorts {
+			if len(row.Retention) > months {
+				months = len(row.Retention)
+			}
+		}
+		for i := 0; i < months; i++ {
+			header = append(header, fmt.Sprintf("month_%d", i))
+		}
+		for _, row := range report.Cohorts {
+			values := []interface{}{row.Cohort, row.Customers}
+			for _, retained := range row.Retention {
+				values = append(values, retained)
+			}
+			// months younger cohorts haven't reached yet are left empty
+			for len(values) < len(header) {
+				values = append(values, nil)
+			}
+			rows = append(rows, values)
+		}
+	default:
+		return badRequestError("Bad value for table: %v", name)
+	}
+
+	table, err := newTableWriter(w, format, "customers", header...)
+	if err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+	for _, row := range rows {
+		if err := table.WriteRow(row...); err != nil {
+			return internalServerError("Error writing export").WithInternalError(err)
+		}
+	}
+	if err := table.Close(); err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+	return nil
+}
+
+type couponRow struct {
+	Period          string `json:"period,omitempty"`
+	CouponCode      string `json:"coupon_code"`
+	Currency        string `json:"currency"`
+	Orders          uint64 `json:"orders"`
+	Discount        uint64 `json:"discount"`
+	Revenue         uint64 `json:"revenue"`
+	AverageDiscount uint64 `json:"average_discount"`
+}
+
+// CouponsReport lists the orders, the discount granted and the revenue per
+// coupon code, optionally split by `interval=day|week|month`.
+func (a *API) CouponsReport(w http.ResponseWriter, r *http.Request) error {
+	db := a.DB(r)
+	instanceID := gcontext.GetInstanceID(r.Context())
+	params := r.URL.Query()
+	ordersTable := db.NewScope(models.Order{}).QuotedTableName()
+
+	period, err := periodExpression(db, params.Get("interval"), ordersTable+".created_at")
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	from, to, err := getTimeQueryParams(params)
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	format, err := exportFormat(r)
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+
+	query := db.
+		Model(&models.Order{}).
+		Select(period+" as period, coupon_code, currency, count(*) as orders, sum(discount) as discount, sum(total) as revenue").
+		Where("payment_state = 'paid' AND instance_id = ? AND coupon_code <> ''", instanceID).
+		Group(groupByPeriod(period, "coupon_code", "currency")).
+		Order("period asc, coupon_code asc, currency asc")
+	query = filterTimeRange(query, ordersTable, from, to)
+
+	rows, err := query.Rows()
+	if err != nil {
+		return internalServerError("Database error").WithInternalError(err)
+	}
+	defer rows.Close()
+	result := []*couponRow{}
+	for rows.Next() {
+		row := &couponRow{}
+		if err := rows.Scan(&row.Period, &row.CouponCode, &row.Currency, &row.Orders, &row.Discount, &row.Revenue); err != nil {
 			return internalServerError("Database error").WithInternalError(err)
 		}
+		if row.Orders > 0 {
+			row.AverageDiscount = row.Discount / row.Orders
+		}
 		result = append(result, row)
 	}
 
+	if format != "" {
+		return exportCouponsReport(w, format, result)
+	}
 	return sendJSON(w, http.StatusOK, result)
 }
+
+func exportCouponsReport(w http.ResponseWriter, format string, result []*couponRow) error {
+	table, err := newTableWriter(w, format, "coupons", "period", "coupon_code", "currency", "orders", "discount", "revenue", "average_discount")
+	if err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+	for _, row := range result {
+		if err := table.WriteRow(row.Period, row.CouponCode, row.Currency, row.Orders, row.Discount, row.Revenue, row.AverageDiscount); err != nil {
+			return internalServerError("Error writing export").WithInternalError(err)
+		}
+	}
+	if err := table.Close(); err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+	return nil
+}
+
+// CouponOrders lists the paid orders that used a coupon code within the
+// requested time range.
+func (a *API) CouponOrders(w http.ResponseWriter, r *http.Request) error {
+	db := a.DB(r)
+	instanceID := gcontext.GetInstanceID(r.Context())
+	code := chi.URLParam(r, "coupon_code")
+	ordersTable := db.NewScope(models.Order{}).QuotedTableName()
+
+	from, to, err := getTimeQueryParams(r.URL.Query())
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	format, err := exportFormat(r)
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+
+	query := orderQuery(db).
+		Where(ordersTable+".payment_state = 'paid' AND "+ordersTable+".instance_id = ? AND "+ordersTable+".coupon_code = ?", instanceID, code).
+		Order(ordersTable + ".created_at desc")
+	query = filterTimeRange(query, ordersTable, from, to)
+
+	if format != "" {
+		return exportOrders(w, db, query, format)
+	}
+
+	offset, limit, err := paginate(w, r, query.Model(&models.Order{}))
+	if err != nil {
+		return badRequestError("Bad Pagination Parameters: %v", err)
+	}
+
+	orders := []models.Order{}
+	if err := query.Offset(offset).Limit(limit).Find(&orders).Error; err != nil {
+		return internalServerError("Error during database query").WithInternalError(err)
+	}
+	return sendJSON(w, http.StatusOK, orders)
+}
@@ -1,12 +1,21 @@
 package api
 
 import (
+	"fmt"
 	"net/http"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
 )
 
+func setOrderDate(t *testing.T, test *RouteTest, orderID string, date time.Time) {
+	require.NoError(t, test.DB.Model(&models.Order{}).Where("id = ?", orderID).UpdateColumn("created_at", date).Error)
+}
+
 func TestSalesReport(t *testing.T) {
 	t.Run("AllTime", func(t *testing.T) {
 		test := NewRouteTest(t)
@@ -22,24 +31,356 @@ func TestSalesReport(t *testing.T) {
 		assert.Equal(t, uint64(0), row.Taxes)
 		assert.Equal(t, "USD", row.Currency)
 		assert.Equal(t, uint64(2), row.Orders)
+		assert.Equal(t, int64(79), row.NetTotal)
+	})
+	t.Run("WithCreditNotes", func(t *testing.T) {
+		test := NewRouteTest(t)
+		createTestRefund(t, test, 1)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/sales", nil, token)
+
+		report := []salesRow{}
+		extractPayload(t, http.StatusOK, recorder, &report)
+		assert.Len(t, report, 1)
+		row := report[0]
+		assert.Equal(t, uint64(79), row.Total)
+		assert.Equal(t, uint64(10), row.Refunds)
+		assert.Equal(t, uint64(1), row.CreditNotes)
+		assert.Equal(t, int64(69), row.NetTotal)
+	})
+	t.Run("Intervals", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		monday := time.Date(2026, time.January, 5, 10, 0, 0, 0, time.UTC)
+		setOrderDate(t, test, test.Data.firstOrder.ID, monday)
+		setOrderDate(t, test, test.Data.secondOrder.ID, monday.AddDate(0, 0, 2))
+		period := fmt.Sprintf("from=%d&to=%d", monday.Add(-time.Hour).Unix(), monday.AddDate(0, 0, 2).Add(time.Hour).Unix())
+
+		report := []salesRow{}
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/reports/sales?interval=day&"+period, nil, token), &report)
+		require.Len(t, report, 3)
+		assert.Equal(t, "2026-01-05", report[0].Period)
+		assert.Equal(t, uint64(24), report[0].Total)
+		assert.Equal(t, "2026-01-06", report[1].Period)
+		assert.Equal(t, uint64(0), report[1].Orders)
+		assert.Equal(t, "2026-01-07", report[2].Period)
+		assert.Equal(t, uint64(55), report[2].Total)
+
+		report = []salesRow{}
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/reports/sales?interval=week&"+period, nil, token), &report)
+		require.Len(t, report, 1)
+		assert.Equal(t, "2026-01-05", report[0].Period)
+		assert.Equal(t, uint64(2), report[0].Orders)
+
+		report = []salesRow{}
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/reports/sales?interval=month&"+period, nil, token), &report)
+		require.Len(t, report, 1)
+		assert.Equal(t, "2026-01-01", report[0].Period)
+		assert.Equal(t, uint64(79), report[0].Total)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/sales?interval=year", nil, token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+	t.Run("Compare", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		now := time.Now()
+		setOrderDate(t, test, test.Data.firstOrder.ID, now.Add(-time.Hour))
+		setOrderDate(t, test, test.Data.secondOrder.ID, now.Add(-36*time.Hour))
+		period := fmt.Sprintf("from=%d&to=%d", now.Add(-24*time.Hour).Unix(), now.Unix())
+
+		report := []salesRow{}
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/reports/sales?compare=true&"+period, nil, token), &report)
+		require.Len(t, report, 1)
+		assert.Equal(t, uint64(24), report[0].Total)
+		require.NotNil(t, report[0].Previous)
+		assert.Equal(t, uint64(55), report[0].Previous.Total)
+		assert.Equal(t, uint64(1), report[0].Previous.Orders)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/sales?compare=true", nil, token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+	t.Run("TaxBreakdown", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		item := test.Data.firstLineItem
+		require.NoError(t, test.DB.Delete(models.LineItemTax{}).Error)
+		for _, tax := range []models.LineItemTax{
+			{Rate: 7, NetTotal: 10, Taxes: 1},
+			{Rate: 19, NetTotal: 8, Taxes: 2},
+			{Rate: 0, NetTotal: 6},
+		} {
+			tax.OrderID = item.OrderID
+			tax.LineItemID = item.ID
+			require.NoError(t, test.DB.Create(&tax).Error)
+		}
+		// an address from before countries were stored as codes
+		legacyAddress := &models.Address{ID: "legacy-address", AddressRequest: models.AddressRequest{Name: "Bruce Wayne", Country: "United States"}}
+		require.NoError(t, test.DB.Create(legacyAddress).Error)
+		require.NoError(t, test.DB.Model(test.Data.secondOrder).UpdateColumn("shipping_address_id", legacyAddress.ID).Error)
+
+		report := []salesRow{}
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/reports/sales", nil, token), &report)
+		require.Len(t, report, 1)
+		taxes := map[uint64]*taxRow{}
+		for _, tax := range report[0].TaxBreakdown {
+			assert.Equal(t, "US", tax.Country)
+			taxes[tax.Rate] = tax
+		}
+		assert.Len(t, taxes, 3)
+		require.Contains(t, taxes, uint64(7))
+		assert.Equal(t, uint64(1), taxes[7].Taxes)
+		assert.Equal(t, uint64(10), taxes[7].NetTotal)
+		require.Contains(t, taxes, uint64(19))
+		assert.Equal(t, uint64(2), taxes[19].Taxes)
+		assert.Equal(t, uint64(8), taxes[19].NetTotal)
+		// the other order was priced before taxes were stored by rate
+		require.Contains(t, taxes, uint64(0))
+		assert.Equal(t, uint64(61), taxes[0].NetTotal)
 	})
 }
 
 func TestProductsReport(t *testing.T) {
-	test := NewRouteTest(t)
 	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
-	recorder := test.TestEndpoint(http.MethodGet, "/reports/products", nil, token)
-
-	report := []productsRow{}
-	extractPayload(t, http.StatusOK, recorder, &report)
-	assert.Len(t, report, 3)
-	prod1 := report[0]
-	assert.Equal(t, "234-fancy-belts", prod1.Sku)
-	assert.Equal(t, uint64(45), prod1.Total)
-	prod2 := report[1]
-	assert.Equal(t, "123-i-can-fly-456", prod2.Sku)
-	assert.Equal(t, uint64(24), prod2.Total)
-	prod3 := report[2]
-	assert.Equal(t, "456-i-rollover-all-things", prod3.Sku)
-	assert.Equal(t, uint64(10), prod3.Total)
+
+	t.Run("AllTime", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/products", nil, token)
+
+		report := []productsRow{}
+		extractPayload(t, http.StatusOK, recorder, &report)
+		assert.Len(t, report, 3)
+		prod1 := report[0]
+		assert.Equal(t, "234-fancy-belts", prod1.Sku)
+		assert.Equal(t, uint64(45), prod1.Total)
+		prod2 := report[1]
+		assert.Equal(t, "123-i-can-fly-456", prod2.Sku)
+		assert.Equal(t, uint64(24), prod2.Total)
+		assert.Equal(t, uint64(2), prod2.Units)
+		prod3 := report[2]
+		assert.Equal(t, "456-i-rollover-all-things", prod3.Sku)
+		assert.Equal(t, uint64(10), prod3.Total)
+	})
+
+	t.Run("To", func(t *testing.T) {
+		test := NewRouteTest(t)
+		setOrderDate(t, test, test.Data.secondOrder.ID, time.Now().Add(time.Hour))
+
+		url := fmt.Sprintf("/reports/products?to=%d", time.Now().Add(time.Minute).Unix())
+		report := []productsRow{}
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, url, nil, token), &report)
+		require.Len(t, report, 1)
+		assert.Equal(t, "123-i-can-fly-456", report[0].Sku)
+	})
+
+	t.Run("DiscountsAndTaxes", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(test.Data.firstLineItem).UpdateColumns(map[string]interface{}{
+			"addon_price":           3,
+			"calculation_discount":  5,
+			"calculation_net_total": 10,
+			"calculation_taxes":     2,
+		}).Error)
+
+		report := []productsRow{}
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/reports/products?order_by=units+asc", nil, token), &report)
+		require.Len(t, report, 3)
+		row := report[0]
+		assert.Equal(t, "234-fancy-belts", row.Sku)
+		for _, r := range report {
+			if r.Sku == "123-i-can-fly-456" {
+				row = r
+			}
+		}
+		assert.Equal(t, uint64(2), row.Units)
+		assert.Equal(t, uint64(30), row.Gross)
+		assert.Equal(t, uint64(10), row.Discount)
+		assert.Equal(t, uint64(20), row.Net)
+		assert.Equal(t, uint64(4), row.Taxes)
+		assert.Equal(t, uint64(24), row.Total)
+	})
+
+	t.Run("GroupBy", func(t *testing.T) {
+		test := NewRouteTest(t)
+
+		report := []productsRow{}
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/reports/products?group_by=type&order_by=units", nil, token), &report)
+		require.Len(t, report, 3)
+		assert.Empty(t, report[0].Sku)
+		assert.Equal(t, uint64(2), report[0].Units)
+
+		report = []productsRow{}
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/reports/products?group_by=coupon", nil, token), &report)
+		require.Len(t, report, 2)
+		assert.Equal(t, "", report[0].CouponCode)
+		assert.Equal(t, uint64(55), report[0].Total)
+		assert.Equal(t, "zerodiscount", report[1].CouponCode)
+		assert.Equal(t, uint64(24), report[1].Total)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/products?group_by=color", nil, token)
+		validateError(t, http.StatusBadRequest, recorder)
+		recorder = test.TestEndpoint(http.MethodGet, "/reports/products?order_by=color", nil, token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+
+	t.Run("Refunds", func(t *testing.T) {
+		test := NewRouteTest(t)
+		refund := createTestRefund(t, test, 1)
+		require.NoError(t, test.DB.Create(&models.RefundItem{
+			OrderID:       test.Data.firstOrder.ID,
+			TransactionID: refund.ID,
+			LineItemID:    test.Data.firstLineItem.ID,
+			Sku:           test.Data.firstLineItem.Sku,
+			Quantity:      1,
+			Amount:        10,
+		}).Error)
+
+		report := []productsRow{}
+		extractPayload(t, http.StatusOK, test.TestEndpoint(http.MethodGet, "/reports/products?order_by=refunded_units", nil, token), &report)
+		require.Len(t, report, 3)
+		assert.Equal(t, "123-i-can-fly-456", report[0].Sku)
+		assert.Equal(t, uint64(1), report[0].RefundedUnits)
+		assert.Equal(t, uint64(10), report[0].RefundedAmount)
+	})
+}
+
+func TestCustomersReport(t *testing.T) {
+	setup := func(t *testing.T) *RouteTest {
+		test := NewRouteTest(t)
+		setOrderDate(t, test, test.Data.firstOrder.ID, time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC))
+		setOrderDate(t, test, test.Data.secondOrder.ID, time.Date(2026, 3, 5, 12, 0, 0, 0, time.UTC))
+
+		guest := models.NewOrder("", "session", "BRUCE@wayneindustries.com", "USD")
+		guest.PaymentState = models.PaidState
+		guest.Total = 10
+		require.NoError(t, test.DB.Create(guest).Error)
+		setOrderDate(t, test, guest.ID, time.Date(2026, 3, 20, 12, 0, 0, 0, time.UTC))
+
+		stranger := models.NewOrder("", "session", "joker@example.com", "USD")
+		stranger.PaymentState = models.PaidState
+		stranger.Total = 30
+		require.NoError(t, test.DB.Create(stranger).Error)
+		setOrderDate(t, test, stranger.ID, time.Date(2026, 3, 6, 12, 0, 0, 0, time.UTC))
+		return test
+	}
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	t.Run("Monthly", func(t *testing.T) {
+		test := setup(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/customers?interval=month", nil, token)
+
+		report := customersReport{}
+		extractPayload(t, http.StatusOK, recorder, &report)
+		require.Len(t, report.Periods, 2)
+		assert.Equal(t, customerPeriodRow{Period: "2026-01-01", Currency: "USD", NewCustomers: 1, Orders: 1, Revenue: 24, AverageOrderValue: 24}, *report.Periods[0])
+		assert.Equal(t, customerPeriodRow{Period: "2026-03-01", Currency: "USD", NewCustomers: 1, ReturningCustomers: 1, Orders: 3, Revenue: 95, AverageOrderValue: 31}, *report.Periods[1])
+
+		require.Len(t, report.LifetimeValue, 1)
+		ltv := report.LifetimeValue[0]
+		assert.Equal(t, uint64(2), ltv.Customers)
+		assert.Equal(t, uint64(59), ltv.Average)
+		assert.Equal(t, uint64(30), ltv.Median)
+		assert.Equal(t, uint64(89), ltv.Max)
+
+		require.Len(t, report.Cohorts, 2)
+		assert.Equal(t, cohortRow{Cohort: "2026-01", Customers: 1, Retention: []uint64{1, 0, 1}}, *report.Cohorts[0])
+		assert.Equal(t, cohortRow{Cohort: "2026-03", Customers: 1, Retention: []uint64{1}}, *report.Cohorts[1])
+	})
+	t.Run("Range", func(t *testing.T) {
+		test := setup(t)
+		from := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC).Unix()
+		recorder := test.TestEndpoint(http.MethodGet, fmt.Sprintf("/reports/customers?from=%d", from), nil, token)
+
+		report := customersReport{}
+		extractPayload(t, http.StatusOK, recorder, &report)
+		require.Len(t, report.Periods, 1)
+		assert.Equal(t, uint64(1), report.Periods[0].NewCustomers)
+		assert.Equal(t, uint64(1), report.Periods[0].ReturningCustomers)
+		require.Len(t, report.Cohorts, 1)
+		assert.Equal(t, "2026-03", report.Cohorts[0].Cohort)
+	})
+	t.Run("UntilEnd", func(t *testing.T) {
+		test := setup(t)
+		to := time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC).Unix()
+		recorder := test.TestEndpoint(http.MethodGet, fmt.Sprintf("/reports/customers?interval=month&to=%d", to), nil, token)
+
+		report := customersReport{}
+		extractPayload(t, http.StatusOK, recorder, &report)
+		require.Len(t, report.Periods, 2)
+		assert.Equal(t, customerPeriodRow{Period: "2026-03-01", Currency: "USD", NewCustomers: 1, ReturningCustomers: 1, Orders: 2, Revenue: 85, AverageOrderValue: 42}, *report.Periods[1])
+
+		require.Len(t, report.LifetimeValue, 1)
+		assert.Equal(t, uint64(79), report.LifetimeValue[0].Max)
+	})
+	t.Run("ExportCohorts", func(t *testing.T) {
+		test := setup(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/customers?format=csv&table=cohorts", nil, token)
+		require.Equal(t, http.StatusOK, recorder.Code)
+		assert.Equal(t, "cohort,customers,month_0,month_1,month_2\n2026-01,1,1,0,1\n2026-03,1,1,,\n", recorder.Body.String())
+	})
+	t.Run("BadTable", func(t *testing.T) {
+		test := setup(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/customers?format=csv&table=nope", nil, token)
+		validateError(t, http.StatusBadRequest, recorder)
+	})
+}
+
+func TestCouponsReport(t *testing.T) {
+	setup := func(t *testing.T) *RouteTest {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(test.Data.secondOrder).UpdateColumns(map[string]interface{}{"coupon_code": "summer", "discount": 5}).Error)
+		require.NoError(t, test.DB.Model(test.Data.firstOrder).UpdateColumn("discount", 3).Error)
+		setOrderDate(t, test, test.Data.firstOrder.ID, time.Date(2026, 1, 10, 12, 0, 0, 0, time.UTC))
+		setOrderDate(t, test, test.Data.secondOrder.ID, time.Date(2026, 2, 10, 12, 0, 0, 0, time.UTC))
+		return test
+	}
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+	t.Run("AllTime", func(t *testing.T) {
+		test := setup(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/coupons", nil, token)
+
+		report := []couponRow{}
+		extractPayload(t, http.StatusOK, recorder, &report)
+		require.Len(t, report, 2)
+		assert.Equal(t, couponRow{CouponCode: "summer", Currency: "USD", Orders: 1, Discount: 5, Revenue: 55, AverageDiscount: 5}, report[0])
+		assert.Equal(t, couponRow{CouponCode: "zerodiscount", Currency: "USD", Orders: 1, Discount: 3, Revenue: 24, AverageDiscount: 3}, report[1])
+	})
+	t.Run("Monthly", func(t *testing.T) {
+		test := setup(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/coupons?interval=month", nil, token)
+
+		report := []couponRow{}
+		extractPayload(t, http.StatusOK, recorder, &report)
+		require.Len(t, report, 2)
+		assert.Equal(t, "2026-01-01", report[0].Period)
+		assert.Equal(t, "zerodiscount", report[0].CouponCode)
+		assert.Equal(t, "2026-02-01", report[1].Period)
+		assert.Equal(t, "summer", report[1].CouponCode)
+	})
+	t.Run("Orders", func(t *testing.T) {
+		test := setup(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/coupons/summer", nil, token)
+
+		orders := []models.Order{}
+		extractPayload(t, http.StatusOK, recorder, &orders)
+		require.Len(t, orders, 1)
+		assert.Equal(t, test.Data.secondOrder.ID, orders[0].ID)
+		assert.Len(t, orders[0].LineItems, 2)
+		assert.Equal(t, "1", recorder.Header().Get("X-Total-Count"))
+	})
+	t.Run("OrdersOutOfRange", func(t *testing.T) {
+		test := setup(t)
+		from := time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC).Unix()
+		recorder := test.TestEndpoint(http.MethodGet, fmt.Sprintf("/reports/coupons/zerodiscount?from=%d", from), nil, token)
+
+		orders := []models.Order{}
+		extractPayload(t, http.StatusOK, recorder, &orders)
+		assert.Len(t, orders, 0)
+	})
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := setup(t)
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/coupons", nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
 }
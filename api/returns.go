@@ -0,0 +1,469 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+type returnItemParams struct {
+	LineItemID int64  `json:"line_item_id"`
+	Quantity   uint64 `json:"quantity"`
+}
+
+type returnParams struct {
+	Reason string             `json:"reason"`
+	Items  []returnItemParams `json:"items"`
+}
+
+type returnRejectParams struct {
+	Reason string `json:"reason"`
+}
+
+type returnRefundParams struct {
+	Amount uint64 `json:"amount"`
+}
+
+func (a *API) returnRoutes(r *router) {
+	r.Get("/", a.ReturnListForOrder)
+	r.With(addGetBody).Post("/", a.ReturnCreate)
+
+	r.Route("/{return_id}", func(r *router) {
+		r.Use(adminRequired)
+		r.Post("/approve", a.ReturnApprove)
+		r.With(addGetBody).Post("/reject", a.ReturnReject)
+		r.Post("/receive", a.ReturnReceive)
+		r.With(addGetBody).Post("/refund", a.ReturnRefund)
+	})
+}
+
+// ReturnList lists the returns of all orders, optionally filtered by state.
+// Requires admin permissions.
+func (a *API) ReturnList(w http.ResponseWriter, r *http.Request) error {
+	query := a.DB(r).Where("instance_id = ?", gcontext.GetInstanceID(r.Context()))
+	if state := r.URL.Query().Get("state"); state != "" {
+		if !containsString(models.ReturnStates, state) {
+			return badRequestError("Bad value for state: %v", state)
+		}
+		query = query.Where("state = ?", state)
+	}
+
+	format, err := exportFormat(r)
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	if format != "" {
+		return exportReturns(w, a.DB(r), query.Order("created_at desc"), format)
+	}
+
+	offset, limit, err := paginate(w, r, query.Model(&models.Return{}))
+	if err != nil {
+		return badRequestError("Bad Pagination Parameters: %v", err)
+	}
+
+	returns := []*models.Return{}
+	if result := query.Preload("Items").Order("created_at desc").Offset(offset).Limit(limit).Find(&returns); result.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	return sendJSON(w, http.StatusOK, returns)
+}
+
+var returnExportHeader = []string{
+	"return_id", "order_id", "user_id", "state", "reason", "rejection_reason", "transaction_id",
+	"received_at", "created_at", "line_item_id", "sku", "quantity",
+}
+
+// exportReturns streams the returns matching the query with one row per
+// returned item. Returns are read from a cursor and their items are loaded
+// for a batch of returns at a time.
+func exportReturns(w http.ResponseWriter, db *gorm.DB, query *gorm.DB, format string) error {
+	rows, err := query.Model(&models.Return{}).Rows()
+	if err != nil {
+		return internalServerError("Error during database query").WithInternalError(err)
+	}
+	defer rows.Close()
+
+	table, err := newTableWriter(w, format, "returns", returnExportHeader...)
+	if err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+
+	batch := make([]*models.Return, 0, exportBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		returnIDs := make([]string, len(batch))
+		for i, ret := range batch {
+			returnIDs[i] = ret.ID
+		}
+		items := []*models.ReturnItem{}
+		if err := db.Where("return_id IN (?)", returnIDs).Order("id asc").Find(&items).Error; err != nil {
+			return err
+		}
+		itemsByReturn := map[string][]*models.ReturnItem{}
+		for _, item := range items {
+			itemsByReturn[item.ReturnID] = append(itemsByReturn[item.ReturnID], item)
+		}
+
+		for _, ret := range batch {
+			returnValues := []interface{}{
+				ret.ID, ret.OrderID, ret.UserID, ret.State, ret.Reason, ret.RejectionReason, ret.TransactionID,
+				ret.ReceivedAt, ret.CreatedAt,
+			}
+			returnItems := itemsByReturn[ret.ID]
+			if len(returnItems) == 0 {
+				if err := table.WriteRow(returnValues...); err != nil {
+					return err
+				}
+				continue
+			}
+			for _, item := range returnItems {
+				values := append(returnValues[:len(returnValues):len(returnValues)], item.LineItemID, item.Sku, item.Quantity)
+				if err := table.WriteRow(values...); err != nil {
+					return err
+				}
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	for rows.Next() {
+		ret := &models.Return{}
+		if err := db.ScanRows(rows, ret); err != nil {
+			return internalServerError("Error during database query").WithInternalError(err)
+		}
+		batch = append(batch, ret)
+		if len(batch) == exportBatchSize {
+			if err := flush(); err != nil {
+				return internalServerError("Error writing export").WithInternalError(err)
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+	if err := table.Close(); err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+	return nil
+}
+
+// ReturnListForOrder lists the returns of an order.
+func (a *API) ReturnListForOrder(w http.ResponseWriter, r *http.Request) error {
+	order, httpErr := a.returnOrder(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if !hasOrderAccess(r.Context(), order) {
+		return unauthorizedError("You don't have access to this order")
+	}
+
+	returns := []*models.Return{}
+	if result := a.DB(r).Preload("Items").Where("order_id = ?", order.ID).Order("created_at asc").Find(&returns); result.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	return sendJSON(w, http.StatusOK, returns)
+}
+
+// ReturnCreate requests the return of line items of a paid order.
+func (a *API) ReturnCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := gcontext.GetConfig(ctx)
+
+	order, httpErr := a.returnOrder(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if !hasOrderAccess(ctx, order) {
+		return unauthorizedError("You don't have access to this order")
+	}
+
+	params := &returnParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read return params: %v", err)
+	}
+	params.Reason = strings.TrimSpace(params.Reason)
+	if params.Reason == "" {
+		return badRequestError("A return must have a reason")
+	}
+	if len(params.Items) == 0 {
+		return badRequestError("A return must have line items")
+	}
+	if order.PaymentState != models.PaidState {
+		return badRequestError("Only paid orders can be returned")
+	}
+
+	userID := ""
+	if claims := gcontext.GetClaims(ctx); claims != nil {
+		userID = claims.Subject
+	}
+
+	tx := a.DB(r).Begin()
+	ret := models.NewReturn(order, userID, params.Reason)
+	items, httpErr := returnItems(tx, order, params.Items)
+	if httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	ret.Items = items
+
+	if result := tx.Create(ret); result.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error creating return").WithInternalError(result.Error)
+	}
+	models.LogEvent(tx, r.RemoteAddr, userID, order.ID, models.EventCreated, []string{"return", ret.ID, ret.State})
+	if err := queueReturnHook(tx, config, order, ret); err != nil {
+		tx.Rollback()
+		return internalServerError("Failed to process webhook").WithInternalError(err)
+	}
+	if result := tx.Commit(); result.Error != nil {
+		return internalServerError("Error creating return").WithInternalError(result.Error)
+	}
+
+	return sendJSON(w, http.StatusCreated, ret)
+}
+
+// ReturnApprove accepts a requested return.
+func (a *API) ReturnApprove(w http.ResponseWriter, r *http.Request) error {
+	order, ret, httpErr := a.loadReturn(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if httpErr := a.transitionReturn(r, order, ret, models.ReturnApproved); httpErr != nil {
+		return httpErr
+	}
+	return sendJSON(w, http.StatusOK, ret)
+}
+
+// ReturnReject declines a requested return.
+func (a *API) ReturnReject(w http.ResponseWriter, r *http.Request) error {
+	params := &returnRejectParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read return params: %v", err)
+	}
+
+	order, ret, httpErr := a.loadReturn(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	ret.RejectionReason = strings.TrimSpace(params.Reason)
+	if httpErr := a.transitionReturn(r, order, ret, models.ReturnRejected); httpErr != nil {
+		return httpErr
+	}
+	return sendJSON(w, http.StatusOK, ret)
+}
+
+// ReturnReceive records that the items of an approved return arrived.
+func (a *API) ReturnReceive(w http.ResponseWriter, r *http.Request) error {
+	order, ret, httpErr := a.loadReturn(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if httpErr := a.transitionReturn(r, order, ret, models.ReturnReceived); httpErr != nil {
+		return httpErr
+	}
+	return sendJSON(w, http.StatusOK, ret)
+}
+
+// ReturnRefund refunds the items of a received return on the charge of the
+// order. The amount defaults to the price paid for the items.
+func (a *API) ReturnRefund(w http.ResponseWriter, r *http.Request) error {
+	db := a.DB(r)
+	params := &returnRefundParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read refund params: %v", err)
+	}
+
+	order, ret, httpErr := a.loadReturn(r)
+	if httpErr != nil {
+		return httpErr
+	}
+	if ret.State != models.ReturnReceived {
+		return badRequestError("Only received returns can be refunded")
+	}
+
+	charge, httpErr := paidCharge(db, order.ID)
+	if httpErr != nil {
+		return httpErr
+	}
+
+	refund := refundParams{PaymentParams: PaymentParams{Amount: params.Amount, Currency: charge.Currency}}
+	for _, item := range ret.Items {
+		refund.Items = append(refund.Items, refundItemParams{LineItemID: item.LineItemID, Quantity: item.Quantity})
+	}
+	if refund.Amount == 0 {
+		items, httpErr := refundItemsForOrder(db, order, refund.Items)
+		if httpErr != nil {
+			return httpErr
+		}
+		for _, item := range items {
+			refund.Amount += item.Amount
+		}
+	}
+
+	// claim the return, so it's only refunded once
+	claimed, err := ret.Claim(db, models.ReturnRefunding)
+	if err != nil {
+		return internalServerError("Error saving return").WithInternalError(err)
+	}
+	if !claimed {
+		return badRequestError("The return is already being refunded")
+	}
+
+	m, httpErr := a.refundTransaction(r, db, charge, refund)
+	if httpErr == nil && m.Status != models.PaidState {
+		httpErr = internalServerError("Refund failed: %s", m.FailureDescription)
+	}
+	if httpErr != nil {
+		if err := ret.ReleaseClaim(db, models.ReturnReceived); err != nil {
+			getLogEntry(r).WithError(err).WithField("return_id", ret.ID).Error("Failed to release the return after a failed refund")
+		}
+		return httpErr
+	}
+
+	ret.TransactionID = m.ID
+	if httpErr := a.transitionReturn(r, order, ret, models.ReturnRefunded); httpErr != nil {
+		return httpErr
+	}
+	return sendJSON(w, http.StatusOK, ret)
+}
+
+// transitionReturn moves a return to a new state, recording the step as an
+// event and a webhook.
+func (a *API) transitionReturn(r *http.Request, order *models.Order, ret *models.Return, to string) *HTTPError {
+	ctx := r.Context()
+	config := gcontext.GetConfig(ctx)
+	claims := gcontext.GetClaims(ctx)
+
+	if err := ret.Transition(to); err != nil {
+		return badRequestError(err.Error())
+	}
+
+	tx := a.DB(r).Begin()
+	if result := tx.Save(ret); result.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving return").WithInternalError(result.Error)
+	}
+	models.LogEvent(tx, r.RemoteAddr, claims.Subject, order.ID, models.EventUpdated, []string{"return", ret.ID, ret.State})
+	if err := queueReturnHook(tx, config, order, ret); err != nil {
+		tx.Rollback()
+		return internalServerError("Failed to process webhook").WithInternalError(err)
+	}
+	if result := tx.Commit(); result.Error != nil {
+		return internalServerError("Error saving return").WithInternalError(result.Error)
+	}
+	return nil
+}
+
+func (a *API) returnOrder(r *http.Request) (*models.Order, *HTTPError) {
+	ctx := r.Context()
+	order := &models.Order{}
+	result := a.DB(r).Preload("LineItems").Where("instance_id = ?", gcontext.GetInstanceID(ctx)).First(order, "id = ?", gcontext.GetOrderID(ctx))
+	if result.Error != nil {
+		if result.RecordNotFound() {
+			return nil, notFoundError("Order not found")
+		}
+		return nil, internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	return order, nil
+}
+
+func (a *API) loadReturn(r *http.Request) (*models.Order, *models.Return, *HTTPError) {
+	order, httpErr := a.returnOrder(r)
+	if httpErr != nil {
+		return nil, nil, httpErr
+	}
+
+	ret := &models.Return{}
+	result := a.DB(r).Preload("Items").Where("order_id = ?", order.ID).First(ret, "id = ?", chi.URLParam(r, "return_id"))
+	if result.Error != nil {
+		if result.RecordNotFound() {
+			return nil, nil, notFoundError("Return not found")
+		}
+		return nil, nil, internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	return order, ret, nil
+}
+
+// returnItems checks that the requested quantities haven't been returned or
+// refunded already.
+func returnItems(db *gorm.DB, order *models.Order, params []returnItemParams) ([]*models.ReturnItem, *HTTPError) {
+	returned, err := models.ReturnedQuantities(db, order.ID)
+	if err != nil {
+		return nil, internalServerError("Error while querying for returns").WithInternalError(err)
+	}
+	refunded, err := models.RefundedQuantities(db, order.ID)
+	if err != nil {
+		return nil, internalServerError("Error while querying for refunds").WithInternalError(err)
+	}
+
+	// items refunded for a return are already counted as returned
+	refundedReturns := []*models.Return{}
+	if rsp := db.Preload("Items").Where("order_id = ? AND state = ?", order.ID, models.ReturnRefunded).Find(&refundedReturns); rsp.Error != nil {
+		return nil, internalServerError("Error while querying for returns").WithInternalError(rsp.Error)
+	}
+	for _, ret := range refundedReturns {
+		for _, item := range ret.Items {
+			if refunded[item.LineItemID] >= item.Quantity {
+				refunded[item.LineItemID] -= item.Quantity
+			}
+		}
+	}
+
+	lineItems := map[int64]*models.LineItem{}
+	for _, item := range order.LineItems {
+		lineItems[item.ID] = item
+	}
+
+	items := []*models.ReturnItem{}
+	for _, param := range params {
+		item, ok := lineItems[param.LineItemID]
+		if !ok {
+			return nil, badRequestError("Line item %d does not belong to the order", param.LineItemID)
+		}
+		if param.Quantity == 0 {
+			return nil, badRequestError("Quantity of line item %d must be positive", param.LineItemID)
+		}
+		unavailable := returned[item.ID] + refunded[item.ID]
+		if unavailable+param.Quantity > item.Quantity {
+			return nil, badRequestError("Only %d of line item %d can be returned", item.Quantity-unavailable, item.ID)
+		}
+		returned[item.ID] += param.Quantity
+
+		items = append(items, &models.ReturnItem{
+			OrderID:    order.ID,
+			LineItemID: item.ID,
+			Sku:        item.Sku,
+			Quantity:   param.Quantity,
+		})
+	}
+	return items, nil
+}
+
+func queueReturnHook(tx *gorm.DB, config *conf.Configuration, order *models.Order, ret *models.Return) error {
+	if config.Webhooks.Return == "" {
+		return nil
+	}
+	hook, err := models.NewHook("return", config.SiteURL, config.Webhooks.Return, order.UserID, order.ID, config.Webhooks.Secret, ret)
+	if err != nil {
+		return err
+	}
+	return tx.Save(hook).Error
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
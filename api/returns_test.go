@@ -0,0 +1,151 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func requestReturn(t *testing.T, test *RouteTest, body string, code int) *models.Return {
+	url := "/orders/" + test.Data.firstOrder.ID + "/returns"
+	recorder := test.TestEndpoint(http.MethodPost, url, strings.NewReader(body), test.Data.testUserToken)
+	if code != http.StatusCreated {
+		validateError(t, code, recorder)
+		return nil
+	}
+	ret := &models.Return{}
+	extractPayload(t, http.StatusCreated, recorder, ret)
+	return ret
+}
+
+func returnStep(t *testing.T, test *RouteTest, ret *models.Return, step string, code int) *models.Return {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	url := "/orders/" + test.Data.firstOrder.ID + "/returns/" + ret.ID + "/" + step
+	recorder := test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{}`), token)
+	if code != http.StatusOK {
+		validateError(t, code, recorder)
+		return nil
+	}
+	updated := &models.Return{}
+	extractPayload(t, http.StatusOK, recorder, updated)
+	return updated
+}
+
+func TestReturns(t *testing.T) {
+	t.Run("Workflow", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Webhooks.Return = "https://example.com/hooks/return"
+
+		ret := requestReturn(t, test, `{"reason": "Cape too short", "items": [{"line_item_id": 11, "quantity": 1}]}`, http.StatusCreated)
+		assert.Equal(t, models.ReturnRequested, ret.State)
+		assert.Equal(t, test.Data.testUser.ID, ret.UserID)
+		require.Len(t, ret.Items, 1)
+		assert.Equal(t, test.Data.firstLineItem.Sku, ret.Items[0].Sku)
+
+		ret = returnStep(t, test, ret, "approve", http.StatusOK)
+		assert.Equal(t, models.ReturnApproved, ret.State)
+		returnStep(t, test, ret, "refund", http.StatusBadRequest)
+
+		ret = returnStep(t, test, ret, "receive", http.StatusOK)
+		assert.Equal(t, models.ReturnReceived, ret.State)
+		assert.NotNil(t, ret.ReceivedAt)
+
+		url := "/orders/" + test.Data.firstOrder.ID + "/returns/" + ret.ID + "/refund"
+		refunded := &models.Return{}
+		extractPayload(t, http.StatusOK, runMemProviderRefund(t, test, url, map[string]interface{}{}), refunded)
+		assert.Equal(t, models.ReturnRefunded, refunded.State)
+		require.NotEmpty(t, refunded.TransactionID)
+
+		refund := &models.Transaction{}
+		require.NoError(t, test.DB.Preload("RefundItems").First(refund, "id = ?", refunded.TransactionID).Error)
+		assert.EqualValues(t, 12, refund.Amount)
+		require.Len(t, refund.RefundItems, 1)
+		assert.EqualValues(t, 1, refund.RefundItems[0].Quantity)
+
+		events := []models.Event{}
+		require.NoError(t, test.DB.Where("order_id = ? AND changes LIKE ?", test.Data.firstOrder.ID, "return,"+ret.ID+",%").Find(&events).Error)
+		assert.Len(t, events, 4)
+		hooks := []models.Hook{}
+		require.NoError(t, test.DB.Where("order_id = ? AND type = ?", test.Data.firstOrder.ID, "return").Find(&hooks).Error)
+		assert.Len(t, hooks, 4)
+
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		recorder := test.TestEndpoint(http.MethodGet, "/reports/products", nil, token)
+		report := []productsRow{}
+		extractPayload(t, http.StatusOK, recorder, &report)
+		for _, row := range report {
+			if row.Sku == test.Data.firstLineItem.Sku {
+				assert.EqualValues(t, 1, row.ReturnedUnits)
+				assert.EqualValues(t, 1, row.RefundedUnits)
+			}
+		}
+	})
+	t.Run("RefundOnce", func(t *testing.T) {
+		test := NewRouteTest(t)
+		ret := requestReturn(t, test, `{"reason": "Cape too short", "items": [{"line_item_id": 11, "quantity": 1}]}`, http.StatusCreated)
+		returnStep(t, test, ret, "approve", http.StatusOK)
+		ret = returnStep(t, test, ret, "receive", http.StatusOK)
+
+		// another request claimed the return for its refund
+		require.NoError(t, test.DB.Model(ret).UpdateColumn("state", models.ReturnRefunding).Error)
+		url := "/orders/" + test.Data.firstOrder.ID + "/returns/" + ret.ID + "/refund"
+		validateError(t, http.StatusBadRequest, runMemProviderRefund(t, test, url, map[string]interface{}{}))
+
+		refunds := 0
+		require.NoError(t, test.DB.Model(&models.Transaction{}).Where("order_id = ? AND type = ?", test.Data.firstOrder.ID, models.RefundTransactionType).Count(&refunds).Error)
+		assert.Equal(t, 0, refunds)
+	})
+	t.Run("Reject", func(t *testing.T) {
+		test := NewRouteTest(t)
+		ret := requestReturn(t, test, `{"reason": "Changed my mind", "items": [{"line_item_id": 11, "quantity": 2}]}`, http.StatusCreated)
+		requestReturn(t, test, `{"reason": "Again", "items": [{"line_item_id": 11, "quantity": 1}]}`, http.StatusBadRequest)
+
+		ret = returnStep(t, test, ret, "reject", http.StatusOK)
+		assert.Equal(t, models.ReturnRejected, ret.State)
+		returnStep(t, test, ret, "approve", http.StatusBadRequest)
+
+		requestReturn(t, test, `{"reason": "Again", "items": [{"line_item_id": 11, "quantity": 1}]}`, http.StatusCreated)
+	})
+	t.Run("InvalidRequests", func(t *testing.T) {
+		test := NewRouteTest(t)
+		requestReturn(t, test, `{"items": [{"line_item_id": 11, "quantity": 1}]}`, http.StatusBadRequest)
+		requestReturn(t, test, `{"reason": "Too big"}`, http.StatusBadRequest)
+		requestReturn(t, test, `{"reason": "Too big", "items": [{"line_item_id": 11, "quantity": 3}]}`, http.StatusBadRequest)
+		requestReturn(t, test, `{"reason": "Too big", "items": [{"line_item_id": 21, "quantity": 1}]}`, http.StatusBadRequest)
+
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+		requestReturn(t, test, `{"reason": "Too big", "items": [{"line_item_id": 11, "quantity": 1}]}`, http.StatusBadRequest)
+	})
+	t.Run("List", func(t *testing.T) {
+		test := NewRouteTest(t)
+		ret := requestReturn(t, test, `{"reason": "Cape too short", "items": [{"line_item_id": 11, "quantity": 1}]}`, http.StatusCreated)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+
+		recorder := test.TestEndpoint(http.MethodGet, "/returns?state=requested", nil, token)
+		returns := []models.Return{}
+		extractPayload(t, http.StatusOK, recorder, &returns)
+		require.Len(t, returns, 1)
+		assert.Equal(t, ret.ID, returns[0].ID)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/returns?state=approved", nil, token)
+		extractPayload(t, http.StatusOK, recorder, &returns)
+		assert.Len(t, returns, 0)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/orders/"+test.Data.firstOrder.ID+"/returns", nil, test.Data.testUserToken)
+		extractPayload(t, http.StatusOK, recorder, &returns)
+		assert.Len(t, returns, 1)
+	})
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		ret := requestReturn(t, test, `{"reason": "Cape too short", "items": [{"line_item_id": 11, "quantity": 1}]}`, http.StatusCreated)
+		url := "/orders/" + test.Data.firstOrder.ID + "/returns/" + ret.ID + "/approve"
+		recorder := test.TestEndpoint(http.MethodPost, url, nil, test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
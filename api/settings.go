@@ -1,18 +1,26 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/conf"
 	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/sirupsen/logrus"
 )
 
+const defaultSettingsCacheTime = 1 * time.Minute
+
 func (a *API) ViewSettings(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
 	config := gcontext.GetConfig(ctx)
 
-	settings, err := a.loadSettings(ctx)
+	settings, err := a.loadSettings(ctx, getLogEntry(r))
 	if err != nil {
 		return fmt.Errorf("Error loading site settings: %v", err)
 	}
@@ -32,3 +40,131 @@ func (a *API) ViewSettings(w http.ResponseWriter, r *http.Request) error {
 	sendJSON(w, 200, settings)
 	return nil
 }
+
+// RefreshSettings drops the cached site settings of the instance and loads
+// them again from the site.
+func (a *API) RefreshSettings(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := gcontext.GetConfig(ctx)
+
+	settings, err := a.settings.refresh(a.httpClient, gcontext.GetInstanceID(ctx), config, getLogEntry(r))
+	if err != nil {
+		return internalServerError("Error loading site settings").WithInternalError(err)
+	}
+	return sendJSON(w, http.StatusOK, settings)
+}
+
+func (a *API) loadSettings(ctx context.Context, log logrus.FieldLogger) (*calculator.Settings, error) {
+	config := gcontext.GetConfig(ctx)
+	return a.settings.load(a.httpClient, gcontext.GetInstanceID(ctx), config, log)
+}
+
+type settingsCacheEntry struct {
+	settings     *calculator.Settings
+	etag         string
+	lastModified string
+	expires      time.Time
+}
+
+// settingsCache holds the last good copy of the site settings per instance.
+// Expired copies are revalidated with conditional requests and served as
+// long as the site can't be reached.
+type settingsCache struct {
+	mutex   sync.Mutex
+	entries map[string]*settingsCacheEntry
+}
+
+func newSettingsCache() *settingsCache {
+	return &settingsCache{entries: make(map[string]*settingsCacheEntry)}
+}
+
+func (c *settingsCache) load(client *http.Client, instanceID string, config *conf.Configuration, log logrus.FieldLogger) (*calculator.Settings, error) {
+	key := instanceID + "|" + config.SettingsURL()
+
+	c.mutex.Lock()
+	entry := c.entries[key]
+	c.mutex.Unlock()
+	if entry != nil && time.Now().Before(entry.expires) {
+		return copySettings(entry.settings), nil
+	}
+
+	settings, err := c.fetch(client, key, entry, config)
+	if err != nil {
+		if entry == nil {
+			return nil, err
+		}
+		log.WithError(err).Warn("Failed to load site settings, using last known copy")
+		return copySettings(entry.settings), nil
+	}
+	return copySettings(settings), nil
+}
+
+func (c *settingsCache) refresh(client *http.Client, instanceID string, config *conf.Configuration, log logrus.FieldLogger) (*calculator.Settings, error) {
+	key := instanceID + "|" + config.SettingsURL()
+	settings, err := c.fetch(client, key, nil, config)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("Refreshed site settings")
+	return copySettings(settings), nil
+}
+
+func (c *settingsCache) fetch(client *http.Client, key string, entry *settingsCacheEntry, config *conf.Configuration) (*calculator.Settings, error) {
+	req, err := http.NewRequest(http.MethodGet, config.SettingsURL(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		if entry.etag != "" {
+			req.Header.Set("If-None-Match", entry.etag)
+		}
+		if entry.lastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.lastModified)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading site settings: %v", err)
+	}
+	defer resp.Body.Close()
+
+	next := &settingsCacheEntry{
+		settings:     &calculator.Settings{},
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		expires:      time.Now().Add(settingsCacheTime(config)),
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotModified && entry != nil:
+		next.settings = entry.settings
+		next.etag = entry.etag
+		next.lastModified = entry.lastModified
+	case resp.StatusCode == http.StatusOK:
+		if err := json.NewDecoder(resp.Body).Decode(next.settings); err != nil {
+			return nil, fmt.Errorf("Error parsing site settings: %v", err)
+		}
+	case resp.StatusCode == http.StatusNotFound && config.Settings.MissingAsEmpty:
+	default:
+		return nil, fmt.Errorf("Error loading site settings: %v", resp.Status)
+	}
+
+	c.mutex.Lock()
+	c.entries[key] = next
+	c.mutex.Unlock()
+	return next.settings, nil
+}
+
+func settingsCacheTime(config *conf.Configuration) time.Duration {
+	if config.Settings.CacheTTL != 0 {
+		return time.Duration(config.Settings.CacheTTL) * time.Second
+	}
+	return defaultSettingsCacheTime
+}
+
+// copySettings returns a copy that callers can modify without changing the
+// cached settings.
+func copySettings(settings *calculator.Settings) *calculator.Settings {
+	s := *settings
+	return &s
+}
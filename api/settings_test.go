@@ -0,0 +1,155 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/calculator"
+	"github.com/netlify/gocommerce/conf"
+)
+
+// settingsTestAPI keeps a single API around, so the settings cache is
+// shared between requests.
+type settingsTestAPI struct {
+	*RouteTest
+	api *API
+}
+
+func newSettingsTestAPI(t *testing.T, siteURL string) *settingsTestAPI {
+	test := NewRouteTest(t)
+	test.Config.SiteURL = siteURL
+	globalConfig := new(conf.GlobalConfiguration)
+	ctx, err := WithInstanceConfig(context.Background(), globalConfig.SMTP, test.Config, "")
+	require.NoError(t, err)
+	return &settingsTestAPI{test, NewAPIWithVersion(ctx, test.GlobalConfig, logrus.StandardLogger(), test.DB, "")}
+}
+
+func (s *settingsTestAPI) request(method, url string, token *jwt.Token) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	req := httptest.NewRequest(method, baseURL+url, nil)
+	if token != nil {
+		require.NoError(s.T, signHTTPRequest(req, token, s.Config.JWT.Secret))
+	}
+	s.api.handler.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func startSettingsSite(status *int32, percentage *int32, requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/gocommerce/settings.json" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		atomic.AddInt32(requests, 1)
+		if code := atomic.LoadInt32(status); code != http.StatusOK {
+			w.WriteHeader(int(code))
+			return
+		}
+		etag := fmt.Sprintf(`"%d"`, atomic.LoadInt32(percentage))
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		fmt.Fprintf(w, `{"taxes": [{"percentage": %d, "countries": ["Germany"]}]}`, atomic.LoadInt32(percentage))
+	}))
+}
+
+func TestSettingsCache(t *testing.T) {
+	t.Run("Revalidate", func(t *testing.T) {
+		status, percentage, requests := int32(http.StatusOK), int32(19), int32(0)
+		site := startSettingsSite(&status, &percentage, &requests)
+		defer site.Close()
+		test := newSettingsTestAPI(t, site.URL)
+		test.Config.Settings.CacheTTL = -1
+
+		settings := &calculator.Settings{}
+		extractPayload(t, http.StatusOK, test.request(http.MethodGet, "/settings", nil), settings)
+		require.Len(t, settings.Taxes, 1)
+		assert.EqualValues(t, 19, settings.Taxes[0].Percentage)
+
+		settings = &calculator.Settings{}
+		extractPayload(t, http.StatusOK, test.request(http.MethodGet, "/settings", nil), settings)
+		require.Len(t, settings.Taxes, 1)
+		assert.EqualValues(t, 19, settings.Taxes[0].Percentage)
+		assert.EqualValues(t, 2, atomic.LoadInt32(&requests))
+
+		atomic.StoreInt32(&percentage, 7)
+		settings = &calculator.Settings{}
+		extractPayload(t, http.StatusOK, test.request(http.MethodGet, "/settings", nil), settings)
+		assert.EqualValues(t, 7, settings.Taxes[0].Percentage)
+	})
+
+	t.Run("Cached", func(t *testing.T) {
+		status, percentage, requests := int32(http.StatusOK), int32(19), int32(0)
+		site := startSettingsSite(&status, &percentage, &requests)
+		defer site.Close()
+		test := newSettingsTestAPI(t, site.URL)
+
+		test.request(http.MethodGet, "/settings", nil)
+		test.request(http.MethodGet, "/settings", nil)
+		assert.EqualValues(t, 1, atomic.LoadInt32(&requests))
+	})
+
+	t.Run("SiteDown", func(t *testing.T) {
+		status, percentage, requests := int32(http.StatusOK), int32(19), int32(0)
+		site := startSettingsSite(&status, &percentage, &requests)
+		defer site.Close()
+		test := newSettingsTestAPI(t, site.URL)
+		test.Config.Settings.CacheTTL = -1
+
+		test.request(http.MethodGet, "/settings", nil)
+		atomic.StoreInt32(&status, http.StatusBadGateway)
+
+		settings := &calculator.Settings{}
+		extractPayload(t, http.StatusOK, test.request(http.MethodGet, "/settings", nil), settings)
+		require.Len(t, settings.Taxes, 1)
+		assert.EqualValues(t, 19, settings.Taxes[0].Percentage)
+	})
+
+	t.Run("Missing", func(t *testing.T) {
+		status, percentage, requests := int32(http.StatusNotFound), int32(19), int32(0)
+		site := startSettingsSite(&status, &percentage, &requests)
+		defer site.Close()
+		test := newSettingsTestAPI(t, site.URL)
+
+		recorder := test.request(http.MethodGet, "/settings", nil)
+		assert.Equal(t, http.StatusInternalServerError, recorder.Code)
+
+		test.Config.Settings.MissingAsEmpty = true
+		settings := &calculator.Settings{}
+		extractPayload(t, http.StatusOK, test.request(http.MethodGet, "/settings", nil), settings)
+		assert.Len(t, settings.Taxes, 0)
+	})
+
+	t.Run("Refresh", func(t *testing.T) {
+		status, percentage, requests := int32(http.StatusOK), int32(19), int32(0)
+		site := startSettingsSite(&status, &percentage, &requests)
+		defer site.Close()
+		test := newSettingsTestAPI(t, site.URL)
+
+		test.request(http.MethodGet, "/settings", nil)
+		atomic.StoreInt32(&percentage, 7)
+
+		recorder := test.request(http.MethodPost, "/settings/refresh", test.Data.testUserToken)
+		assert.Equal(t, http.StatusUnauthorized, recorder.Code)
+
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		settings := &calculator.Settings{}
+		extractPayload(t, http.StatusOK, test.request(http.MethodPost, "/settings/refresh", token), settings)
+		assert.EqualValues(t, 7, settings.Taxes[0].Percentage)
+
+		settings = &calculator.Settings{}
+		extractPayload(t, http.StatusOK, test.request(http.MethodGet, "/settings", nil), settings)
+		assert.EqualValues(t, 7, settings.Taxes[0].Percentage)
+	})
+}
@@ -0,0 +1,305 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/conf"
+	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/models"
+)
+
+type shipmentItemParams struct {
+	LineItemID int64  `json:"line_item_id"`
+	Quantity   uint64 `json:"quantity"`
+}
+
+type shipmentParams struct {
+	Carrier        string               `json:"carrier"`
+	TrackingNumber string               `json:"tracking_number"`
+	TrackingURL    string               `json:"tracking_url"`
+	Items          []shipmentItemParams `json:"items"`
+}
+
+type shipmentUpdateParams struct {
+	Carrier        *string `json:"carrier"`
+	TrackingNumber *string `json:"tracking_number"`
+	TrackingURL    *string `json:"tracking_url"`
+}
+
+func (a *API) shipmentRoutes(r *router) {
+	r.Get("/", a.ShipmentList)
+	r.With(adminRequired).With(addGetBody).Post("/", a.ShipmentCreate)
+	r.With(adminRequired).With(addGetBody).Put("/{shipment_id}", a.ShipmentUpdate)
+}
+
+// ShipmentList lists the shipments of an order.
+func (a *API) ShipmentList(w http.ResponseWriter, r *http.Request) error {
+	order, err := a.shipmentOrder(r)
+	if err != nil {
+		return err
+	}
+	if !hasOrderAccess(r.Context(), order) {
+		return unauthorizedError("You don't have access to this order")
+	}
+	format, err := exportFormat(r)
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+
+	shipments := []*models.Shipment{}
+	if result := a.DB(r).Preload("Items").Where("order_id = ?", order.ID).Order("created_at asc").Find(&shipments); result.Error != nil {
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	if format != "" {
+		return exportShipments(w, format, shipments)
+	}
+	return sendJSON(w, http.StatusOK, shipments)
+}
+
+// exportShipments writes the shipments of an order with one row per shipped
+// item.
+func exportShipments(w http.ResponseWriter, format string, shipments []*models.Shipment) error {
+	table, err := newTableWriter(w, format, "shipments",
+		"shipment_id", "order_id", "carrier", "tracking_number", "tracking_url", "created_at", "line_item_id", "sku", "quantity")
+	if err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+	for _, shipment := range shipments {
+		for _, item := range shipment.Items {
+			err := table.WriteRow(shipment.ID, shipment.OrderID, shipment.Carrier, shipment.TrackingNumber, shipment.TrackingURL, shipment.CreatedAt,
+				item.LineItemID, item.Sku, item.Quantity)
+			if err != nil {
+				return internalServerError("Error writing export").WithInternalError(err)
+			}
+		}
+	}
+	if err := table.Close(); err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+	return nil
+}
+
+// ShipmentCreate records a parcel sent for an order. Without items, all line
+// items that haven't been shipped yet are included. The fulfillment state of
+// the order is derived from the quantities shipped so far, and the buyer is
+// notified by email.
+func (a *API) ShipmentCreate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	log := getLogEntry(r)
+	config := gcontext.GetConfig(ctx)
+	claims := gcontext.GetClaims(ctx)
+
+	order, err := a.shipmentOrder(r)
+	if err != nil {
+		return err
+	}
+
+	params := &shipmentParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read shipment params: %v", err)
+	}
+	if order.PaymentState != models.PaidState {
+		return badRequestError("Can't ship an order that has not been paid")
+	}
+
+	// concurrent shipments wait for each other, so they can't ship the same
+	// items twice or transition from a stale fulfillment state
+	tx := a.DB(r).Begin()
+	if err := models.LockOrder(tx, order.ID); err != nil {
+		tx.Rollback()
+		return internalServerError("Error creating shipment").WithInternalError(err)
+	}
+	if result := tx.Select("state, fulfillment_state").First(order, "id = ?", order.ID); result.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	shipped, err := models.ShippedQuantities(tx, order.ID)
+	if err != nil {
+		tx.Rollback()
+		return internalServerError("Error during database query").WithInternalError(err)
+	}
+
+	shipment := models.NewShipment(order, params.Carrier, params.TrackingNumber, params.TrackingURL)
+	items, httpErr := shipmentItems(order, shipped, params.Items)
+	if httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	shipment.Items = items
+
+	if result := tx.Create(shipment); result.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error creating shipment").WithInternalError(result.Error)
+	}
+	models.LogEvent(tx, r.RemoteAddr, claims.Subject, order.ID, models.EventCreated, []string{"shipment", shipment.ID})
+
+	for _, item := range shipment.Items {
+		shipped[item.LineItemID] += item.Quantity
+	}
+	change, err := order.Transition(tx, config, r.RemoteAddr, claims.Subject, models.FulfillmentStateField, order.ShipmentFulfillmentState(shipped))
+	if err != nil {
+		tx.Rollback()
+		if _, ok := err.(*models.TransitionError); ok {
+			return badRequestError(err.Error())
+		}
+		return internalServerError("Error changing fulfillment state").WithInternalError(err)
+	}
+	if err := change.QueueHook(tx); err != nil {
+		tx.Rollback()
+		return internalServerError("Failed to process webhook").WithInternalError(err)
+	}
+	update := map[string]interface{}{"fulfillment_state": order.FulfillmentState, "state": order.State}
+	if result := tx.Model(order).UpdateColumns(update); result.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving order").WithInternalError(result.Error)
+	}
+
+	if err := queueShipmentHook(tx, config, order, shipment); err != nil {
+		tx.Rollback()
+		return internalServerError("Failed to process webhook").WithInternalError(err)
+	}
+	if result := tx.Commit(); result.Error != nil {
+		return internalServerError("Error creating shipment").WithInternalError(result.Error)
+	}
+
+	if order.Email != "" {
+		mailer := gcontext.GetMailer(ctx)
+		if err := mailer.ShipmentMail(order, shipment); err != nil {
+			log.WithError(err).WithField("order_id", order.ID).Error("Error sending shipment mail")
+		} else {
+			models.LogEvent(a.DB(r), r.RemoteAddr, claims.Subject, order.ID, models.EventEmail, []string{"shipment", order.Email})
+		}
+	}
+
+	return sendJSON(w, http.StatusCreated, shipment)
+}
+
+// ShipmentUpdate changes the carrier and tracking details of a shipment.
+func (a *API) ShipmentUpdate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	config := gcontext.GetConfig(ctx)
+	claims := gcontext.GetClaims(ctx)
+
+	order, err := a.shipmentOrder(r)
+	if err != nil {
+		return err
+	}
+
+	params := &shipmentUpdateParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read shipment params: %v", err)
+	}
+
+	db := a.DB(r)
+	shipment := &models.Shipment{}
+	result := db.Preload("Items").Where("order_id = ?", order.ID).First(shipment, "id = ?", chi.URLParam(r, "shipment_id"))
+	if result.Error != nil {
+		if result.RecordNotFound() {
+			return notFoundError("Shipment not found")
+		}
+		return internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+
+	diff := models.EventDiff{}
+	if params.Carrier != nil {
+		diff.Add("shipment.carrier", shipment.Carrier, *params.Carrier)
+		shipment.Carrier = *params.Carrier
+	}
+	if params.TrackingNumber != nil {
+		diff.Add("shipment.tracking_number", shipment.TrackingNumber, *params.TrackingNumber)
+		shipment.TrackingNumber = *params.TrackingNumber
+	}
+	if params.TrackingURL != nil {
+		diff.Add("shipment.tracking_url", shipment.TrackingURL, *params.TrackingURL)
+		shipment.TrackingURL = *params.TrackingURL
+	}
+	if len(diff) == 0 {
+		return sendJSON(w, http.StatusOK, shipment)
+	}
+
+	tx := db.Begin()
+	if result := tx.Save(shipment); result.Error != nil {
+		tx.Rollback()
+		return internalServerError("Error saving shipment").WithInternalError(result.Error)
+	}
+	models.LogEventDiff(tx, r.RemoteAddr, claims.Subject, order.ID, models.EventUpdated, diff)
+	if err := queueShipmentHook(tx, config, order, shipment); err != nil {
+		tx.Rollback()
+		return internalServerError("Failed to process webhook").WithInternalError(err)
+	}
+	if result := tx.Commit(); result.Error != nil {
+		return internalServerError("Error saving shipment").WithInternalError(result.Error)
+	}
+
+	return sendJSON(w, http.StatusOK, shipment)
+}
+
+func (a *API) shipmentOrder(r *http.Request) (*models.Order, error) {
+	ctx := r.Context()
+	order := &models.Order{}
+	result := a.DB(r).Preload("LineItems").Where("instance_id = ?", gcontext.GetInstanceID(ctx)).First(order, "id = ?", gcontext.GetOrderID(ctx))
+	if result.Error != nil {
+		if result.RecordNotFound() {
+			return nil, notFoundError("Order not found")
+		}
+		return nil, internalServerError("Error during database query").WithInternalError(result.Error)
+	}
+	return order, nil
+}
+
+// shipmentItems checks that the requested quantities haven't been shipped
+// already. Without params all remaining quantities are shipped.
+func shipmentItems(order *models.Order, shipped map[int64]uint64, params []shipmentItemParams) ([]*models.ShipmentItem, *HTTPError) {
+	lineItems := map[int64]*models.LineItem{}
+	for _, item := range order.LineItems {
+		lineItems[item.ID] = item
+	}
+
+	if len(params) == 0 {
+		for _, item := range order.LineItems {
+			if shipped[item.ID] < item.Quantity {
+				params = append(params, shipmentItemParams{LineItemID: item.ID, Quantity: item.Quantity - shipped[item.ID]})
+			}
+		}
+		if len(params) == 0 {
+			return nil, badRequestError("All line items of the order have been shipped already")
+		}
+	}
+
+	items := []*models.ShipmentItem{}
+	requested := map[int64]uint64{}
+	for _, param := range params {
+		item, ok := lineItems[param.LineItemID]
+		if !ok {
+			return nil, badRequestError("Line item %d does not belong to the order", param.LineItemID)
+		}
+		if param.Quantity == 0 {
+			return nil, badRequestError("Quantity of line item %d must be positive", param.LineItemID)
+		}
+		requested[item.ID] += param.Quantity
+		if shipped[item.ID]+requested[item.ID] > item.Quantity {
+			return nil, badRequestError("Only %d of line item %d can be shipped", item.Quantity-shipped[item.ID], item.ID)
+		}
+		items = append(items, &models.ShipmentItem{
+			OrderID:    order.ID,
+			LineItemID: item.ID,
+			Sku:        item.Sku,
+			Quantity:   param.Quantity,
+		})
+	}
+	return items, nil
+}
+
+func queueShipmentHook(tx *gorm.DB, config *conf.Configuration, order *models.Order, shipment *models.Shipment) error {
+	if config.Webhooks.Shipment == "" {
+		return nil
+	}
+	hook, err := models.NewHook("shipment", config.SiteURL, config.Webhooks.Shipment, order.UserID, order.ID, config.Webhooks.Secret, shipment)
+	if err != nil {
+		return err
+	}
+	return tx.Save(hook).Error
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/netlify/gocommerce/models"
+)
+
+func createShipment(t *testing.T, test *RouteTest, orderID, body string, code int) *models.Shipment {
+	token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+	recorder := test.TestEndpoint(http.MethodPost, "/orders/"+orderID+"/shipments", strings.NewReader(body), token)
+	if code != http.StatusCreated {
+		validateError(t, code, recorder)
+		return nil
+	}
+	shipment := &models.Shipment{}
+	extractPayload(t, http.StatusCreated, recorder, shipment)
+	return shipment
+}
+
+func fulfillmentState(t *testing.T, test *RouteTest, orderID string) string {
+	order := &models.Order{}
+	require.NoError(t, test.DB.First(order, "id = ?", orderID).Error)
+	return order.FulfillmentState
+}
+
+func TestShipments(t *testing.T) {
+	t.Run("PartialFulfillment", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Config.Webhooks.Shipment = "https://example.com/hooks/shipment"
+		orderID := test.Data.secondOrder.ID
+
+		first := createShipment(t, test, orderID, `{"carrier": "UPS", "tracking_number": "1Z999", "items": [{"line_item_id": 21, "quantity": 1}]}`, http.StatusCreated)
+		assert.Equal(t, "UPS", first.Carrier)
+		require.Len(t, first.Items, 1)
+		assert.Equal(t, "456-i-rollover-all-things", first.Items[0].Sku)
+		assert.Equal(t, models.PartiallyShippedState, fulfillmentState(t, test, orderID))
+
+		second := createShipment(t, test, orderID, `{"carrier": "DHL"}`, http.StatusCreated)
+		require.Len(t, second.Items, 2)
+		assert.Equal(t, uint64(1), second.Items[0].Quantity)
+		assert.Equal(t, uint64(1), second.Items[1].Quantity)
+		assert.Equal(t, models.ShippedState, fulfillmentState(t, test, orderID))
+
+		createShipment(t, test, orderID, `{}`, http.StatusBadRequest)
+
+		hooks := []models.Hook{}
+		require.NoError(t, test.DB.Where("order_id = ? AND type = ?", orderID, "shipment").Find(&hooks).Error)
+		assert.Len(t, hooks, 2)
+
+		emails := []models.Event{}
+		require.NoError(t, test.DB.Where("order_id = ? AND type = ?", orderID, models.EventEmail).Find(&emails).Error)
+		assert.Len(t, emails, 2)
+
+		recorder := test.TestEndpoint(http.MethodGet, "/orders/"+orderID+"/shipments", nil, test.Data.testUserToken)
+		shipments := []models.Shipment{}
+		extractPayload(t, http.StatusOK, recorder, &shipments)
+		assert.Len(t, shipments, 2)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/orders/"+orderID, nil, test.Data.testUserToken)
+		order := &models.Order{}
+		extractPayload(t, http.StatusOK, recorder, order)
+		assert.Len(t, order.Shipments, 2)
+		assert.Equal(t, models.ShippedState, order.State)
+	})
+	t.Run("InvalidItems", func(t *testing.T) {
+		test := NewRouteTest(t)
+		orderID := test.Data.secondOrder.ID
+		createShipment(t, test, orderID, `{"items": [{"line_item_id": 21, "quantity": 3}]}`, http.StatusBadRequest)
+		createShipment(t, test, orderID, `{"items": [{"line_item_id": 21, "quantity": 0}]}`, http.StatusBadRequest)
+		createShipment(t, test, orderID, `{"items": [{"line_item_id": 11, "quantity": 1}]}`, http.StatusBadRequest)
+		createShipment(t, test, orderID, `{"items": [{"line_item_id": 22, "quantity": 1}, {"line_item_id": 22, "quantity": 1}]}`, http.StatusBadRequest)
+		assert.Equal(t, models.PendingState, fulfillmentState(t, test, orderID))
+	})
+	t.Run("Unpaid", func(t *testing.T) {
+		test := NewRouteTest(t)
+		test.Data.firstOrder.PaymentState = models.PendingState
+		require.NoError(t, test.DB.Save(test.Data.firstOrder).Error)
+		createShipment(t, test, test.Data.firstOrder.ID, `{}`, http.StatusBadRequest)
+	})
+	t.Run("Update", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		shipment := createShipment(t, test, test.Data.firstOrder.ID, `{"carrier": "UPS"}`, http.StatusCreated)
+
+		url := fmt.Sprintf("/orders/%s/shipments/%s", test.Data.firstOrder.ID, shipment.ID)
+		recorder := test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"tracking_number": "1Z999", "tracking_url": "https://ups.example/1Z999"}`), token)
+		updated := &models.Shipment{}
+		extractPayload(t, http.StatusOK, recorder, updated)
+		assert.Equal(t, "UPS", updated.Carrier)
+		assert.Equal(t, "1Z999", updated.TrackingNumber)
+		assert.Len(t, updated.Items, 1)
+
+		events := []models.Event{}
+		require.NoError(t, test.DB.Where("order_id = ? AND changes = ?", test.Data.firstOrder.ID, "shipment.tracking_number,shipment.tracking_url").Find(&events).Error)
+		require.Len(t, events, 1)
+		assert.Equal(t, "1Z999", events[0].Diff["shipment.tracking_number"].After)
+
+		url = fmt.Sprintf("/orders/%s/shipments/%s", test.Data.secondOrder.ID, shipment.ID)
+		recorder = test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"carrier": "DHL"}`), token)
+		validateError(t, http.StatusNotFound, recorder)
+	})
+	t.Run("ManualFulfillment", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("admin-yo", "admin@wayneindustries.com")
+		orderID := test.Data.secondOrder.ID
+		createShipment(t, test, orderID, `{"items": [{"line_item_id": 21, "quantity": 1}]}`, http.StatusCreated)
+
+		recorder := test.TestEndpoint(http.MethodPut, "/orders/"+orderID, strings.NewReader(`{"fulfillment_state": "shipped"}`), token)
+		validateError(t, http.StatusBadRequest, recorder)
+		assert.Equal(t, models.PartiallyShippedState, fulfillmentState(t, test, orderID))
+	})
+	t.Run("NotAdmin", func(t *testing.T) {
+		test := NewRouteTest(t)
+		recorder := test.TestEndpoint(http.MethodPost, "/orders/"+test.Data.firstOrder.ID+"/shipments", strings.NewReader(`{}`), test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+}
@@ -98,6 +98,14 @@ func (a *API) UserList(w http.ResponseWriter, r *http.Request) error {
 	instanceID := gcontext.GetInstanceID(r.Context())
 	query = query.Where(userTable+".instance_id = ?", instanceID)
 
+	format, err := exportFormat(r)
+	if err != nil {
+		return badRequestError(err.Error())
+	}
+	if format != "" {
+		return exportUsers(w, query, format)
+	}
+
 	offset, limit, err := paginate(w, r, query.Model(&models.User{}))
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -121,6 +129,42 @@ func (a *API) UserList(w http.ResponseWriter, r *http.Request) error {
 	return sendJSON(w, http.StatusOK, users)
 }
 
+// exportUsers streams the users matching the query with their order stats.
+func exportUsers(w http.ResponseWriter, query *gorm.DB, format string) error {
+	orderTable := query.NewScope(models.Order{}).QuotedTableName()
+	userTable := query.NewScope(models.User{}).QuotedTableName()
+	rows, err := query.Model(&models.User{}).Select("" +
+		userTable + ".id, " + userTable + ".email, " + userTable + ".name, " + userTable + ".created_at, " +
+		"COUNT(" + orderTable + ".id) AS order_count, " +
+		"MAX(" + orderTable + ".created_at) AS last_order_at").Rows()
+	if err != nil {
+		return internalServerError("Failed to execute request").WithInternalError(err)
+	}
+	defer rows.Close()
+
+	table, err := newTableWriter(w, format, "users", "id", "email", "name", "created_at", "order_count", "last_order_at")
+	if err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+	for rows.Next() {
+		user := models.User{LastOrderAt: &models.HackyNullTime{}}
+		if err := rows.Scan(&user.ID, &user.Email, &user.Name, &user.CreatedAt, &user.OrderCount, user.LastOrderAt); err != nil {
+			return internalServerError("Failed to execute request").WithInternalError(err)
+		}
+		var lastOrderAt interface{}
+		if user.LastOrderAt.Valid {
+			lastOrderAt = user.LastOrderAt.Time
+		}
+		if err := table.WriteRow(user.ID, user.Email, user.Name, user.CreatedAt, user.OrderCount, lastOrderAt); err != nil {
+			return internalServerError("Error writing export").WithInternalError(err)
+		}
+	}
+	if err := table.Close(); err != nil {
+		return internalServerError("Error writing export").WithInternalError(err)
+	}
+	return nil
+}
+
 // UserView will return the user specified.
 // If you're an admin you can request a user that is not your self
 func (a *API) UserView(w http.ResponseWriter, r *http.Request) error {
@@ -151,6 +195,9 @@ func (a *API) AddressList(w http.ResponseWriter, r *http.Request) error {
 	if results.Error != nil {
 		return internalServerError("problem while querying for userID: %s", userID).WithInternalError(results.Error)
 	}
+	for i := range addrs {
+		markDefaultAddress(user, &addrs[i])
+	}
 
 	return sendJSON(w, http.StatusOK, &addrs)
 }
@@ -173,10 +220,18 @@ func (a *API) AddressView(w http.ResponseWriter, r *http.Request) error {
 	if results.Error != nil {
 		return internalServerError("problem while querying for userID: %s", userID).WithInternalError(results.Error)
 	}
+	markDefaultAddress(user, addr)
 
 	return sendJSON(w, http.StatusOK, &addr)
 }
 
+// markDefaultAddress flags the address if it is one of the default addresses
+// of the user.
+func markDefaultAddress(user *models.User, addr *models.Address) {
+	addr.DefaultShipping = addr.ID == user.DefaultShippingAddressID
+	addr.DefaultBilling = addr.ID == user.DefaultBillingAddressID
+}
+
 // UserDelete will soft delete the user. It requires admin access
 // return errors or 200 and no body
 func (a *API) UserDelete(w http.ResponseWriter, r *http.Request) error {
@@ -200,6 +255,70 @@ func (a *API) UserDelete(w http.ResponseWriter, r *http.Request) error {
 	return nil
 }
 
+type userMergeParams struct {
+	SourceID string `json:"source_id"`
+}
+
+// UserMerge merges another user of the same instance into this one. The
+// orders, addresses and transactions of the other user are moved over and it
+// is deleted. It requires admin access.
+func (a *API) UserMerge(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	db := a.DB(r)
+	log := getLogEntry(r)
+	claims := gcontext.GetClaims(ctx)
+
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		return notFoundError("Couldn't find a record for " + gcontext.GetUserID(ctx))
+	}
+
+	params := &userMergeParams{}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Could not read merge params: %v", err)
+	}
+	if params.SourceID == "" {
+		return badRequestError("Must provide the ID of the user to merge")
+	}
+	if params.SourceID == user.ID {
+		return badRequestError("Can't merge a user with itself")
+	}
+
+	source, err := models.GetUser(db, params.SourceID)
+	if err != nil {
+		return internalServerError("problem while querying for userID: %s", params.SourceID).WithInternalError(err)
+	}
+	if source == nil {
+		return notFoundError("Couldn't find a record for " + params.SourceID)
+	}
+	instanceID := gcontext.GetInstanceID(ctx)
+	if user.InstanceID != instanceID || source.InstanceID != instanceID {
+		return badRequestError("Can only merge users of this instance")
+	}
+
+	orderIDs := []string{}
+	if result := db.Model(&models.Order{}).Where("instance_id = ? AND user_id = ?", instanceID, source.ID).Pluck("id", &orderIDs); result.Error != nil {
+		return internalServerError("Error while querying for orders").WithInternalError(result.Error)
+	}
+
+	tx := db.Begin()
+	if err := models.MergeUsers(tx, instanceID, user, source); err != nil {
+		tx.Rollback()
+		return internalServerError("Error while merging users").WithInternalError(err)
+	}
+	for _, orderID := range orderIDs {
+		diff := models.EventDiff{}
+		diff.Add("user_id", source.ID, user.ID)
+		models.LogEventDiff(tx, r.RemoteAddr, claims.Subject, orderID, models.EventUpdated, diff)
+	}
+	if result := tx.Commit(); result.Error != nil {
+		return internalServerError("Error while merging users").WithInternalError(result.Error)
+	}
+
+	log.WithField("source_id", source.ID).Infof("Merged user with %d orders", len(orderIDs))
+	return sendJSON(w, http.StatusOK, user)
+}
+
 func (a *API) UserBulkDelete(w http.ResponseWriter, r *http.Request) error {
 	log := getLogEntry(r)
 	db := a.DB(r)
@@ -235,10 +354,12 @@ func (a *API) UserBulkDelete(w http.ResponseWriter, r *http.Request) error {
 	return tx.Commit().Error
 }
 
-// AddressDelete will soft delete the address associated with that user. It requires admin access
+// AddressDelete will soft delete the address associated with that user.
+// Orders using the address keep a copy of it.
 // return errors or 200 and no body
 func (a *API) AddressDelete(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
+	db := a.DB(r)
 	addrID := chi.URLParam(r, "addr_id")
 	log := getLogEntry(r).WithField("addr_id", addrID)
 
@@ -248,18 +369,52 @@ func (a *API) AddressDelete(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
-	rsp := a.DB(r).Delete(&models.Address{ID: addrID})
-	if rsp.RecordNotFound() {
+	addr := &models.Address{}
+	if rsp := db.First(addr, "id = ? AND user_id = ?", addrID, user.ID); rsp.RecordNotFound() {
 		log.Warn("Attempted to delete an address that doesn't exist")
 		return nil
 	} else if rsp.Error != nil {
 		return internalServerError("error while deleting address").WithInternalError(rsp.Error)
 	}
 
+	tx := db.Begin()
+	if err := addr.DetachFromOrders(tx); err != nil {
+		tx.Rollback()
+		return internalServerError("error while deleting address").WithInternalError(err)
+	}
+	if rsp := tx.Delete(addr); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("error while deleting address").WithInternalError(rsp.Error)
+	}
+	defaults := map[string]interface{}{}
+	if user.DefaultShippingAddressID == addr.ID {
+		defaults["default_shipping_address_id"] = ""
+	}
+	if user.DefaultBillingAddressID == addr.ID {
+		defaults["default_billing_address_id"] = ""
+	}
+	if len(defaults) > 0 {
+		if rsp := tx.Model(user).UpdateColumns(defaults); rsp.Error != nil {
+			tx.Rollback()
+			return internalServerError("error while deleting address").WithInternalError(rsp.Error)
+		}
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("error while deleting address").WithInternalError(rsp.Error)
+	}
+
 	log.Info("deleted address")
 	return nil
 }
 
+// addressParams are the fields of an address and whether it should be the
+// default shipping or billing address of the user.
+type addressParams struct {
+	models.AddressRequest
+	DefaultShipping *bool `json:"default_shipping"`
+	DefaultBilling  *bool `json:"default_billing"`
+}
+
 // CreateNewAddress will create an address associated with that user
 func (a *API) CreateNewAddress(w http.ResponseWriter, r *http.Request) error {
 	ctx := r.Context()
@@ -269,25 +424,112 @@ func (a *API) CreateNewAddress(w http.ResponseWriter, r *http.Request) error {
 		return notFoundError("Couldn't find a record for " + userID)
 	}
 
-	addrReq := new(models.AddressRequest)
-	err := json.NewDecoder(r.Body).Decode(addrReq)
+	params := new(addressParams)
+	err := json.NewDecoder(r.Body).Decode(params)
 	if err != nil {
 		return badRequestError("Failed to parse json body: %v", err)
 	}
 
-	if err := addrReq.Validate(); err != nil {
+	if err := params.AddressRequest.Validate(); err != nil {
 		return badRequestError("requested address is missing a required field: %v", err)
 	}
 
 	addr := models.Address{
-		AddressRequest: *addrReq,
+		AddressRequest: params.AddressRequest,
 		ID:             uuid.NewRandom().String(),
 		UserID:         userID,
 	}
-	rsp := a.DB(r).Create(&addr)
-	if rsp.Error != nil {
+	tx := a.DB(r).Begin()
+	if rsp := tx.Create(&addr); rsp.Error != nil {
+		tx.Rollback()
+		return internalServerError("failed to save address").WithInternalError(rsp.Error)
+	}
+	if httpErr := setDefaultAddress(tx, user, &addr, params); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
 		return internalServerError("failed to save address").WithInternalError(rsp.Error)
 	}
 
 	return sendJSON(w, http.StatusOK, &struct{ ID string }{ID: addr.ID})
 }
+
+// AddressUpdate changes an address of the user. Fields missing from the
+// request keep their value. Orders using the address keep a copy of the old
+// one.
+func (a *API) AddressUpdate(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	db := a.DB(r)
+	addrID := chi.URLParam(r, "addr_id")
+	userID := gcontext.GetUserID(ctx)
+	user := gcontext.GetUser(ctx)
+	if user == nil {
+		return notFoundError("Couldn't find a record for " + userID)
+	}
+
+	addr := &models.Address{}
+	if rsp := db.First(addr, "id = ? AND user_id = ?", addrID, userID); rsp.RecordNotFound() {
+		return notFoundError("Address not found")
+	} else if rsp.Error != nil {
+		return internalServerError("problem while querying for address: %s", addrID).WithInternalError(rsp.Error)
+	}
+
+	params := &addressParams{AddressRequest: addr.AddressRequest}
+	if err := json.NewDecoder(r.Body).Decode(params); err != nil {
+		return badRequestError("Failed to parse json body: %v", err)
+	}
+	if err := params.AddressRequest.Validate(); err != nil {
+		return badRequestError("requested address is missing a required field: %v", err)
+	}
+
+	tx := db.Begin()
+	if params.AddressRequest != addr.AddressRequest {
+		if err := addr.DetachFromOrders(tx); err != nil {
+			tx.Rollback()
+			return internalServerError("failed to save address").WithInternalError(err)
+		}
+		addr.AddressRequest = params.AddressRequest
+		if rsp := tx.Save(addr); rsp.Error != nil {
+			tx.Rollback()
+			return internalServerError("failed to save address").WithInternalError(rsp.Error)
+		}
+	}
+	if httpErr := setDefaultAddress(tx, user, addr, params); httpErr != nil {
+		tx.Rollback()
+		return httpErr
+	}
+	if rsp := tx.Commit(); rsp.Error != nil {
+		return internalServerError("failed to save address").WithInternalError(rsp.Error)
+	}
+
+	markDefaultAddress(user, addr)
+	return sendJSON(w, http.StatusOK, addr)
+}
+
+// setDefaultAddress makes the address the default shipping or billing address
+// of the user, or stops it from being one, as requested in the params.
+func setDefaultAddress(tx *gorm.DB, user *models.User, addr *models.Address, params *addressParams) *HTTPError {
+	defaults := map[string]interface{}{}
+	update := func(flag *bool, column string, current *string) {
+		switch {
+		case flag == nil:
+		case *flag:
+			*current = addr.ID
+			defaults[column] = addr.ID
+		case *current == addr.ID:
+			*current = ""
+			defaults[column] = ""
+		}
+	}
+	update(params.DefaultShipping, "default_shipping_address_id", &user.DefaultShippingAddressID)
+	update(params.DefaultBilling, "default_billing_address_id", &user.DefaultBillingAddressID)
+	if len(defaults) == 0 {
+		return nil
+	}
+
+	if rsp := tx.Model(user).UpdateColumns(defaults); rsp.Error != nil {
+		return internalServerError("failed to save default address").WithInternalError(rsp.Error)
+	}
+	return nil
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -288,6 +289,83 @@ func TestUserDelete(t *testing.T) {
 	})
 }
 
+func TestUserMerge(t *testing.T) {
+	t.Run("Simple", func(t *testing.T) {
+		test := NewRouteTest(t)
+		source := models.User{ID: "robin", Email: "robin@wayneindustries.com", Name: "Dick Grayson"}
+		addr := getTestAddress()
+		addr.UserID = source.ID
+		order := models.NewOrder("", "session3", source.Email, "USD")
+		order.UserID = source.ID
+		transaction := models.NewTransaction(order)
+		for _, i := range []interface{}{&source, addr, order, transaction} {
+			require.NoError(t, test.DB.Create(i).Error)
+		}
+
+		token := testAdminToken("magical-unicorn", "")
+		body := strings.NewReader(`{"source_id": "robin"}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/users/"+test.Data.testUser.ID+"/merge", body, token)
+		user := &models.User{}
+		extractPayload(t, http.StatusOK, recorder, user)
+		assert.Equal(t, test.Data.testUser.ID, user.ID)
+		assert.Equal(t, test.Data.testUser.Name, user.Name)
+
+		saved := &models.Order{}
+		require.NoError(t, test.DB.First(saved, "id = ?", order.ID).Error)
+		assert.Equal(t, test.Data.testUser.ID, saved.UserID)
+		savedAddr := &models.Address{}
+		require.NoError(t, test.DB.First(savedAddr, "id = ?", addr.ID).Error)
+		assert.Equal(t, test.Data.testUser.ID, savedAddr.UserID)
+		savedTransaction := &models.Transaction{}
+		require.NoError(t, test.DB.First(savedTransaction, "id = ?", transaction.ID).Error)
+		assert.Equal(t, test.Data.testUser.ID, savedTransaction.UserID)
+
+		assert.False(t, test.DB.Unscoped().First(&source).RecordNotFound())
+		assert.NotNil(t, source.DeletedAt, "merged user wasn't deleted")
+
+		events := []models.Event{}
+		require.NoError(t, test.DB.Where("order_id = ? AND changes = ?", order.ID, "user_id").Find(&events).Error)
+		require.Len(t, events, 1)
+		assert.Equal(t, "robin", events[0].Diff["user_id"].Before)
+		assert.Equal(t, test.Data.testUser.ID, events[0].Diff["user_id"].After)
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		test := NewRouteTest(t)
+		token := testAdminToken("magical-unicorn", "")
+		url := "/users/" + test.Data.testUser.ID + "/merge"
+
+		recorder := test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{"source_id": "`+test.Data.testUser.ID+`"}`), token)
+		validateError(t, http.StatusBadRequest, recorder)
+
+		recorder = test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{"source_id": "dne"}`), token)
+		validateError(t, http.StatusNotFound, recorder)
+
+		recorder = test.TestEndpoint(http.MethodPost, url, strings.NewReader(`{"source_id": "dne"}`), test.Data.testUserToken)
+		validateError(t, http.StatusUnauthorized, recorder)
+	})
+
+	t.Run("OtherInstance", func(t *testing.T) {
+		test := NewRouteTest(t)
+		source := models.User{InstanceID: "other-instance", ID: "selina", Email: "selina@example.com"}
+		order := models.NewOrder("other-instance", "session4", source.Email, "USD")
+		order.UserID = source.ID
+		for _, i := range []interface{}{&source, order} {
+			require.NoError(t, test.DB.Create(i).Error)
+		}
+
+		token := testAdminToken("magical-unicorn", "")
+		body := strings.NewReader(`{"source_id": "selina"}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/users/"+test.Data.testUser.ID+"/merge", body, token)
+		validateError(t, http.StatusBadRequest, recorder)
+
+		saved := &models.Order{}
+		require.NoError(t, test.DB.First(saved, "id = ?", order.ID).Error)
+		assert.Equal(t, source.ID, saved.UserID)
+		assert.False(t, test.DB.First(&models.User{}, "id = ?", source.ID).RecordNotFound())
+	})
+}
+
 func TestUserBulkDelete(t *testing.T) {
 	t.Run("SingleUser", func(t *testing.T) {
 		test := NewRouteTest(t)
@@ -395,7 +473,123 @@ func TestUserAddressDelete(t *testing.T) {
 	assert.NotNil(t, addr.DeletedAt)
 }
 
+func TestUserAddressDeleteByCustomer(t *testing.T) {
+	t.Run("UsedByOrder", func(t *testing.T) {
+		test := NewRouteTest(t)
+		require.NoError(t, test.DB.Model(test.Data.testUser).UpdateColumn("default_shipping_address_id", test.Data.testAddress.ID).Error)
+
+		url := "/users/" + test.Data.testUser.ID + "/addresses/" + test.Data.testAddress.ID
+		recorder := test.TestEndpoint(http.MethodDelete, url, nil, test.Data.testUserToken)
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		order := &models.Order{}
+		require.NoError(t, orderQuery(test.DB).First(order, "id = ?", test.Data.firstOrder.ID).Error)
+		assert.NotEqual(t, test.Data.testAddress.ID, order.ShippingAddressID)
+		assert.Equal(t, test.Data.testAddress.Address1, order.ShippingAddress.Address1)
+
+		user := &models.User{}
+		require.NoError(t, test.DB.First(user, "id = ?", test.Data.testUser.ID).Error)
+		assert.Empty(t, user.DefaultShippingAddressID)
+
+		addrs := []models.Address{}
+		require.NoError(t, test.DB.Where("user_id = ?", test.Data.testUser.ID).Find(&addrs).Error)
+		assert.Empty(t, addrs)
+	})
+
+	t.Run("OtherUser", func(t *testing.T) {
+		test := NewRouteTest(t)
+		other := createUser(test, "joker", "joker@example.com", "Joker")
+		url := "/users/" + other.ID + "/addresses/" + test.Data.testAddress.ID
+		recorder := test.TestEndpoint(http.MethodDelete, url, nil, testToken(other.ID, other.Email))
+		assert.Equal(t, http.StatusOK, recorder.Code)
+
+		assert.False(t, test.DB.First(&models.Address{}, "id = ?", test.Data.testAddress.ID).RecordNotFound())
+	})
+}
+
+func TestUserAddressUpdate(t *testing.T) {
+	t.Run("Simple", func(t *testing.T) {
+		test := NewRouteTest(t)
+		addr := getTestAddress()
+		addr.UserID = test.Data.testUser.ID
+		require.NoError(t, test.DB.Create(addr).Error)
+
+		url := "/users/" + test.Data.testUser.ID + "/addresses/" + addr.ID
+		body := strings.NewReader(`{"city": "queens", "default_shipping": true, "default_billing": true}`)
+		recorder := test.TestEndpoint(http.MethodPut, url, body, test.Data.testUserToken)
+		saved := &models.Address{}
+		extractPayload(t, http.StatusOK, recorder, saved)
+		assert.Equal(t, addr.ID, saved.ID)
+		assert.Equal(t, "queens", saved.City)
+		assert.Equal(t, addr.Name, saved.Name)
+		assert.True(t, saved.DefaultShipping)
+		assert.True(t, saved.DefaultBilling)
+
+		user := &models.User{}
+		require.NoError(t, test.DB.First(user, "id = ?", test.Data.testUser.ID).Error)
+		assert.Equal(t, addr.ID, user.DefaultShippingAddressID)
+		assert.Equal(t, addr.ID, user.DefaultBillingAddressID)
+
+		recorder = test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"default_billing": false}`), test.Data.testUserToken)
+		saved = &models.Address{}
+		extractPayload(t, http.StatusOK, recorder, saved)
+		assert.True(t, saved.DefaultShipping)
+		assert.False(t, saved.DefaultBilling)
+	})
+
+	t.Run("UsedByOrder", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/users/" + test.Data.testUser.ID + "/addresses/" + test.Data.testAddress.ID
+		body := strings.NewReader(`{"address1": "1007 Mountain Drive"}`)
+		recorder := test.TestEndpoint(http.MethodPut, url, body, test.Data.testUserToken)
+		saved := &models.Address{}
+		extractPayload(t, http.StatusOK, recorder, saved)
+		assert.Equal(t, test.Data.testAddress.ID, saved.ID)
+		assert.Equal(t, "1007 Mountain Drive", saved.Address1)
+
+		for _, id := range []string{test.Data.firstOrder.ID, test.Data.secondOrder.ID} {
+			order := &models.Order{}
+			require.NoError(t, orderQuery(test.DB).First(order, "id = ?", id).Error)
+			assert.NotEqual(t, test.Data.testAddress.ID, order.ShippingAddressID)
+			assert.Equal(t, test.Data.testAddress.Address1, order.ShippingAddress.Address1)
+			assert.Equal(t, test.Data.testAddress.Address1, order.BillingAddress.Address1)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		test := NewRouteTest(t)
+		url := "/users/" + test.Data.testUser.ID + "/addresses/" + test.Data.testAddress.ID
+		recorder := test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"name": ""}`), test.Data.testUserToken)
+		validateError(t, http.StatusBadRequest, recorder)
+
+		other := createUser(test, "joker", "joker@example.com", "Joker")
+		url = "/users/" + other.ID + "/addresses/" + test.Data.testAddress.ID
+		recorder = test.TestEndpoint(http.MethodPut, url, strings.NewReader(`{"city": "arkham"}`), testToken(other.ID, other.Email))
+		validateError(t, http.StatusNotFound, recorder)
+	})
+}
+
 func TestUserAddressCreate(t *testing.T) {
+	t.Run("Customer", func(t *testing.T) {
+		test := NewRouteTest(t)
+		body := strings.NewReader(`{
+			"name": "Bruce Wayne", "address1": "1007 Mountain Drive",
+			"city": "Gotham", "state": "NY", "country": "USA", "zip": "10001",
+			"default_shipping": true
+		}`)
+		recorder := test.TestEndpoint(http.MethodPost, "/users/"+test.Data.testUser.ID+"/addresses", body, test.Data.testUserToken)
+		results := struct {
+			ID string
+		}{}
+		extractPayload(t, http.StatusOK, recorder, &results)
+
+		recorder = test.TestEndpoint(http.MethodGet, "/users/"+test.Data.testUser.ID+"/addresses/"+results.ID, nil, test.Data.testUserToken)
+		addr := &models.Address{}
+		extractPayload(t, http.StatusOK, recorder, addr)
+		assert.True(t, addr.DefaultShipping)
+		assert.False(t, addr.DefaultBilling)
+	})
+
 	t.Run("Success", func(t *testing.T) {
 		test := NewRouteTest(t)
 		addr := getTestAddress()
@@ -100,6 +100,17 @@ func testToken(args ...string) *jwt.Token {
 	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 }
 
+func testVerifiedToken(id, email string, verified bool) *jwt.Token {
+	claims := &claims.JWTClaims{
+		StandardClaims: jwt.StandardClaims{
+			Subject: id,
+		},
+		Email:         email,
+		EmailVerified: &verified,
+	}
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+}
+
 func testExpiredToken(id, email string) *jwt.Token {
 	claims := &claims.JWTClaims{
 		StandardClaims: jwt.StandardClaims{
@@ -158,9 +169,10 @@ func setupTestData() *TestData {
 		AddressRequest: models.AddressRequest{
 			Name:     "wayne",
 			Address1: "123 cave way",
-			Country:  "dcland",
+			Country:  "US",
+			State:    "NJ",
 			City:     "gotham",
-			Zip:      "324234",
+			Zip:      "07001",
 		},
 		User: testUser,
 	}
@@ -282,7 +294,8 @@ func getTestAddress() *models.Address {
 		AddressRequest: models.AddressRequest{
 			Name:     "Peter Parker",
 			Address1: "123 spidey lane",
-			Country:  "marvel-land",
+			Country:  "US",
+			State:    "NY",
 			City:     "new york",
 			Zip:      "10007",
 		},
@@ -372,6 +385,7 @@ type RouteTest struct {
 }
 
 func NewRouteTest(t *testing.T) *RouteTest {
+	models.ResetCatalogCache()
 	db, globalConfig, config, data := db(t)
 	return &RouteTest{db, globalConfig, config, t, data}
 }
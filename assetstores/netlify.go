@@ -30,7 +30,7 @@ type netlifySignature struct {
 	URL string `json:"url"`
 }
 
-func (n *netlifyProvider) SignURL(downloadURL string) (string, error) {
+func (n *netlifyProvider) SignURL(_, downloadURL string) (string, error) {
 	url, err := url.Parse(downloadURL)
 	if err != nil {
 		return "", err
@@ -6,6 +6,6 @@ func newNoopProvider() (*noopProvider, error) {
 	return &noopProvider{}, nil
 }
 
-func (n *noopProvider) SignURL(url string) (string, error) {
+func (n *noopProvider) SignURL(_, url string) (string, error) {
 	return url, nil
 }
@@ -0,0 +1,194 @@
+package assetstores
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/netlify/gocommerce/conf"
+	"github.com/pkg/errors"
+)
+
+const (
+	s3Algorithm   = "AWS4-HMAC-SHA256"
+	s3DateFormat  = "20060102T150405Z"
+	s3MaxExpiry   = 7 * 24 * time.Hour
+	defaultRegion = "us-east-1"
+)
+
+// s3Provider signs download URLs of an S3-compatible object store with
+// query string authentication (AWS signature version 4).
+type s3Provider struct {
+	endpoint  *url.URL
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	pathStyle bool
+	expiry    time.Duration
+
+	now func() time.Time
+}
+
+func newS3Provider(config *conf.Configuration) (*s3Provider, error) {
+	s3 := config.Downloads.S3
+	if s3.AccessKeyID == "" || s3.SecretAccessKey == "" {
+		return nil, errors.New("No access key configured for S3")
+	}
+
+	endpoint := s3.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3.amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse S3 endpoint")
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("S3 endpoint must be an absolute URL: %v", endpoint)
+	}
+
+	region := s3.Region
+	if region == "" {
+		region = defaultRegion
+	}
+	expiry := urlExpiry(config)
+	if expiry > s3MaxExpiry {
+		expiry = s3MaxExpiry
+	}
+
+	return &s3Provider{
+		endpoint:  u,
+		region:    region,
+		bucket:    s3.Bucket,
+		accessKey: s3.AccessKeyID,
+		secretKey: s3.SecretAccessKey,
+		pathStyle: s3.PathStyle,
+		expiry:    expiry,
+		now:       time.Now,
+	}, nil
+}
+
+// SignURL presigns a GET request for the object. The download URL is either
+// the key of the object in the configured bucket or `s3://bucket/key`.
+func (s *s3Provider) SignURL(_, downloadURL string) (string, error) {
+	bucket, key, err := s.object(downloadURL)
+	if err != nil {
+		return "", err
+	}
+
+	u := *s.endpoint
+	if s.pathStyle {
+		u.Path = "/" + bucket + "/" + key
+	} else {
+		u.Host = bucket + "." + u.Host
+		u.Path = "/" + key
+	}
+
+	now := s.now().UTC()
+	date := now.Format("20060102")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+
+	query := map[string]string{
+		"X-Amz-Algorithm":     s3Algorithm,
+		"X-Amz-Credential":    s.accessKey + "/" + scope,
+		"X-Amz-Date":          now.Format(s3DateFormat),
+		"X-Amz-Expires":       strconv.Itoa(int(s.expiry / time.Second)),
+		"X-Amz-SignedHeaders": "host",
+	}
+	canonicalQuery := s3CanonicalQuery(query)
+	canonicalURI := s3Escape(u.Path, false)
+
+	canonicalRequest := strings.Join([]string{
+		"GET",
+		canonicalURI,
+		canonicalQuery,
+		"host:" + u.Host + "\n",
+		"host",
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3Algorithm,
+		query["X-Amz-Date"],
+		scope,
+		hex.EncodeToString(requestHash[:]),
+	}, "\n")
+
+	signingKey := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{date, s.region, "s3", "aws4_request"} {
+		signingKey = hmacSHA256(signingKey, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	return u.Scheme + "://" + u.Host + canonicalURI + "?" + canonicalQuery + "&X-Amz-Signature=" + signature, nil
+}
+
+func (s *s3Provider) object(downloadURL string) (string, string, error) {
+	bucket := s.bucket
+	key := downloadURL
+	if strings.HasPrefix(downloadURL, "s3://") {
+		parts := strings.SplitN(strings.TrimPrefix(downloadURL, "s3://"), "/", 2)
+		bucket = parts[0]
+		key = ""
+		if len(parts) == 2 {
+			key = parts[1]
+		}
+	} else if strings.Contains(downloadURL, "://") {
+		return "", "", fmt.Errorf("Download URL is not an S3 object: %v", downloadURL)
+	}
+
+	key = strings.TrimPrefix(key, "/")
+	if bucket == "" {
+		return "", "", errors.New("No S3 bucket configured for download")
+	}
+	if key == "" {
+		return "", "", errors.New("Download URL is missing the S3 object key")
+	}
+	return bucket, key, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func s3CanonicalQuery(query map[string]string) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = s3Escape(k, true) + "=" + s3Escape(query[k], true)
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Escape percent-encodes everything but the unreserved characters of
+// RFC 3986, and slashes unless encodeSlash is set.
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
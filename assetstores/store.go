@@ -2,13 +2,18 @@ package assetstores
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/netlify/gocommerce/conf"
 )
 
+const defaultURLExpiry = 1 * time.Hour
+
 // Store is the interface wrapping an asset store that can sign download URLs.
 type Store interface {
-	SignURL(string) (string, error)
+	// SignURL returns a URL to download the file at downloadURL. The ID of
+	// the download is used by stores serving the files through GoCommerce.
+	SignURL(downloadID, downloadURL string) (string, error)
 }
 
 // NewStore creates an asset store based on the provided configuration.
@@ -16,9 +21,20 @@ func NewStore(config *conf.Configuration) (Store, error) {
 	switch config.Downloads.Provider {
 	case "netlify":
 		return newNetlifyProvider(config.Downloads.NetlifyToken)
+	case "s3":
+		return newS3Provider(config)
+	case "local":
+		return newLocalProvider(config)
 	case "":
 		return newNoopProvider()
 	default:
 		return nil, fmt.Errorf("Unknown asset store provider '%v'", config.Downloads.Provider)
 	}
 }
+
+func urlExpiry(config *conf.Configuration) time.Duration {
+	if config.Downloads.URLExpiry > 0 {
+		return time.Duration(config.Downloads.URLExpiry) * time.Second
+	}
+	return defaultURLExpiry
+}
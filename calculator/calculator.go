@@ -2,9 +2,11 @@ package calculator
 
 import (
 	"math"
+	"sort"
 	"strconv"
 
 	"github.com/netlify/gocommerce/claims"
+	"github.com/netlify/gocommerce/countries"
 	"github.com/sirupsen/logrus"
 )
 
@@ -24,6 +26,16 @@ type Price struct {
 	NetTotal uint64
 	Taxes    uint64
 	Total    int64
+
+	// TaxAmounts sums up the taxes of all items by tax rate.
+	TaxAmounts []TaxAmount
+}
+
+// TaxAmount is the part of a price taxed at a single rate.
+type TaxAmount struct {
+	Rate     uint64
+	NetTotal uint64
+	Taxes    uint64
 }
 
 // ItemPrice is the price of a single line item.
@@ -36,6 +48,11 @@ type ItemPrice struct {
 	Taxes    uint64
 	Total    int64
 
+	// TaxAmounts splits the net total and taxes of the item by tax rate, as
+	// the parts of an item can be taxed at different rates. For the items of
+	// a Price they cover the whole quantity, like the totals of the Price.
+	TaxAmounts []TaxAmount
+
 	DiscountItems []DiscountItem
 }
 
@@ -173,7 +190,7 @@ func (t *Tax) AppliesTo(country, productType string) bool {
 	if t.Countries != nil && len(t.Countries) > 0 {
 		applies = false
 		for _, c := range t.Countries {
-			if c == country {
+			if countries.Same(c, country) {
 				applies = true
 				break
 			}
@@ -186,7 +203,7 @@ func calculateAmountsForSingleItem(settings *Settings, lineLogger logrus.FieldLo
 	itemPrice := ItemPrice{Quantity: item.GetQuantity()}
 
 	singlePrice := item.PriceInLowestUnit() * multiplier
-	_, itemPrice.Subtotal = calculateTaxes(singlePrice, item, params, settings)
+	_, itemPrice.Subtotal, _ = calculateTaxes(singlePrice, item, params, settings)
 
 	// apply discount to original price
 	coupon := params.Coupon
@@ -220,7 +237,7 @@ func calculateAmountsForSingleItem(settings *Settings, lineLogger logrus.FieldLo
 		discountedPrice = singlePrice - itemPrice.Discount
 	}
 
-	itemPrice.Taxes, itemPrice.NetTotal = calculateTaxes(discountedPrice, item, params, settings)
+	itemPrice.Taxes, itemPrice.NetTotal, itemPrice.TaxAmounts = calculateTaxes(discountedPrice, item, params, settings)
 	itemPrice.Total = int64(itemPrice.NetTotal + itemPrice.Taxes)
 
 	return itemPrice
@@ -257,8 +274,6 @@ func CalculatePrice(settings *Settings, jwtClaims map[string]interface{}, params
 				"item_taxes":    itemPrice.Taxes,
 			}).Info("calculated item price")
 
-		price.Items = append(price.Items, itemPrice)
-
 		// avoid issues with rounding when multiplying by quantity before taxation
 		itemPriceMultiple := calculateAmountsForSingleItem(settings, lineLogger, jwtClaims, params, item, item.GetQuantity())
 		price.Subtotal += itemPriceMultiple.Subtotal
@@ -266,7 +281,12 @@ func CalculatePrice(settings *Settings, jwtClaims map[string]interface{}, params
 		price.NetTotal += itemPriceMultiple.NetTotal
 		price.Taxes += itemPriceMultiple.Taxes
 		price.Total += itemPriceMultiple.Total
+		price.TaxAmounts = addTaxAmounts(price.TaxAmounts, itemPriceMultiple.TaxAmounts...)
+
+		itemPrice.TaxAmounts = itemPriceMultiple.TaxAmounts
+		price.Items = append(price.Items, itemPrice)
 	}
+	sort.Slice(price.TaxAmounts, func(i, j int) bool { return price.TaxAmounts[i].Rate < price.TaxAmounts[j].Rate })
 
 	price.Total = int64(price.NetTotal + price.Taxes)
 	priceLogger.WithFields(
@@ -293,7 +313,7 @@ func calculateDiscount(amountToDiscount, percentage, fixed uint64) uint64 {
 	return discount
 }
 
-func calculateTaxes(amountToTax uint64, item Item, params PriceParameters, settings *Settings) (taxes uint64, subtotal uint64) {
+func calculateTaxes(amountToTax uint64, item Item, params PriceParameters, settings *Settings) (taxes uint64, subtotal uint64, amounts []TaxAmount) {
 	includeTaxes := settings != nil && settings.PricesIncludeTaxes
 	originalPrice := item.PriceInLowestUnit()
 
@@ -326,24 +346,45 @@ func calculateTaxes(amountToTax uint64, item Item, params PriceParameters, setti
 	taxes = 0
 	if len(taxAmounts) == 0 {
 		subtotal = amountToTax
+		amounts = []TaxAmount{{NetTotal: amountToTax}}
 		return
 	}
 
 	subtotal = 0
 	for _, tax := range taxAmounts {
+		var taxAmount uint64
 		if includeTaxes {
-			taxAmount := rint(float64(tax.price) / float64(100+tax.percentage) * 100 * (float64(tax.percentage) / 100))
+			taxAmount = rint(float64(tax.price) / float64(100+tax.percentage) * 100 * (float64(tax.percentage) / 100))
 			tax.price -= taxAmount
-			taxes += taxAmount
 		} else {
-			taxes += rint(float64(tax.price) * float64(tax.percentage) / 100)
+			taxAmount = rint(float64(tax.price) * float64(tax.percentage) / 100)
 		}
+		taxes += taxAmount
 		subtotal += tax.price
+		amounts = addTaxAmounts(amounts, TaxAmount{Rate: tax.percentage, NetTotal: tax.price, Taxes: taxAmount})
 	}
-
 	return
 }
 
+// addTaxAmounts adds the amounts to the ones taxed at the same rate.
+func addTaxAmounts(amounts []TaxAmount, add ...TaxAmount) []TaxAmount {
+	for _, amount := range add {
+		found := false
+		for i := range amounts {
+			if amounts[i].Rate == amount.Rate {
+				amounts[i].NetTotal += amount.NetTotal
+				amounts[i].Taxes += amount.Taxes
+				found = true
+				break
+			}
+		}
+		if !found {
+			amounts = append(amounts, amount)
+		}
+	}
+	return amounts
+}
+
 // Nopes - no `round` method in go
 // See https://github.com/golang/go/blob/master/src/math/floor.go#L58
 
@@ -159,6 +159,33 @@ func TestCountryBasedVAT(t *testing.T) {
 	})
 }
 
+func TestCountryBasedVATWithCountryCode(t *testing.T) {
+	settings := &Settings{
+		Taxes: []*Tax{&Tax{
+			Percentage:   19,
+			ProductTypes: []string{"test"},
+			Countries:    []string{"Germany"},
+		}},
+	}
+
+	params := PriceParameters{"DE", "EUR", nil, []Item{&TestItem{price: 100, itemType: "test"}}}
+	price := CalculatePrice(settings, nil, params, testLogger)
+	validatePrice(t, price, Price{
+		Subtotal: 100,
+		NetTotal: 100,
+		Taxes:    19,
+		Total:    119,
+	})
+
+	params = PriceParameters{"AT", "EUR", nil, []Item{&TestItem{price: 100, itemType: "test"}}}
+	price = CalculatePrice(settings, nil, params, testLogger)
+	validatePrice(t, price, Price{
+		Subtotal: 100,
+		NetTotal: 100,
+		Total:    100,
+	})
+}
+
 func TestCouponWithNoTaxes(t *testing.T) {
 	coupon := &TestCoupon{itemType: "test", percentage: 10}
 	params := PriceParameters{"USA", "USD", coupon, []Item{&TestItem{price: 100, itemType: "test"}}}
@@ -248,6 +275,38 @@ func TestPricingItems(t *testing.T) {
 		Taxes:    10,
 		Total:    110,
 	})
+
+	expected := []TaxAmount{{Rate: 7, NetTotal: 80, Taxes: 6}, {Rate: 21, NetTotal: 20, Taxes: 4}}
+	assert.Equal(t, expected, price.TaxAmounts)
+	assert.Equal(t, expected, price.Items[0].TaxAmounts)
+}
+
+func TestTaxAmountsForQuantity(t *testing.T) {
+	settings := &Settings{Taxes: []*Tax{&Tax{
+		Percentage:   7,
+		ProductTypes: []string{"book"},
+		Countries:    []string{"DE"},
+	}, &Tax{
+		Percentage:   19,
+		ProductTypes: []string{"ebook"},
+		Countries:    []string{"DE"},
+	}}}
+	book := &TestItem{price: 15, itemType: "book", quantity: 3}
+	ebook := &TestItem{price: 35, itemType: "ebook", quantity: 1}
+	params := PriceParameters{"DE", "USD", nil, []Item{book, ebook}}
+	price := CalculatePrice(settings, nil, params, testLogger)
+
+	validatePrice(t, price, Price{
+		Subtotal: 80,
+		Discount: 0,
+		NetTotal: 80,
+		Taxes:    10,
+		Total:    90,
+	})
+	// a single book is taxed 1, three books are taxed 3
+	assert.Equal(t, uint64(1), price.Items[0].Taxes)
+	assert.Equal(t, []TaxAmount{{Rate: 7, NetTotal: 45, Taxes: 3}}, price.Items[0].TaxAmounts)
+	assert.Equal(t, []TaxAmount{{Rate: 7, NetTotal: 45, Taxes: 3}, {Rate: 19, NetTotal: 35, Taxes: 7}}, price.TaxAmounts)
 }
 
 func TestMemberDiscounts(t *testing.T) {
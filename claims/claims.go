@@ -8,9 +8,11 @@ import (
 
 // JWTClaims represents the JWT claims information.
 type JWTClaims struct {
-	Email        string                 `json:"email"`
-	AppMetaData  map[string]interface{} `json:"app_metadata"`
-	UserMetaData map[string]interface{} `json:"user_metadata"`
+	Email string `json:"email"`
+	// EmailVerified is only set by identity providers that verify emails
+	EmailVerified *bool                  `json:"email_verified,omitempty"`
+	AppMetaData   map[string]interface{} `json:"app_metadata"`
+	UserMetaData  map[string]interface{} `json:"user_metadata"`
 	jwt.StandardClaims
 }
 
@@ -31,12 +31,25 @@ type SMTPConfiguration struct {
 	AdminEmail string `json:"admin_email" split_words:"true"`
 }
 
+// ShippingConfiguration limits the countries orders can be shipped to.
+// Countries are given by name or ISO 3166-1 code.
+type ShippingConfiguration struct {
+	// AllowedCountries are the only countries that can be shipped to if set
+	AllowedCountries []string `json:"allowed_countries" split_words:"true"`
+	// DeniedCountries are the countries that can't be shipped to
+	DeniedCountries []string `json:"denied_countries" split_words:"true"`
+}
+
 // GlobalConfiguration holds all the global configuration for gocommerce
 type GlobalConfiguration struct {
 	API struct {
 		Host     string
 		Port     int `envconfig:"PORT" default:"8080"`
 		Endpoint string
+		// TrustedProxies are the subnets of the proxies whose X-Forwarded-For
+		// header is used for the client IP. By default the header of any client
+		// is used, which lets clients fake their IP.
+		TrustedProxies []string `split_words:"true"`
 	}
 	DB                DBConfiguration
 	Logging           LoggingConfig `envconfig:"LOG"`
@@ -47,8 +60,26 @@ type GlobalConfiguration struct {
 
 // EmailContentConfiguration holds the configuration for emails, both subjects and template URLs.
 type EmailContentConfiguration struct {
-	OrderConfirmation string `json:"order_confirmation" split_words:"true"`
-	OrderReceived     string `json:"order_received" split_words:"true"`
+	OrderConfirmation  string `json:"order_confirmation" split_words:"true"`
+	OrderReceived      string `json:"order_received" split_words:"true"`
+	DownloadsUpdated   string `json:"downloads_updated" split_words:"true"`
+	OrderNote          string `json:"order_note" split_words:"true"`
+	Shipment           string `json:"shipment" split_words:"true"`
+	LicenseKeysMissing string `json:"license_keys_missing" split_words:"true"`
+}
+
+// SequenceConfiguration holds the numbering rules for a kind of legal document.
+//
+// Format may contain the placeholders {number}, {number:N} (zero padded to N
+// digits), {year}, {yy}, {month}, {currency} and {entity}. It defaults to the
+// plain number. Reset can be set to "yearly" to restart the sequence every
+// year, which requires the format to contain {year} or {yy} so that numbers
+// don't repeat. PerCurrency keeps a separate sequence for each currency,
+// which requires the format to contain {currency} for the same reason.
+type SequenceConfiguration struct {
+	Format      string `json:"format"`
+	Reset       string `json:"reset"`
+	PerCurrency bool   `json:"per_currency" split_words:"true"`
 }
 
 // Configuration holds all the per-tenant configuration for gocommerce
@@ -78,10 +109,82 @@ type Configuration struct {
 	} `json:"payment"`
 
 	Downloads struct {
+		// Provider is one of "netlify", "s3" or "local", downloads are
+		// served from their original URL if empty
 		Provider     string `json:"provider"`
 		NetlifyToken string `json:"netlify_token" split_words:"true"`
+		// URLExpiry is the number of seconds signed download URLs are valid
+		URLExpiry int `json:"url_expiry" split_words:"true"`
+
+		S3 struct {
+			Endpoint        string `json:"endpoint"`
+			Region          string `json:"region"`
+			Bucket          string `json:"bucket"`
+			AccessKeyID     string `json:"access_key_id" split_words:"true"`
+			SecretAccessKey string `json:"secret_access_key" split_words:"true"`
+			// PathStyle puts the bucket in the path instead of the host name,
+			// as needed by most self-hosted S3-compatible servers
+			PathStyle bool `json:"path_style" split_words:"true"`
+		} `json:"s3"`
+
+		Local struct {
+			// Path is the directory the download files are read from
+			Path string `json:"path"`
+			// Endpoint is the public URL of the GoCommerce API used in the
+			// signed download URLs, they are relative if empty
+			Endpoint string `json:"endpoint"`
+			// SigningSecret for download URLs, defaults to the JWT secret
+			SigningSecret string `json:"signing_secret" split_words:"true"`
+		} `json:"local"`
 	} `json:"downloads"`
 
+	Invoices struct {
+		// Entity is the legal entity issuing invoices. Instances with the
+		// same entity share their sequences. Defaults to the instance.
+		Entity string `json:"entity"`
+		// CurrencyEntities overrides the entity for orders in a currency
+		CurrencyEntities map[string]string `json:"currency_entities" split_words:"true"`
+
+		Numbers     SequenceConfiguration `json:"numbers"`
+		CreditNotes SequenceConfiguration `json:"credit_notes" split_words:"true"`
+	} `json:"invoices"`
+
+	Catalog struct {
+		// Provider is one of "html" (default), "json" or "database"
+		Provider string `json:"provider"`
+		// URL of the product feed for the json provider, relative to the site
+		URL string `json:"url"`
+		// CacheTTL is the number of seconds product metadata is cached,
+		// negative values disable the cache
+		CacheTTL int `json:"cache_ttl" split_words:"true"`
+		// Timeout is the number of seconds to wait for product metadata
+		Timeout int `json:"timeout"`
+	} `json:"catalog"`
+
+	Settings struct {
+		// CacheTTL is the number of seconds before the site settings are
+		// revalidated
+		CacheTTL int `json:"cache_ttl" split_words:"true"`
+		// MissingAsEmpty uses empty settings if the site has no settings file
+		MissingAsEmpty bool `json:"missing_as_empty" split_words:"true"`
+	} `json:"settings"`
+
+	GuestOrders struct {
+		// ClaimPolicy is one of "manual" (default) to link guest orders to
+		// a user through the claim endpoint, "auto" to also link them on the
+		// first authenticated request of the user, or "disabled"
+		ClaimPolicy string `json:"claim_policy" split_words:"true"`
+		// Orders are only linked for tokens with a true email_verified
+		// claim, since anyone can sign up with the email of a guest order.
+		// AllowUnverifiedEmail also links them for tokens without the
+		// claim, for identity providers that only issue tokens for verified
+		// emails. Tokens with a false email_verified claim are always
+		// refused.
+		AllowUnverifiedEmail bool `json:"allow_unverified_email" split_words:"true"`
+	} `json:"guest_orders" split_words:"true"`
+
+	Shipping ShippingConfiguration `json:"shipping"`
+
 	Coupons struct {
 		URL      string `json:"url"`
 		User     string `json:"user"`
@@ -89,15 +192,25 @@ type Configuration struct {
 	} `json:"coupons"`
 
 	Webhooks struct {
-		Order   string `json:"order"`
-		Payment string `json:"payment"`
-		Update  string `json:"update"`
-		Refund  string `json:"refund"`
+		Order       string `json:"order"`
+		Payment     string `json:"payment"`
+		Update      string `json:"update"`
+		Refund      string `json:"refund"`
+		Fulfillment string `json:"fulfillment"`
+		Shipment    string `json:"shipment"`
+		Return      string `json:"return"`
 
 		Secret string `json:"secret"`
 	} `json:"webhooks"`
 }
 
+// The policies for linking guest orders to users.
+const (
+	ClaimPolicyManual   = "manual"
+	ClaimPolicyAuto     = "auto"
+	ClaimPolicyDisabled = "disabled"
+)
+
 func (c *Configuration) SettingsURL() string {
 	return c.SiteURL + "/gocommerce/settings.json"
 }
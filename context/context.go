@@ -38,6 +38,7 @@ const (
 	instanceIDKey      = contextKey("instance_id")
 	instanceKey        = contextKey("instance")
 	dbKey              = contextKey("db")
+	productKey         = contextKey("product")
 )
 
 // WithConfig adds the tenant configuration to the context.
@@ -227,6 +228,17 @@ func WithOrderID(ctx context.Context, orderID string) context.Context {
 	return context.WithValue(ctx, orderIDKey, orderID)
 }
 
+// GetProduct reads the catalog product from the context.
+func GetProduct(ctx context.Context) *models.Product {
+	p, _ := ctx.Value(productKey).(*models.Product)
+	return p
+}
+
+// WithProduct adds the catalog product to the context.
+func WithProduct(ctx context.Context, product *models.Product) context.Context {
+	return context.WithValue(ctx, productKey, product)
+}
+
 // WithInstanceID adds the instance id to the context.
 func WithInstanceID(ctx context.Context, id string) context.Context {
 	return context.WithValue(ctx, instanceIDKey, id)
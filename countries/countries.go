@@ -0,0 +1,72 @@
+// Package countries looks up ISO 3166 country and subdivision codes, so that
+// addresses and tax settings can name countries either way.
+package countries
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/pariz/gountries"
+)
+
+var (
+	query     *gountries.Query
+	queryOnce sync.Once
+)
+
+// the dataset takes a while to load, so it's only done on first use
+func data() *gountries.Query {
+	queryOnce.Do(func() {
+		query = gountries.New()
+	})
+	return query
+}
+
+// Code returns the ISO 3166-1 alpha-2 code of a country given by its alpha-2
+// or alpha-3 code, or by its common or official name. It returns false if the
+// country is unknown.
+func Code(country string) (string, bool) {
+	country = strings.TrimSpace(country)
+	if country == "" {
+		return "", false
+	}
+	if c, err := data().FindCountryByAlpha(country); err == nil {
+		return c.Alpha2, true
+	}
+	if c, err := data().FindCountryByName(country); err == nil {
+		return c.Alpha2, true
+	}
+	return "", false
+}
+
+// Same reports whether two country names or codes refer to the same country.
+func Same(a, b string) bool {
+	if strings.EqualFold(a, b) {
+		return true
+	}
+	codeA, okA := Code(a)
+	codeB, okB := Code(b)
+	return okA && okB && codeA == codeB
+}
+
+// SubdivisionCode returns the code of a subdivision of the country with the
+// given alpha-2 code, given by its code or name. States are accepted as they
+// are for countries without known subdivisions.
+func SubdivisionCode(country, state string) (string, bool) {
+	subdivisions := data().Subdivisions[strings.ToLower(country)]
+	if len(subdivisions) == 0 {
+		return state, true
+	}
+
+	for _, sd := range subdivisions {
+		if strings.EqualFold(sd.Code, state) || strings.EqualFold(sd.Name, state) {
+			return sd.Code, true
+		}
+		for _, name := range sd.Names {
+			if strings.EqualFold(name, state) {
+				return sd.Code, true
+			}
+		}
+	}
+	return "", false
+}
@@ -16,6 +16,10 @@ type Mailer interface {
 	OrderConfirmationMail(transaction *models.Transaction) error
 	OrderReceivedMail(transaction *models.Transaction) error
 	OrderConfirmationMailBody(transaction *models.Transaction, templateURL string) (string, error)
+	DownloadsUpdatedMail(order *models.Order, downloads []models.Download) error
+	OrderNoteMail(order *models.Order, note *models.OrderNote) error
+	ShipmentMail(order *models.Order, shipment *models.Shipment) error
+	LicenseKeysMissingMail(order *models.Order, reason error) error
 }
 
 type mailer struct {
@@ -68,6 +72,7 @@ func NewMailer(smtp conf.SMTPConfiguration, instanceConfig *conf.Configuration)
 				"dateFormat":     dateFormat,
 				"price":          price,
 				"hasProductType": hasProductType,
+				"hasLicenseKeys": hasLicenseKeys,
 			},
 			Logger: logrus.New(),
 		},
@@ -98,6 +103,15 @@ func hasProductType(order *models.Order, productType string) bool {
 	return false
 }
 
+func hasLicenseKeys(order *models.Order) bool {
+	for _, download := range order.Downloads {
+		if download.LicenseKey != "" {
+			return true
+		}
+	}
+	return false
+}
+
 const defaultConfirmationTemplate = `<h2>Thank you for your order!</h2>
 
 <ul>
@@ -106,6 +120,15 @@ const defaultConfirmationTemplate = `<h2>Thank you for your order!</h2>
 {{ end }}
 </ul>
 
+{{ if hasLicenseKeys .Order }}
+<h3>Your license keys</h3>
+<ul>
+{{ range .Order.Downloads }}{{ if .LicenseKey }}
+<li>{{ .Title }}: <code>{{ .LicenseKey }}</code></li>
+{{ end }}{{ end }}
+</ul>
+{{ end }}
+
 <p>Total amount: <strong>{{ .Order.Total }}</strong></p>
 `
 
@@ -151,6 +174,124 @@ func (m *mailer) OrderReceivedMail(transaction *models.Transaction) error {
 	)
 }
 
+const defaultDownloadsUpdatedTemplate = `<h2>An update is available for your order</h2>
+
+<ul>
+{{ range .Downloads }}
+<li>{{ .Title }}{{ if .Version }} (version {{ .Version }}){{ end }}</li>
+{{ end }}
+</ul>
+
+<p>Visit <a href="{{ .SiteURL }}">{{ .SiteURL }}</a> to download the new files.</p>
+`
+
+// DownloadsUpdatedMail notifies the buyer of an order about new downloads
+func (m *mailer) DownloadsUpdatedMail(order *models.Order, downloads []models.Download) error {
+	return m.TemplateMailer.Mail(
+		order.Email,
+		withDefault(m.Config.Mailer.Subjects.DownloadsUpdated, "Update Available"),
+		m.Config.Mailer.Templates.DownloadsUpdated,
+		defaultDownloadsUpdatedTemplate,
+		map[string]interface{}{
+			"SiteURL":   m.Config.SiteURL,
+			"Order":     order,
+			"Downloads": downloads,
+		},
+	)
+}
+
+const defaultOrderNoteTemplate = `<h2>A message about your order</h2>
+
+<p>{{ .Note.Text }}</p>
+
+<p>Visit <a href="{{ .SiteURL }}">{{ .SiteURL }}</a> to see your order.</p>
+`
+
+// OrderNoteMail sends a customer visible note to the buyer of an order
+func (m *mailer) OrderNoteMail(order *models.Order, note *models.OrderNote) error {
+	return m.TemplateMailer.Mail(
+		order.Email,
+		withDefault(m.Config.Mailer.Subjects.OrderNote, "A Message About Your Order"),
+		m.Config.Mailer.Templates.OrderNote,
+		defaultOrderNoteTemplate,
+		map[string]interface{}{
+			"SiteURL": m.Config.SiteURL,
+			"Order":   order,
+			"Note":    note,
+		},
+	)
+}
+
+const defaultShipmentTemplate = `<h2>Your order is on its way!</h2>
+
+<ul>
+{{ range .Items }}
+<li>{{ .Title }} <strong>{{ .Quantity }}</strong></li>
+{{ end }}
+</ul>
+
+{{ if .Shipment.TrackingNumber }}
+<p>{{ .Shipment.Carrier }} tracking number:
+{{ if .Shipment.TrackingURL }}<a href="{{ .Shipment.TrackingURL }}">{{ .Shipment.TrackingNumber }}</a>{{ else }}{{ .Shipment.TrackingNumber }}{{ end }}</p>
+{{ end }}
+`
+
+type shipmentMailItem struct {
+	Title    string
+	Sku      string
+	Quantity uint64
+}
+
+// ShipmentMail notifies the buyer of an order about a shipment
+func (m *mailer) ShipmentMail(order *models.Order, shipment *models.Shipment) error {
+	titles := map[int64]string{}
+	for _, item := range order.LineItems {
+		titles[item.ID] = item.Title
+	}
+	items := make([]shipmentMailItem, len(shipment.Items))
+	for i, item := range shipment.Items {
+		items[i] = shipmentMailItem{Title: titles[item.LineItemID], Sku: item.Sku, Quantity: item.Quantity}
+	}
+
+	return m.TemplateMailer.Mail(
+		order.Email,
+		withDefault(m.Config.Mailer.Subjects.Shipment, "Your Order Has Shipped"),
+		m.Config.Mailer.Templates.Shipment,
+		defaultShipmentTemplate,
+		map[string]interface{}{
+			"SiteURL":  m.Config.SiteURL,
+			"Order":    order,
+			"Shipment": shipment,
+			"Items":    items,
+		},
+	)
+}
+
+const defaultLicenseKeysMissingTemplate = `<h2>License keys could not be assigned</h2>
+
+<p>Order <a href="{{ .SiteURL }}">{{ .Order.ID }}</a> from {{ .Order.Email }} was paid, but its license keys could not be assigned:</p>
+
+<p><strong>{{ .Reason }}</strong></p>
+
+<p>Add keys to the pool and assign them to the order.</p>
+`
+
+// LicenseKeysMissingMail notifies the shop admin that the license keys of a
+// paid order couldn't be assigned
+func (m *mailer) LicenseKeysMissingMail(order *models.Order, reason error) error {
+	return m.TemplateMailer.Mail(
+		m.TemplateMailer.From,
+		withDefault(m.Config.Mailer.Subjects.LicenseKeysMissing, "License Keys Missing For Order {{ .Order.ID }}"),
+		m.Config.Mailer.Templates.LicenseKeysMissing,
+		defaultLicenseKeysMissingTemplate,
+		map[string]interface{}{
+			"SiteURL": m.Config.SiteURL,
+			"Order":   order,
+			"Reason":  reason.Error(),
+		},
+	)
+}
+
 func (m *mailer) OrderConfirmationMailBody(transaction *models.Transaction, templateURL string) (string, error) {
 	if templateURL == "" {
 		templateURL = m.Config.Mailer.Templates.OrderConfirmation
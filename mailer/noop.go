@@ -18,3 +18,19 @@ func (m *noopMailer) OrderReceivedMail(transaction *models.Transaction) error {
 func (m *noopMailer) OrderConfirmationMailBody(transaction *models.Transaction, templateURL string) (string, error) {
 	return "Order Confirmed", nil
 }
+
+func (m *noopMailer) DownloadsUpdatedMail(order *models.Order, downloads []models.Download) error {
+	return nil
+}
+
+func (m *noopMailer) OrderNoteMail(order *models.Order, note *models.OrderNote) error {
+	return nil
+}
+
+func (m *noopMailer) ShipmentMail(order *models.Order, shipment *models.Shipment) error {
+	return nil
+}
+
+func (m *noopMailer) LicenseKeysMissingMail(order *models.Order, reason error) error {
+	return nil
+}
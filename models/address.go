@@ -4,6 +4,11 @@ import (
 	"fmt"
 	"strings"
 	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/countries"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
 )
 
 // AddressRequest is the raw address data
@@ -32,6 +37,9 @@ type Address struct {
 	User   *User  `json:"-"`
 	UserID string `json:"-"`
 
+	DefaultShipping bool `json:"default_shipping,omitempty" sql:"-"`
+	DefaultBilling  bool `json:"default_billing,omitempty" sql:"-"`
+
 	CreatedAt time.Time  `json:"created_at"`
 	DeletedAt *time.Time `json:"deleted_at"`
 }
@@ -41,15 +49,56 @@ func (Address) TableName() string {
 	return tableName("addresses")
 }
 
-// Validate validates the AddressRequest model
-func (a AddressRequest) Validate() error {
+// DetachFromOrders gives the orders using an address a copy of it that isn't
+// part of the address book of the user, so it can be changed or deleted
+// without changing past orders.
+func (a *Address) DetachFromOrders(tx *gorm.DB) error {
+	count := 0
+	orders := tx.Unscoped().Model(&Order{}).Where("shipping_address_id = ? OR billing_address_id = ?", a.ID, a.ID)
+	if result := orders.Count(&count); result.Error != nil {
+		return errors.Wrap(result.Error, "Error querying orders")
+	}
+	if count == 0 {
+		return nil
+	}
+
+	detached := &Address{
+		AddressRequest: a.AddressRequest,
+		ID:             uuid.NewRandom().String(),
+		CreatedAt:      a.CreatedAt,
+	}
+	if result := tx.Create(detached); result.Error != nil {
+		return errors.Wrap(result.Error, "Error copying address")
+	}
+	for _, column := range []string{"shipping_address_id", "billing_address_id"} {
+		result := tx.Unscoped().Model(&Order{}).Where(column+" = ?", a.ID).UpdateColumn(column, detached.ID)
+		if result.Error != nil {
+			return errors.Wrap(result.Error, "Error updating orders")
+		}
+	}
+	return nil
+}
+
+// Validate validates the AddressRequest model. The country is normalized to
+// its ISO 3166-1 alpha-2 code and the state to the code of the subdivision.
+func (a *AddressRequest) Validate() error {
 	a.combineNames()
+	a.Country = strings.TrimSpace(a.Country)
+	a.State = strings.TrimSpace(a.State)
+	a.Zip = strings.TrimSpace(a.Zip)
+
+	country, known := countries.Code(a.Country)
 	required := map[string]string{
 		"name":    a.Name,
 		"address": a.Address1,
 		"country": a.Country,
 		"city":    a.City,
-		"zip":     a.Zip,
+	}
+	if !noPostalCodes[country] {
+		required["zip"] = a.Zip
+	}
+	if stateRequired[country] {
+		required["state"] = a.State
 	}
 
 	missing := []string{}
@@ -63,6 +112,27 @@ func (a AddressRequest) Validate() error {
 		return fmt.Errorf("Required field missing: " + strings.Join(missing, ","))
 	}
 
+	if !known {
+		return fmt.Errorf("Unknown country: %v", a.Country)
+	}
+	a.Country = country
+
+	if a.State != "" {
+		state, ok := countries.SubdivisionCode(country, a.State)
+		if !ok {
+			return fmt.Errorf("Unknown state for %v: %v", country, a.State)
+		}
+		a.State = state
+	}
+
+	if a.Zip != "" {
+		zip, ok := normalizePostalCode(country, a.Zip)
+		if !ok {
+			return fmt.Errorf("Invalid zip for %v: %v", country, a.Zip)
+		}
+		a.Zip = zip
+	}
+
 	return nil
 }
 
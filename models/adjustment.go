@@ -0,0 +1,101 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+// AdjustmentChargeType and AdjustmentRefundType are the kinds of adjustments.
+// A charge collects the amount an edit added to a paid order, a refund pays
+// back the amount it removed.
+const (
+	AdjustmentChargeType = "charge"
+	AdjustmentRefundType = "refund"
+)
+
+// AdjustmentProcessingState is the state of an adjustment while it's being
+// charged or refunded.
+const AdjustmentProcessingState = "processing"
+
+// Adjustment is the difference in price caused by editing a paid order. It
+// stays pending until the difference has been charged or refunded, is
+// processing in the meantime, and is paid afterwards.
+type Adjustment struct {
+	InstanceID string `json:"-" sql:"index"`
+	ID         string `json:"id"`
+	OrderID    string `json:"order_id" sql:"index"`
+
+	Type     string `json:"type"`
+	Amount   uint64 `json:"amount"`
+	Currency string `json:"currency"`
+
+	TotalBefore uint64 `json:"total_before"`
+	TotalAfter  uint64 `json:"total_after"`
+
+	State         string `json:"state"`
+	TransactionID string `json:"transaction_id,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName returns the database table name for the Adjustment model.
+func (Adjustment) TableName() string {
+	return tableName("adjustments")
+}
+
+// NewAdjustment creates a pending Adjustment for the change of the total of
+// an order. It returns nil if the total didn't change.
+func NewAdjustment(order *Order, totalBefore uint64) *Adjustment {
+	adjustment := &Adjustment{
+		InstanceID:  order.InstanceID,
+		ID:          uuid.NewRandom().String(),
+		OrderID:     order.ID,
+		Currency:    order.Currency,
+		TotalBefore: totalBefore,
+		TotalAfter:  order.Total,
+		State:       PendingState,
+	}
+	switch {
+	case order.Total > totalBefore:
+		adjustment.Type = AdjustmentChargeType
+		adjustment.Amount = order.Total - totalBefore
+	case order.Total < totalBefore:
+		adjustment.Type = AdjustmentRefundType
+		adjustment.Amount = totalBefore - order.Total
+	default:
+		return nil
+	}
+	return adjustment
+}
+
+// Claim marks a pending adjustment as processing before it's charged or
+// refunded, so that concurrent requests can't both act on it. It returns
+// false if another request claimed or settled the adjustment first.
+func (a *Adjustment) Claim(db *gorm.DB) (bool, error) {
+	result := db.Model(&Adjustment{}).
+		Where("id = ? AND state = ? AND transaction_id = ?", a.ID, PendingState, "").
+		UpdateColumn("state", AdjustmentProcessingState)
+	if result.Error != nil {
+		return false, errors.Wrap(result.Error, "Error claiming adjustment")
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	a.State = AdjustmentProcessingState
+	return true, nil
+}
+
+// ReleaseClaim moves a claimed adjustment back to pending, when charging or
+// refunding it failed.
+func (a *Adjustment) ReleaseClaim(db *gorm.DB) error {
+	result := db.Model(&Adjustment{}).Where("id = ? AND state = ?", a.ID, AdjustmentProcessingState).UpdateColumn("state", PendingState)
+	if result.Error != nil {
+		return errors.Wrap(result.Error, "Error releasing adjustment")
+	}
+	a.State = PendingState
+	return nil
+}
@@ -0,0 +1,230 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/PuerkitoBio/goquery"
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/conf"
+	"github.com/pkg/errors"
+)
+
+const (
+	// HTMLCatalogProvider scrapes product metadata from the product pages.
+	HTMLCatalogProvider = "html"
+	// FeedCatalogProvider reads all products from a single JSON feed.
+	FeedCatalogProvider = "json"
+	// DatabaseCatalogProvider reads products managed through the admin API.
+	DatabaseCatalogProvider = "database"
+
+	defaultProductFeedPath = "/gocommerce/products.json"
+)
+
+// Catalog is the source of product metadata for line items.
+type Catalog interface {
+	// Product returns the metadata of the product with the sku listed at
+	// path. If sku is empty and path only lists a single product, that
+	// product is returned.
+	Product(path, sku string) (*LineItemMetadata, error)
+}
+
+// NewCatalog creates a catalog based on the provided configuration. The
+// database is only needed for the database provider.
+func NewCatalog(config *conf.Configuration, db *gorm.DB, instanceID string) (Catalog, error) {
+	switch config.Catalog.Provider {
+	case "", HTMLCatalogProvider:
+		return &htmlCatalog{
+			siteURL: config.SiteURL,
+			fetcher: newCatalogFetcher(config, instanceID),
+		}, nil
+	case FeedCatalogProvider:
+		return newFeedCatalog(config, instanceID)
+	case DatabaseCatalogProvider:
+		if db == nil {
+			return nil, errors.New("Database catalog requires a database connection")
+		}
+		return &databaseCatalog{db: db, instanceID: instanceID}, nil
+	default:
+		return nil, fmt.Errorf("Unknown catalog provider '%v'", config.Catalog.Provider)
+	}
+}
+
+// catalogFetcher loads metadata documents through the shared cache.
+type catalogFetcher struct {
+	instanceID string
+	client     *http.Client
+	ttl        time.Duration
+}
+
+func newCatalogFetcher(config *conf.Configuration, instanceID string) *catalogFetcher {
+	timeout := defaultCatalogTimeout
+	if config.Catalog.Timeout > 0 {
+		timeout = time.Duration(config.Catalog.Timeout) * time.Second
+	}
+	ttl := defaultCatalogCacheTTL
+	if config.Catalog.CacheTTL != 0 {
+		ttl = time.Duration(config.Catalog.CacheTTL) * time.Second
+	}
+
+	return &catalogFetcher{
+		instanceID: instanceID,
+		client:     &http.Client{Timeout: timeout},
+		ttl:        ttl,
+	}
+}
+
+func (f *catalogFetcher) fetch(url string, parse func(*http.Response) (interface{}, error)) (interface{}, error) {
+	return productMetadataCache.Fetch(f.client, f.instanceID, url, f.ttl, parse)
+}
+
+func selectProduct(products []*LineItemMetadata, sku string) (*LineItemMetadata, error) {
+	if len(products) == 1 && sku == "" {
+		return products[0], nil
+	}
+
+	for _, meta := range products {
+		if meta.Sku == sku {
+			return meta, nil
+		}
+	}
+
+	return nil, fmt.Errorf("No product Sku from path matched: %v", sku)
+}
+
+// htmlCatalog reads products from `.gocommerce-product` script tags on the
+// product pages of the site.
+type htmlCatalog struct {
+	siteURL string
+	fetcher *catalogFetcher
+}
+
+func (c *htmlCatalog) Product(path, sku string) (*LineItemMetadata, error) {
+	products, err := c.fetcher.fetch(c.siteURL+path, func(resp *http.Response) (interface{}, error) {
+		return parseProductPage(resp, path)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return selectProduct(products.([]*LineItemMetadata), sku)
+}
+
+func parseProductPage(resp *http.Response, path string) ([]*LineItemMetadata, error) {
+	doc, err := goquery.NewDocumentFromResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+
+	metaTag := doc.Find(".gocommerce-product")
+	if metaTag.Length() == 0 {
+		return nil, fmt.Errorf("No script tag with class gocommerce-product tag found for '%v'", path)
+	}
+	metaProducts := []*LineItemMetadata{}
+	var parsingErr error
+	metaTag.EachWithBreak(func(_ int, tag *goquery.Selection) bool {
+		meta := &LineItemMetadata{}
+		parsingErr = json.Unmarshal([]byte(tag.Text()), meta)
+		if parsingErr != nil {
+			return false
+		}
+		metaProducts = append(metaProducts, meta)
+		return true
+	})
+	if parsingErr != nil {
+		return nil, fmt.Errorf("Error parsing product metadata: %v", parsingErr)
+	}
+
+	return metaProducts, nil
+}
+
+type feedProduct struct {
+	Path string `json:"path"`
+	LineItemMetadata
+}
+
+type productFeed struct {
+	Products []*feedProduct `json:"products"`
+}
+
+// feedCatalog reads all products from a single JSON document of the form
+// `{"products": [{"path": "/my-product", "sku": "my-product", ...}]}`.
+type feedCatalog struct {
+	url     string
+	fetcher *catalogFetcher
+}
+
+func newFeedCatalog(config *conf.Configuration, instanceID string) (*feedCatalog, error) {
+	feedURL := config.Catalog.URL
+	if feedURL == "" {
+		feedURL = defaultProductFeedPath
+	}
+
+	u, err := url.Parse(feedURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse product feed URL")
+	}
+	if !u.IsAbs() {
+		siteURL, err := url.Parse(config.SiteURL)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to parse Site URL")
+		}
+		u = siteURL.ResolveReference(u)
+	}
+
+	return &feedCatalog{
+		url:     u.String(),
+		fetcher: newCatalogFetcher(config, instanceID),
+	}, nil
+}
+
+func (c *feedCatalog) Product(path, sku string) (*LineItemMetadata, error) {
+	feed, err := c.fetcher.fetch(c.url, func(resp *http.Response) (interface{}, error) {
+		feed := &productFeed{}
+		if err := json.NewDecoder(resp.Body).Decode(feed); err != nil {
+			return nil, errors.Wrap(err, "Error parsing product feed")
+		}
+		return feed, nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Error loading product feed")
+	}
+
+	matches := []*LineItemMetadata{}
+	for _, p := range feed.(*productFeed).Products {
+		if (sku != "" && p.Sku == sku) || (path != "" && p.Path == path) {
+			meta := p.LineItemMetadata
+			matches = append(matches, &meta)
+		}
+	}
+	return selectProduct(matches, sku)
+}
+
+// databaseCatalog reads the Product records of an instance.
+type databaseCatalog struct {
+	db         *gorm.DB
+	instanceID string
+}
+
+func (c *databaseCatalog) Product(path, sku string) (*LineItemMetadata, error) {
+	query := c.db.Where("instance_id = ?", c.instanceID)
+	if sku != "" {
+		query = query.Where("sku = ?", sku)
+	} else {
+		query = query.Where("path = ?", path)
+	}
+
+	products := []Product{}
+	if err := query.Find(&products).Error; err != nil {
+		return nil, errors.Wrap(err, "Error querying products")
+	}
+
+	metaProducts := make([]*LineItemMetadata, len(products))
+	for i := range products {
+		metaProducts[i] = products[i].Meta
+	}
+	return selectProduct(metaProducts, sku)
+}
@@ -0,0 +1,239 @@
+package models
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// MaxConcurrentMetadataFetches bounds the number of simultaneous
+	// product metadata lookups of a single order or download refresh.
+	MaxConcurrentMetadataFetches = 10
+
+	defaultCatalogCacheTTL = 1 * time.Minute
+	defaultCatalogTimeout  = 10 * time.Second
+	maxCatalogCacheEntries = 10000
+)
+
+// CatalogCacheStats holds the counters of the product metadata cache for an
+// instance.
+type CatalogCacheStats struct {
+	Hits        uint64  `json:"hits"`
+	Misses      uint64  `json:"misses"`
+	Revalidated uint64  `json:"revalidated"`
+	Errors      uint64  `json:"errors"`
+	Entries     int     `json:"entries"`
+	HitRate     float64 `json:"hit_rate"`
+}
+
+type catalogCacheEntry struct {
+	value        interface{}
+	etag         string
+	lastModified string
+	expires      time.Time
+}
+
+type catalogFetch struct {
+	done  chan struct{}
+	value interface{}
+	err   error
+}
+
+// catalogCache caches parsed product metadata documents per instance and URL.
+// Expired entries are revalidated with the ETag and Last-Modified headers of
+// the last response, and concurrent fetches of the same document share one
+// request.
+type catalogCache struct {
+	mutex    sync.Mutex
+	entries  map[string]*catalogCacheEntry
+	inflight map[string]*catalogFetch
+	stats    map[string]*CatalogCacheStats
+	now      func() time.Time
+}
+
+var productMetadataCache = &catalogCache{
+	entries:  make(map[string]*catalogCacheEntry),
+	inflight: make(map[string]*catalogFetch),
+	stats:    make(map[string]*CatalogCacheStats),
+	now:      time.Now,
+}
+
+// GetCatalogCacheStats returns the current counters of the product
+// metadata cache for an instance.
+func GetCatalogCacheStats(instanceID string) CatalogCacheStats {
+	return productMetadataCache.Stats(instanceID)
+}
+
+// ResetCatalogCache drops all cached product metadata, resets the counters
+// and restores the clock.
+func ResetCatalogCache() {
+	productMetadataCache.Reset()
+}
+
+// SetCatalogCacheClock replaces the clock used to expire cached product
+// metadata, so that tests don't have to wait for entries to expire.
+func SetCatalogCacheClock(now func() time.Time) {
+	productMetadataCache.mutex.Lock()
+	productMetadataCache.now = now
+	productMetadataCache.mutex.Unlock()
+}
+
+func (c *catalogCache) Stats(instanceID string) CatalogCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := CatalogCacheStats{}
+	if counters, ok := c.stats[instanceID]; ok {
+		stats = *counters
+	}
+	for key := range c.entries {
+		if strings.HasPrefix(key, instanceID+"|") {
+			stats.Entries++
+		}
+	}
+	if lookups := stats.Hits + stats.Revalidated + stats.Misses; lookups > 0 {
+		stats.HitRate = float64(stats.Hits+stats.Revalidated) / float64(lookups)
+	}
+	return stats
+}
+
+func (c *catalogCache) Reset() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.entries = make(map[string]*catalogCacheEntry)
+	c.stats = make(map[string]*CatalogCacheStats)
+	c.now = time.Now
+}
+
+// counters returns the counters of an instance. Must be called with the
+// mutex held.
+func (c *catalogCache) counters(instanceID string) *CatalogCacheStats {
+	stats, ok := c.stats[instanceID]
+	if !ok {
+		stats = &CatalogCacheStats{}
+		c.stats[instanceID] = stats
+	}
+	return stats
+}
+
+// Fetch returns the document at url parsed by parse, fetching it only if
+// there is no fresh copy in the cache.
+func (c *catalogCache) Fetch(client *http.Client, instanceID, url string, ttl time.Duration, parse func(*http.Response) (interface{}, error)) (interface{}, error) {
+	key := instanceID + "|" + url
+
+	c.mutex.Lock()
+	entry := c.entries[key]
+	if entry != nil && c.now().Before(entry.expires) {
+		c.counters(instanceID).Hits++
+		c.mutex.Unlock()
+		return entry.value, nil
+	}
+	if fetch, ok := c.inflight[key]; ok {
+		// sharing a request counts as a hit, it doesn't reach the site
+		c.counters(instanceID).Hits++
+		c.mutex.Unlock()
+		<-fetch.done
+		return fetch.value, fetch.err
+	}
+	fetch := &catalogFetch{done: make(chan struct{})}
+	c.inflight[key] = fetch
+	c.mutex.Unlock()
+
+	fetch.value, fetch.err = c.fetch(client, instanceID, key, url, entry, ttl, parse)
+
+	c.mutex.Lock()
+	delete(c.inflight, key)
+	c.mutex.Unlock()
+	close(fetch.done)
+
+	return fetch.value, fetch.err
+}
+
+func (c *catalogCache) fetch(client *http.Client, instanceID, key, url string, entry *catalogCacheEntry, ttl time.Duration, parse func(*http.Response) (interface{}, error)) (interface{}, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		if entry.etag != "" {
+			req.Header.Set("If-None-Match", entry.etag)
+		}
+		if entry.lastModified != "" {
+			req.Header.Set("If-Modified-Since", entry.lastModified)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		c.countError(instanceID)
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && entry != nil {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		c.counters(instanceID).Revalidated++
+		c.entries[key] = &catalogCacheEntry{
+			value:        entry.value,
+			etag:         entry.etag,
+			lastModified: entry.lastModified,
+			expires:      c.now().Add(ttl),
+		}
+		return entry.value, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		c.countError(instanceID)
+		return nil, fmt.Errorf("Error fetching product metadata from %s: %s", url, resp.Status)
+	}
+
+	value, err := parse(resp)
+	if err != nil {
+		c.countError(instanceID)
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.counters(instanceID).Misses++
+	if ttl > 0 {
+		c.evict()
+		c.entries[key] = &catalogCacheEntry{
+			value:        value,
+			etag:         resp.Header.Get("ETag"),
+			lastModified: resp.Header.Get("Last-Modified"),
+			expires:      c.now().Add(ttl),
+		}
+	}
+	return value, nil
+}
+
+func (c *catalogCache) countError(instanceID string) {
+	c.mutex.Lock()
+	c.counters(instanceID).Errors++
+	c.mutex.Unlock()
+}
+
+// evict makes room for a new entry. Expired entries are kept for
+// revalidation until the cache is full. Must be called with the mutex held.
+func (c *catalogCache) evict() {
+	if len(c.entries) < maxCatalogCacheEntries {
+		return
+	}
+	now := c.now()
+	for key, entry := range c.entries {
+		if now.After(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) < maxCatalogCacheEntries {
+			return
+		}
+		delete(c.entries, key)
+	}
+}
@@ -63,6 +63,7 @@ func tableName(defaultName string) string {
 func AutoMigrate(db *gorm.DB) error {
 	db = db.AutoMigrate(Address{},
 		LineItem{},
+		LineItemTax{},
 		AddonItem{},
 		PriceItem{},
 		Hook{},
@@ -74,6 +75,16 @@ func AutoMigrate(db *gorm.DB) error {
 		Event{},
 		Instance{},
 		InvoiceNumber{},
+		Sequence{},
+		Product{},
+		LicenseKey{},
+		RefundItem{},
+		Shipment{},
+		ShipmentItem{},
+		Return{},
+		ReturnItem{},
+		Adjustment{},
+		Erasure{},
 	)
 	return db.Error
 }
@@ -0,0 +1,61 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/conf"
+)
+
+// NextCreditNoteNumber allocates the next credit note number for a refund
+// on the order and returns it together with the formatted credit note ID.
+func NextCreditNoteNumber(tx *gorm.DB, config *conf.Configuration, order *Order) (int64, string, error) {
+	var seqConfig conf.SequenceConfiguration
+	if config != nil {
+		seqConfig = config.Invoices.CreditNotes
+	}
+	return nextDocumentNumber(tx, creditNoteSequence, seqConfig, config, order.InstanceID, order.Currency, nil)
+}
+
+// CreditNote is the legal document issued for a refund. It is not stored on
+// its own but assembled from the refund transaction and the refunded order.
+type CreditNote struct {
+	ID            string `json:"id"`
+	Number        int64  `json:"number"`
+	InvoiceID     string `json:"invoice_id"`
+	InvoiceNumber int64  `json:"invoice_number"`
+	TransactionID string `json:"transaction_id"`
+	OrderID       string `json:"order_id"`
+
+	Email          string  `json:"email"`
+	BillingAddress Address `json:"billing_address"`
+	VATNumber      string  `json:"vatnumber,omitempty"`
+
+	Amount   uint64 `json:"amount"`
+	Currency string `json:"currency"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// NewCreditNote builds the credit note for a refund transaction. It returns
+// nil if the transaction has not been assigned a credit note number.
+func NewCreditNote(refund *Transaction, order *Order) *CreditNote {
+	if refund.Type != RefundTransactionType || refund.CreditNoteNumber == 0 {
+		return nil
+	}
+
+	return &CreditNote{
+		ID:             refund.CreditNoteID,
+		Number:         refund.CreditNoteNumber,
+		InvoiceID:      refund.InvoiceID,
+		InvoiceNumber:  refund.InvoiceNumber,
+		TransactionID:  refund.ID,
+		OrderID:        order.ID,
+		Email:          order.Email,
+		BillingAddress: order.BillingAddress,
+		VATNumber:      order.VATNumber,
+		Amount:         refund.Amount,
+		Currency:       refund.Currency,
+		CreatedAt:      refund.CreatedAt,
+	}
+}
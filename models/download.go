@@ -18,8 +18,24 @@ type Download struct {
 	Format string `json:"format"`
 	URL    string `json:"url"`
 
+	// Version of the product the download belongs to. A new version of a
+	// download is added to the order next to the previous ones.
+	Version string `json:"version,omitempty"`
+
 	DownloadCount uint64 `json:"downloads"`
 
+	// MaxDownloads limits how often the download can be accessed
+	MaxDownloads uint64 `json:"max_downloads,omitempty"`
+	// MaxDownloadsPerIP limits how often the download can be accessed from
+	// a single IP address
+	MaxDownloadsPerIP uint64 `json:"max_downloads_per_ip,omitempty"`
+	// ExpiryDays is the number of days after the purchase during which the
+	// download can be accessed
+	ExpiryDays uint64 `json:"expiry_days,omitempty"`
+
+	// LicenseKey is set for downloads delivering a key instead of a file
+	LicenseKey string `json:"license_key,omitempty"`
+
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
 	DeletedAt *time.Time `json:"-" sql:"index"`
@@ -32,7 +48,7 @@ func (Download) TableName() string {
 
 // SignURL signs a download URL using the provided asset store.
 func (d *Download) SignURL(store assetstores.Store) error {
-	signedURL, err := store.SignURL(d.URL)
+	signedURL, err := store.SignURL(d.ID, d.URL)
 	if err != nil {
 		return err
 	}
@@ -40,3 +56,12 @@ func (d *Download) SignURL(store assetstores.Store) error {
 
 	return nil
 }
+
+// Expired returns whether the download period of a purchase made at paidAt is
+// over.
+func (d *Download) Expired(paidAt time.Time) bool {
+	if d.ExpiryDays == 0 {
+		return false
+	}
+	return time.Now().After(paidAt.Add(time.Duration(d.ExpiryDays) * 24 * time.Hour))
+}
@@ -0,0 +1,193 @@
+package models
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+// personalDiffFields are the fields of an event diff that hold personal data.
+var personalDiffFields = []string{"email", "meta", "session_id", "vatnumber"}
+
+// Erasure is the audit record of the personal data of a user being erased.
+// It only keeps the IDs and the number of records that were anonymized.
+type Erasure struct {
+	InstanceID string `json:"-" sql:"index"`
+	ID         string `json:"id"`
+	UserID     string `json:"user_id" sql:"index"`
+	ErasedBy   string `json:"erased_by"`
+
+	Orders    int `json:"orders"`
+	Addresses int `json:"addresses"`
+	Notes     int `json:"notes"`
+	Returns   int `json:"returns"`
+	Events    int `json:"events"`
+	Hooks     int `json:"hooks"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the Erasure model.
+func (Erasure) TableName() string {
+	return tableName("erasures")
+}
+
+// UserOrders filters a query to the orders of a user and the guest orders with
+// its email.
+func UserOrders(db *gorm.DB, instanceID string, user *User) *gorm.DB {
+	db = db.Where("instance_id = ?", instanceID)
+	if user.Email == "" {
+		return db.Where("user_id = ?", user.ID)
+	}
+	return db.Where("user_id = ? OR email = ?", user.ID, user.Email)
+}
+
+// ErasePersonalData anonymizes the personal data of a user: the user itself,
+// the orders of the user and the guest orders with its email, their addresses,
+// notes and returns, and the events and webhooks about them. Webhooks that
+// weren't delivered yet are cancelled. Amounts, line items, invoices and
+// transactions are kept since they have to be retained as financial records.
+// An Erasure is created as audit record.
+func ErasePersonalData(tx *gorm.DB, instanceID string, user *User, erasedBy string) (*Erasure, error) {
+	erasure := &Erasure{
+		InstanceID: instanceID,
+		ID:         uuid.NewRandom().String(),
+		UserID:     user.ID,
+		ErasedBy:   erasedBy,
+	}
+
+	orders := []*Order{}
+	if result := UserOrders(tx.Unscoped(), instanceID, user).Find(&orders); result.Error != nil {
+		return nil, errors.Wrap(result.Error, "Error querying orders")
+	}
+
+	orderIDs := []string{}
+	addressIDs := []string{}
+	for _, order := range orders {
+		orderIDs = append(orderIDs, order.ID)
+		addressIDs = append(addressIDs, order.ShippingAddressID, order.BillingAddressID)
+	}
+	erasure.Orders = len(orderIDs)
+
+	if len(orderIDs) > 0 {
+		result := tx.Unscoped().Model(&Order{}).Where("id IN (?)", orderIDs).UpdateColumns(map[string]interface{}{
+			"email":         "",
+			"ip":            "",
+			"session_id":    "",
+			"raw_meta_data": "",
+			"raw_claims":    "",
+			"vat_number":    "",
+		})
+		if result.Error != nil {
+			return nil, errors.Wrap(result.Error, "Error anonymizing orders")
+		}
+		if result := tx.Unscoped().Model(&LineItem{}).Where("order_id IN (?)", orderIDs).UpdateColumn("raw_meta_data", ""); result.Error != nil {
+			return nil, errors.Wrap(result.Error, "Error anonymizing line items")
+		}
+	}
+
+	result := tx.Unscoped().Model(&Address{}).Where("user_id = ? OR id IN (?)", user.ID, addressIDs).UpdateColumns(map[string]interface{}{
+		"name":       "",
+		"first_name": "",
+		"last_name":  "",
+		"company":    "",
+		"address1":   "",
+		"address2":   "",
+		"city":       "",
+		"zip":        "",
+	})
+	if result.Error != nil {
+		return nil, errors.Wrap(result.Error, "Error anonymizing addresses")
+	}
+	erasure.Addresses = int(result.RowsAffected)
+
+	result = tx.Unscoped().Model(&OrderNote{}).Where("order_id IN (?)", orderIDs).UpdateColumn("text", "")
+	if result.Error != nil {
+		return nil, errors.Wrap(result.Error, "Error anonymizing order notes")
+	}
+	erasure.Notes = int(result.RowsAffected)
+
+	result = tx.Model(&Return{}).Where("user_id = ? OR order_id IN (?)", user.ID, orderIDs).UpdateColumns(map[string]interface{}{
+		"reason":           "",
+		"rejection_reason": "",
+	})
+	if result.Error != nil {
+		return nil, errors.Wrap(result.Error, "Error anonymizing returns")
+	}
+	erasure.Returns = int(result.RowsAffected)
+
+	events := []Event{}
+	if result := tx.Where("user_id = ? OR order_id IN (?)", user.ID, orderIDs).Find(&events); result.Error != nil {
+		return nil, errors.Wrap(result.Error, "Error querying events")
+	}
+	for _, event := range events {
+		if err := anonymizeEvent(tx, &event); err != nil {
+			return nil, err
+		}
+	}
+	erasure.Events = len(events)
+
+	hooks := tx.Model(&Hook{}).Where("user_id = ? OR order_id IN (?)", user.ID, orderIDs)
+	result = hooks.Where("done = ?", true).UpdateColumns(map[string]interface{}{
+		"payload":       "",
+		"response_body": "",
+	})
+	if result.Error != nil {
+		return nil, errors.Wrap(result.Error, "Error anonymizing webhooks")
+	}
+	erasure.Hooks = int(result.RowsAffected)
+
+	// delivering a webhook without its payload makes no sense
+	result = hooks.Where("done = ?", false).UpdateColumns(map[string]interface{}{
+		"payload":       "",
+		"response_body": "",
+		"done":          true,
+		"failed":        true,
+		"error_message": "Cancelled by the erasure of personal data",
+	})
+	if result.Error != nil {
+		return nil, errors.Wrap(result.Error, "Error cancelling webhooks")
+	}
+	erasure.Hooks += int(result.RowsAffected)
+
+	if result := tx.Unscoped().Model(user).UpdateColumns(map[string]interface{}{"email": "", "name": ""}); result.Error != nil {
+		return nil, errors.Wrap(result.Error, "Error anonymizing user")
+	}
+
+	if result := tx.Create(erasure); result.Error != nil {
+		return nil, errors.Wrap(result.Error, "Error creating erasure record")
+	}
+	return erasure, nil
+}
+
+// anonymizeEvent removes the IP, the recipients of emails and the changes of
+// personal fields from an event.
+func anonymizeEvent(tx *gorm.DB, event *Event) error {
+	changes := event.Changes
+	if event.Type == string(EventEmail) {
+		changes = strings.SplitN(changes, ",", 2)[0]
+	}
+
+	rawDiff := ""
+	for _, field := range personalDiffFields {
+		delete(event.Diff, field)
+	}
+	if len(event.Diff) > 0 {
+		data, err := json.Marshal(event.Diff)
+		if err != nil {
+			return errors.Wrap(err, "Error anonymizing event")
+		}
+		rawDiff = string(data)
+	}
+
+	result := tx.Model(event).UpdateColumns(map[string]interface{}{
+		"ip":       "",
+		"changes":  changes,
+		"raw_diff": rawDiff,
+	})
+	return errors.Wrap(result.Error, "Error anonymizing event")
+}
@@ -1,6 +1,9 @@
 package models
 
 import (
+	"encoding/json"
+	"reflect"
+	"sort"
 	"strings"
 	"time"
 
@@ -22,6 +25,9 @@ type Event struct {
 	Type    string `json:"type"`
 	Changes string `json:"data"`
 
+	Diff    EventDiff `json:"diff,omitempty" sql:"-"`
+	RawDiff string    `json:"-" sql:"type:text"`
+
 	CreatedAt time.Time `json:"created_at"`
 }
 
@@ -30,6 +36,53 @@ func (Event) TableName() string {
 	return tableName("events")
 }
 
+// AfterFind database callback.
+func (e *Event) AfterFind() error {
+	if e.RawDiff != "" {
+		return json.Unmarshal([]byte(e.RawDiff), &e.Diff)
+	}
+	return nil
+}
+
+// BeforeSave database callback.
+func (e *Event) BeforeSave() error {
+	if len(e.Diff) > 0 {
+		data, err := json.Marshal(e.Diff)
+		if err != nil {
+			return err
+		}
+		e.RawDiff = string(data)
+	}
+	return nil
+}
+
+// FieldChange holds the value of a field before and after an update.
+type FieldChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// EventDiff maps the changed fields of an order to their change.
+type EventDiff map[string]FieldChange
+
+// Add records the change of a field, unless the value stayed the same.
+func (d EventDiff) Add(field string, before, after interface{}) {
+	if reflect.DeepEqual(before, after) {
+		return
+	}
+	d[field] = FieldChange{Before: before, After: after}
+}
+
+// Fields returns the names of the changed fields in alphabetical order.
+func (d EventDiff) Fields() []string {
+	fields := make([]string, 0, len(d))
+	for field := range d {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
 // EventType is the type of change that occurred.
 type EventType string
 
@@ -40,6 +93,8 @@ const (
 	EventUpdated EventType = "updated"
 	// EventDeleted is the EventType when an order is deleted.
 	EventDeleted EventType = "deleted"
+	// EventEmail is the EventType when an email about an order is sent.
+	EventEmail EventType = "email"
 )
 
 // LogEvent logs a new event
@@ -55,3 +110,17 @@ func LogEvent(db *gorm.DB, ip, userID, orderID string, eventType EventType, chan
 	}
 	db.Create(event)
 }
+
+// LogEventDiff logs a new event with the before and after values of the
+// changed fields.
+func LogEventDiff(db *gorm.DB, ip, userID, orderID string, eventType EventType, diff EventDiff) {
+	event := &Event{
+		IP:      ip,
+		UserID:  userID,
+		OrderID: orderID,
+		Type:    string(eventType),
+		Changes: strings.Join(diff.Fields(), ","),
+		Diff:    diff,
+	}
+	db.Create(event)
+}
@@ -25,7 +25,8 @@ const signatureExpiration = 5 * time.Minute
 type Hook struct {
 	ID uint64
 
-	UserID string
+	UserID  string
+	OrderID string `sql:"index"`
 
 	Type string
 
@@ -56,7 +57,7 @@ func (Hook) TableName() string {
 }
 
 // NewHook creates a Hook model.
-func NewHook(hookType, siteURL, hookURL, userID, secret string, payload interface{}) (*Hook, error) {
+func NewHook(hookType, siteURL, hookURL, userID, orderID, secret string, payload interface{}) (*Hook, error) {
 	fullHookURL, err := url.Parse(hookURL)
 	if err != nil {
 		return nil, errors.Wrapf(err, "Failed to parse Webhook URL")
@@ -76,6 +77,7 @@ func NewHook(hookType, siteURL, hookURL, userID, secret string, payload interfac
 	return &Hook{
 		Type:    hookType,
 		UserID:  userID,
+		OrderID: orderID,
 		URL:     fullHookURL.String(),
 		Secret:  secret,
 		Payload: string(json),
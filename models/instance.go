@@ -121,6 +121,8 @@ func (i *Instance) BeforeDelete(tx *gorm.DB) error {
 	delModels := map[string]interface{}{
 		"transaction":    Transaction{},
 		"invoice number": InvoiceNumber{},
+		"product":        Product{},
+		"license key":    LicenseKey{},
 	}
 
 	for name, dm := range delModels {
@@ -128,5 +130,10 @@ func (i *Instance) BeforeDelete(tx *gorm.DB) error {
 			return errors.Wrap(result.Error, fmt.Sprintf("Error deleting %s records", name))
 		}
 	}
+
+	// sequences of an entity configured for several instances stay in use
+	if result := tx.Delete(Sequence{}, "entity = ?", i.ID); result.Error != nil {
+		return errors.Wrap(result.Error, "Error deleting sequence records")
+	}
 	return nil
 }
@@ -1,12 +1,12 @@
 package models
 
 import (
-	"log"
-	"strings"
-
 	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/conf"
 )
 
+// InvoiceNumber holds the invoice counter used before sequences were
+// configurable. Unscoped invoice sequences continue where it left off.
 type InvoiceNumber struct {
 	InstanceID string `gorm:"primary_key"`
 	Number     int64
@@ -17,28 +17,24 @@ func (InvoiceNumber) TableName() string {
 	return tableName("invoice_numbers")
 }
 
-// NextInvoiceNumber updates and returns the next invoice number for the instance
-func NextInvoiceNumber(tx *gorm.DB, instanceID string) (int64, error) {
-	number := InvoiceNumber{}
-	if instanceID == "" {
-		instanceID = "global-instance"
-	}
-
-	if result := tx.Where(InvoiceNumber{InstanceID: instanceID}).Attrs(InvoiceNumber{Number: 0}).FirstOrCreate(&number); result.Error != nil {
-		return 0, result.Error
+// NextInvoiceNumber allocates the next invoice number for an order and
+// returns it together with the formatted invoice ID.
+func NextInvoiceNumber(tx *gorm.DB, config *conf.Configuration, order *Order) (int64, string, error) {
+	var seqConfig conf.SequenceConfiguration
+	if config != nil {
+		seqConfig = config.Invoices.Numbers
 	}
-
-	numberTable := tx.NewScope(InvoiceNumber{}).QuotedTableName()
-	if result := tx.Raw("select number from "+numberTable+" where instance_id = ? for update", instanceID).Scan(&number); result.Error != nil {
-		if strings.Contains(result.Error.Error(), "syntax error") {
-			log.Println("This DB driver doesn't support select for update, hoping for the best...")
-		} else {
-			return 0, result.Error
+	return nextDocumentNumber(tx, invoiceSequence, seqConfig, config, order.InstanceID, order.Currency, func() (int64, error) {
+		// the legacy counter is per instance, whatever entity issues now
+		instanceID := order.InstanceID
+		if instanceID == "" {
+			instanceID = "global-instance"
 		}
-	}
-	if result := tx.Model(number).Update("number", gorm.Expr("number + 1")); result.Error != nil {
-		return 0, result.Error
-	}
-
-	return number.Number + 1, nil
+		legacy := InvoiceNumber{}
+		result := tx.Where(InvoiceNumber{InstanceID: instanceID}).First(&legacy)
+		if result.RecordNotFound() {
+			return 0, nil
+		}
+		return legacy.Number, result.Error
+	})
 }
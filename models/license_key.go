@@ -0,0 +1,113 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+// LicenseKeyProductType is the product type of line items that are
+// delivered as keys from the license key pool of their sku.
+const LicenseKeyProductType = "license_key"
+
+// LicenseKeyFormat is the format of downloads holding a license key.
+const LicenseKeyFormat = "license_key"
+
+// maxAssignAttempts bounds the retries when concurrent payments compete for
+// the same key.
+const maxAssignAttempts = 5
+
+// LicenseKey is a unique key uploaded by an admin. It is assigned to a single
+// order when the order is paid.
+type LicenseKey struct {
+	ID         string `json:"id"`
+	InstanceID string `json:"-" gorm:"unique_index:idx_license_keys_instance_key"`
+	Sku        string `json:"sku" sql:"index"`
+	Key        string `json:"key" gorm:"column:license_key;unique_index:idx_license_keys_instance_key"`
+
+	OrderID    string     `json:"order_id,omitempty" sql:"index"`
+	DownloadID string     `json:"download_id,omitempty"`
+	AssignedAt *time.Time `json:"assigned_at,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the LicenseKey model.
+func (LicenseKey) TableName() string {
+	return tableName("license_keys")
+}
+
+// AssignLicenseKeys assigns a key from the pool to every unit of the license
+// key line items of the order and delivers them as downloads. Keys that were
+// already assigned to the order are kept, so it is safe to call it again. It
+// returns an error if the pool of a sku runs out of keys.
+func AssignLicenseKeys(tx *gorm.DB, order *Order) error {
+	items := []LineItem{}
+	if err := tx.Where("order_id = ? AND type = ?", order.ID, LicenseKeyProductType).Find(&items).Error; err != nil {
+		return errors.Wrap(err, "Error loading license key line items")
+	}
+
+	for _, item := range items {
+		var assigned uint64
+		if err := tx.Model(&LicenseKey{}).Where("order_id = ? AND sku = ?", order.ID, item.Sku).Count(&assigned).Error; err != nil {
+			return errors.Wrap(err, "Error counting assigned license keys")
+		}
+
+		for ; assigned < item.Quantity; assigned++ {
+			key, err := assignLicenseKey(tx, order, item.Sku)
+			if err != nil {
+				return err
+			}
+
+			download := Download{
+				ID:         uuid.NewRandom().String(),
+				OrderID:    order.ID,
+				LineItemID: item.ID,
+				Title:      item.Title,
+				Sku:        item.Sku,
+				Format:     LicenseKeyFormat,
+				LicenseKey: key.Key,
+			}
+			if err := tx.Create(&download).Error; err != nil {
+				return errors.Wrap(err, "Error creating license key download")
+			}
+			if err := tx.Model(key).Update("download_id", download.ID).Error; err != nil {
+				return errors.Wrap(err, "Error assigning license key")
+			}
+			order.Downloads = append(order.Downloads, download)
+		}
+	}
+	return nil
+}
+
+func assignLicenseKey(tx *gorm.DB, order *Order, sku string) (*LicenseKey, error) {
+	for attempt := 0; attempt < maxAssignAttempts; attempt++ {
+		key := &LicenseKey{}
+		rsp := tx.Where("instance_id = ? AND sku = ? AND order_id = ?", order.InstanceID, sku, "").
+			Order("created_at asc").
+			First(key)
+		if rsp.RecordNotFound() {
+			return nil, fmt.Errorf("No license keys left for sku %s", sku)
+		}
+		if rsp.Error != nil {
+			return nil, errors.Wrap(rsp.Error, "Error loading license key")
+		}
+
+		now := time.Now()
+		rsp = tx.Model(&LicenseKey{}).
+			Where("id = ? AND order_id = ?", key.ID, "").
+			Updates(map[string]interface{}{"order_id": order.ID, "assigned_at": now})
+		if rsp.Error != nil {
+			return nil, errors.Wrap(rsp.Error, "Error assigning license key")
+		}
+		if rsp.RowsAffected == 1 {
+			key.OrderID = order.ID
+			key.AssignedAt = &now
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("Failed to assign a license key for sku %s", sku)
+}
@@ -4,15 +4,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-	"net/http"
 	"strconv"
 	"time"
 
-	"github.com/PuerkitoBio/goquery"
 	"github.com/jinzhu/gorm"
 	"github.com/netlify/gocommerce/calculator"
 	"github.com/netlify/gocommerce/claims"
-	"github.com/netlify/gocommerce/conf"
 	"github.com/pborman/uuid"
 )
 
@@ -29,6 +26,24 @@ func (DiscountItem) TableName() string {
 	return tableName("discount_items")
 }
 
+// LineItemTax is the part of a line item taxed at a single rate. Line items
+// can consist of parts taxed at different rates, so reports sum these up
+// instead of the taxes of the line items.
+type LineItemTax struct {
+	ID         int64  `json:"-"`
+	OrderID    string `json:"-" sql:"index"`
+	LineItemID int64  `json:"-" sql:"index"`
+
+	Rate     uint64 `json:"rate"`
+	NetTotal uint64 `json:"net_total"`
+	Taxes    uint64 `json:"taxes"`
+}
+
+// TableName returns the database table name for the LineItemTax model.
+func (LineItemTax) TableName() string {
+	return tableName("line_item_taxes")
+}
+
 // CalculationDetail holds details about pricing for line items
 type CalculationDetail struct {
 	Subtotal uint64 `json:"subtotal"`
@@ -39,6 +54,10 @@ type CalculationDetail struct {
 	NetTotal uint64 `json:"net_total"`
 	Taxes    uint64 `json:"taxes"`
 	Total    int64  `json:"total"`
+
+	// TaxItems split the taxes of all units by rate. They are only set when
+	// the line item was priced, and are saved along with it.
+	TaxItems []LineItemTax `json:"-" sql:"-"`
 }
 
 // LineItem is a single item in an Order.
@@ -98,6 +117,27 @@ func (i *LineItem) AfterFind() error {
 	return nil
 }
 
+// AfterSave database callback. Replaces the taxes of a line item that was
+// priced; line items loaded from the database don't carry them.
+func (i *LineItem) AfterSave(tx *gorm.DB) error {
+	if i.CalculationDetail == nil || i.TaxItems == nil {
+		return nil
+	}
+	if result := tx.Delete(LineItemTax{}, "line_item_id = ?", i.ID); result.Error != nil {
+		return result.Error
+	}
+	for idx := range i.TaxItems {
+		tax := &i.TaxItems[idx]
+		tax.ID = 0
+		tax.OrderID = i.OrderID
+		tax.LineItemID = i.ID
+		if result := tx.Create(tax); result.Error != nil {
+			return result.Error
+		}
+	}
+	return nil
+}
+
 func (i *LineItem) BeforeDelete(tx *gorm.DB) error {
 	for _, p := range i.PriceItems {
 		if r := tx.Delete(p); r.Error != nil {
@@ -251,8 +291,8 @@ func (i *LineItem) GetQuantity() uint64 {
 }
 
 // Process calculates the price of a LineItem.
-func (i *LineItem) Process(config *conf.Configuration, userClaims map[string]interface{}, order *Order) error {
-	meta, err := i.FetchMeta(config.SiteURL)
+func (i *LineItem) Process(catalog Catalog, userClaims map[string]interface{}, order *Order) error {
+	meta, err := i.FetchMeta(catalog)
 	if err != nil {
 		return err
 	}
@@ -293,57 +333,26 @@ func (i *LineItem) Process(config *conf.Configuration, userClaims map[string]int
 }
 
 // FetchMeta determines the product metadata for the item based on its path
-func (i *LineItem) FetchMeta(siteURL string) (*LineItemMetadata, error) {
-	resp, err := http.Get(siteURL + i.Path)
+func (i *LineItem) FetchMeta(catalog Catalog) (*LineItemMetadata, error) {
+	meta, err := catalog.Product(i.Path, i.Sku)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
-
-	doc, err := goquery.NewDocumentFromResponse(resp)
-	if err != nil {
-		return nil, err
-	}
-
-	metaTag := doc.Find(".gocommerce-product")
-	if metaTag.Length() == 0 {
-		return nil, fmt.Errorf("No script tag with class gocommerce-product tag found for '%v'", i.Title)
-	}
-	metaProducts := []*LineItemMetadata{}
-	var parsingErr error
-	metaTag.EachWithBreak(func(_ int, tag *goquery.Selection) bool {
-		meta := &LineItemMetadata{}
-		parsingErr = json.Unmarshal([]byte(tag.Text()), meta)
-		if parsingErr != nil {
-			return false
-		}
-		metaProducts = append(metaProducts, meta)
-		return true
-	})
-	if parsingErr != nil {
-		return nil, fmt.Errorf("Error parsing product metadata: %v", parsingErr)
-	}
 
-	if len(metaProducts) == 1 && i.Sku == "" {
-		i.Sku = metaProducts[0].Sku
+	if i.Sku == "" {
+		i.Sku = meta.Sku
 	}
-
-	for _, meta := range metaProducts {
-		if meta.Sku == i.Sku {
-			return meta, nil
-		}
-	}
-
-	return nil, fmt.Errorf("No product Sku from path matched: %v", i.Sku)
+	return meta, nil
 }
 
-// MissingDownloads returns all downloads that are not yet listed in the order
+// MissingDownloads returns all downloads that are not yet listed in the order.
+// Downloads are matched by URL and version.
 func (i *LineItem) MissingDownloads(order *Order, meta *LineItemMetadata) []Download {
 	downloads := []Download{}
 	for _, metaDownload := range meta.Downloads {
 		alreadyCreated := false
 		for _, d := range order.Downloads {
-			if d.URL == metaDownload.URL {
+			if d.URL == metaDownload.URL && d.Version == metaDownload.Version {
 				alreadyCreated = true
 				break
 			}
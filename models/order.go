@@ -23,6 +23,10 @@ const PaidState = "paid"
 // ShippingState is the shipping state of an order
 const ShippingState = "shipping"
 
+// PartiallyShippedState is the fulfillment state of an Order with some but
+// not all of its line items shipped
+const PartiallyShippedState = "partially_shipped"
+
 // ShippedState is the shipped state of an Order
 const ShippedState = "shipped"
 
@@ -40,6 +44,7 @@ var PaymentStates = []string{
 var FulfillmentStates = []string{
 	PendingState,
 	ShippingState,
+	PartiallyShippedState,
 	ShippedState,
 }
 
@@ -55,6 +60,7 @@ type Order struct {
 	InstanceID    string `json:"-" sql:"index"`
 	ID            string `json:"id"`
 	InvoiceNumber int64  `json:"invoice_number,omitempty"`
+	InvoiceID     string `json:"invoice_id,omitempty"`
 
 	IP string `json:"ip"`
 
@@ -70,10 +76,13 @@ type Order struct {
 
 	Currency string `json:"currency"`
 	Taxes    uint64 `json:"taxes"`
-	Shipping uint64 `json:"shipping"`
-	SubTotal uint64 `json:"subtotal"`
-	Discount uint64 `json:"discount"`
-	NetTotal uint64 `json:"net_total"`
+	// TaxAmounts split up the taxes by rate. They are only set when the
+	// order was priced, see LineItemTax for the stored amounts.
+	TaxAmounts []calculator.TaxAmount `json:"-" sql:"-"`
+	Shipping   uint64                 `json:"shipping"`
+	SubTotal   uint64                 `json:"subtotal"`
+	Discount   uint64                 `json:"discount"`
+	NetTotal   uint64                 `json:"net_total"`
 
 	Total uint64 `json:"total"`
 
@@ -85,6 +94,8 @@ type Order struct {
 
 	Transactions []*Transaction `json:"transactions"`
 	Notes        []*OrderNote   `json:"notes"`
+	Shipments    []*Shipment    `json:"shipments"`
+	Adjustments  []*Adjustment  `json:"adjustments"`
 
 	ShippingAddress   Address `json:"shipping_address" gorm:"ForeignKey:ShippingAddressID"`
 	ShippingAddressID string  `json:"shipping_address_id"`
@@ -102,6 +113,11 @@ type Order struct {
 	Coupon    *Coupon `json:"coupon,omitempty" sql:"-"`
 	RawCoupon string  `json:"-" sql:"type:text"`
 
+	// Claims are the JWT claims of the buyer the order was priced with, so
+	// member discounts are kept when the order is repriced.
+	Claims    map[string]interface{} `json:"-" sql:"-"`
+	RawClaims string                 `json:"-" sql:"type:text"`
+
 	CreatedAt time.Time  `json:"created_at" sql:"index"`
 	UpdatedAt time.Time  `json:"updated_at"`
 	DeletedAt *time.Time `json:"-" sql:"index"`
@@ -129,6 +145,12 @@ func (o *Order) AfterFind() error {
 			return err
 		}
 	}
+	if o.RawClaims != "" {
+		err := json.Unmarshal([]byte(o.RawClaims), &o.Claims)
+		if err != nil {
+			return err
+		}
+	}
 
 	return nil
 }
@@ -149,6 +171,13 @@ func (o *Order) BeforeSave() error {
 		}
 		o.RawCoupon = string(data)
 	}
+	if o.Claims != nil {
+		data, err := json.Marshal(o.Claims)
+		if err != nil {
+			return err
+		}
+		o.RawClaims = string(data)
+	}
 
 	return nil
 }
@@ -168,6 +197,14 @@ func NewOrder(instanceID, sessionID, email, currency string) *Order {
 	return order
 }
 
+// LockOrder locks the row of an order until tx ends, so that checks of what
+// was already refunded or shipped can't race with each other. A no-op update
+// takes the lock since not every database supports SELECT ... FOR UPDATE.
+func LockOrder(tx *gorm.DB, orderID string) error {
+	result := tx.Model(&Order{}).Where("id = ?", orderID).UpdateColumn("updated_at", gorm.Expr("updated_at"))
+	return errors.Wrap(result.Error, "Error locking order")
+}
+
 // CalculateTotal calculates the total price of an Order.
 func (o *Order) CalculateTotal(settings *calculator.Settings, claims map[string]interface{}, log logrus.FieldLogger) {
 	items := make([]calculator.Item, len(o.LineItems))
@@ -180,6 +217,7 @@ func (o *Order) CalculateTotal(settings *calculator.Settings, claims map[string]
 
 	o.SubTotal = price.Subtotal
 	o.Taxes = price.Taxes
+	o.TaxAmounts = price.TaxAmounts
 	o.Discount = price.Discount
 	o.NetTotal = price.NetTotal
 
@@ -191,6 +229,14 @@ func (o *Order) CalculateTotal(settings *calculator.Settings, claims map[string]
 			NetTotal: item.NetTotal,
 			Taxes:    item.Taxes,
 			Total:    item.Total,
+			TaxItems: make([]LineItemTax, len(item.TaxAmounts)),
+		}
+		for j, amount := range item.TaxAmounts {
+			o.LineItems[i].CalculationDetail.TaxItems[j] = LineItemTax{
+				Rate:     amount.Rate,
+				NetTotal: amount.NetTotal,
+				Taxes:    amount.Taxes,
+			}
 		}
 
 		for _, discount := range item.DiscountItems {
@@ -201,6 +247,7 @@ func (o *Order) CalculateTotal(settings *calculator.Settings, claims map[string]
 		}
 	}
 
+	o.Total = 0
 	if price.Total > 0 {
 		o.Total = uint64(price.Total)
 	}
@@ -208,16 +255,65 @@ func (o *Order) CalculateTotal(settings *calculator.Settings, claims map[string]
 
 // UpdateDownloads will refetch downloads for all line items in the order and
 // update the downloads in the order
-func (o *Order) UpdateDownloads(config *conf.Configuration, log logrus.FieldLogger) error {
+func (o *Order) UpdateDownloads(db *gorm.DB, config *conf.Configuration, log logrus.FieldLogger) error {
 	updateMap := downloadRefreshItemSet{}
 	for _, item := range o.LineItems {
 		updateMap.Add(item, o)
 	}
-	updates, err := updateMap.Update(nil, config, log)
+	updates, err := updateMap.Update(db, config, log)
 	log.Debugf("Updated downloads of %d orders", len(updates))
 	return err
 }
 
+// DownloadUpdate holds the downloads that were added to an order by a refresh.
+type DownloadUpdate struct {
+	Order     *Order
+	Downloads []Download
+}
+
+// RefreshSkuDownloads refetches the downloads of a sku for all paid orders of
+// an instance containing it. New downloads and new versions of existing ones
+// are added to the orders, which are returned but not saved.
+func RefreshSkuDownloads(db *gorm.DB, config *conf.Configuration, instanceID, sku string, log logrus.FieldLogger) ([]DownloadUpdate, error) {
+	lineItemsTable := db.NewScope(LineItem{}).QuotedTableName()
+
+	orders := []*Order{}
+	query := db.Where("instance_id = ? AND payment_state = ?", instanceID, PaidState).
+		Where("id IN (SELECT order_id FROM "+lineItemsTable+" WHERE sku = ?)", sku).
+		Preload("LineItems").
+		Preload("Downloads")
+	if err := query.Find(&orders).Error; err != nil {
+		return nil, errors.Wrap(err, "Error loading orders for sku")
+	}
+
+	updateMap := downloadRefreshItemSet{}
+	known := make(map[string]int, len(orders))
+	for _, order := range orders {
+		for _, item := range order.LineItems {
+			if item.Sku == sku {
+				updateMap.Add(item, order)
+				known[order.ID] = len(order.Downloads)
+				break
+			}
+		}
+	}
+
+	updated, err := updateMap.Update(db, config, log)
+	if err != nil {
+		return nil, err
+	}
+
+	updates := make([]DownloadUpdate, len(updated))
+	for i, order := range updated {
+		updates[i] = DownloadUpdate{
+			Order:     order,
+			Downloads: order.Downloads[known[order.ID]:],
+		}
+	}
+	log.Debugf("Updated downloads of %d orders for sku '%s'", len(updates), sku)
+	return updates, nil
+}
+
 func (o *Order) BeforeDelete(tx *gorm.DB) error {
 	cascadeModels := map[string]interface{}{
 		"line item": &[]LineItem{},
@@ -229,9 +325,17 @@ func (o *Order) BeforeDelete(tx *gorm.DB) error {
 	}
 
 	delModels := map[string]interface{}{
-		"event":       Event{},
-		"transaction": Transaction{},
-		"download":    Download{},
+		"event":         Event{},
+		"transaction":   Transaction{},
+		"download":      Download{},
+		"refund item":   RefundItem{},
+		"order note":    OrderNote{},
+		"shipment":      Shipment{},
+		"shipment item": ShipmentItem{},
+		"return":        Return{},
+		"return item":   ReturnItem{},
+		"adjustment":    Adjustment{},
+		"line item tax": LineItemTax{},
 	}
 	for name, dm := range delModels {
 		if result := tx.Delete(dm, "order_id = ?", o.ID); result.Error != nil {
@@ -269,21 +373,32 @@ func (m downloadRefreshItemSet) Add(item *LineItem, order *Order) {
 	mapping.orders = append(mapping.orders, order)
 }
 
-// UpdateDownloads fetches downloads for all line items and updates orders with new downloads
+// Update fetches downloads for all line items and updates orders with new
+// downloads. The product metadata is fetched by a bounded pool of goroutines.
 func (m downloadRefreshItemSet) Update(db *gorm.DB, config *conf.Configuration, log logrus.FieldLogger) (updates []*Order, err error) {
-	// @todo: run in parallel with goroutines, lock orders with mutexes
+	var updatesLock sync.Mutex
+	sem := make(chan struct{}, MaxConcurrentMetadataFetches)
+	var wg sync.WaitGroup
+
 	for instanceID, items := range m {
-		if config == nil {
+		instanceConfig := config
+		if instanceConfig == nil {
 			if db == nil {
 				err = errors.New("Instance config or database connection missing")
-				return
+				break
 			}
 			instance := Instance{}
 			if queryErr := db.First(&instance, Instance{ID: instanceID}).Error; queryErr != nil {
 				err = errors.Wrap(queryErr, "Failed fetching instance for order")
-				return
+				break
 			}
-			config = instance.BaseConfig
+			instanceConfig = instance.BaseConfig
+		}
+
+		catalog, catalogErr := NewCatalog(instanceConfig, db, instanceID)
+		if catalogErr != nil {
+			err = errors.Wrap(catalogErr, "Failed creating product catalog")
+			break
 		}
 
 		for _, entry := range items {
@@ -294,30 +409,44 @@ func (m downloadRefreshItemSet) Update(db *gorm.DB, config *conf.Configuration,
 				)
 				continue
 			}
-			log.Debugf("Updating downloads for item with sku '%s'", entry.item.Sku)
-			meta, fetchErr := entry.item.FetchMeta(config.SiteURL)
-			if fetchErr != nil {
-				// item might not be offered anymore, preserve downloads
-				log.WithError(fetchErr).
-					WithFields(map[string]interface{}{
-						"path": entry.item.Path,
-						"sku":  entry.item.Sku,
-					}).
-					Warning("Fetching product metadata failed. Skipping item.")
-				continue
-			}
-			for _, order := range entry.orders {
-				downloads := entry.item.MissingDownloads(order, meta)
-				if len(downloads) == 0 {
-					continue
-				}
-				// @todo: Lock order mutex if run in goroutines
-				order.Downloads = append(order.Downloads, downloads...)
 
-				updates = append(updates, order)
-			}
+			sem <- struct{}{}
+			wg.Add(1)
+			go func(entry *downloadRefreshItemSetEntry) {
+				defer func() {
+					wg.Done()
+					<-sem
+				}()
+
+				log.Debugf("Updating downloads for item with sku '%s'", entry.item.Sku)
+				meta, fetchErr := entry.item.FetchMeta(catalog)
+				if fetchErr != nil {
+					// item might not be offered anymore, preserve downloads
+					log.WithError(fetchErr).
+						WithFields(map[string]interface{}{
+							"path": entry.item.Path,
+							"sku":  entry.item.Sku,
+						}).
+						Warning("Fetching product metadata failed. Skipping item.")
+					return
+				}
+				for _, order := range entry.orders {
+					order.ModificationLock.Lock()
+					downloads := entry.item.MissingDownloads(order, meta)
+					order.Downloads = append(order.Downloads, downloads...)
+					order.ModificationLock.Unlock()
+					if len(downloads) == 0 {
+						continue
+					}
+
+					updatesLock.Lock()
+					updates = append(updates, order)
+					updatesLock.Unlock()
+				}
+			}(entry)
 		}
 	}
 
+	wg.Wait()
 	return
 }
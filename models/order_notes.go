@@ -4,12 +4,20 @@ import "time"
 
 // OrderNote model which represent notes on a model.
 type OrderNote struct {
-	ID int64 `json:"-"`
+	ID int64 `json:"id"`
 
-	UserID string `json:"user_id"`
+	OrderID string `json:"order_id" sql:"index"`
+
+	UserID      string `json:"user_id,omitempty"`
+	AuthorEmail string `json:"author_email,omitempty"`
 
 	Text string `json:"text" sql:"type:text"`
 
+	// CustomerVisible notes are shown to the owner of the order, other notes
+	// are internal to the shop.
+	CustomerVisible bool       `json:"customer_visible"`
+	EmailedAt       *time.Time `json:"emailed_at,omitempty"`
+
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
 	DeletedAt *time.Time `json:"-"`
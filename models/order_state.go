@@ -0,0 +1,198 @@
+package models
+
+import (
+	"fmt"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/conf"
+	"github.com/pkg/errors"
+)
+
+// PaymentStateField and FulfillmentStateField name the states of an Order
+// that are changed through transitions.
+const (
+	PaymentStateField     = "payment_state"
+	FulfillmentStateField = "fulfillment_state"
+)
+
+// OrderMail is a mail that is sent after a transition has been committed.
+type OrderMail string
+
+const (
+	// OrderConfirmationMail is sent to the buyer of a paid order.
+	OrderConfirmationMail OrderMail = "order_confirmation"
+	// OrderReceivedMail is sent to the shop for a paid order.
+	OrderReceivedMail OrderMail = "order_received"
+)
+
+// orderTransition is an allowed change of one of the states of an order,
+// with the guard that must pass and the side effects it has.
+type orderTransition struct {
+	from  []string
+	to    string
+	guard func(o *Order) error
+	hook  func(config *conf.Configuration) (hookType, url string)
+	mails []OrderMail
+}
+
+var orderTransitions = map[string][]orderTransition{
+	PaymentStateField: {
+		{
+			from:  []string{PendingState, FailedState},
+			to:    PaidState,
+			hook:  func(config *conf.Configuration) (string, string) { return "payment", config.Webhooks.Payment },
+			mails: []OrderMail{OrderConfirmationMail, OrderReceivedMail},
+		},
+		{from: []string{PendingState}, to: FailedState},
+		{from: []string{FailedState}, to: PendingState},
+	},
+	FulfillmentStateField: {
+		{
+			from:  []string{PendingState},
+			to:    ShippingState,
+			guard: requirePaid,
+			hook:  func(config *conf.Configuration) (string, string) { return "fulfillment", config.Webhooks.Fulfillment },
+		},
+		{
+			from:  []string{PendingState, ShippingState},
+			to:    PartiallyShippedState,
+			guard: requirePaid,
+			hook:  func(config *conf.Configuration) (string, string) { return "fulfillment", config.Webhooks.Fulfillment },
+		},
+		{
+			from:  []string{PendingState, ShippingState, PartiallyShippedState},
+			to:    ShippedState,
+			guard: requirePaid,
+			hook:  func(config *conf.Configuration) (string, string) { return "fulfillment", config.Webhooks.Fulfillment },
+		},
+		{from: []string{ShippingState}, to: PendingState},
+	},
+}
+
+func requirePaid(o *Order) error {
+	if o.PaymentState != PaidState {
+		return errors.New("the order has not been paid")
+	}
+	return nil
+}
+
+// TransitionError is returned for a transition that is not allowed.
+type TransitionError struct {
+	Field  string
+	From   string
+	To     string
+	Reason string
+}
+
+func (e *TransitionError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("Can't change %s from '%s' to '%s': %s", e.Field, e.From, e.To, e.Reason)
+	}
+	return fmt.Sprintf("Can't change %s from '%s' to '%s'", e.Field, e.From, e.To)
+}
+
+// StateChange describes a transition an order went through.
+type StateChange struct {
+	Field string
+	From  string
+	To    string
+	Mails []OrderMail
+
+	hook    *Hook
+	hookErr error
+}
+
+// QueueHook saves the webhook of the change, if there is one. It's kept out
+// of the transition so a webhook that can't be queued doesn't undo it.
+func (c *StateChange) QueueHook(db *gorm.DB) error {
+	if c == nil {
+		return nil
+	}
+	if c.hookErr != nil {
+		return errors.Wrap(c.hookErr, "Failed to process webhook")
+	}
+	if c.hook == nil {
+		return nil
+	}
+	return errors.Wrap(db.Save(c.hook).Error, "Failed to save webhook")
+}
+
+// Transition moves the payment or fulfillment state of an order to a new
+// state. It checks that the transition is allowed, updates the order and logs
+// an event. The order itself is not saved. The webhook and mails of the
+// transition are returned with the change, to be queued with QueueHook and
+// sent once tx is committed. Moving to the current state is a no-op that
+// returns no change.
+func (o *Order) Transition(tx *gorm.DB, config *conf.Configuration, ip, userID, field, to string) (*StateChange, error) {
+	transitions, ok := orderTransitions[field]
+	if !ok {
+		return nil, errors.Errorf("Unknown order state: %s", field)
+	}
+
+	state := o.stateField(field)
+	if *state == to {
+		return nil, nil
+	}
+
+	var transition *orderTransition
+	for i := range transitions {
+		if transitions[i].to == to && contains(transitions[i].from, *state) {
+			transition = &transitions[i]
+			break
+		}
+	}
+	if transition == nil {
+		return nil, &TransitionError{Field: field, From: *state, To: to}
+	}
+	if transition.guard != nil {
+		if err := transition.guard(o); err != nil {
+			return nil, &TransitionError{Field: field, From: *state, To: to, Reason: err.Error()}
+		}
+	}
+
+	change := &StateChange{Field: field, From: *state, To: to, Mails: transition.mails}
+	*state = to
+	o.State = o.overallState()
+
+	diff := EventDiff{}
+	diff.Add(field, change.From, change.To)
+	LogEventDiff(tx, ip, userID, o.ID, EventUpdated, diff)
+
+	if transition.hook != nil && config != nil {
+		if hookType, url := transition.hook(config); url != "" {
+			change.hook, change.hookErr = NewHook(hookType, config.SiteURL, url, o.UserID, o.ID, config.Webhooks.Secret, o)
+		}
+	}
+
+	return change, nil
+}
+
+func (o *Order) stateField(field string) *string {
+	if field == FulfillmentStateField {
+		return &o.FulfillmentState
+	}
+	return &o.PaymentState
+}
+
+// overallState sums up the payment and fulfillment states of the order.
+func (o *Order) overallState() string {
+	switch {
+	case o.PaymentState == FailedState:
+		return FailedState
+	case o.PaymentState != PaidState:
+		return PendingState
+	case o.FulfillmentState == PendingState:
+		return PaidState
+	default:
+		return o.FulfillmentState
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,52 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Product is a product in the database catalog of an instance.
+type Product struct {
+	InstanceID string `json:"-" gorm:"unique_index:idx_products_instance_sku"`
+	ID         string `json:"id"`
+	Sku        string `json:"sku" gorm:"unique_index:idx_products_instance_sku"`
+	Path       string `json:"path" sql:"index"`
+
+	Meta    *LineItemMetadata `json:"meta" sql:"-"`
+	RawMeta string            `json:"-" sql:"type:text"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName returns the database table name for the Product model.
+func (Product) TableName() string {
+	return tableName("products")
+}
+
+// AfterFind database callback.
+func (p *Product) AfterFind() error {
+	p.Meta = &LineItemMetadata{}
+	if p.RawMeta != "" {
+		if err := json.Unmarshal([]byte(p.RawMeta), p.Meta); err != nil {
+			return err
+		}
+	}
+	p.Meta.Sku = p.Sku
+	return nil
+}
+
+// BeforeSave database callback.
+func (p *Product) BeforeSave() error {
+	if p.Meta == nil {
+		p.Meta = &LineItemMetadata{}
+	}
+	p.Meta.Sku = p.Sku
+
+	data, err := json.Marshal(p.Meta)
+	if err != nil {
+		return err
+	}
+	p.RawMeta = string(data)
+	return nil
+}
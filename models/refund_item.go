@@ -0,0 +1,66 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pkg/errors"
+)
+
+// RefundItem records the quantity of a line item covered by a refund.
+type RefundItem struct {
+	ID            int64  `json:"id"`
+	OrderID       string `json:"-" sql:"index"`
+	TransactionID string `json:"-" sql:"index"`
+
+	LineItemID int64  `json:"line_item_id"`
+	Sku        string `json:"sku"`
+	Quantity   uint64 `json:"quantity"`
+	Amount     uint64 `json:"amount"`
+
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// TableName returns the database table name for the RefundItem model.
+func (RefundItem) TableName() string {
+	return tableName("refund_items")
+}
+
+// RefundedQuantities returns the quantities of the line items of an order that
+// were refunded successfully, by line item ID.
+func RefundedQuantities(db *gorm.DB, orderID string) (map[int64]uint64, error) {
+	return refundItemQuantities(db, orderID, PaidState)
+}
+
+// ReservedRefundQuantities returns the quantities of the line items of an
+// order that were refunded or are being refunded, by line item ID.
+func ReservedRefundQuantities(db *gorm.DB, orderID string) (map[int64]uint64, error) {
+	return refundItemQuantities(db, orderID, PaidState, PendingState)
+}
+
+func refundItemQuantities(db *gorm.DB, orderID string, statuses ...string) (map[int64]uint64, error) {
+	transactionsTable := db.NewScope(Transaction{}).QuotedTableName()
+	itemsTable := db.NewScope(RefundItem{}).QuotedTableName()
+
+	rows, err := db.Model(&RefundItem{}).
+		Select(itemsTable+".line_item_id, sum("+itemsTable+".quantity)").
+		Joins("JOIN "+transactionsTable+" ON "+transactionsTable+".id = "+itemsTable+".transaction_id").
+		Where(itemsTable+".order_id = ? AND "+transactionsTable+".status IN (?)", orderID, statuses).
+		Group(itemsTable + ".line_item_id").
+		Rows()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error querying refunded quantities")
+	}
+	defer rows.Close()
+
+	refunded := map[int64]uint64{}
+	for rows.Next() {
+		var lineItemID int64
+		var quantity uint64
+		if err := rows.Scan(&lineItemID, &quantity); err != nil {
+			return nil, errors.Wrap(err, "Error querying refunded quantities")
+		}
+		refunded[lineItemID] = quantity
+	}
+	return refunded, nil
+}
@@ -0,0 +1,165 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+// The states a Return goes through.
+const (
+	ReturnRequested = "requested"
+	ReturnApproved  = "approved"
+	ReturnRejected  = "rejected"
+	ReturnReceived  = "received"
+	ReturnRefunding = "refunding"
+	ReturnRefunded  = "refunded"
+)
+
+// ReturnStates are the possible values for the State field of a Return
+var ReturnStates = []string{
+	ReturnRequested,
+	ReturnApproved,
+	ReturnRejected,
+	ReturnReceived,
+	ReturnRefunding,
+	ReturnRefunded,
+}
+
+var returnTransitions = map[string][]string{
+	ReturnRequested: {ReturnApproved, ReturnRejected},
+	ReturnApproved:  {ReturnReceived},
+	ReturnReceived:  {ReturnRefunding},
+	ReturnRefunding: {ReturnRefunded},
+}
+
+// Return is a request of a customer to send back line items of a paid order.
+type Return struct {
+	InstanceID string `json:"-" sql:"index"`
+	ID         string `json:"id"`
+	OrderID    string `json:"order_id" sql:"index"`
+	UserID     string `json:"user_id,omitempty"`
+
+	State           string `json:"state" sql:"index"`
+	Reason          string `json:"reason" sql:"type:text"`
+	RejectionReason string `json:"rejection_reason,omitempty" sql:"type:text"`
+
+	Items []*ReturnItem `json:"items"`
+
+	// TransactionID is the refund issued for the return
+	TransactionID string `json:"transaction_id,omitempty"`
+
+	ReceivedAt *time.Time `json:"received_at,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// TableName returns the database table name for the Return model.
+func (Return) TableName() string {
+	return tableName("returns")
+}
+
+// ReturnItem is the quantity of a line item that is sent back with a return.
+type ReturnItem struct {
+	ID       int64  `json:"id"`
+	ReturnID string `json:"-" sql:"index"`
+	OrderID  string `json:"-" sql:"index"`
+
+	LineItemID int64  `json:"line_item_id"`
+	Sku        string `json:"sku"`
+	Quantity   uint64 `json:"quantity"`
+}
+
+// TableName returns the database table name for the ReturnItem model.
+func (ReturnItem) TableName() string {
+	return tableName("return_items")
+}
+
+// NewReturn creates a requested Return for an order.
+func NewReturn(order *Order, userID, reason string) *Return {
+	return &Return{
+		InstanceID: order.InstanceID,
+		ID:         uuid.NewRandom().String(),
+		OrderID:    order.ID,
+		UserID:     userID,
+		State:      ReturnRequested,
+		Reason:     reason,
+	}
+}
+
+// Transition moves a return to a new state, if the workflow allows it.
+func (r *Return) Transition(to string) error {
+	for _, state := range returnTransitions[r.State] {
+		if state == to {
+			r.State = to
+			if to == ReturnReceived {
+				now := time.Now()
+				r.ReceivedAt = &now
+			}
+			return nil
+		}
+	}
+	return &TransitionError{Field: "state", From: r.State, To: to}
+}
+
+// Claim moves a return to a new state only if it's still in the state it was
+// loaded in, so that concurrent requests can't both act on it. It returns
+// false if another request changed the return first.
+func (r *Return) Claim(db *gorm.DB, to string) (bool, error) {
+	from := r.State
+	if err := r.Transition(to); err != nil {
+		return false, err
+	}
+	result := db.Model(&Return{}).Where("id = ? AND state = ?", r.ID, from).UpdateColumn("state", to)
+	if result.Error != nil {
+		r.State = from
+		return false, errors.Wrap(result.Error, "Error claiming return")
+	}
+	if result.RowsAffected == 0 {
+		r.State = from
+		return false, nil
+	}
+	return true, nil
+}
+
+// ReleaseClaim moves a claimed return back to the state it was claimed from,
+// when the work it was claimed for failed.
+func (r *Return) ReleaseClaim(db *gorm.DB, from string) error {
+	result := db.Model(&Return{}).Where("id = ? AND state = ?", r.ID, r.State).UpdateColumn("state", from)
+	if result.Error != nil {
+		return errors.Wrap(result.Error, "Error releasing return")
+	}
+	r.State = from
+	return nil
+}
+
+// ReturnedQuantities returns the quantities of the line items of an order
+// that are part of a return which hasn't been rejected, by line item ID.
+func ReturnedQuantities(db *gorm.DB, orderID string) (map[int64]uint64, error) {
+	returnsTable := db.NewScope(Return{}).QuotedTableName()
+	itemsTable := db.NewScope(ReturnItem{}).QuotedTableName()
+
+	rows, err := db.Model(&ReturnItem{}).
+		Select(itemsTable+".line_item_id, sum("+itemsTable+".quantity)").
+		Joins("JOIN "+returnsTable+" ON "+returnsTable+".id = "+itemsTable+".return_id").
+		Where(itemsTable+".order_id = ? AND "+returnsTable+".state <> ?", orderID, ReturnRejected).
+		Group(itemsTable + ".line_item_id").
+		Rows()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error querying returned quantities")
+	}
+	defer rows.Close()
+
+	returned := map[int64]uint64{}
+	for rows.Next() {
+		var lineItemID int64
+		var quantity uint64
+		if err := rows.Scan(&lineItemID, &quantity); err != nil {
+			return nil, errors.Wrap(err, "Error querying returned quantities")
+		}
+		returned[lineItemID] = quantity
+	}
+	return returned, nil
+}
@@ -0,0 +1,181 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/netlify/gocommerce/conf"
+	"github.com/pkg/errors"
+)
+
+const (
+	invoiceSequence    = "invoice"
+	creditNoteSequence = "credit_note"
+
+	defaultSequenceFormat = "{number}"
+	yearlyReset           = "yearly"
+)
+
+var sequencePlaceholder = regexp.MustCompile(`\{(\w+)(?::(\d+))?\}`)
+
+// Sequence is a gap-free counter for legal document numbers. Sequences
+// belong to the legal entity issuing the documents, which can be shared by
+// several instances.
+type Sequence struct {
+	Name   string `gorm:"primary_key"`
+	Entity string `sql:"index"`
+	Number int64
+
+	UpdatedAt time.Time
+}
+
+// TableName returns the database table name for the Sequence model.
+func (Sequence) TableName() string {
+	return tableName("sequences")
+}
+
+// NextSequenceNumber increments and returns the sequence with the given name.
+//
+// The increment is a single UPDATE statement, which takes a row lock on
+// Postgres and MySQL and the database write lock on SQLite. Concurrent
+// allocations are therefore serialized until the surrounding transaction
+// finishes, and rolling it back releases the number again, so the sequence
+// never has gaps as long as it is called inside the transaction that
+// persists the number.
+//
+// When the sequence doesn't exist yet it starts after the number returned by
+// seed, which may be nil to start at 1.
+func NextSequenceNumber(tx *gorm.DB, entity, name string, seed func() (int64, error)) (int64, error) {
+	updated, err := incrementSequence(tx, name)
+	if err != nil {
+		return 0, err
+	}
+
+	if !updated {
+		var start int64
+		if seed != nil {
+			if start, err = seed(); err != nil {
+				return 0, err
+			}
+		}
+
+		// A concurrent transaction creating the same sequence makes the
+		// insert fail once it commits. The savepoint keeps the transaction
+		// usable, so the sequence it created can be incremented instead.
+		seq := &Sequence{Name: name, Entity: entity, Number: start + 1}
+		tx.Exec("SAVEPOINT create_sequence")
+		createErr := tx.Create(seq).Error
+		if createErr == nil {
+			tx.Exec("RELEASE SAVEPOINT create_sequence")
+			return seq.Number, nil
+		}
+		tx.Exec("ROLLBACK TO SAVEPOINT create_sequence")
+
+		if updated, err = incrementSequence(tx, name); err != nil {
+			return 0, err
+		}
+		if !updated {
+			return 0, errors.Wrapf(createErr, "Error creating sequence %s", name)
+		}
+	}
+
+	seq := &Sequence{}
+	if err := tx.Where("name = ?", name).First(seq).Error; err != nil {
+		return 0, err
+	}
+	return seq.Number, nil
+}
+
+func incrementSequence(tx *gorm.DB, name string) (bool, error) {
+	table := tx.NewScope(Sequence{}).QuotedTableName()
+	result := tx.Exec("UPDATE "+table+" SET number = number + 1, updated_at = ? WHERE name = ?", time.Now(), name)
+	return result.RowsAffected > 0, result.Error
+}
+
+// FormatSequenceNumber renders a document number according to a format like
+// "INV-{year}-{number:6}".
+func FormatSequenceNumber(format string, number int64, date time.Time, currency, entity string) string {
+	if format == "" {
+		format = defaultSequenceFormat
+	}
+
+	return sequencePlaceholder.ReplaceAllStringFunc(format, func(placeholder string) string {
+		parts := sequencePlaceholder.FindStringSubmatch(placeholder)
+		switch parts[1] {
+		case "number":
+			if parts[2] != "" {
+				width, _ := strconv.Atoi(parts[2])
+				return fmt.Sprintf("%0*d", width, number)
+			}
+			return strconv.FormatInt(number, 10)
+		case "year":
+			return strconv.Itoa(date.Year())
+		case "yy":
+			return fmt.Sprintf("%02d", date.Year()%100)
+		case "month":
+			return fmt.Sprintf("%02d", int(date.Month()))
+		case "currency":
+			return currency
+		case "entity":
+			return entity
+		default:
+			return placeholder
+		}
+	})
+}
+
+func sequenceEntity(config *conf.Configuration, instanceID, currency string) string {
+	if config != nil {
+		if entity, ok := config.Invoices.CurrencyEntities[currency]; ok && entity != "" {
+			return entity
+		}
+		if config.Invoices.Entity != "" {
+			return config.Invoices.Entity
+		}
+	}
+	if instanceID == "" {
+		return "global-instance"
+	}
+	return instanceID
+}
+
+// nextDocumentNumber allocates a number from the sequence selected by the
+// configuration and returns it together with its formatted representation.
+func nextDocumentNumber(tx *gorm.DB, kind string, seqConfig conf.SequenceConfiguration, config *conf.Configuration, instanceID, currency string, seed func() (int64, error)) (int64, string, error) {
+	now := time.Now()
+	entity := sequenceEntity(config, instanceID, currency)
+
+	nameParts := []string{kind, entity}
+	scoped := false
+	if seqConfig.PerCurrency {
+		// each currency counts separately, so only the currency tells them apart
+		if !strings.Contains(seqConfig.Format, "{currency}") {
+			return 0, "", fmt.Errorf("The %s number format must contain {currency} to count per currency", kind)
+		}
+		nameParts = append(nameParts, currency)
+		scoped = true
+	}
+	if seqConfig.Reset == yearlyReset {
+		// numbers restart every year, so only the year tells them apart
+		if !strings.Contains(seqConfig.Format, "{year}") && !strings.Contains(seqConfig.Format, "{yy}") {
+			return 0, "", fmt.Errorf("The %s number format must contain {year} or {yy} to reset yearly", kind)
+		}
+		nameParts = append(nameParts, strconv.Itoa(now.Year()))
+		scoped = true
+	}
+
+	var seedFn func() (int64, error)
+	if !scoped {
+		seedFn = seed
+	}
+
+	number, err := NextSequenceNumber(tx, entity, strings.Join(nameParts, ":"), seedFn)
+	if err != nil {
+		return 0, "", err
+	}
+	return number, FormatSequenceNumber(seqConfig.Format, number, now, currency, entity), nil
+}
@@ -0,0 +1,103 @@
+package models
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
+)
+
+// Shipment is a parcel sent for an order.
+type Shipment struct {
+	ID      string `json:"id"`
+	OrderID string `json:"order_id" sql:"index"`
+
+	Carrier        string `json:"carrier"`
+	TrackingNumber string `json:"tracking_number"`
+	TrackingURL    string `json:"tracking_url"`
+
+	Items []*ShipmentItem `json:"items"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TableName returns the database table name for the Shipment model.
+func (Shipment) TableName() string {
+	return tableName("shipments")
+}
+
+// ShipmentItem is the quantity of a line item contained in a shipment.
+type ShipmentItem struct {
+	ID         int64  `json:"id"`
+	ShipmentID string `json:"-" sql:"index"`
+	OrderID    string `json:"-" sql:"index"`
+
+	LineItemID int64  `json:"line_item_id"`
+	Sku        string `json:"sku"`
+	Quantity   uint64 `json:"quantity"`
+}
+
+// TableName returns the database table name for the ShipmentItem model.
+func (ShipmentItem) TableName() string {
+	return tableName("shipment_items")
+}
+
+// NewShipment creates a Shipment for an order.
+func NewShipment(order *Order, carrier, trackingNumber, trackingURL string) *Shipment {
+	return &Shipment{
+		ID:             uuid.NewRandom().String(),
+		OrderID:        order.ID,
+		Carrier:        carrier,
+		TrackingNumber: trackingNumber,
+		TrackingURL:    trackingURL,
+	}
+}
+
+// ShippedQuantities returns the quantities of the line items of an order that
+// were shipped, by line item ID.
+func ShippedQuantities(db *gorm.DB, orderID string) (map[int64]uint64, error) {
+	rows, err := db.Model(&ShipmentItem{}).
+		Select("line_item_id, sum(quantity)").
+		Where("order_id = ?", orderID).
+		Group("line_item_id").
+		Rows()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error querying shipped quantities")
+	}
+	defer rows.Close()
+
+	shipped := map[int64]uint64{}
+	for rows.Next() {
+		var lineItemID int64
+		var quantity uint64
+		if err := rows.Scan(&lineItemID, &quantity); err != nil {
+			return nil, errors.Wrap(err, "Error querying shipped quantities")
+		}
+		shipped[lineItemID] = quantity
+	}
+	return shipped, nil
+}
+
+// ShipmentFulfillmentState derives the fulfillment state of an order from the
+// quantities of its line items that were shipped.
+func (o *Order) ShipmentFulfillmentState(shipped map[int64]uint64) string {
+	some, all := false, true
+	for _, item := range o.LineItems {
+		if shipped[item.ID] > 0 {
+			some = true
+		}
+		if shipped[item.ID] < item.Quantity {
+			all = false
+		}
+	}
+	switch {
+	case some && all:
+		return ShippedState
+	case some:
+		return PartiallyShippedState
+	default:
+		return PendingState
+	}
+}
@@ -5,6 +5,7 @@ import (
 
 	"github.com/jinzhu/gorm"
 	"github.com/pborman/uuid"
+	"github.com/pkg/errors"
 )
 
 // ChargeTransactionType is the charge transaction type.
@@ -20,9 +21,17 @@ type Transaction struct {
 	Order         *Order `json:"-"`
 	OrderID       string `json:"order_id"`
 	InvoiceNumber int64  `json:"invoice_number"`
+	InvoiceID     string `json:"invoice_id,omitempty"`
+
+	// CreditNoteNumber and CreditNoteID are only set on successful refunds
+	CreditNoteNumber int64  `json:"credit_note_number,omitempty"`
+	CreditNoteID     string `json:"credit_note_id,omitempty"`
 
 	ProcessorID string `json:"processor_id"`
 
+	// ChargeID is the charge a refund pays back
+	ChargeID string `json:"charge_id,omitempty" sql:"index"`
+
 	User   *User  `json:"-"`
 	UserID string `json:"user_id,omitempty"`
 
@@ -39,6 +48,9 @@ type Transaction struct {
 	DeletedAt *time.Time `json:"-"`
 
 	ProviderMetadata map[string]interface{} `json:"provider_metadata,omitempty" sql:"-"`
+
+	// RefundItems lists the line items covered by a refund
+	RefundItems []*RefundItem `json:"refund_items,omitempty"`
 }
 
 // TableName returns the database table name for the Transaction model.
@@ -71,3 +83,16 @@ func GetTransaction(db *gorm.DB, id string) (*Transaction, error) {
 	}
 	return trans, nil
 }
+
+// RefundedAmount returns the amount of the refunds of a charge that are paid
+// or still pending. Refunds made before they were linked to their charge are
+// counted against every charge of their order.
+func RefundedAmount(db *gorm.DB, charge *Transaction) (uint64, error) {
+	var amount uint64
+	err := db.Model(&Transaction{}).
+		Select("COALESCE(sum(amount), 0)").
+		Where("type = ? AND status IN (?)", RefundTransactionType, []string{PaidState, PendingState}).
+		Where("charge_id = ? OR ((charge_id IS NULL OR charge_id = '') AND order_id = ?)", charge.ID, charge.OrderID).
+		Row().Scan(&amount)
+	return amount, errors.Wrap(err, "Error querying refunded amount")
+}
@@ -17,6 +17,15 @@ type User struct {
 	Email      string `json:"email"`
 	Name       string `json:"name"`
 
+	// OrdersClaimedAt is when the guest orders with the email of the user
+	// were last linked to the user
+	OrdersClaimedAt *time.Time `json:"orders_claimed_at,omitempty"`
+
+	// DefaultShippingAddressID and DefaultBillingAddressID are the addresses
+	// from the address book of the user that are used for new orders
+	DefaultShippingAddressID string `json:"default_shipping_address_id,omitempty"`
+	DefaultBillingAddressID  string `json:"default_billing_address_id,omitempty"`
+
 	CreatedAt time.Time  `json:"created_at"`
 	UpdatedAt time.Time  `json:"updated_at"`
 	DeletedAt *time.Time `json:"-"`
@@ -96,6 +105,46 @@ func GetUser(db *gorm.DB, userID string) (*User, error) {
 	return user, nil
 }
 
+// MergeUsers moves the orders, addresses, transactions, returns and webhooks
+// of source to target, and deletes source afterwards. Both users must belong
+// to the instance. The name of source is kept if target has none.
+func MergeUsers(tx *gorm.DB, instanceID string, target, source *User) error {
+	if target.InstanceID != instanceID || source.InstanceID != instanceID {
+		return errors.New("Can't merge users of another instance")
+	}
+
+	// addresses and webhooks belong to the instance through their user
+	moveModels := map[string]interface{}{
+		"address": Address{},
+		"hook":    Hook{},
+	}
+	instanceModels := map[string]interface{}{
+		"order":       Order{},
+		"transaction": Transaction{},
+		"return":      Return{},
+	}
+	for name, mm := range moveModels {
+		if result := tx.Model(mm).Where("user_id = ?", source.ID).UpdateColumn("user_id", target.ID); result.Error != nil {
+			return errors.Wrap(result.Error, fmt.Sprintf("Error moving %s records", name))
+		}
+	}
+	for name, mm := range instanceModels {
+		if result := tx.Model(mm).Where("instance_id = ? AND user_id = ?", instanceID, source.ID).UpdateColumn("user_id", target.ID); result.Error != nil {
+			return errors.Wrap(result.Error, fmt.Sprintf("Error moving %s records", name))
+		}
+	}
+
+	if target.Name == "" && source.Name != "" {
+		if result := tx.Model(target).UpdateColumn("name", source.Name); result.Error != nil {
+			return errors.Wrap(result.Error, "Error updating user")
+		}
+	}
+	if result := tx.Delete(source); result.Error != nil {
+		return errors.Wrap(result.Error, "Error deleting user")
+	}
+	return nil
+}
+
 func (u *User) BeforeDelete(tx *gorm.DB) error {
 	cascadeModels := map[string]interface{}{
 		"order": &[]Order{},
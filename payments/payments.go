@@ -26,7 +26,7 @@ type Provider interface {
 }
 
 // Charger wraps the Charge method which creates new payments with the provider.
-type Charger func(amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error)
+type Charger func(amount uint64, currency string, order *models.Order, invoiceID string) (string, error)
 
 // Refunder wraps the Refund method which refunds payments with the provider.
 type Refunder func(transactionID string, amount uint64, currency string) (string, error)
@@ -6,16 +6,15 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
-	"strings"
 	"sync"
 
 	"github.com/netlify/gocommerce/models"
-	"github.com/pariz/gountries"
 	"github.com/sirupsen/logrus"
 
 	paypalsdk "github.com/netlify/PayPal-Go-SDK"
 	"github.com/netlify/gocommerce/conf"
 	gcontext "github.com/netlify/gocommerce/context"
+	"github.com/netlify/gocommerce/countries"
 	"github.com/netlify/gocommerce/payments"
 	"github.com/pborman/uuid"
 	"github.com/pkg/errors"
@@ -91,8 +90,8 @@ func (p *paypalPaymentProvider) NewCharger(ctx context.Context, r *http.Request,
 		return nil, errors.New("Payments requires a paypal_payment_id and paypal_user_id pair")
 	}
 
-	return func(amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
-		return p.charge(log, bp.PaypalID, bp.PaypalUserID, amount, currency, order, invoiceNumber)
+	return func(amount uint64, currency string, order *models.Order, invoiceID string) (string, error) {
+		return p.charge(log, bp.PaypalID, bp.PaypalUserID, amount, currency, order, invoiceID)
 	}, nil
 }
 
@@ -116,10 +115,8 @@ func prepareItemsFromOrder(order *models.Order) []paypalsdk.Item {
 }
 
 func prepareShippingAddress(addr models.Address) *paypalsdk.ShippingAddress {
-	countryQuery := gountries.New()
-
-	country, err := countryQuery.FindCountryByName(strings.ToLower(addr.Country))
-	if err != nil {
+	countryCode, ok := countries.Code(addr.Country)
+	if !ok {
 		return nil
 	}
 
@@ -128,17 +125,17 @@ func prepareShippingAddress(addr models.Address) *paypalsdk.ShippingAddress {
 		Line1:         addr.Address1,
 		Line2:         addr.Address2,
 		City:          addr.City,
-		CountryCode:   country.Codes.Alpha2,
+		CountryCode:   countryCode,
 		PostalCode:    addr.Zip,
 		State:         addr.State,
 	}
 }
 
-func (p *paypalPaymentProvider) updatePaymentWithOrder(paymentID string, order *models.Order, invoiceNumber int64) error {
+func (p *paypalPaymentProvider) updatePaymentWithOrder(paymentID string, order *models.Order, invoiceID string) error {
 	invoiceNumPatch := paypalsdk.PaymentPatch{
 		Operation: "add",
 		Path:      "/transactions/0/invoice_number",
-		Value:     fmt.Sprintf("%d", invoiceNumber),
+		Value:     invoiceID,
 	}
 
 	itemList := paypalsdk.ItemList{
@@ -157,7 +154,7 @@ func (p *paypalPaymentProvider) updatePaymentWithOrder(paymentID string, order *
 	return err
 }
 
-func (p *paypalPaymentProvider) charge(log logrus.FieldLogger, paymentID string, userID string, amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
+func (p *paypalPaymentProvider) charge(log logrus.FieldLogger, paymentID string, userID string, amount uint64, currency string, order *models.Order, invoiceID string) (string, error) {
 	payment, err := p.client.GetPayment(paymentID)
 	if err != nil {
 		return "", err
@@ -176,7 +173,7 @@ func (p *paypalPaymentProvider) charge(log logrus.FieldLogger, paymentID string,
 		return "", fmt.Errorf("The Amount in the transaction doesn't match the amount for the order: %v", payment.Transactions[0].Amount)
 	}
 
-	if err := p.updatePaymentWithOrder(paymentID, order, invoiceNumber); err != nil {
+	if err := p.updatePaymentWithOrder(paymentID, order, invoiceID); err != nil {
 		log := log.WithError(err)
 		switch e := err.(type) {
 		case *paypalsdk.ErrorResponse:
@@ -60,8 +60,8 @@ func (s *stripePaymentProvider) NewCharger(ctx context.Context, r *http.Request,
 	if bp.StripePaymentMethodID == "" {
 		return nil, errors.New("Stripe requires a stripe_payment_method_id for creating a payment intent")
 	}
-	return func(amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
-		return s.chargePaymentIntent(bp.StripePaymentMethodID, amount, currency, order, invoiceNumber)
+	return func(amount uint64, currency string, order *models.Order, invoiceID string) (string, error) {
+		return s.chargePaymentIntent(bp.StripePaymentMethodID, amount, currency, order, invoiceID)
 	}, nil
 }
 
@@ -79,17 +79,17 @@ func prepareShippingAddress(addr models.Address) *stripe.ShippingDetailsParams {
 	}
 }
 
-func (s *stripePaymentProvider) chargePaymentIntent(paymentMethodID string, amount uint64, currency string, order *models.Order, invoiceNumber int64) (string, error) {
+func (s *stripePaymentProvider) chargePaymentIntent(paymentMethodID string, amount uint64, currency string, order *models.Order, invoiceID string) (string, error) {
 	params := &stripe.PaymentIntentParams{
 		PaymentMethod: stripe.String(paymentMethodID),
 		Amount:        stripe.Int64(int64(amount)),
 		Currency:      stripe.String(currency),
-		Description:   stripe.String(fmt.Sprintf("Invoice No. %d", invoiceNumber)),
+		Description:   stripe.String("Invoice No. " + invoiceID),
 		Shipping:      prepareShippingAddress(order.ShippingAddress),
 		Params: stripe.Params{
 			Metadata: map[string]string{
 				"order_id":       order.ID,
-				"invoice_number": fmt.Sprintf("%d", invoiceNumber),
+				"invoice_number": invoiceID,
 			},
 		},
 		ConfirmationMethod: stripe.String(string(